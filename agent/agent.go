@@ -25,6 +25,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -57,6 +59,8 @@ type Agent struct {
 	services  map[string]pct.ServiceManager
 	updater   *pct.Updater
 	keepalive *time.Ticker
+	// New keepalive from ReloadConfig for Run
+	keepaliveChan chan uint
 	// --
 	cmdSync        *pct.SyncChan
 	cmdChan        chan *proto.Cmd
@@ -81,6 +85,8 @@ func NewAgent(config *Config, logger *pct.Logger, api pct.APIConnector, client p
 		status:     pct.NewStatus([]string{"agent", "agent-cmd-handler"}),
 		cmdChan:    make(chan *proto.Cmd, CMD_QUEUE_SIZE),
 		statusChan: make(chan *proto.Cmd, STATUS_QUEUE_SIZE),
+		// --
+		keepaliveChan: make(chan uint, 1),
 	}
 	return agent
 }
@@ -244,6 +250,9 @@ func (agent *Agent) Run() error {
 				cmd := &proto.Cmd{Cmd: "Pong"}
 				agent.reply(cmd.Reply(nil, nil))
 			}
+		case keepalive := <-agent.keepaliveChan:
+			agent.keepalive.Stop()
+			agent.keepalive = time.NewTicker(time.Duration(keepalive) * time.Second)
 		}
 	}
 }
@@ -284,11 +293,16 @@ func (agent *Agent) stop() {
 	agent.statusHandlerSync.Wait()
 }
 
+// LoadConfig returns the agent config file, overridden by the environment, see
+// Config.ApplyEnvOverrides, with defaults for the options not set.
 func LoadConfig() ([]byte, error) {
 	config := &Config{}
 	if err := pct.Basedir.ReadConfig("agent", config); err != nil {
 		return nil, err
 	}
+	if err := config.ApplyEnvOverrides(); err != nil {
+		return nil, err
+	}
 	if config.ApiHostname == "" {
 		config.ApiHostname = DEFAULT_API_HOSTNAME
 	}
@@ -609,6 +623,97 @@ func (agent *Agent) handleSetConfig(cmd *proto.Cmd) (interface{}, []error) {
 	return &finalConfig, errs
 }
 
+// ConfigReload is what ReloadConfig changed.
+type ConfigReload struct {
+	Applied   []string // fields changed in the running agent
+	Restart   []string // fields that changed but need a restart to take effect
+	Reconnect bool     // API hostname or key changed, so the cmd websocket should reconnect
+}
+
+// Agent config fields that ReloadConfig applies to the running agent.  Links
+// come from the API, not the config file, so they're never reloaded.
+var reloadableConfig = map[string]bool{
+	"ApiHostname": true,
+	"ApiKey":      true,
+	"Keepalive":   true,
+	"Links":       true,
+}
+
+// ReloadConfig applies the new config, usually the config file re-read on
+// SIGHUP, to the running agent.  Only the API hostname and key, and keepalive
+// are applied; other changed fields are logged as needing a restart and keep
+// their current values.  The API connector uses the new hostname and key, but
+// the cmd websocket isn't reconnected; that's up to the caller if Reconnect.
+func (agent *Agent) ReloadConfig(newConfig *Config) (*ConfigReload, error) {
+	agent.logger.Debug("ReloadConfig:call")
+	defer agent.logger.Debug("ReloadConfig:return")
+
+	if err := newConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	agent.configMux.RLock()
+	finalConfig := *agent.config // copy current config
+	agent.configMux.RUnlock()
+
+	reload := &ConfigReload{
+		Applied: []string{},
+		Restart: []string{},
+	}
+	var err error
+
+	if newConfig.ApiHostname != finalConfig.ApiHostname || newConfig.ApiKey != finalConfig.ApiKey {
+		if err = agent.api.Connect(newConfig.ApiHostname, newConfig.ApiKey, agent.api.AgentUuid()); err != nil {
+			err = errors.New("agent.api.Connect:" + err.Error())
+		} else {
+			if newConfig.ApiHostname != finalConfig.ApiHostname {
+				agent.logger.Info("Changed API host from", finalConfig.ApiHostname, "to", newConfig.ApiHostname)
+				reload.Applied = append(reload.Applied, "ApiHostname")
+			}
+			if newConfig.ApiKey != finalConfig.ApiKey {
+				agent.logger.Info("Changed API key")
+				reload.Applied = append(reload.Applied, "ApiKey")
+			}
+			finalConfig.ApiHostname = newConfig.ApiHostname
+			finalConfig.ApiKey = newConfig.ApiKey
+			reload.Reconnect = true
+		}
+	}
+
+	if newConfig.Keepalive != finalConfig.Keepalive {
+		agent.logger.Info("Changed keepalive from", finalConfig.Keepalive, "to", newConfig.Keepalive)
+		// Only the latest keepalive matters if Run hasn't received the last one.
+		select {
+		case <-agent.keepaliveChan:
+		default:
+		}
+		agent.keepaliveChan <- newConfig.Keepalive
+		finalConfig.Keepalive = newConfig.Keepalive
+		reload.Applied = append(reload.Applied, "Keepalive")
+	}
+
+	oldVal := reflect.ValueOf(finalConfig)
+	newVal := reflect.ValueOf(*newConfig)
+	for i := 0; i < oldVal.NumField(); i++ {
+		name := oldVal.Type().Field(i).Name
+		if reloadableConfig[name] {
+			continue
+		}
+		if !reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			reload.Restart = append(reload.Restart, name)
+		}
+	}
+	if len(reload.Restart) > 0 {
+		agent.logger.Warn("Restart agent for these config changes to take effect: " + strings.Join(reload.Restart, ", "))
+	}
+
+	agent.configMux.Lock()
+	defer agent.configMux.Unlock()
+	agent.config = &finalConfig
+
+	return reload, err
+}
+
 func (agent *Agent) handleVersion(cmd *proto.Cmd) (interface{}, []error) {
 	v := &proto.Version{
 		Running:  VERSION + REL,
@@ -660,7 +765,21 @@ func (agent *Agent) statusHandler() {
 		case cmd := <-agent.statusChan:
 			switch cmd.Service {
 			case "":
-				replyChan <- cmd.Reply(agent.AllStatus())
+				opts := StatusOptions{}
+				if len(cmd.Data) > 0 {
+					if err := json.Unmarshal(cmd.Data, &opts); err != nil {
+						replyChan <- cmd.Reply(nil, err)
+						continue
+					}
+				}
+				switch opts.Format {
+				case "":
+					replyChan <- cmd.Reply(agent.AllStatus())
+				case STATUS_FORMAT_REPORT:
+					replyChan <- cmd.Reply(agent.StatusReport())
+				default:
+					replyChan <- cmd.Reply(nil, fmt.Errorf("Invalid status format: %s", opts.Format))
+				}
 			case "agent":
 				replyChan <- cmd.Reply(agent.Status())
 			default:
@@ -696,3 +815,75 @@ func (agent *Agent) AllStatus() map[string]string {
 	}
 	return status
 }
+
+// ProcessStatus is the status of one process, e.g. instance-mrms: Idle.
+type ProcessStatus struct {
+	Name   string
+	Status string
+}
+
+// ServiceStatus is the status of one service manager's processes.  Error is
+// set instead of Processes if the status could not be gotten.
+type ServiceStatus struct {
+	Name      string
+	Processes []ProcessStatus // sorted by Name
+	Error     string          `json:",omitempty"`
+}
+
+// StatusReport is the status of the agent and all its services.
+type StatusReport struct {
+	Agent    []ProcessStatus // sorted by Name
+	Services []ServiceStatus // sorted by Name
+}
+
+// A Status cmd with StatusOptions{Format: STATUS_FORMAT_REPORT} and no service
+// is replied to with a StatusReport instead of one flat map of all processes.
+const STATUS_FORMAT_REPORT = "report"
+
+type StatusOptions struct {
+	Format string
+}
+
+// StatusReport returns the status of the agent and every service.
+// statusHandler:@goroutine[2]
+func (agent *Agent) StatusReport() *StatusReport {
+	report := &StatusReport{
+		Agent:    processStatus(agent.Status()),
+		Services: []ServiceStatus{},
+	}
+	names := make([]string, 0, len(agent.services))
+	for service := range agent.services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	for _, service := range names {
+		status := ServiceStatus{Name: service}
+		if manager := agent.services[service]; manager == nil { // should not happen
+			status.Error = fmt.Sprintf("%s service manager is nil", service)
+		} else {
+			status.Processes = processStatus(manager.Status())
+		}
+		report.Services = append(report.Services, status)
+	}
+	return report
+}
+
+// StatusJSON returns the StatusReport as JSON.  Processes and services are
+// sorted, so the document is stable for the same statuses.
+// statusHandler:@goroutine[2]
+func (agent *Agent) StatusJSON() ([]byte, error) {
+	return json.Marshal(agent.StatusReport())
+}
+
+func processStatus(status map[string]string) []ProcessStatus {
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	processes := make([]ProcessStatus, len(names))
+	for i, name := range names {
+		processes[i] = ProcessStatus{Name: name, Status: status[name]}
+	}
+	return processes
+}
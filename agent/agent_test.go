@@ -242,6 +242,82 @@ func (s *AgentTestSuite) TestStatus(t *C) {
 	t.Check(ok, Equals, false)
 }
 
+func (s *AgentTestSuite) TestStatusJSON(t *C) {
+	data, err := s.agent.StatusJSON()
+	t.Assert(err, IsNil)
+
+	got := agent.StatusReport{}
+	err = json.Unmarshal(data, &got)
+	t.Assert(err, IsNil)
+
+	t.Check(hasProcess(got.Agent, "agent"), Equals, true)
+
+	// Services are sorted by name so the document is stable.
+	t.Assert(got.Services, HasLen, 2)
+	t.Check(got.Services[0].Name, Equals, "mm")
+	t.Check(got.Services[1].Name, Equals, "qan")
+	t.Check(hasProcess(got.Services[0].Processes, "mm"), Equals, true)
+	t.Check(hasProcess(got.Services[1].Processes, "qan"), Equals, true)
+	t.Check(got.Services[0].Error, Equals, "")
+
+	again, err := s.agent.StatusJSON()
+	t.Assert(err, IsNil)
+	t.Check(string(again), Equals, string(data))
+}
+
+func (s *AgentTestSuite) TestStatusReportCmd(t *C) {
+	data, err := json.Marshal(agent.StatusOptions{Format: agent.STATUS_FORMAT_REPORT})
+	t.Assert(err, IsNil)
+	statusCmd := &proto.Cmd{
+		Ts:   time.Now(),
+		User: "daniel",
+		Cmd:  "Status",
+		Data: data,
+	}
+	s.sendChan <- statusCmd
+
+	reply := waitReply(s.recvChan, "Status")
+	t.Assert(reply, NotNil)
+	t.Assert(reply.Error, Equals, "")
+	got := agent.StatusReport{}
+	err = json.Unmarshal(reply.Data, &got)
+	t.Assert(err, IsNil)
+	t.Check(hasProcess(got.Agent, "agent"), Equals, true)
+	t.Check(got.Services, HasLen, 2)
+
+	// Invalid format
+	statusCmd.Data = []byte(`{"Format":"xml"}`)
+	s.sendChan <- statusCmd
+	reply = waitReply(s.recvChan, "Status")
+	t.Assert(reply, NotNil)
+	t.Check(reply.Error, Equals, "Invalid status format: xml")
+}
+
+// waitReply returns the first reply to cmd, skipping replies to other cmds,
+// like Stop from the previous test's TearDownTest.
+func waitReply(recvChan chan *proto.Reply, cmd string) *proto.Reply {
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case reply := <-recvChan:
+			if reply.Cmd == cmd {
+				return reply
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+func hasProcess(processes []agent.ProcessStatus, name string) bool {
+	for _, p := range processes {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *AgentTestSuite) TestStatusAfterConnFail(t *C) {
 	// Use optional ConnectChan in mock ws client for this test only.
 	connectChan := make(chan bool)
@@ -514,6 +590,16 @@ func (s *AgentTestSuite) TestLoadConfig(t *C) {
 		test.Dump(got)
 		t.Error(diff)
 	}
+
+	// The environment overrides the file, e.g. in containers.
+	defer os.Setenv(agent.ENV_API_KEY, os.Getenv(agent.ENV_API_KEY))
+	os.Setenv(agent.ENV_API_KEY, "env key")
+	bytes, err = agent.LoadConfig()
+	t.Assert(err, IsNil)
+	got = &agent.Config{}
+	err = json.Unmarshal(bytes, got)
+	t.Assert(err, IsNil)
+	t.Check(got.ApiKey, Equals, "env key")
 }
 
 func (s *AgentTestSuite) TestGetConfig(t *C) {
@@ -760,6 +846,43 @@ func (s *AgentTestSuite) TestSetConfigApiHostname(t *C) {
 	t.Check(gotCalled, DeepEquals, expectCalled)
 }
 
+func (s *AgentTestSuite) TestReloadConfig(t *C) {
+	newConfig := *s.config
+	newConfig.ApiHostname = "http://localhost"
+	newConfig.Keepalive = 2
+	newConfig.PidFile = "/tmp/percona-agent-reload.pid"
+
+	reload, err := s.agent.ReloadConfig(&newConfig)
+	t.Assert(err, IsNil)
+	t.Check(reload.Applied, DeepEquals, []string{"ApiHostname", "Keepalive"})
+	t.Check(reload.Restart, DeepEquals, []string{"PidFile"})
+	t.Check(reload.Reconnect, Equals, true)
+
+	// API connector uses the new host.
+	t.Check(s.api.Hostname(), Equals, "http://localhost")
+	t.Check(s.api.ApiKey(), Equals, "789")
+
+	// Hot fields changed in memory, but PidFile needs a restart.
+	configs, errs := s.agent.GetConfig()
+	t.Assert(errs, HasLen, 0)
+	gotConfig := &agent.Config{}
+	if err := json.Unmarshal([]byte(configs[0].Config), gotConfig); err != nil {
+		t.Fatal(err)
+	}
+	t.Check(gotConfig.ApiHostname, Equals, "http://localhost")
+	t.Check(gotConfig.Keepalive, Equals, uint(2))
+	t.Check(gotConfig.PidFile, Equals, "")
+
+	// Invalid config isn't applied.
+	badConfig := newConfig
+	badConfig.ApiHostname = "http://example.com"
+	badConfig.Keepalive = agent.MAX_KEEPALIVE + 1
+	reload, err = s.agent.ReloadConfig(&badConfig)
+	t.Check(err, NotNil)
+	t.Check(reload, IsNil)
+	t.Check(s.api.Hostname(), Equals, "http://localhost")
+}
+
 func (s *AgentTestSuite) TestKeepalive(t *C) {
 	// Agent should be sending a Pong every 1s now which is sent as a
 	// reply to no cmd (it's a platypus).
@@ -854,3 +977,123 @@ func (s *AgentTestSuite) TestCmdToService(t *C) {
 	t.Assert(s.services["mm"].Cmds, HasLen, 1)
 	t.Check(s.services["mm"].Cmds[0].Cmd, Equals, "Hello")
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Config test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ConfigTestSuite struct {
+}
+
+var _ = Suite(&ConfigTestSuite{})
+
+func validConfig() *agent.Config {
+	return &agent.Config{
+		AgentUuid:   "abc-123-def",
+		ApiHostname: agent.DEFAULT_API_HOSTNAME,
+		ApiKey:      "123",
+		Keepalive:   agent.DEFAULT_KEEPALIVE,
+		PidFile:     agent.DEFAULT_PIDFILE,
+	}
+}
+
+func (s *ConfigTestSuite) TestValidate(t *C) {
+	config := validConfig()
+	t.Check(config.Validate(), IsNil)
+}
+
+func (s *ConfigTestSuite) TestValidateApiHostname(t *C) {
+	config := validConfig()
+	config.ApiHostname = ""
+	err := config.Validate()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config: ApiHostname is empty")
+}
+
+func (s *ConfigTestSuite) TestValidateApiKey(t *C) {
+	config := validConfig()
+	config.ApiKey = ""
+	err := config.Validate()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config: ApiKey is empty")
+}
+
+func (s *ConfigTestSuite) TestValidateKeepalive(t *C) {
+	// Zero means default.
+	config := validConfig()
+	config.Keepalive = 0
+	t.Check(config.Validate(), IsNil)
+	t.Check(config.Keepalive, Equals, uint(agent.DEFAULT_KEEPALIVE))
+
+	config.Keepalive = agent.MAX_KEEPALIVE + 1
+	err := config.Validate()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config: Keepalive 3601 is greater than 3600 seconds")
+}
+
+func (s *ConfigTestSuite) TestValidatePidFile(t *C) {
+	config := validConfig()
+	config.PidFile = ""
+	err := config.Validate()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config: PidFile is empty")
+}
+
+func (s *ConfigTestSuite) TestValidateAll(t *C) {
+	config := &agent.Config{}
+	err := config.Validate()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config: ApiHostname is empty; ApiKey is empty; PidFile is empty")
+}
+
+func (s *ConfigTestSuite) TestApplyEnvOverrides(t *C) {
+	envs := []string{agent.ENV_API_HOSTNAME, agent.ENV_API_KEY, agent.ENV_KEEPALIVE, agent.ENV_PIDFILE}
+	for _, env := range envs {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Setenv(env, "")
+	}
+
+	// No env vars, no changes.
+	config := validConfig()
+	t.Check(config.ApplyEnvOverrides(), IsNil)
+	t.Check(config, DeepEquals, validConfig())
+
+	// Each env var overrides its value.
+	os.Setenv(agent.ENV_API_HOSTNAME, "api.example.com")
+	t.Check(config.ApplyEnvOverrides(), IsNil)
+	t.Check(config.ApiHostname, Equals, "api.example.com")
+
+	os.Setenv(agent.ENV_API_KEY, "456")
+	t.Check(config.ApplyEnvOverrides(), IsNil)
+	t.Check(config.ApiKey, Equals, "456")
+
+	os.Setenv(agent.ENV_KEEPALIVE, "30")
+	t.Check(config.ApplyEnvOverrides(), IsNil)
+	t.Check(config.Keepalive, Equals, uint(30))
+
+	os.Setenv(agent.ENV_PIDFILE, "/var/run/agent.pid")
+	t.Check(config.ApplyEnvOverrides(), IsNil)
+	t.Check(config.PidFile, Equals, "/var/run/agent.pid")
+
+	t.Check(config.AgentUuid, Equals, "abc-123-def")
+	t.Check(config.Validate(), IsNil)
+
+	// Invalid values are errors and change nothing.
+	os.Setenv(agent.ENV_API_KEY, "789")
+	os.Setenv(agent.ENV_KEEPALIVE, "soon")
+	err := config.ApplyEnvOverrides()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config environment: PERCONA_AGENT_KEEPALIVE soon is not a number of seconds")
+	t.Check(config.ApiKey, Equals, "456")
+
+	os.Setenv(agent.ENV_KEEPALIVE, "-1")
+	t.Check(config.ApplyEnvOverrides(), NotNil)
+
+	os.Setenv(agent.ENV_KEEPALIVE, "3601")
+	os.Setenv(agent.ENV_API_HOSTNAME, "api example.com")
+	err = config.ApplyEnvOverrides()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid agent config environment: PERCONA_AGENT_KEEPALIVE 3601 is greater than 3600 seconds; PERCONA_AGENT_API_HOSTNAME api example.com has spaces")
+	t.Check(config.Keepalive, Equals, uint(30))
+	t.Check(config.ApiHostname, Equals, "api.example.com")
+}
@@ -17,10 +17,27 @@
 
 package agent
 
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
 const (
 	DEFAULT_API_HOSTNAME = "cloud-api.percona.com"
 	DEFAULT_KEEPALIVE    = 76
 	DEFAULT_PIDFILE      = "percona-agent.pid"
+	MAX_KEEPALIVE        = 3600 // 1 hour
+)
+
+// Environment variables that override the config, see ApplyEnvOverrides.
+const (
+	ENV_API_HOSTNAME = "PERCONA_AGENT_API_HOSTNAME"
+	ENV_API_KEY      = "PERCONA_AGENT_API_KEY"
+	ENV_KEEPALIVE    = "PERCONA_AGENT_KEEPALIVE"
+	ENV_PIDFILE      = "PERCONA_AGENT_PIDFILE"
 )
 
 type Config struct {
@@ -30,4 +47,86 @@ type Config struct {
 	Keepalive   uint
 	Links       map[string]string `json:",omitempty"`
 	PidFile     string
+	// Max concurrent API requests, pct.DEFAULT_MAX_API_REQUESTS if zero.
+	MaxApiRequests uint `json:",omitempty"`
+	// Gzip API request bodies of pct.DEFAULT_COMPRESS_MIN_SIZE bytes or more.
+	CompressApiRequests bool `json:",omitempty"`
+	// Extra HTTP headers sent with every API request, e.g. for a gateway.
+	ApiHeaders map[string]string `json:",omitempty"`
+	// Hide MySQL usernames, not just passwords, in logs and status.
+	HideDSNUsername bool `json:",omitempty"`
+	// Report a changed MySQL server_uuid as a failover, not a restart.
+	DetectFailover bool `json:",omitempty"`
+	// Store instances of unsupported types, without monitoring, instead of rejecting them.
+	AllowUnknownInstances bool `json:",omitempty"`
+	// Seconds the instance manager waits for instances at startup before
+	// starting the rest in the background, instance.DEFAULT_START_TIMEOUT if zero.
+	InstanceStartTimeout uint `json:",omitempty"`
+	// Seconds between re-syncs of all instance info, to report changes that
+	// don't restart MySQL; zero (the default) disables it.
+	InstanceResyncInterval uint `json:",omitempty"`
+	// Seconds to wait connecting to MySQL, and for each MySQL restart check
+	// (mrms/monitor.DEFAULT_CHECK_TIMEOUT if zero); zero means no connect timeout.
+	MySQLTimeout uint `json:",omitempty"`
+}
+
+// Validate checks that the config is usable, setting Keepalive to
+// DEFAULT_KEEPALIVE if it is zero. All problems are reported in one error.
+func (c *Config) Validate() error {
+	var errs []string
+	if c.ApiHostname == "" {
+		errs = append(errs, "ApiHostname is empty")
+	}
+	if c.ApiKey == "" {
+		errs = append(errs, "ApiKey is empty")
+	}
+	if c.Keepalive == 0 {
+		c.Keepalive = DEFAULT_KEEPALIVE
+	} else if c.Keepalive > MAX_KEEPALIVE {
+		errs = append(errs, fmt.Sprintf("Keepalive %d is greater than %d seconds", c.Keepalive, MAX_KEEPALIVE))
+	}
+	if c.PidFile == "" {
+		errs = append(errs, "PidFile is empty")
+	}
+	if len(errs) > 0 {
+		return errors.New("Invalid agent config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ApplyEnvOverrides sets the config values for which an ENV_* environment
+// variable is set and not empty, e.g. so containers can configure the agent
+// without a config file.  If a value is invalid, nothing is changed and all
+// problems are reported in one error.
+func (c *Config) ApplyEnvOverrides() error {
+	var errs []string
+	keepalive := c.Keepalive
+	if v := os.Getenv(ENV_KEEPALIVE); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s is not a number of seconds", ENV_KEEPALIVE, v))
+		} else if n > MAX_KEEPALIVE {
+			errs = append(errs, fmt.Sprintf("%s %d is greater than %d seconds", ENV_KEEPALIVE, n, MAX_KEEPALIVE))
+		} else {
+			keepalive = uint(n)
+		}
+	}
+	hostname := strings.TrimSpace(os.Getenv(ENV_API_HOSTNAME))
+	if strings.ContainsAny(hostname, " \t") {
+		errs = append(errs, fmt.Sprintf("%s %s has spaces", ENV_API_HOSTNAME, hostname))
+	}
+	if len(errs) > 0 {
+		return errors.New("Invalid agent config environment: " + strings.Join(errs, "; "))
+	}
+	if hostname != "" {
+		c.ApiHostname = hostname
+	}
+	if v := strings.TrimSpace(os.Getenv(ENV_API_KEY)); v != "" {
+		c.ApiKey = v
+	}
+	c.Keepalive = keepalive
+	if v := os.Getenv(ENV_PIDFILE); v != "" {
+		c.PidFile = v
+	}
+	return nil
 }
@@ -29,6 +29,8 @@ import (
 	sysconfigMySQL "github.com/percona/percona-agent/sysconfig/mysql"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"strconv"
 )
 
 type Api struct {
@@ -47,11 +49,76 @@ func (a *Api) Init(hostname, apiKey string, headers map[string]string) (code int
 	return a.apiConnector.Init(hostname, apiKey, headers)
 }
 
-func (a *Api) CreateServerInstance(si *proto.ServerInstance) (*proto.ServerInstance, error) {
+// CheckLargeResponse fetches the pct.LARGE_RESPONSE_LINK entry link with the
+// connector's headers plus the given headers.
+func (a *Api) CheckLargeResponse(headers map[string]string) (*pct.ResponseCheck, error) {
+	url := a.apiConnector.EntryLink(pct.LARGE_RESPONSE_LINK)
+	if url == "" {
+		// Init only pings the API, so get the entry links: GET <API hostname>/
+		entryURL := a.apiConnector.URL()
+		code, data, err := a.apiConnector.Get(a.apiConnector.ApiKey(), entryURL)
+		if a.debug {
+			log.Printf("code=%d\n", code)
+			log.Printf("err=%s\n", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if code != http.StatusOK {
+			return nil, fmt.Errorf("Failed to get entry links from %s (status code %d)", entryURL, code)
+		}
+		links := &proto.Links{}
+		if err := json.Unmarshal(data, links); err != nil {
+			return nil, err
+		}
+		url = links.Links[pct.LARGE_RESPONSE_LINK]
+		if url == "" {
+			return nil, fmt.Errorf("API has no %s link", pct.LARGE_RESPONSE_LINK)
+		}
+	}
+	allHeaders := a.apiConnector.Headers()
+	for k, v := range headers {
+		allHeaders[k] = v
+	}
+	return pct.CheckLargeResponse(url, a.apiConnector.ApiKey(), allHeaders)
+}
+
+// FindServerInstance returns the server instance with the hostname, or nil if
+// the API doesn't have one.
+func (a *Api) FindServerInstance(hostname string) (*proto.ServerInstance, error) {
+	// GET <api>/instances/server?hostname=<hostname>
+	url := a.apiConnector.URL("instances", "server") + "?hostname=" + neturl.QueryEscape(hostname)
+	code, data, err := a.apiConnector.Get(a.apiConnector.ApiKey(), url)
+	if a.debug {
+		log.Printf("code=%d\n", code)
+		log.Printf("err=%s\n", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code == http.StatusNotFound {
+		return nil, nil
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get server instances (status code %d)", code)
+	}
+	instances := []proto.ServerInstance{}
+	if err := json.Unmarshal(data, &instances); err != nil {
+		return nil, fmt.Errorf("Failed to parse server instances: %s", err)
+	}
+	for _, si := range instances {
+		if si.Hostname == hostname {
+			return &si, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *Api) CreateServerInstance(si *proto.ServerInstance) (*proto.ServerInstance, bool, error) {
 	// POST <api>/instances/server
 	data, err := json.Marshal(si)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	url := a.apiConnector.URL("instances", "server")
 	resp, _, err := a.apiConnector.Post(a.apiConnector.ApiKey(), url, data)
@@ -60,18 +127,21 @@ func (a *Api) CreateServerInstance(si *proto.ServerInstance) (*proto.ServerInsta
 		log.Printf("err=%s\n", err)
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	// Create new instance, if it already exist then just use it
 	// todo: better handling of duplicate instance
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
-		return nil, fmt.Errorf("Failed to create server instance (status code %d)", resp.StatusCode)
+		return nil, false, fmt.Errorf("Failed to create server instance (status code %d)", resp.StatusCode)
 	}
 
+	// Conflict means it already existed, so the installer didn't create it.
+	created := resp.StatusCode == http.StatusCreated
+
 	// API returns URI of new resource in Location header
 	uri := resp.Header.Get("Location")
 	if uri == "" {
-		return nil, fmt.Errorf("API did not return location of new server instance")
+		return nil, false, fmt.Errorf("API did not return location of new server instance")
 	}
 
 	// GET <api>/instances/server/id (URI)
@@ -81,22 +151,22 @@ func (a *Api) CreateServerInstance(si *proto.ServerInstance) (*proto.ServerInsta
 		log.Printf("err=%s\n", err)
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if code != http.StatusOK {
-		return nil, fmt.Errorf("Failed to get new server instance (status code %d)", code)
+		return nil, false, fmt.Errorf("Failed to get new server instance (status code %d)", code)
 	}
 	if err := json.Unmarshal(data, si); err != nil {
-		return nil, fmt.Errorf("Failed to parse server instance entity: %s", err)
+		return nil, false, fmt.Errorf("Failed to parse server instance entity: %s", err)
 	}
-	return si, nil
+	return si, created, nil
 }
 
-func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance, error) {
+func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance, bool, error) {
 	// POST <api>/instances/mysql
 	data, err := json.Marshal(mi)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	url := a.apiConnector.URL("instances", "mysql")
 	resp, _, err := a.apiConnector.Post(a.apiConnector.ApiKey(), url, data)
@@ -105,7 +175,7 @@ func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance
 		log.Printf("err=%s\n", err)
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// Create new instance, if it already exist then update it
@@ -113,7 +183,7 @@ func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance
 		// API returns URI of existing resource in Location header
 		uri := resp.Header.Get("Location")
 		if uri == "" {
-			return nil, fmt.Errorf("API did not return location of existing MySQL instance")
+			return nil, false, fmt.Errorf("API did not return location of existing MySQL instance")
 		}
 
 		resp, _, err := a.apiConnector.Put(a.apiConnector.ApiKey(), uri, data)
@@ -122,19 +192,21 @@ func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance
 			log.Printf("err=%s\n", err)
 		}
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("Failed to update MySQL instance (status code %d)", resp.StatusCode)
+			return nil, false, fmt.Errorf("Failed to update MySQL instance (status code %d)", resp.StatusCode)
 		}
 	} else if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("Failed to create MySQL instance (status code %d)", resp.StatusCode)
+		return nil, false, fmt.Errorf("Failed to create MySQL instance (status code %d)", resp.StatusCode)
 	}
 
+	created := resp.StatusCode == http.StatusCreated
+
 	// API returns URI of new (or already existing one) resource in Location header
 	uri := resp.Header.Get("Location")
 	if uri == "" {
-		return nil, fmt.Errorf("API did not return location of new MySQL instance")
+		return nil, false, fmt.Errorf("API did not return location of new MySQL instance")
 	}
 
 	// GET <api>/instances/mysql/id (URI)
@@ -144,21 +216,21 @@ func (a *Api) CreateMySQLInstance(mi *proto.MySQLInstance) (*proto.MySQLInstance
 		log.Printf("err=%s\n", err)
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if code != http.StatusOK {
-		return nil, fmt.Errorf("Failed to get new MySQL instance (status code %d)", code)
+		return nil, false, fmt.Errorf("Failed to get new MySQL instance (status code %d)", code)
 	}
 	if err := json.Unmarshal(data, mi); err != nil {
-		return nil, fmt.Errorf("Failed to parse MySQL instance entity: %s", err)
+		return nil, false, fmt.Errorf("Failed to parse MySQL instance entity: %s", err)
 	}
-	return mi, nil
+	return mi, created, nil
 }
 
-func (a *Api) CreateAgent(agent *proto.Agent) (*proto.Agent, error) {
+func (a *Api) CreateAgent(agent *proto.Agent) (*proto.Agent, bool, error) {
 	data, err := json.Marshal(agent)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	url := a.apiConnector.URL("agents")
 	resp, _, err := a.apiConnector.Post(a.apiConnector.ApiKey(), url, data)
@@ -167,25 +239,27 @@ func (a *Api) CreateAgent(agent *proto.Agent) (*proto.Agent, error) {
 		log.Printf("err=%s\n", err)
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusConflict {
 		// agent was created or already exist - either is ok, continue
 	} else if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-Percona-Agents-Limit") != "" {
-		return nil, fmt.Errorf(
+		return nil, false, fmt.Errorf(
 			"Maximum number of %s agents exceeded.\n"+
 				"Go to https://cloud.percona.com/agents and remove unused agents or contact Percona to increase limit.",
 			resp.Header.Get("X-Percona-Agents-Limit"),
 		)
 	} else {
-		return nil, fmt.Errorf("Failed to create agent instance (status code %d)", resp.StatusCode)
+		return nil, false, fmt.Errorf("Failed to create agent instance (status code %d)", resp.StatusCode)
 	}
 
+	created := resp.StatusCode == http.StatusCreated
+
 	// API returns URI of new resource in Location header
 	uri := resp.Header.Get("Location")
 	if uri == "" {
-		return nil, fmt.Errorf("API did not return location of new agent")
+		return nil, false, fmt.Errorf("API did not return location of new agent")
 	}
 
 	// GET <api>/agents/:uuid
@@ -194,18 +268,72 @@ func (a *Api) CreateAgent(agent *proto.Agent) (*proto.Agent, error) {
 		log.Printf("code=%d\n", code)
 		log.Printf("err=%s\n", err)
 	}
+	if err != nil {
+		return nil, false, err
+	}
+	if code != http.StatusOK {
+		return nil, false, fmt.Errorf("Failed to get new agent (status code %d)", code)
+	}
+	if err := json.Unmarshal(data, agent); err != nil {
+		return nil, false, fmt.Errorf("Failed to parse agent entity: %s", err)
+	}
+	return agent, created, nil
+}
+
+// GetAgent returns the agent, or nil if the API doesn't have it (404).
+func (a *Api) GetAgent(uuid string) (*proto.Agent, error) {
+	// GET <api>/agents/:uuid
+	url := a.apiConnector.URL("agents", uuid)
+	code, data, err := a.apiConnector.Get(a.apiConnector.ApiKey(), url)
+	if a.debug {
+		log.Printf("code=%d\n", code)
+		log.Printf("err=%s\n", err)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if code == http.StatusNotFound {
+		return nil, nil
+	}
 	if code != http.StatusOK {
-		return nil, fmt.Errorf("Failed to get new agent (status code %d)", code)
+		return nil, fmt.Errorf("Failed to get agent %s (status code %d)", uuid, code)
 	}
+	agent := &proto.Agent{}
 	if err := json.Unmarshal(data, agent); err != nil {
 		return nil, fmt.Errorf("Failed to parse agent entity: %s", err)
 	}
 	return agent, nil
 }
 
+// DeleteAgent deletes the agent.  It's not an error if the agent doesn't exist.
+func (a *Api) DeleteAgent(uuid string) error {
+	// DELETE <api>/agents/:uuid
+	return a.delete("agent "+uuid, a.apiConnector.URL("agents", uuid))
+}
+
+// DeleteInstance deletes the service instance, e.g. server or mysql.  It's not
+// an error if the instance doesn't exist.
+func (a *Api) DeleteInstance(service string, id uint) error {
+	// DELETE <api>/instances/:service/:id
+	return a.delete(fmt.Sprintf("%s instance %d", service, id), a.apiConnector.URL("instances", service, strconv.FormatUint(uint64(id), 10)))
+}
+
+func (a *Api) delete(what, url string) error {
+	resp, _, err := a.apiConnector.Delete(a.apiConnector.ApiKey(), url)
+	if a.debug {
+		log.Printf("resp=%#v\n", resp)
+		log.Printf("err=%s\n", err)
+	}
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("Failed to delete %s (status code %d)", what, resp.StatusCode)
+}
+
 func (a *Api) UpdateAgent(agent *proto.Agent, uuid string) (*proto.Agent, error) {
 	data, err := json.Marshal(agent)
 	if err != nil {
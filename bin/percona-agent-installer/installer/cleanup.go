@@ -0,0 +1,118 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/pct"
+	"path/filepath"
+	"strings"
+)
+
+// resources are what the installer created, so cleanup can remove them.
+type resources struct {
+	agentUuid string                  // created via the API
+	instances []proto.ServiceInstance // created via the API
+	configs   []string                // written to the config dir, e.g. agent or mysql-1
+}
+
+func (r resources) empty() bool {
+	return r.agentUuid == "" && len(r.instances) == 0 && len(r.configs) == 0
+}
+
+// Uninstall deletes the agent and its instances via the API and removes the
+// local config files, like cleanup after a failed install.  The agent UUID and
+// API key are read from the agent config; -api-key overrides the key.
+func (i *Installer) Uninstall() error {
+	config := &agent.Config{}
+	if err := pct.Basedir.ReadConfig("agent", config); err != nil {
+		return fmt.Errorf("Cannot read agent config: %s", err)
+	}
+	if config.AgentUuid == "" {
+		return fmt.Errorf("Agent is not installed in %s", pct.Basedir.Path())
+	}
+	if config.ApiHostname != "" {
+		i.agentConfig.ApiHostname = config.ApiHostname
+	}
+	if i.agentConfig.ApiKey == "" {
+		i.agentConfig.ApiKey = config.ApiKey
+	}
+	if err := i.VerifyApiKey(); err != nil {
+		return err
+	}
+
+	if err := i.instanceRepo.Init(); err != nil {
+		return fmt.Errorf("Cannot read instances: %s", err)
+	}
+	i.created.agentUuid = config.AgentUuid
+	for _, service := range []string{"mysql", "server"} {
+		for _, id := range i.instanceRepo.ListByType(service) {
+			i.created.instances = append(i.created.instances, proto.ServiceInstance{Service: service, InstanceId: id})
+		}
+	}
+	files, err := filepath.Glob(pct.Basedir.Dir("config") + "/*" + pct.CONFIG_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		i.created.configs = append(i.created.configs, strings.TrimSuffix(filepath.Base(file), pct.CONFIG_FILE_SUFFIX))
+	}
+
+	if !i.cleanup() {
+		return fmt.Errorf("Failed to uninstall completely, see the warnings above")
+	}
+	fmt.Fprintln(i.out, "Uninstalled")
+	return nil
+}
+
+// cleanup removes, best-effort, the resources in reverse order of creation:
+// the config files, then the instances and the agent via the API.  Failures
+// are printed and don't stop it.  It returns true if everything was removed.
+func (i *Installer) cleanup() bool {
+	ok := true
+	for n := len(i.created.configs) - 1; n >= 0; n-- {
+		file := pct.Basedir.ConfigFile(i.created.configs[n])
+		if err := pct.Basedir.RemoveConfig(i.created.configs[n]); err != nil {
+			i.warn(nil, "cannot remove %s: %s", file, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(i.out, "Removed %s\n", file)
+	}
+	for n := len(i.created.instances) - 1; n >= 0; n-- {
+		in := i.created.instances[n]
+		if err := i.api.DeleteInstance(in.Service, in.InstanceId); err != nil {
+			i.warn(nil, "cannot delete %s instance %d: %s", in.Service, in.InstanceId, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(i.out, "Deleted %s instance: id=%d\n", in.Service, in.InstanceId)
+	}
+	if i.created.agentUuid != "" {
+		if err := i.api.DeleteAgent(i.created.agentUuid); err != nil {
+			i.warn(nil, "cannot delete agent %s: %s", i.created.agentUuid, err)
+			ok = false
+		} else {
+			fmt.Fprintf(i.out, "Deleted agent: uuid=%s\n", i.created.agentUuid)
+		}
+	}
+	i.created = resources{}
+	return ok
+}
@@ -21,12 +21,48 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/agent"
 	"github.com/percona/percona-agent/data"
 	pctLog "github.com/percona/percona-agent/log"
 	"github.com/percona/percona-agent/pct"
 )
 
+// NewAgentConfig returns the agent config from the flags and the environment,
+// see agent.Config.ApplyEnvOverrides.  -api-host beats the environment if
+// apiHostnameSet, i.e. it was given on the command line.  The API key from
+// the environment isn't used here because loadApiKey uses it only if neither
+// -api-key nor -api-key-file is given.
+func NewAgentConfig(apiHostname string, apiHostnameSet bool, apiKey string) (*agent.Config, error) {
+	config := &agent.Config{}
+	if err := config.ApplyEnvOverrides(); err != nil {
+		return nil, err
+	}
+	if apiHostnameSet || config.ApiHostname == "" {
+		config.ApiHostname = apiHostname
+	}
+	config.ApiKey = apiKey
+	return config, nil
+}
+
+// dryRun prints what would be done with v, as JSON, and returns true if
+// -dry-run is set, in which case the caller must not do it.
+func (i *Installer) dryRun(what string, v interface{}) bool {
+	if !i.flags.Bool["dry-run"] {
+		return false
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		bytes = []byte(fmt.Sprintf("%+v", v))
+	}
+	fmt.Fprintf(i.out, "Dry run: would %s: %s\n", what, bytes)
+	return true
+}
+
 func (i *Installer) writeInstances(si *proto.ServerInstance, mi *proto.MySQLInstance) error {
+	// Dry run already printed the instances when they would have been created.
+	if i.flags.Bool["dry-run"] {
+		return nil
+	}
 	// We could write the instance structs directly, but this is the job of an
 	// instance repo and it's easy enough to create one, so do the right thing.
 	if si != nil {
@@ -37,6 +73,7 @@ func (i *Installer) writeInstances(si *proto.ServerInstance, mi *proto.MySQLInst
 		if err := i.instanceRepo.Add("server", si.Id, bytes, true); err != nil {
 			return err
 		}
+		i.created.configs = append(i.created.configs, i.instanceRepo.Name("server", si.Id))
 	}
 	if mi != nil {
 		bytes, err := json.Marshal(mi)
@@ -46,6 +83,7 @@ func (i *Installer) writeInstances(si *proto.ServerInstance, mi *proto.MySQLInst
 		if err := i.instanceRepo.Add("mysql", mi.Id, bytes, true); err != nil {
 			return err
 		}
+		i.created.configs = append(i.created.configs, i.instanceRepo.Name("mysql", mi.Id))
 	}
 	return nil
 }
@@ -59,9 +97,13 @@ func (i *Installer) writeConfigs(configs []proto.AgentConfig) error {
 			name += fmt.Sprintf("-%s-%d", config.ExternalService.Service, config.ExternalService.InstanceId)
 		}
 
+		if i.dryRun("write "+name+" config", config) {
+			continue
+		}
 		if err := pct.Basedir.WriteConfigString(name, config.Config); err != nil {
 			return err
 		}
+		i.created.configs = append(i.created.configs, name)
 	}
 
 	return nil
@@ -102,6 +144,9 @@ func (i *Installer) getDataConfig() (*proto.AgentConfig, error) {
 }
 
 func (i *Installer) getAgentConfig() (*proto.AgentConfig, error) {
+	if err := i.agentConfig.Validate(); err != nil {
+		return nil, err
+	}
 	configJson, err := json.Marshal(i.agentConfig)
 	if err != nil {
 		return nil, err
@@ -26,20 +26,36 @@ import (
 	"github.com/percona/percona-agent/bin/percona-agent-installer/term"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/url"
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var portNumberRe = regexp.MustCompile(`\.\d+$`)
+// API_KEY_ENV is the environment variable with the API key, used if neither
+// -api-key nor -api-key-file is given.  It's the same one the agent uses.
+const API_KEY_ENV = agent.ENV_API_KEY
+
+// VerifyApiKey retries transient failures this many times, waiting the delay,
+// doubled after each try up to the max, between tries, when not interactive.
+const (
+	DEFAULT_VERIFY_API_KEY_ATTEMPTS = 5
+	DEFAULT_VERIFY_API_KEY_DELAY    = 1 * time.Second
+	MAX_VERIFY_API_KEY_DELAY        = 30 * time.Second
+	DEFAULT_API_SLOW_THRESHOLD      = 5 * time.Second
+)
 
 type Flags struct {
-	Bool   map[string]bool
-	String map[string]string
-	Int64  map[string]int64
+	Bool     map[string]bool
+	String   map[string]string
+	Int64    map[string]int64
+	Duration map[string]time.Duration
 }
 
 type Installer struct {
@@ -52,6 +68,13 @@ type Installer struct {
 	// --
 	hostname   string
 	defaultDSN mysql.DSN
+	created    resources
+	result     Result
+	warnings   []InstallWarning
+	stdout     io.Writer
+	out        io.Writer // stdout, or discarded with -output=json
+	// --
+	ConnFactory mysql.ConnectionFactory // for SelfTest
 }
 
 func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanceRepo *instance.Repo, agentConfig *agent.Config, flags Flags) *Installer {
@@ -62,12 +85,10 @@ func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanc
 		agentConfig.PidFile = agent.DEFAULT_PIDFILE
 	}
 	hostname, _ := os.Hostname()
-	defaultDSN := mysql.DSN{
-		Username: flags.String["mysql-user"],
-		Password: flags.String["mysql-pass"],
-		Hostname: flags.String["mysql-host"],
-		Port:     flags.String["mysql-port"],
-		Socket:   flags.String["mysql-socket"],
+	defaultDSN := NewDefaultDSN(flags)
+	var out io.Writer = os.Stdout
+	if flags.String["output"] == OUTPUT_JSON {
+		out = ioutil.Discard
 	}
 	installer := &Installer{
 		term:         terminal,
@@ -79,11 +100,72 @@ func NewInstaller(terminal *term.Terminal, basedir string, api *api.Api, instanc
 		// --
 		hostname:   hostname,
 		defaultDSN: defaultDSN,
+		stdout:     os.Stdout,
+		out:        out,
+		// --
+		ConnFactory: &mysql.RealConnectionFactory{Timeout: VERIFY_MYSQL_TIMEOUT},
 	}
 	return installer
 }
 
+// NewDefaultDSN returns the MySQL DSN from the -mysql-uri option, if any, with
+// the values of the other -mysql-* options, which override the URI.  The URI
+// must already be valid.
+func NewDefaultDSN(flags Flags) mysql.DSN {
+	dsn := mysql.DSN{}
+	if uri := flags.String["mysql-uri"]; uri != "" {
+		dsn, _ = mysql.ParseURI(uri)
+	}
+	if user := flags.String["mysql-user"]; user != "" {
+		dsn.Username = user
+	}
+	if pass := flags.String["mysql-pass"]; pass != "" {
+		dsn.Password = pass
+	}
+	if host := flags.String["mysql-host"]; host != "" {
+		dsn.Hostname = host
+		dsn.Socket = ""
+		dsn.Protocol = ""
+	}
+	if port := flags.String["mysql-port"]; port != "" {
+		dsn.Port = port
+	}
+	if socket := flags.String["mysql-socket"]; socket != "" {
+		dsn.Socket = socket
+		dsn.Hostname = ""
+		dsn.Port = ""
+		dsn.Protocol = ""
+	}
+	if mode := flags.String["mysql-tls"]; mode != "" {
+		dsn.TLS = mode
+	}
+	if ca := flags.String["mysql-ssl-ca"]; ca != "" {
+		dsn.TLSCA = ca
+	}
+	if cert := flags.String["mysql-ssl-cert"]; cert != "" {
+		dsn.TLSCert = cert
+	}
+	if key := flags.String["mysql-ssl-key"]; key != "" {
+		dsn.TLSKey = key
+	}
+	return dsn
+}
+
 func (i *Installer) Run() (err error) {
+	// If the install fails, remove what it created so a retry starts clean.
+	defer func() {
+		if err != nil && !i.created.empty() {
+			fmt.Fprintf(i.out, "Install failed, cleaning up: %s\n", err)
+			i.cleanup()
+		}
+		i.printWarnings()
+		i.printResult(err)
+	}()
+
+	if i.flags.Bool["dry-run"] {
+		fmt.Fprintln(i.out, "Dry run: nothing will be created or written")
+	}
+
 	/**
 	 * Get the API key.
 	 */
@@ -100,6 +182,12 @@ func (i *Installer) Run() (err error) {
 		return err
 	}
 
+	if i.flags.Bool["check-large-response"] {
+		if err := i.CheckLargeResponse(); err != nil {
+			return err
+		}
+	}
+
 	if i.flags.Bool["create-agent"] {
 		protoAgent, err := i.InstallerCreateAgentWithInitialServiceConfigs()
 		if err != nil {
@@ -120,6 +208,7 @@ func (i *Installer) Run() (err error) {
 	if err != nil {
 		return err
 	}
+	i.result.ServerInstance = si
 
 	// MySQL instance
 	var mi *proto.MySQLInstance
@@ -130,9 +219,15 @@ func (i *Installer) Run() (err error) {
 				return err
 			} else {
 				// Automated install, log the error and continue.
-				fmt.Printf("Failed to set up MySQL (ignoring because interactive=false): %s\n", err)
+				msg := fmt.Sprintf("Failed to set up MySQL (ignoring because interactive=false): %s", err)
+				if i.flags.String["output"] == OUTPUT_JSON {
+					i.result.Warnings = append(i.result.Warnings, msg)
+				} else {
+					fmt.Fprintln(i.out, msg)
+				}
 			}
 		}
+		i.result.MySQLInstance = mi
 	}
 
 	if err = i.writeInstances(si, mi); err != nil {
@@ -156,14 +251,28 @@ func (i *Installer) Run() (err error) {
 			return fmt.Errorf("Created agent but failed to write configs: %s", err)
 		}
 	} else {
-		fmt.Println("Not creating agent (-create-agent=false)")
+		fmt.Fprintln(i.out, "Not creating agent (-create-agent=false)")
+	}
+
+	/**
+	 * Verify the agent can use the installed configs.
+	 */
+	if i.flags.Bool["verify"] && !i.flags.Bool["dry-run"] {
+		// The install is done, so a failure is only a warning.
+		if err := i.SelfTest(mi); err != nil {
+			i.warn(nil, "%s. The agent may not work until this is fixed.", err)
+		}
 	}
 
 	return nil // success
 }
 
 func (i *Installer) InstallerGetApiKey() error {
-	fmt.Printf("API host: %s\n", i.agentConfig.ApiHostname)
+	fmt.Fprintf(i.out, "API host: %s\n", i.agentConfig.ApiHostname)
+
+	if err := i.loadApiKey(); err != nil {
+		return err
+	}
 
 	if !i.flags.Bool["interactive"] && i.agentConfig.ApiKey == "" {
 		return fmt.Errorf(
@@ -172,18 +281,19 @@ func (i *Installer) InstallerGetApiKey() error {
 		)
 	} else {
 		if i.agentConfig.ApiKey == "" {
-			fmt.Printf(
-				"No API Key Defined.\n" +
+			fmt.Fprintf(i.out,
+				"No API Key Defined.\n"+
 					"Please Enter your API Key, it is available at https://cloud.percona.com/api-key\n",
 			)
 		}
 		for i.agentConfig.ApiKey == "" {
-			apiKey, err := i.term.PromptString("API key", "")
+			apiKey, err := i.term.PromptPassword("API key")
 			if err != nil {
 				return err
 			}
+			apiKey = strings.TrimSpace(apiKey)
 			if apiKey == "" {
-				fmt.Println("API key is required, please try again.")
+				fmt.Fprintln(i.out, "API key is required, please try again.")
 				continue
 			}
 			i.agentConfig.ApiKey = apiKey
@@ -194,11 +304,62 @@ func (i *Installer) InstallerGetApiKey() error {
 	return nil
 }
 
+// loadApiKey sets the API key, if -api-key didn't, from the -api-key-file file,
+// else from the API_KEY_ENV environment variable.  If neither has the key,
+// it's not set, so it's prompted for in interactive mode.
+func (i *Installer) loadApiKey() error {
+	source := "-api-key"
+	if i.agentConfig.ApiKey == "" {
+		if file := i.flags.String["api-key-file"]; file != "" {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("Cannot read API key file: %s", err)
+			}
+			apiKey := strings.TrimSpace(string(data))
+			if apiKey == "" {
+				return fmt.Errorf("API key file %s is empty", file)
+			}
+			i.agentConfig.ApiKey = apiKey
+			source = file
+		} else if apiKey := strings.TrimSpace(os.Getenv(API_KEY_ENV)); apiKey != "" {
+			i.agentConfig.ApiKey = apiKey
+			source = API_KEY_ENV
+		}
+	}
+	if i.flags.Bool["debug"] && i.agentConfig.ApiKey != "" {
+		log.Printf("API key %s from %s\n", RedactApiKey(i.agentConfig.ApiKey), source)
+	}
+	return nil
+}
+
+// RedactApiKey returns the API key with all but its last 4 characters hidden,
+// for logging.
+func RedactApiKey(apiKey string) string {
+	if len(apiKey) <= 4 {
+		return strings.Repeat("*", len(apiKey))
+	}
+	return strings.Repeat("*", len(apiKey)-4) + apiKey[len(apiKey)-4:]
+}
+
 func (i *Installer) VerifyApiKey() error {
+	maxAttempts := i.flags.Int64["api-verify-attempts"]
+	if maxAttempts <= 0 {
+		maxAttempts = DEFAULT_VERIFY_API_KEY_ATTEMPTS
+	}
+	delay := i.flags.Duration["api-verify-delay"]
+	if delay <= 0 {
+		delay = DEFAULT_VERIFY_API_KEY_DELAY
+	}
+	slow := i.flags.Duration["api-slow-threshold"]
+	if slow <= 0 {
+		slow = DEFAULT_API_SLOW_THRESHOLD
+	}
+	attempt := int64(0)
 VERIFY_API_KEY:
 	for {
+		attempt++
 		startTime := time.Now()
-		fmt.Printf("Verifying API key %s...\n", i.agentConfig.ApiKey)
+		fmt.Fprintf(i.out, "Verifying API key %s...\n", RedactApiKey(i.agentConfig.ApiKey))
 		headers := map[string]string{
 			"X-Percona-Agent-Version": agent.VERSION,
 		}
@@ -217,33 +378,53 @@ VERIFY_API_KEY:
 			log.Printf("err=%s\n", err)
 		}
 		ok := false
+		transient := false
 		if timeout {
-			fmt.Printf(
+			fmt.Fprintf(i.out,
 				"Error: API connection timeout (%ds): %s\n"+
-					"Before you try again, please check your connection and DNS configuration.\n",
+					"Before you try again, please check your connection and DNS configuration, "+
+					"or use -api-timeout to wait longer.\n",
 				elapsedTimeInSeconds,
 				err,
 			)
+			transient = true
 		} else if err != nil {
-			fmt.Printf("Error: %s\n", err)
+			fmt.Fprintf(i.out, "Error: %s\n", err)
+			transient = true
 		} else if code >= 500 {
-			fmt.Printf("Sorry, there's an API problem (status code %d). "+
+			fmt.Fprintf(i.out, "Sorry, there's an API problem (status code %d). "+
 				"Please try to install again. If the problem continues, contact Percona.\n",
 				code)
+			transient = true
 		} else if code == 401 {
 			return fmt.Errorf("Access denied.  Check the API key and try again.")
 		} else if code >= 300 {
-			fmt.Printf("Sorry, there's an installer problem (status code %d). "+
+			fmt.Fprintf(i.out, "Sorry, there's an installer problem (status code %d). "+
 				"Please try to install again. If the problem continues, contact Percona.\n",
 				code)
 		} else if code != 200 {
-			fmt.Printf("Sorry, there's an installer problem (status code %d). "+
+			fmt.Fprintf(i.out, "Sorry, there's an installer problem (status code %d). "+
 				"Please try to install again. If the problem continues, contact Percona.\n",
 				code)
 		} else {
 			ok = true
 		}
 
+		if !ok && !i.flags.Bool["interactive"] {
+			// Automated install: nobody to ask, so retry transient failures.
+			if !transient {
+				return fmt.Errorf("Failed to verify API key")
+			}
+			if attempt >= maxAttempts {
+				return fmt.Errorf("Failed to verify API key after %d attempts", attempt)
+			}
+			fmt.Fprintf(i.out, "Trying again in %s (attempt %d of %d)...\n", delay, attempt+1, maxAttempts)
+			time.Sleep(delay)
+			if delay *= 2; delay > MAX_VERIFY_API_KEY_DELAY {
+				delay = MAX_VERIFY_API_KEY_DELAY
+			}
+			continue VERIFY_API_KEY
+		}
 		if !ok {
 			again, err := i.term.PromptBool("Try again?", "Y")
 			if err != nil {
@@ -256,17 +437,20 @@ VERIFY_API_KEY:
 		}
 
 		// https://jira.percona.com/browse/PCT-617
-		// Warn user if request took at least 5s
-		if elapsedTimeInSeconds >= 5 {
-			fmt.Printf(
-				"WARNING: Request to API took %d seconds but it should have taken < 1 second."+
+		// Warn user if request took at least -api-slow-threshold (5s)
+		if elapsedTime >= slow {
+			i.warn(nil,
+				"Request to API took %.1f seconds but it should have taken < 1 second."+
 					" There might be a connection problem, or resolving DNS is very slow."+
 					" Before continuing, please check the connection and DNS configuration"+
 					" as this could prevent percona-agent from installing or working properly."+
 					" If running CentOS or Fedora 19+ in a Vagrant VirtualBox, see this bug:\n"+
-					" https://github.com/mitchellh/vagrant/issues/1172\n",
-				elapsedTimeInSeconds,
+					" https://github.com/mitchellh/vagrant/issues/1172",
+				elapsedTime.Seconds(),
 			)
+			if i.flags.Bool["assume-yes"] {
+				break // scripted install on a known slow link
+			}
 			proceed, err := i.term.PromptBool("Continue?", "Y")
 			if err != nil {
 				return err
@@ -282,19 +466,85 @@ VERIFY_API_KEY:
 	return nil
 }
 
+// CheckLargeResponse verifies that a large API response is received intact.
+// Ping only sends a small response, so it can succeed on a network path with
+// a broken MTU that later drops large responses like the instance list.
+func (i *Installer) CheckLargeResponse() error {
+	fmt.Fprintln(i.out, "Checking large API response...")
+	headers := map[string]string{
+		"X-Percona-Agent-Version": agent.VERSION,
+	}
+	check, err := i.api.CheckLargeResponse(headers)
+	if err != nil {
+		return err
+	}
+	if i.flags.Bool["debug"] {
+		log.Println(check)
+	}
+	if check.Ok() {
+		return nil
+	}
+	i.warn(nil,
+		"%s. Small requests to the API work but large responses do not."+
+			" This usually means a network device is dropping large packets (path MTU problem)."+
+			" Before continuing, please check the network MTU configuration"+
+			" as this could prevent percona-agent from working properly.",
+		check,
+	)
+	proceed, err := i.term.PromptBool("Continue?", "Y")
+	if err != nil {
+		return err
+	}
+	if !proceed {
+		return fmt.Errorf("Failed because of large API response problem")
+	}
+	return nil
+}
+
 func (i *Installer) InstallerCreateServerInstance() (si *proto.ServerInstance, err error) {
 	if i.flags.Bool["create-server-instance"] {
+		// The server instance is only the hostname, the same as the agent
+		// reports in its server info, see pct.SystemInfo.
+		hostname := i.hostname
+		if sys, err := pct.SystemInfo(); err == nil {
+			hostname = sys.Hostname
+			if i.flags.Bool["debug"] {
+				log.Printf("system info: %+v\n", *sys)
+			}
+		} else if i.flags.Bool["debug"] {
+			log.Printf("Cannot get system info: %s\n", err)
+		}
+		// Reuse the server instance if the API already has one for this host,
+		// e.g. when re-installing, else there would be a duplicate.
+		if !i.flags.Bool["force"] {
+			existing, err := i.api.FindServerInstance(hostname)
+			if err != nil {
+				if i.flags.Bool["debug"] {
+					log.Printf("Cannot find server instance %s, creating it: %s\n", hostname, err)
+				}
+			} else if existing != nil {
+				fmt.Fprintf(i.out, "Using existing server instance: hostname=%s id=%d\n", existing.Hostname, existing.Id)
+				return existing, nil
+			}
+		}
 		// POST <api>/instances/server
 		si = &proto.ServerInstance{
-			Hostname: i.hostname,
+			Hostname: hostname,
 		}
-		si, err = i.api.CreateServerInstance(si)
+		if i.dryRun("create server instance", si) {
+			return si, nil
+		}
+		var created bool
+		si, created, err = i.api.CreateServerInstance(si)
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("Created server instance: hostname=%s id=%d\n", si.Hostname, si.Id)
+		if created {
+			i.created.instances = append(i.created.instances, proto.ServiceInstance{Service: "server", InstanceId: si.Id})
+		}
+		fmt.Fprintf(i.out, "Created server instance: hostname=%s id=%d\n", si.Hostname, si.Id)
 	} else {
-		fmt.Println("Not creating server instance (-create-server-instance=false)")
+		fmt.Fprintln(i.out, "Not creating server instance (-create-server-instance=false)")
 	}
 
 	return si, nil
@@ -311,19 +561,33 @@ func (i *Installer) InstallerCreateMySQLInstance() (mi *proto.MySQLInstance, err
 			return nil, err
 		}
 
+		// Non-MySQL installs have no agent MySQL user to check with.
+		if agentDSN.Username != "" {
+			if err := i.verifyMySQLVersion(agentDSN); err != nil {
+				return nil, err
+			}
+		}
+
 		// Create MySQL instance in API.
 		dsnString, _ := agentDSN.DSN()
 		mi = &proto.MySQLInstance{
 			Hostname: i.hostname,
 			DSN:      dsnString,
 		}
-		mi, err = i.api.CreateMySQLInstance(mi)
+		if i.dryRun("create MySQL instance", mi) {
+			return mi, nil
+		}
+		var created bool
+		mi, created, err = i.api.CreateMySQLInstance(mi)
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mi.DSN, mi.Hostname, mi.Id)
+		if created {
+			i.created.instances = append(i.created.instances, proto.ServiceInstance{Service: "mysql", InstanceId: mi.Id})
+		}
+		fmt.Fprintf(i.out, "Created MySQL instance: dsn=%s hostname=%s id=%d\n", mi.DSN, mi.Hostname, mi.Id)
 	} else {
-		fmt.Println("Not creating MySQL instance (-create-mysql-instance=false)")
+		fmt.Fprintln(i.out, "Not creating MySQL instance (-create-mysql-instance=false)")
 	}
 
 	return mi, nil
@@ -354,8 +618,7 @@ func (i *Installer) InstallerGetDefaultConfigs(si *proto.ServerInstance, mi *pro
 		// Server metrics monitor
 		config, err := i.api.GetMmServerConfig(si)
 		if err != nil {
-			fmt.Println(err)
-			fmt.Println("WARNING: cannot start server metrics monitor")
+			i.warnService("mm-server", err, "cannot start server metrics monitor")
 		} else {
 			configs = append(configs, *config)
 		}
@@ -365,8 +628,7 @@ func (i *Installer) InstallerGetDefaultConfigs(si *proto.ServerInstance, mi *pro
 				// MySQL metrics tracker
 				config, err = i.api.GetMmMySQLConfig(mi)
 				if err != nil {
-					fmt.Println(err)
-					fmt.Println("WARNING: cannot start MySQL metrics monitor")
+					i.warnService("mm-mysql", err, "cannot start MySQL metrics monitor")
 				} else {
 					configs = append(configs, *config)
 				}
@@ -374,46 +636,149 @@ func (i *Installer) InstallerGetDefaultConfigs(si *proto.ServerInstance, mi *pro
 				// MySQL config tracker
 				config, err = i.api.GetSysconfigMySQLConfig(mi)
 				if err != nil {
-					fmt.Println(err)
-					fmt.Println("WARNING: cannot start MySQL configuration monitor")
+					i.warnService("sysconfig-mysql", err, "cannot start MySQL configuration monitor")
 				} else {
 					configs = append(configs, *config)
 				}
 
 				// QAN
 				// MySQL is local if the server hostname == MySQL hostname without port number.
-				if i.hostname == portNumberRe.ReplaceAllLiteralString(mi.Hostname, "") {
+				if i.isLocalMySQL(mi) {
 					if i.flags.Bool["debug"] {
 						log.Printf("MySQL is local")
 					}
 					config, err := i.api.GetQanConfig(mi)
 					if err != nil {
-						fmt.Println(err)
-						fmt.Println("WARNING: cannot start Query Analytics")
+						i.warnService("qan-mysql", err, "cannot start Query Analytics")
 					} else {
 						configs = append(configs, *config)
 					}
 				}
 			}
 		} else {
-			fmt.Println("Not starting MySQL services (-start-mysql-services=false)")
+			fmt.Fprintln(i.out, "Not starting MySQL services (-start-mysql-services=false)")
 		}
 	} else {
-		fmt.Println("Not starting default services (-start-services=false)")
+		fmt.Fprintln(i.out, "Not starting default services (-start-services=false)")
 	}
 
 	return configs, nil
 }
 
+func (i *Installer) isLocalMySQL(mi *proto.MySQLInstance) bool {
+	return IsLocalMySQL(i.hostname, mi)
+}
+
+// IsLocalMySQL returns true if MySQL runs on the server with the hostname:
+// the instance DSN is a socket or an address of this server, or the MySQL
+// hostname, which has the port if it's not the default, is the hostname.
+func IsLocalMySQL(hostname string, mi *proto.MySQLInstance) bool {
+	dsn, err := mysql.ParseDSN(mi.DSN)
+	if err != nil {
+		// Only the MySQL hostname to go on.
+		if mi.Hostname == hostname {
+			return true
+		}
+		host, _ := instance.SplitMySQLHostname(mi.Hostname)
+		return host == hostname
+	}
+	if dsn.Socket != "" || isLocalHost(hostname, dsn.Hostname) {
+		return true
+	}
+	// Not a local address, but it can be a name that doesn't resolve here.
+	port := uint(instance.DEFAULT_MYSQL_PORT)
+	if p, err := strconv.ParseUint(dsn.Port, 10, 16); err == nil {
+		port = uint(p)
+	}
+	return mi.Hostname == hostname || mi.Hostname == instance.MySQLHostname(hostname, port)
+}
+
+// isLocalHost returns true if host, a name or IPv4 or IPv6 address, is this
+// server: localhost, the hostname, or a loopback or interface address.
+func isLocalHost(hostname, host string) bool {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i] // IPv6 zone, e.g. fe80::1%eth0
+	}
+	if host == "" || host == "localhost" || host == hostname {
+		return true
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, _ = net.LookupIP(host); len(ips) == 0 {
+		return false
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (i *Installer) InstallerCreateAgentWithInitialServiceConfigs() (protoAgent *proto.Agent, err error) {
+	// Re-running the installer must not create a duplicate agent.
+	if !i.flags.Bool["force"] {
+		protoAgent, err := i.existingAgent()
+		if err != nil {
+			return nil, err
+		}
+		if protoAgent != nil {
+			fmt.Fprintf(i.out, "Using existing agent: uuid=%s (-force to create a new agent)\n", protoAgent.Uuid)
+			return protoAgent, nil
+		}
+	}
+
 	protoAgent = &proto.Agent{
 		Hostname: i.hostname,
 		Version:  agent.VERSION,
 	}
-	protoAgent, err = i.api.CreateAgent(protoAgent)
+	if i.dryRun("create agent", protoAgent) {
+		return protoAgent, nil
+	}
+	protoAgent, created, err := i.api.CreateAgent(protoAgent)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Created agent: uuid=%s\n", protoAgent.Uuid)
+	if created {
+		i.created.agentUuid = protoAgent.Uuid
+	}
+	fmt.Fprintf(i.out, "Created agent: uuid=%s\n", protoAgent.Uuid)
+	return protoAgent, nil
+}
+
+// existingAgent returns the agent with the UUID in the agent config, or in the
+// agent config file if it's not set, or nil if there's no UUID or the API no
+// longer has the agent.
+func (i *Installer) existingAgent() (*proto.Agent, error) {
+	uuid := i.agentConfig.AgentUuid
+	if uuid == "" {
+		config := &agent.Config{}
+		if err := pct.Basedir.ReadConfig("agent", config); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Cannot read agent config: %s", err)
+		}
+		uuid = config.AgentUuid
+	}
+	if uuid == "" {
+		return nil, nil
+	}
+	protoAgent, err := i.api.GetAgent(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot check existing agent %s: %s", uuid, err)
+	}
+	if protoAgent == nil {
+		fmt.Fprintf(i.out, "Existing agent %s not found, creating a new agent\n", uuid)
+		return nil, nil
+	}
+	if protoAgent.Uuid == "" {
+		protoAgent.Uuid = uuid
+	}
 	return protoAgent, nil
 }
@@ -19,19 +19,54 @@ package installer
 
 import (
 	"fmt"
-	"github.com/mewpkg/gopass"
 	"github.com/percona/percona-agent/agent"
 	"github.com/percona/percona-agent/mysql"
 	"log"
 	"math/rand"
+	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
-func MakeGrant(dsn mysql.DSN, user string, pass string, mysqlMaxUserConns int64) []string {
+const VERIFY_MYSQL_TIMEOUT = 10 * time.Second
+
+// DEFAULT_MIN_MYSQL_VERSION is the oldest MySQL version on which all agent
+// features work, the default -mysql-min-version.  The agent can still monitor
+// older versions back to agent.MIN_SUPPORTED_MYSQL_VERSION.
+const DEFAULT_MIN_MYSQL_VERSION = "5.5"
+
+// MySQLFeature is an agent feature that requires a newer MySQL version than
+// agent.MIN_SUPPORTED_MYSQL_VERSION.
+type MySQLFeature struct {
+	Name       string
+	MinVersion string
+}
+
+// MYSQL_FEATURES are listed when warning about an old MySQL version, see
+// UnsupportedMySQLFeatures.
+var MYSQL_FEATURES = []MySQLFeature{
+	{"Performance Schema metrics", "5.5"},
+	{"Query Analytics from the Performance Schema", "5.6"},
+}
+
+// Privileges granted to the agent MySQL user, see MakeGrant.
+const (
+	// Only what the agent needs without the slow log: PROCESS for the
+	// processlist and InnoDB status, REPLICATION CLIENT for SHOW SLAVE STATUS,
+	// and the Performance Schema, which QAN reads and resets.
+	GRANT_LEVEL_MINIMAL = "minimal"
+	// Also SUPER to set the global slow log variables for QAN, and SELECT on
+	// all tables to EXPLAIN queries.
+	GRANT_LEVEL_STANDARD = "standard"
+)
+
+// MakeGrant returns the statements to create the agent MySQL user with the
+// privileges of the grant level, GRANT_LEVEL_STANDARD if level is empty.
+func MakeGrant(dsn mysql.DSN, user string, pass string, mysqlMaxUserConns int64, level string) []string {
 	host := "%"
 	if dsn.Socket != "" || dsn.Hostname == "localhost" {
 		host = "localhost"
@@ -42,8 +77,18 @@ func MakeGrant(dsn mysql.DSN, user string, pass string, mysqlMaxUserConns int64)
 	// Just in case, disable it for this session
 	grants := []string{
 		"SET SESSION old_passwords=0",
-		fmt.Sprintf("GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
-		fmt.Sprintf("GRANT UPDATE, DELETE, DROP ON performance_schema.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
+	}
+	switch level {
+	case GRANT_LEVEL_MINIMAL:
+		grants = append(grants,
+			fmt.Sprintf("GRANT PROCESS, REPLICATION CLIENT, USAGE ON *.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
+			fmt.Sprintf("GRANT SELECT, UPDATE, DELETE, DROP ON performance_schema.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
+		)
+	default:
+		grants = append(grants,
+			fmt.Sprintf("GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
+			fmt.Sprintf("GRANT UPDATE, DELETE, DROP ON performance_schema.* TO '%s'@'%s' IDENTIFIED BY '%s' WITH MAX_USER_CONNECTIONS %d", user, host, pass, mysqlMaxUserConns),
+		)
 	}
 	return grants
 }
@@ -53,19 +98,21 @@ func (i *Installer) getAgentDSN() (dsn mysql.DSN, err error) {
 		// Connect as root, create percona-agent MySQL user.
 		dsn, err = i.createNewMySQLUser()
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(i.out, err)
 			return dsn, fmt.Errorf("Failed to create MySQL user for agent")
 		}
-		fmt.Printf("Created MySQL user: %s\n", dsn.StringWithSuffixes())
+		if !i.flags.Bool["dry-run"] {
+			fmt.Fprintf(i.out, "Created MySQL user: %s\n", dsn.StringWithSuffixes())
+		}
 	} else {
 		if i.flags.Bool["interactive"] {
 			// Prompt for existing percona-agent MySQL user.
 			dsn, err = i.useExistingMySQLUser()
 			if err != nil {
-				fmt.Println(err)
+				fmt.Fprintln(i.out, err)
 				return dsn, fmt.Errorf("Failed to get MySQL user for agent")
 			}
-			fmt.Printf("Using MySQL user: %s\n", dsn.StringWithSuffixes())
+			fmt.Fprintf(i.out, "Using MySQL user: %s\n", dsn.StringWithSuffixes())
 		} else {
 			if i.flags.String["agent-mysql-user"] != "" && i.flags.String["agent-mysql-pass"] != "" {
 				dsn = i.defaultDSN
@@ -79,14 +126,14 @@ func (i *Installer) getAgentDSN() (dsn mysql.DSN, err error) {
 				// Overwrite the detected user/pass with the ones specified in the command line
 				dsn.Username = i.flags.String["agent-mysql-user"]
 				dsn.Password = i.flags.String["agent-mysql-pass"]
-				fmt.Printf("Using provided user/pass for mysql-agent user. DSN: %s\n", dsn)
+				fmt.Fprintf(i.out, "Using provided user/pass for mysql-agent user. DSN: %s\n", dsn)
 				// Verify new DSN
 				if err := i.verifyMySQLConnection(dsn); err != nil {
 					return dsn, err
 				}
 			} else {
 				// Non-MySQL install (e.g. only system metrics).
-				fmt.Println("Skip creating MySQL user (-create-mysql-user=false)")
+				fmt.Fprintln(i.out, "Skip creating MySQL user (-create-mysql-user=false)")
 			}
 			return dsn, nil
 		}
@@ -104,19 +151,19 @@ func (i *Installer) createNewMySQLUser() (dsn mysql.DSN, err error) {
 			}
 		}
 	}
-	fmt.Printf("MySQL root DSN: %s\n", superUserDSN)
+	fmt.Fprintf(i.out, "MySQL root DSN: %s\n", superUserDSN)
 
 	// Try to connect as root automatically.  If this fails and interactive is true,
 	// start prompting user to enter valid root MySQL connection info.
 	if err = i.verifyMySQLConnection(superUserDSN); err != nil {
-		fmt.Printf("Error connecting to MySQL %s: %s\n", superUserDSN, err)
+		fmt.Fprintf(i.out, "Error connecting to MySQL %s: %s\n", superUserDSN, err)
 		if i.flags.Bool["interactive"] {
 			if again, err := i.term.PromptBool("Try again?", "Y"); err != nil {
 				return superUserDSN, err
 			} else if !again {
 				return superUserDSN, fmt.Errorf("Failed to connect to MySQL")
 			}
-			fmt.Println("Specify a root/super MySQL user to create a user for the agent")
+			fmt.Fprintln(i.out, "Specify a root/super MySQL user to create a user for the agent")
 			if err := i.getDSNFromUser(&superUserDSN); err != nil {
 				return dsn, err
 			}
@@ -156,21 +203,19 @@ func (i *Installer) createMySQLUser(dsn mysql.DSN) (mysql.DSN, error) {
 	userDSN.Password = fmt.Sprintf("%p%d", &dsn, rand.Uint32())
 	userDSN.OldPasswords = i.flags.Bool["old-passwords"]
 
+	if i.dryRun("create MySQL user", userDSN.StringWithSuffixes()) {
+		return userDSN, nil
+	}
+
 	dsnString, _ := dsn.DSN()
 	conn := mysql.NewConnection(dsnString)
 	if err := conn.Connect(1); err != nil {
 		return userDSN, err
 	}
 	defer conn.Close()
-	grants := MakeGrant(dsn, userDSN.Username, userDSN.Password, i.flags.Int64["mysql-max-user-connections"])
-	for _, grant := range grants {
-		if i.flags.Bool["debug"] {
-			log.Println(grant)
-		}
-		_, err := conn.DB().Exec(grant)
-		if err != nil {
-			return userDSN, fmt.Errorf("Error executing %s: %s", grant, err)
-		}
+	grants := MakeGrant(dsn, userDSN.Username, userDSN.Password, i.flags.Int64["mysql-max-user-connections"], i.flags.String["grant-level"])
+	if err := i.execGrants(conn, grants, userDSN.Password); err != nil {
+		return userDSN, err
 	}
 
 	// Go MySQL driver resolves localhost to 127.0.0.1 but localhost is a special
@@ -179,21 +224,33 @@ func (i *Installer) createMySQLUser(dsn mysql.DSN) (mysql.DSN, error) {
 	if dsn.Hostname == "localhost" {
 		dsn2 := dsn
 		dsn2.Hostname = "127.0.0.1"
-		grants := MakeGrant(dsn2, userDSN.Username, userDSN.Password, i.flags.Int64["mysql-max-user-connections"])
-		for _, grant := range grants {
-			if i.flags.Bool["debug"] {
-				log.Println(grant)
-			}
-			_, err := conn.DB().Exec(grant)
-			if err != nil {
-				return userDSN, fmt.Errorf("Error executing %s: %s", grant, err)
-			}
+		grants := MakeGrant(dsn2, userDSN.Username, userDSN.Password, i.flags.Int64["mysql-max-user-connections"], i.flags.String["grant-level"])
+		if err := i.execGrants(conn, grants, userDSN.Password); err != nil {
+			return userDSN, err
 		}
 	}
 
 	return userDSN, nil
 }
 
+// execGrants executes the MakeGrant statements and prints each GRANT, with
+// the new user's password hidden.
+func (i *Installer) execGrants(conn mysql.Connector, grants []string, pass string) error {
+	for _, grant := range grants {
+		safeGrant := strings.Replace(grant, "'"+pass+"'", "'"+mysql.HiddenPassword+"'", -1)
+		if i.flags.Bool["debug"] {
+			log.Println(safeGrant)
+		}
+		if _, err := conn.DB().Exec(grant); err != nil {
+			return fmt.Errorf("Error executing %s: %s", safeGrant, err)
+		}
+		if strings.HasPrefix(grant, "GRANT") {
+			fmt.Fprintf(i.out, "MySQL grant: %s\n", safeGrant)
+		}
+	}
+	return nil
+}
+
 func (i *Installer) useExistingMySQLUser() (mysql.DSN, error) {
 	userDSN := i.defaultDSN
 	userDSN.Username = "percona-agent"
@@ -207,14 +264,14 @@ func (i *Installer) useExistingMySQLUser() (mysql.DSN, error) {
 	}
 	for {
 		// Let user specify the MySQL account to use for the agent.
-		fmt.Println("Specify the existing MySQL user to use for the agent")
+		fmt.Fprintln(i.out, "Specify the existing MySQL user to use for the agent")
 		if err := i.getDSNFromUser(&userDSN); err != nil {
 			return userDSN, nil
 		}
 
 		// Verify DSN provided by user
 		if err := i.verifyMySQLConnection(userDSN); err != nil {
-			fmt.Printf("Error connecting to MySQL %s: %s\n", userDSN, err)
+			fmt.Fprintf(i.out, "Error connecting to MySQL %s: %s\n", userDSN, err)
 			if i.flags.Bool["interactive"] {
 				if again, err := i.term.PromptBool("Try again?", "Y"); err != nil {
 					return userDSN, err
@@ -259,7 +316,7 @@ func (i *Installer) getDSNFromUser(dsn *mysql.DSN) error {
 	if i.flags.Bool["plain-passwords"] {
 		password, err = i.term.PromptString("MySQL password", "")
 	} else {
-		password, err = gopass.GetPass("MySQL password: ")
+		password, err = i.term.PromptPassword("MySQL password")
 	}
 	if err != nil {
 		return err
@@ -290,7 +347,73 @@ func (i *Installer) getDSNFromUser(dsn *mysql.DSN) error {
 	return nil
 }
 
+// MYSQL_SOCKET_PATHS are common MySQL socket files, see DetectSocket.
+var MYSQL_SOCKET_PATHS = []string{
+	"/var/run/mysqld/mysqld.sock",
+	"/var/lib/mysql/mysql.sock",
+	"/tmp/mysql.sock",
+	"/var/mysql/mysql.sock",
+}
+
+// DetectSocket sets the socket of a localhost DSN without one: @@socket of the
+// MySQL server conn is connected to, else the first of paths that is a socket
+// file.  conn can be nil.  It returns the socket, or an empty string if the DSN
+// isn't for localhost or no socket was found.
+func DetectSocket(dsn *mysql.DSN, conn mysql.Connector, paths []string) string {
+	if dsn.Socket != "" || (dsn.Hostname != "" && dsn.Hostname != "localhost") || dsn.Protocol == "tcp" {
+		return ""
+	}
+	socket := ""
+	if conn != nil {
+		socket = conn.GetGlobalVarString("socket")
+	}
+	if socket == "" {
+		for _, path := range paths {
+			if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				socket = path
+				break
+			}
+		}
+	}
+	if socket != "" {
+		dsn.Socket = socket
+		dsn.Hostname = ""
+		dsn.Port = ""
+	}
+	return socket
+}
+
+// detectSocket sets the socket of a localhost DSN without one, see DetectSocket.
+// MySQL is asked for its socket over TCP, if it's listening.
+func (i *Installer) detectSocket(dsn *mysql.DSN) {
+	tcpDSN := *dsn
+	tcpDSN.Hostname = "127.0.0.1"
+	var conn mysql.Connector
+	if dsn.Socket == "" {
+		if dsnString, err := tcpDSN.DSN(); err == nil {
+			c := mysql.NewConnection(dsnString + "&timeout=" + VERIFY_MYSQL_TIMEOUT.String())
+			if err := c.Connect(1); err == nil {
+				defer c.Close()
+				conn = c
+			} else if i.flags.Bool["debug"] {
+				log.Printf("Cannot connect to MySQL over TCP to detect its socket: %s", err)
+			}
+		}
+	}
+	if socket := DetectSocket(dsn, conn, MYSQL_SOCKET_PATHS); socket != "" {
+		fmt.Fprintf(i.out, "Detected MySQL socket: %s\n", socket)
+	}
+}
+
+// autodetectDSN fills in the DSN with the mysql client defaults, e.g. from
+// my.cnf, and the MySQL socket if the DSN is for localhost.
 func (i *Installer) autodetectDSN(dsn *mysql.DSN) error {
+	err := i.readMySQLDefaults(dsn)
+	i.detectSocket(dsn)
+	return err
+}
+
+func (i *Installer) readMySQLDefaults(dsn *mysql.DSN) error {
 	params := []string{}
 	if i.flags.String["mysql-defaults-file"] != "" {
 		params = append(params, "--defaults-file="+i.flags.String["mysql-defaults-file"])
@@ -304,11 +427,11 @@ func (i *Installer) autodetectDSN(dsn *mysql.DSN) error {
 	}
 	output := string(byteOutput)
 	if i.flags.Bool["debug"] {
-		log.Println(output)
+		log.Println(hideDefaultsPassword(output))
 	}
 	autoDSN := ParseMySQLDefaults(output)
 	if i.flags.Bool["debug"] {
-		log.Printf("autoDSN: %#v\n", autoDSN)
+		log.Printf("autoDSN: %#v\n", hideDSNPassword(*autoDSN))
 	}
 	// Fill in the given DSN with auto-detected options.
 	if dsn.Username == "" {
@@ -333,11 +456,27 @@ func (i *Installer) autodetectDSN(dsn *mysql.DSN) error {
 		}
 	}
 	if i.flags.Bool["debug"] {
-		log.Printf("dsn: %#v\n", dsn)
+		log.Printf("dsn: %#v\n", hideDSNPassword(*dsn))
 	}
 	return nil
 }
 
+// hideDSNPassword returns the DSN with the password hidden, for logging.
+func hideDSNPassword(dsn mysql.DSN) mysql.DSN {
+	if dsn.Password != "" {
+		dsn.Password = mysql.HiddenPassword
+	}
+	return dsn
+}
+
+var defaultsPasswordRe = regexp.MustCompile("--password=[^ ]+")
+
+// hideDefaultsPassword returns mysql --print-defaults output with the password
+// hidden.
+func hideDefaultsPassword(output string) string {
+	return defaultsPasswordRe.ReplaceAllString(output, "--password="+mysql.HiddenPassword)
+}
+
 func ParseMySQLDefaults(output string) *mysql.DSN {
 	var re *regexp.Regexp
 	var result []string // Result of FindStringSubmatch
@@ -395,13 +534,14 @@ func (i *Installer) verifyMySQLConnection(dsn mysql.DSN) (err error) {
 		return err
 	}
 	if i.flags.Bool["debug"] {
-		log.Printf("verifyMySQLConnection: %#v %s\n", dsn, dsnString)
+		log.Printf("verifyMySQLConnection: %s\n", mysql.HideDSNPassword(dsnString))
 	}
-	conn := mysql.NewConnection(dsnString)
-	if err := conn.Connect(1); err != nil {
-		return err
+	// Only reachability matters here, so don't require any privileges.
+	// dsn.DSN() always has parameters, so append the timeout.
+	dsnString += "&timeout=" + VERIFY_MYSQL_TIMEOUT.String()
+	if err := mysql.NewConnection(dsnString).Ping(); err != nil {
+		return mysql.ClassifyConnError(err) // with a hint how to fix it
 	}
-	conn.Close()
 	return nil
 }
 
@@ -413,3 +553,72 @@ func (i *Installer) IsVersionSupported(conn mysql.Connector) (bool, error) {
 
 	return conn.AtLeastVersion(agent.MIN_SUPPORTED_MYSQL_VERSION)
 }
+
+// CheckMySQLVersion returns the version of the MySQL server, to which conn must
+// be connected, and true if it's at least minVersion.
+func CheckMySQLVersion(conn mysql.Connector, minVersion string) (string, bool, error) {
+	version := conn.GetGlobalVarString("version")
+	if version == "" {
+		return "", false, fmt.Errorf("Cannot get MySQL version")
+	}
+	ok, err := mysql.AtLeastVersion(version, minVersion)
+	if err != nil {
+		return version, false, fmt.Errorf("Cannot parse MySQL version %s: %s", version, err)
+	}
+	return version, ok, nil
+}
+
+// UnsupportedMySQLFeatures returns the names of the MYSQL_FEATURES that don't
+// work with the MySQL version.
+func UnsupportedMySQLFeatures(version string) []string {
+	features := []string{}
+	for _, f := range MYSQL_FEATURES {
+		if ok, err := mysql.AtLeastVersion(version, f.MinVersion); err == nil && !ok {
+			features = append(features, f.Name)
+		}
+	}
+	return features
+}
+
+// VerifyMySQLVersion warns if the MySQL server, to which conn must be connected,
+// is older than -mysql-min-version, or fails with -strict-mysql-version.
+func (i *Installer) VerifyMySQLVersion(conn mysql.Connector) error {
+	minVersion := i.flags.String["mysql-min-version"]
+	if minVersion == "" {
+		minVersion = DEFAULT_MIN_MYSQL_VERSION
+	}
+	version, ok, err := CheckMySQLVersion(conn, minVersion)
+	if err != nil {
+		if i.flags.Bool["strict-mysql-version"] {
+			return err
+		}
+		i.warn(err, "cannot verify MySQL version")
+		return nil
+	}
+	if ok {
+		return nil
+	}
+	msg := fmt.Sprintf("MySQL %s is older than %s", version, minVersion)
+	if features := UnsupportedMySQLFeatures(version); len(features) > 0 {
+		msg += ", so these features will not work: " + strings.Join(features, ", ")
+	}
+	if i.flags.Bool["strict-mysql-version"] {
+		return fmt.Errorf("%s (-strict-mysql-version)", msg)
+	}
+	i.warn(nil, "%s", msg)
+	return nil
+}
+
+// verifyMySQLVersion connects to MySQL with the DSN to VerifyMySQLVersion.
+func (i *Installer) verifyMySQLVersion(dsn mysql.DSN) error {
+	dsnString, err := dsn.DSN()
+	if err != nil {
+		return err
+	}
+	conn := mysql.NewConnection(dsnString + "&timeout=" + VERIFY_MYSQL_TIMEOUT.String())
+	if err := conn.Connect(1); err != nil {
+		return err
+	}
+	defer conn.Close()
+	return i.VerifyMySQLVersion(conn)
+}
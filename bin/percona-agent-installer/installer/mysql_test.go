@@ -19,10 +19,15 @@ package installer_test
 
 import (
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 
+	"github.com/percona/percona-agent/agent"
 	i "github.com/percona/percona-agent/bin/percona-agent-installer/installer"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/mock"
 	. "gopkg.in/check.v1"
 )
 
@@ -45,7 +50,7 @@ func (s *MySQLTestSuite) TestMakeGrant(t *C) {
 
 	dsn.Hostname = "localhost"
 	maxOpenConnections := int64(1)
-	got := i.MakeGrant(dsn, user, pass, maxOpenConnections)
+	got := i.MakeGrant(dsn, user, pass, maxOpenConnections, "")
 	expect := []string{
 		"SET SESSION old_passwords=0",
 		"GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'new-user'@'localhost' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 1",
@@ -54,7 +59,7 @@ func (s *MySQLTestSuite) TestMakeGrant(t *C) {
 	t.Check(got, DeepEquals, expect)
 
 	dsn.Hostname = "127.0.0.1"
-	got = i.MakeGrant(dsn, user, pass, maxOpenConnections)
+	got = i.MakeGrant(dsn, user, pass, maxOpenConnections, "")
 	expect = []string{
 		"SET SESSION old_passwords=0",
 		"GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'new-user'@'127.0.0.1' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 1",
@@ -63,7 +68,7 @@ func (s *MySQLTestSuite) TestMakeGrant(t *C) {
 	t.Check(got, DeepEquals, expect)
 
 	dsn.Hostname = "10.1.1.1"
-	got = i.MakeGrant(dsn, user, pass, maxOpenConnections)
+	got = i.MakeGrant(dsn, user, pass, maxOpenConnections, "")
 	expect = []string{
 		"SET SESSION old_passwords=0",
 		"GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 1",
@@ -73,7 +78,7 @@ func (s *MySQLTestSuite) TestMakeGrant(t *C) {
 
 	dsn.Hostname = ""
 	dsn.Socket = "/var/lib/mysql.sock"
-	got = i.MakeGrant(dsn, user, pass, maxOpenConnections)
+	got = i.MakeGrant(dsn, user, pass, maxOpenConnections, "")
 	expect = []string{
 		"SET SESSION old_passwords=0",
 		"GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'new-user'@'localhost' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 1",
@@ -82,6 +87,32 @@ func (s *MySQLTestSuite) TestMakeGrant(t *C) {
 	t.Check(got, DeepEquals, expect)
 }
 
+func (s *MySQLTestSuite) TestMakeGrantLevel(t *C) {
+	dsn := mysql.DSN{
+		Username: "user",
+		Password: "pass",
+		Hostname: "10.1.1.1",
+	}
+
+	got := i.MakeGrant(dsn, "new-user", "some pass", 5, i.GRANT_LEVEL_MINIMAL)
+	expect := []string{
+		"SET SESSION old_passwords=0",
+		"GRANT PROCESS, REPLICATION CLIENT, USAGE ON *.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 5",
+		"GRANT SELECT, UPDATE, DELETE, DROP ON performance_schema.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 5",
+	}
+	t.Check(got, DeepEquals, expect)
+
+	// Standard is the default.
+	got = i.MakeGrant(dsn, "new-user", "some pass", 5, i.GRANT_LEVEL_STANDARD)
+	expect = []string{
+		"SET SESSION old_passwords=0",
+		"GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 5",
+		"GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'new-user'@'%' IDENTIFIED BY 'some pass' WITH MAX_USER_CONNECTIONS 5",
+	}
+	t.Check(got, DeepEquals, expect)
+	t.Check(i.MakeGrant(dsn, "new-user", "some pass", 5, ""), DeepEquals, expect)
+}
+
 func (s *MySQLTestSuite) TestParseMySQLDefaults(t *C) {
 	output, err := ioutil.ReadFile(sample + "/defaults001")
 	t.Assert(err, IsNil)
@@ -92,3 +123,95 @@ func (s *MySQLTestSuite) TestParseMySQLDefaults(t *C) {
 	}
 	t.Check(got, DeepEquals, expect)
 }
+
+func (s *MySQLTestSuite) TestDetectSocket(t *C) {
+	conn := mock.NewNullMySQL()
+	conn.SetGlobalVarString("socket", "/var/run/mysqld/mysqld.sock")
+
+	// localhost uses the MySQL socket.
+	dsn := mysql.DSN{Username: "user", Password: "pass", Hostname: "localhost"}
+	socket := i.DetectSocket(&dsn, conn, nil)
+	t.Check(socket, Equals, "/var/run/mysqld/mysqld.sock")
+	dsnString, err := dsn.DSN()
+	t.Assert(err, IsNil)
+	t.Check(dsnString, Equals, "user:pass@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true")
+
+	// A given socket, remote host, or TCP isn't changed.
+	for _, dsn := range []mysql.DSN{
+		{Socket: "/tmp/mysql.sock"},
+		{Hostname: "10.1.1.1"},
+		{Hostname: "localhost", Protocol: "tcp"},
+	} {
+		expect := dsn
+		t.Check(i.DetectSocket(&dsn, conn, nil), Equals, "")
+		t.Check(dsn, DeepEquals, expect)
+	}
+
+	// Without MySQL, the first socket file of the paths.
+	tmpDir, err := ioutil.TempDir("/tmp", "installer-test-")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(tmpDir)
+	socketFile := filepath.Join(tmpDir, "mysql.sock")
+	l, err := net.Listen("unix", socketFile)
+	t.Assert(err, IsNil)
+	defer l.Close()
+	notSocket := filepath.Join(tmpDir, "not.sock")
+	err = ioutil.WriteFile(notSocket, []byte{}, 0644)
+	t.Assert(err, IsNil)
+
+	dsn = mysql.DSN{}
+	socket = i.DetectSocket(&dsn, nil, []string{filepath.Join(tmpDir, "none.sock"), notSocket, socketFile})
+	t.Check(socket, Equals, socketFile)
+	t.Check(dsn.Socket, Equals, socketFile)
+
+	// Nothing found: no change.
+	dsn = mysql.DSN{Hostname: "localhost"}
+	t.Check(i.DetectSocket(&dsn, nil, []string{notSocket}), Equals, "")
+	t.Check(dsn, DeepEquals, mysql.DSN{Hostname: "localhost"})
+}
+
+func (s *MySQLTestSuite) TestVerifyMySQLVersion(t *C) {
+	conn := mock.NewNullMySQL()
+
+	// Supported version.
+	conn.SetGlobalVarString("version", "5.6.24-72.2-log")
+	version, ok, err := i.CheckMySQLVersion(conn, i.DEFAULT_MIN_MYSQL_VERSION)
+	t.Assert(err, IsNil)
+	t.Check(version, Equals, "5.6.24-72.2-log")
+	t.Check(ok, Equals, true)
+	t.Check(i.UnsupportedMySQLFeatures(version), DeepEquals, []string{})
+
+	// Unsupported version.
+	conn.SetGlobalVarString("version", "5.1.73-log")
+	version, ok, err = i.CheckMySQLVersion(conn, i.DEFAULT_MIN_MYSQL_VERSION)
+	t.Assert(err, IsNil)
+	t.Check(ok, Equals, false)
+	t.Check(i.UnsupportedMySQLFeatures(version), DeepEquals, []string{
+		"Performance Schema metrics",
+		"Query Analytics from the Performance Schema",
+	})
+
+	// Old versions only warn by default but fail in strict mode.
+	flags := i.Flags{
+		Bool:   map[string]bool{},
+		String: map[string]string{"output": i.OUTPUT_JSON},
+	}
+	inst := i.NewInstaller(nil, "", nil, nil, &agent.Config{}, flags)
+	t.Check(inst.VerifyMySQLVersion(conn), IsNil)
+
+	flags.Bool["strict-mysql-version"] = true
+	inst = i.NewInstaller(nil, "", nil, nil, &agent.Config{}, flags)
+	err = inst.VerifyMySQLVersion(conn)
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Matches, "MySQL 5.1.73-log is older than 5.5, .*Performance Schema metrics.*")
+
+	conn.SetGlobalVarString("version", "5.5.40")
+	t.Check(inst.VerifyMySQLVersion(conn), IsNil)
+
+	// A configurable minimum.
+	flags.String["mysql-min-version"] = "5.6"
+	inst = i.NewInstaller(nil, "", nil, nil, &agent.Config{}, flags)
+	err = inst.VerifyMySQLVersion(conn)
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Matches, "MySQL 5.5.40 is older than 5.6, .*Query Analytics from the Performance Schema.*")
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/mysql"
+	"github.com/percona/percona-agent/pct"
+)
+
+// Values of the -output flag.
+const (
+	OUTPUT_TEXT = "text" // human-readable lines (default)
+	OUTPUT_JSON = "json" // only a Result at the end
+)
+
+// Result is what Run did, printed as JSON at the end with -output=json.  The
+// MySQL instance DSN password is hidden.
+type Result struct {
+	AgentUuid       string                `json:",omitempty"`
+	ServerInstance  *proto.ServerInstance `json:",omitempty"`
+	MySQLInstance   *proto.MySQLInstance  `json:",omitempty"`
+	ConfigFiles     []string
+	Warnings        []string
+	ServiceWarnings []InstallWarning `json:",omitempty"` // also in Warnings
+	Error           string           `json:",omitempty"`
+}
+
+// InstallWarning is a service that the installer could not configure, so the
+// agent will not start it.  Service is the config name without the instance,
+// e.g. mm-server, and Reason is the error.
+type InstallWarning struct {
+	Service string
+	Reason  string
+}
+
+// warn prints the error, if any, and the warning or, with -output=json, adds
+// them to the Result as one warning.
+func (i *Installer) warn(err error, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if i.flags.String["output"] == OUTPUT_JSON {
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		i.result.Warnings = append(i.result.Warnings, msg)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(i.out, err)
+	}
+	fmt.Fprintf(i.out, "WARNING: %s\n", msg)
+}
+
+// warnService records that service could not be configured.  Unlike warn, the
+// warning is not printed until the end of Run, in a summary, see Warnings.
+func (i *Installer) warnService(service string, err error, format string, args ...interface{}) {
+	i.warnings = append(i.warnings, InstallWarning{Service: service, Reason: err.Error()})
+	if i.flags.String["output"] == OUTPUT_JSON {
+		i.warn(err, format, args...)
+	}
+}
+
+// Warnings returns the services that Run could not configure.
+func (i *Installer) Warnings() []InstallWarning {
+	return i.warnings
+}
+
+// printWarnings prints a summary of the service warnings, if any.
+func (i *Installer) printWarnings() {
+	if len(i.warnings) == 0 {
+		return
+	}
+	fmt.Fprintf(i.out, "WARNING: %d service(s) will not start:\n", len(i.warnings))
+	for _, w := range i.warnings {
+		fmt.Fprintf(i.out, "  %s: %s\n", w.Service, w.Reason)
+	}
+}
+
+// printResult prints the Result as JSON if -output=json.  err is the Run error;
+// if there is one, the Result has only the error and warnings because cleanup
+// removed what was created.
+func (i *Installer) printResult(err error) {
+	if i.flags.String["output"] != OUTPUT_JSON {
+		return
+	}
+	result := i.result
+	if err != nil {
+		result = Result{Warnings: i.result.Warnings, ServiceWarnings: i.warnings, Error: err.Error()}
+	} else {
+		result.ServiceWarnings = i.warnings
+		result.AgentUuid = i.agentConfig.AgentUuid
+		for _, name := range i.created.configs {
+			result.ConfigFiles = append(result.ConfigFiles, pct.Basedir.ConfigFile(name))
+		}
+		if result.MySQLInstance != nil {
+			mi := *result.MySQLInstance
+			mi.DSN = mysql.HideDSN(mi.DSN)
+			result.MySQLInstance = &mi
+		}
+	}
+	if result.ConfigFiles == nil {
+		result.ConfigFiles = []string{}
+	}
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+	bytes, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintln(i.stdout, string(bytes))
+}
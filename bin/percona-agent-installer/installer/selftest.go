@@ -0,0 +1,88 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package installer
+
+import (
+	"fmt"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/instance"
+	"strings"
+)
+
+// SelfTest verifies the agent can use what was installed: the MySQL instance
+// DSN to get the MySQL info, if there's a MySQL instance, and the API key, and
+// agent if created, to access the API.  It prints a pass/fail line for each
+// check and returns an error if any failed.
+func (i *Installer) SelfTest(mi *proto.MySQLInstance) error {
+	fmt.Fprintln(i.out, "Verifying install...")
+	failed := []string{}
+	if mi != nil && mi.DSN != "" {
+		if err := i.selfTestMySQL(mi.DSN); err != nil {
+			fmt.Fprintf(i.out, "  MySQL: FAIL: %s\n", err)
+			failed = append(failed, "MySQL")
+		} else {
+			fmt.Fprintln(i.out, "  MySQL: OK")
+		}
+	}
+	if err := i.selfTestAPI(); err != nil {
+		fmt.Fprintf(i.out, "  API: FAIL: %s\n", err)
+		failed = append(failed, "API")
+	} else {
+		fmt.Fprintln(i.out, "  API: OK")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Install verification failed: %s", strings.Join(failed, ", "))
+	}
+	fmt.Fprintln(i.out, "Install verification passed")
+	return nil
+}
+
+func (i *Installer) selfTestMySQL(dsn string) error {
+	conn := i.ConnFactory.Make(dsn)
+	if err := conn.Connect(1); err != nil {
+		return err
+	}
+	defer conn.Close()
+	it := &proto.MySQLInstance{}
+	return instance.GetMySQLInfo(conn, it, instance.QueryTag("", "selftest"), VERIFY_MYSQL_TIMEOUT)
+}
+
+func (i *Installer) selfTestAPI() error {
+	headers := map[string]string{
+		"X-Percona-Agent-Version": agent.VERSION,
+	}
+	code, err := i.api.Init(i.agentConfig.ApiHostname, i.agentConfig.ApiKey, headers)
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return fmt.Errorf("API ping returned status code %d", code)
+	}
+	if i.agentConfig.AgentUuid == "" {
+		return nil
+	}
+	protoAgent, err := i.api.GetAgent(i.agentConfig.AgentUuid)
+	if err != nil {
+		return err
+	}
+	if protoAgent == nil {
+		return fmt.Errorf("Agent %s not found", i.agentConfig.AgentUuid)
+	}
+	return nil
+}
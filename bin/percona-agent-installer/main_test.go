@@ -33,6 +33,7 @@ import (
 	"github.com/go-sql-driver/mysql"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/agent"
+	"github.com/percona/percona-agent/bin/percona-agent-installer/installer"
 	"github.com/percona/percona-agent/data"
 	agentLog "github.com/percona/percona-agent/log"
 	mmMysql "github.com/percona/percona-agent/mm/mysql"
@@ -232,12 +233,14 @@ func (s *MainTestSuite) TestDefaultInstall(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mysqlInstance.DSN, s.mysqlInstance.Hostname, s.mysqlInstance.Id))
@@ -311,12 +314,14 @@ func (s *MainTestSuite) TestNonInteractiveInstallWithJustCredentialDetailsFlags(
 	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mysqlInstance.DSN, s.mysqlInstance.Hostname, s.mysqlInstance.Id))
@@ -417,7 +422,7 @@ func (s *MainTestSuite) TestNonInteractiveInstallWithFlagCreateMySQLUserFalse(t
 	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
@@ -503,7 +508,7 @@ func (s *MainTestSuite) TestWithAgentMySQLUser(t *C) {
 
 	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created agent: uuid=0001\n")
 	// Use the s flag (?s) to let .* match \n
 	t.Assert(cmdTest.ReadLine(), Matches, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
@@ -575,12 +580,14 @@ func (s *MainTestSuite) TestInstall(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(s.apiKey + "\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mysqlInstance.DSN, s.mysqlInstance.Hostname, s.mysqlInstance.Id))
@@ -650,7 +657,7 @@ func (s *MainTestSuite) TestInstallFailsOnAgentsLimit(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(s.apiKey + "\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Maximum number of %d agents exceeded.\n", agentLimit))
 	t.Check(cmdTest.ReadLine(), Equals, "Go to https://cloud.percona.com/agents and remove unused agents or contact Percona to increase limit.\n")
@@ -722,12 +729,14 @@ func (s *MainTestSuite) TestInstallWorksWithExistingMySQLInstanceAndInstanceIsUp
 	t.Check(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(s.apiKey + "\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mysqlInstance.DSN, s.mysqlInstance.Hostname, s.mysqlInstance.Id))
@@ -810,12 +819,14 @@ func (s *MainTestSuite) TestInstallFailsOnUpdatingMySQLInstance(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(s.apiKey + "\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, "Failed to update MySQL instance (status code 500)\n")
@@ -853,7 +864,7 @@ func (s *MainTestSuite) TestInstallWithWrongApiKey(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "Please Enter your API Key, it is available at "+s.apphost+"/api-key\n")
 	t.Assert(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(apiKey + "\n")
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(apiKey)+"...\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Sorry, there's an API problem (status code 500). Please try to install again. If the problem continues, contact Percona.\n")
 
 	t.Assert(cmdTest.ReadLine(), Equals, "Try again? (Y): ")
@@ -909,10 +920,12 @@ func (s *MainTestSuite) TestInstallWithFlagCreateAgentFalse(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "Please Enter your API Key, it is available at "+s.apphost+"/api-key\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(s.apiKey + "\n")
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mysqlInstance.DSN, s.mysqlInstance.Hostname, s.mysqlInstance.Id))
@@ -982,12 +995,14 @@ func (s *MainTestSuite) TestInstallWithFlagOldPasswordsTrue(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "API key: ")
 	cmdTest.Write(s.apiKey + "\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	// Flag -old-passwords=true should add &allowOldPasswords=true to DSN
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true&allowOldPasswords=true\n")
 
@@ -1058,12 +1073,14 @@ func (s *MainTestSuite) TestInstallWithFlagApiKey(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("MySQL root DSN: %s:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)\n", s.username))
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT SUPER, PROCESS, USAGE, SELECT ON *.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
+	t.Check(cmdTest.ReadLine(), Equals, "MySQL grant: GRANT UPDATE, DELETE, DROP ON performance_schema.* TO 'percona-agent'@'localhost' IDENTIFIED BY '<password-hidden>' WITH MAX_USER_CONNECTIONS 5\n")
 	t.Check(cmdTest.ReadLine(), Equals, "Created MySQL user: percona-agent:<password-hidden>@unix(/var/run/mysqld/mysqld.sock)/?parseTime=true\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created MySQL instance: dsn=%s hostname=%s id=%d\n", mysqlInstance.DSN, s.mysqlInstance.Hostname, s.mysqlInstance.Id))
@@ -1134,7 +1151,7 @@ func (s *MainTestSuite) TestInstallWithFlagMysqlFalse(t *C) {
 	t.Check(cmdTest.ReadLine(), Equals, "CTRL-C at any time to quit\n")
 	t.Check(cmdTest.ReadLine(), Equals, "API host: "+s.fakeApi.URL()+"\n")
 
-	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+s.apiKey+"...\n")
+	t.Check(cmdTest.ReadLine(), Equals, "Verifying API key "+installer.RedactApiKey(s.apiKey)+"...\n")
 
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created agent: uuid=%s\n", s.agent.Uuid))
 	t.Check(cmdTest.ReadLine(), Equals, fmt.Sprintf("Created server instance: hostname=%s id=%d\n", s.serverInstance.Hostname, s.serverInstance.Id))
@@ -21,8 +21,10 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"github.com/mewpkg/gopass"
 	"io"
 	"log"
+	"os"
 	"strings"
 )
 
@@ -34,6 +36,7 @@ type Terminal struct {
 	stdin       *bufio.Reader
 	interactive bool
 	debug       bool
+	tty         bool // stdin is a terminal
 }
 
 func NewTerminal(stdin io.Reader, interactive, debug bool) *Terminal {
@@ -41,10 +44,21 @@ func NewTerminal(stdin io.Reader, interactive, debug bool) *Terminal {
 		stdin:       bufio.NewReader(stdin),
 		interactive: interactive,
 		debug:       debug,
+		tty:         isTerminal(stdin),
 	}
 	return t
 }
 
+// isTerminal returns true if r is a terminal, not a pipe or file.
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func (t *Terminal) PromptString(question string, defaultAnswer string) (string, error) {
 	if !t.interactive {
 		return "", ErrNonInteractiveMode
@@ -71,6 +85,24 @@ func (t *Terminal) PromptString(question string, defaultAnswer string) (string,
 	return answer, nil
 }
 
+// PromptPassword prompts for a secret without echoing it.  If stdin is not
+// a terminal, e.g. the answer is piped in, it's read like PromptString but
+// never logged.
+func (t *Terminal) PromptPassword(question string) (string, error) {
+	if !t.interactive {
+		return "", ErrNonInteractiveMode
+	}
+	if t.tty {
+		return gopass.GetPass(question + ": ")
+	}
+	fmt.Printf("%s: ", question)
+	bytes, _, err := t.stdin.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(bytes), "\r"), nil
+}
+
 func (t *Terminal) PromptStringRequired(question string, defaultAnswer string) (string, error) {
 	if !t.interactive {
 		return "", ErrNonInteractiveMode
@@ -0,0 +1,52 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package term_test
+
+import (
+	"github.com/percona/percona-agent/bin/percona-agent-installer/term"
+	. "gopkg.in/check.v1"
+	"strings"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TermTestSuite struct{}
+
+var _ = Suite(&TermTestSuite{})
+
+func (s *TermTestSuite) TestPromptPasswordNotTTY(t *C) {
+	// Input that isn't a terminal is read like any other answer, but spaces
+	// are part of the password.
+	terminal := term.NewTerminal(strings.NewReader(" my pass \r\nnext\n"), true, false)
+	got, err := terminal.PromptPassword("MySQL password")
+	t.Assert(err, IsNil)
+	t.Check(got, Equals, " my pass ")
+	got, err = terminal.PromptPassword("MySQL password")
+	t.Assert(err, IsNil)
+	t.Check(got, Equals, "next")
+
+	// No more input.
+	_, err = terminal.PromptPassword("MySQL password")
+	t.Check(err, NotNil)
+
+	// Never prompts in non-interactive mode.
+	terminal = term.NewTerminal(strings.NewReader("pass\n"), false, false)
+	_, err = terminal.PromptPassword("MySQL password")
+	t.Check(err, Equals, term.ErrNonInteractiveMode)
+}
@@ -63,6 +63,7 @@ var (
 	flagBasedir string
 	flagPidFile string
 	flagVersion bool
+	flagExport  bool
 )
 
 func init() {
@@ -74,6 +75,7 @@ func init() {
 	flag.StringVar(&flagBasedir, "basedir", pct.DEFAULT_BASEDIR, "Agent basedir")
 	flag.StringVar(&flagPidFile, "pidfile", agent.DEFAULT_PIDFILE, "PID file")
 	flag.BoolVar(&flagVersion, "version", false, "Print version")
+	flag.BoolVar(&flagExport, "export-config", false, "Print agent and instance configs without secrets, for sharing")
 	flag.Parse()
 	// We don't accept any possitional arguments
 	if len(flag.Args()) != 0 {
@@ -87,12 +89,57 @@ func init() {
 	}
 }
 
+// exportConfig prints the agent config and all instances with the API key and
+// passwords masked.  It doesn't connect to the API or start the agent.
+func exportConfig() error {
+	if err := pct.Basedir.Init(flagBasedir); err != nil {
+		return err
+	}
+
+	bytes, err := agent.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Invalid agent config: %s\n", err)
+	}
+	agentConfig := &agent.Config{}
+	if err := json.Unmarshal(bytes, agentConfig); err != nil {
+		return fmt.Errorf("Error parsing %s: %s", pct.Basedir.ConfigFile("agent"), err)
+	}
+	if agentConfig.ApiKey != "" {
+		agentConfig.ApiKey = "<api-key-hidden>"
+	}
+
+	// The repo logs, but nothing reads the log chan and pct.Logger doesn't
+	// block, so logging is effectively off.
+	repo := instance.NewRepo(pct.NewLogger(make(chan *proto.LogEntry, 100), "instance-repo"), pct.Basedir.Dir("config"), nil)
+	if err := repo.Init(); err != nil {
+		return err
+	}
+	instances, err := repo.ExportSanitized()
+	if err != nil {
+		return err
+	}
+
+	export := map[string]interface{}{
+		"agent":     agentConfig,
+		"instances": json.RawMessage(instances),
+	}
+	bytes, err = json.MarshalIndent(export, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
 func run() error {
 	version := fmt.Sprintf("percona-agent %s%s rev %s", agent.VERSION, agent.REL, agent.REVISION)
 	if flagVersion {
 		fmt.Println(version)
 		return nil
 	}
+	if flagExport {
+		return exportConfig()
+	}
 	golog.Printf("Running %s pid %d\n", version, os.Getpid())
 
 	if err := pct.Basedir.Init(flagBasedir); err != nil {
@@ -128,15 +175,16 @@ func run() error {
 	golog.Println("ApiHostname: " + agentConfig.ApiHostname)
 	golog.Println("AgentUuid: " + agentConfig.AgentUuid)
 
+	// Before anything logs a DSN.
+	mysql.HideUsername = agentConfig.HideDSNUsername
+
 	/**
 	 * Ping and exit, maybe.
 	 */
 
 	// Set for all connections to API.  X-Percona-API-Key is set automatically
 	// using the pct.APIConnector.
-	headers := map[string]string{
-		"X-Percona-Agent-Version": agent.VERSION,
-	}
+	headers := apiHeaders(agentConfig)
 
 	if flagPing {
 		t0 := time.Now()
@@ -199,7 +247,9 @@ func run() error {
 	/**
 	 * Connection factory
 	 */
-	connFactory := &mysql.RealConnectionFactory{}
+	connFactory := &mysql.RealConnectionFactory{
+		Timeout: time.Duration(agentConfig.MySQLTimeout) * time.Second,
+	}
 
 	/**
 	 * Log relay
@@ -227,6 +277,10 @@ func run() error {
 		pct.NewLogger(logChan, "mrms-monitor"),
 		connFactory,
 	)
+	mrm.SetDetectFailover(agentConfig.DetectFailover)
+	if agentConfig.MySQLTimeout > 0 {
+		mrm.SetCheckTimeout(time.Duration(agentConfig.MySQLTimeout) * time.Second)
+	}
 	mrmsManager := mrms.NewManager(
 		pct.NewLogger(logChan, "mrms-manager"),
 		mrm,
@@ -243,7 +297,13 @@ func run() error {
 		pct.Basedir.Dir("config"),
 		api,
 		mrm,
+		instance.DEFAULT_MRMS_GLOBAL_BUFFER,
 	)
+	itManager.Repo().SetPassthrough(agentConfig.AllowUnknownInstances)
+	if agentConfig.InstanceStartTimeout > 0 {
+		itManager.StartTimeout = time.Duration(agentConfig.InstanceStartTimeout) * time.Second
+	}
+	itManager.ResyncInterval = time.Duration(agentConfig.InstanceResyncInterval) * time.Second
 	if err := itManager.Start(); err != nil {
 		return fmt.Errorf("Error starting instance manager: %s\n", err)
 	}
@@ -446,8 +506,8 @@ func run() error {
 	agentRunning := true
 	statusSigChan := make(chan os.Signal, 1)
 	signal.Notify(statusSigChan, syscall.SIGUSR1) // kill -USER1 PID
-	reconnectSigChan := make(chan os.Signal, 1)
-	signal.Notify(reconnectSigChan, syscall.SIGHUP) // kill -HUP PID
+	reloadSigChan := make(chan os.Signal, 1)
+	signal.Notify(reloadSigChan, syscall.SIGHUP) // kill -HUP PID
 	for agentRunning {
 		select {
 		case stopErr = <-stopChan: // agent or signal
@@ -457,7 +517,16 @@ func run() error {
 		case <-statusSigChan:
 			status := agent.AllStatus()
 			golog.Printf("Status: %+v\n", status)
-		case <-reconnectSigChan:
+		case <-reloadSigChan:
+			golog.Println("Caught SIGHUP, reloading agent config...")
+			reload, err := reloadAgentConfig(agent)
+			if err != nil {
+				golog.Println(err)
+				agentLogger.Warn(err)
+			}
+			if reload == nil || !reload.Reconnect {
+				continue
+			}
 			u, _ := user.Current()
 			cmd := &proto.Cmd{
 				Ts:        time.Now().UTC(),
@@ -475,11 +544,56 @@ func run() error {
 	return stopErr
 }
 
+// reloadAgentConfig re-reads the agent config file and applies it to the
+// running agent.
+func reloadAgentConfig(a *agent.Agent) (*agent.ConfigReload, error) {
+	bytes, err := agent.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot reload agent config: %s", err)
+	}
+	newConfig := &agent.Config{}
+	if err := json.Unmarshal(bytes, newConfig); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", pct.Basedir.ConfigFile("agent"), err)
+	}
+	reload, err := a.ReloadConfig(newConfig)
+	if err != nil {
+		return reload, fmt.Errorf("Cannot reload agent config: %s", err)
+	}
+	if reload != nil {
+		golog.Printf("Reloaded agent config: applied %v, need restart %v\n", reload.Applied, reload.Restart)
+	}
+	return reload, nil
+}
+
+// apiHeaders returns the extra headers from the agent config plus
+// X-Percona-Agent-Version.
+func apiHeaders(agentConfig *agent.Config) map[string]string {
+	headers := map[string]string{}
+	for k, v := range agentConfig.ApiHeaders {
+		headers[k] = v
+	}
+	headers["X-Percona-Agent-Version"] = agent.VERSION
+	return headers
+}
+
 func ConnectAPI(agentConfig *agent.Config, retry int) (*pct.API, error) {
 	golog.Println("ApiHostname: " + agentConfig.ApiHostname)
 	golog.Println("ApiKey: " + agentConfig.ApiKey)
 
 	api := pct.NewAPI()
+	if err := api.SetHeaders(agentConfig.ApiHeaders); err != nil {
+		return nil, err
+	}
+	if agentConfig.MaxApiRequests > 0 {
+		if err := api.SetMaxRequests(int(agentConfig.MaxApiRequests)); err != nil {
+			return nil, err
+		}
+	}
+	if agentConfig.CompressApiRequests {
+		if err := api.SetCompression(pct.DEFAULT_COMPRESS_MIN_SIZE); err != nil {
+			return nil, err
+		}
+	}
 	backoff := pct.NewBackoff(5 * time.Minute)
 	week := time.Hour * 24 * 7
 	t0 := time.Now()
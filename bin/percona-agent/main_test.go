@@ -18,18 +18,24 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/agent"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/test"
+	"github.com/percona/percona-agent/test/fakeapi"
 	. "gopkg.in/check.v1"
 )
 
@@ -117,3 +123,57 @@ func (s *MainTestSuite) TestValidFlag(t *C) {
 	s.cmd = exec.Command(s.bin, "-basedir="+s.basedir, "-ping=false")
 	startWaitIsAlive(s, t)
 }
+
+type ConnectAPITestSuite struct{}
+
+var _ = Suite(&ConnectAPITestSuite{})
+
+func (s *ConnectAPITestSuite) TestApiHeaders(t *C) {
+	headers := make(chan http.Header, 10)
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	links := func(links map[string]string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			headers <- r.Header
+			data, _ := json.Marshal(&proto.Links{Links: links})
+			w.Write(data)
+		}
+	}
+	fakeApi.Append("/", links(map[string]string{
+		"agents":    fakeApi.URL() + "/agents",
+		"instances": fakeApi.URL() + "/instances",
+		"download":  fakeApi.URL() + "/download",
+	}))
+	fakeApi.Append("/agents/abc-123", links(map[string]string{
+		"cmd":  "ws://localhost/cmd",
+		"log":  "ws://localhost/log",
+		"data": "ws://localhost/data",
+	}))
+
+	agentConfig := &agent.Config{
+		ApiHostname: strings.TrimPrefix(fakeApi.URL(), "http://"),
+		ApiKey:      "123",
+		AgentUuid:   "abc-123",
+		ApiHeaders:  map[string]string{"X-Tenant-Id": "tenant-1"},
+	}
+
+	// The websocket clients are given these headers.
+	t.Check(apiHeaders(agentConfig), DeepEquals, map[string]string{
+		"X-Tenant-Id":             "tenant-1",
+		"X-Percona-Agent-Version": agent.VERSION,
+	})
+
+	// Every API request has them.
+	api, err := ConnectAPI(agentConfig, 1)
+	t.Assert(err, IsNil)
+	t.Check(api.Headers(), DeepEquals, agentConfig.ApiHeaders)
+	for i := 0; i < 2; i++ {
+		header := <-headers
+		t.Check(header.Get("X-Tenant-Id"), Equals, "tenant-1")
+	}
+
+	// Invalid header names are rejected.
+	agentConfig.ApiHeaders = map[string]string{"X Bad": "1"}
+	_, err = ConnectAPI(agentConfig, 1)
+	t.Check(err, NotNil)
+}
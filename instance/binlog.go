@@ -0,0 +1,59 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"fmt"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// MySQL 8.0.1 replaced expire_logs_days with binlog_expire_logs_seconds.
+const BINLOG_EXPIRE_SECONDS_VERSION = "8.0.1"
+
+// GetBinlogInfo returns binary log properties in the binlog.* namespace:
+// binlog.enabled (true or false), binlog.log_bin, binlog.format, and
+// binlog.expire_seconds, the retention in seconds regardless of MySQL version.
+// The retention variable itself is returned too: binlog.binlog_expire_logs_seconds
+// for MySQL 8.0 or binlog.expire_logs_days for older versions.
+func GetBinlogInfo(conn mysql.Connector) (map[string]string, error) {
+	logBin := conn.GetGlobalVarString("log_bin")
+	enabled := logBin == "1" || logBin == "ON"
+
+	props := map[string]string{
+		"binlog.enabled": fmt.Sprintf("%t", enabled),
+		"binlog.log_bin": logBin,
+		"binlog.format":  conn.GetGlobalVarString("binlog_format"),
+	}
+
+	hasSeconds, err := conn.AtLeastVersion(BINLOG_EXPIRE_SECONDS_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	if hasSeconds {
+		seconds := conn.GetGlobalVarNumber("binlog_expire_logs_seconds")
+		props["binlog.binlog_expire_logs_seconds"] = fmt.Sprintf("%.0f", seconds)
+		props["binlog.expire_seconds"] = fmt.Sprintf("%.0f", seconds)
+	} else {
+		days := conn.GetGlobalVarNumber("expire_logs_days")
+		props["binlog.expire_logs_days"] = fmt.Sprintf("%.0f", days)
+		props["binlog.expire_seconds"] = fmt.Sprintf("%.0f", days*86400)
+	}
+
+	return props, nil
+}
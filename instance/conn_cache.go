@@ -0,0 +1,122 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// connCache keeps the connections used to get MySQL info open so that getting
+// the info again, e.g. when MySQL restarts, reuses the connection.  A
+// connection is closed when it hasn't been used for the idle timeout.
+type connCache struct {
+	conns map[string]*cachedConn
+	mux   sync.Mutex
+}
+
+type cachedConn struct {
+	conn  mysql.Connector
+	users int // callers that got but haven't released the connection
+	timer *time.Timer
+}
+
+func newConnCache() *connCache {
+	return &connCache{
+		conns: make(map[string]*cachedConn),
+	}
+}
+
+// get returns a connected connection for dsn, the cached one if there is one,
+// else a new one made by factory.  The caller must release it.
+func (c *connCache) get(factory mysql.ConnectionFactory, dsn string) (*cachedConn, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if cc, ok := c.conns[dsn]; ok {
+		cc.users++
+		if cc.timer != nil {
+			cc.timer.Stop()
+		}
+		return cc, nil
+	}
+	conn := factory.Make(dsn)
+	if err := conn.Connect(1); err != nil {
+		return nil, err
+	}
+	cc := &cachedConn{conn: conn, users: 1}
+	c.conns[dsn] = cc
+	return cc, nil
+}
+
+// release returns the connection to the cache, closing it after idle, or
+// right away if idle is zero or broken is true, e.g. because a query failed.
+func (c *connCache) release(dsn string, cc *cachedConn, idle time.Duration, broken bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	cc.users--
+	if c.conns[dsn] != cc {
+		// Removed by closeAll or a broken release while in use.
+		if cc.users == 0 {
+			cc.conn.Close()
+		}
+		return
+	}
+	if idle <= 0 || broken {
+		delete(c.conns, dsn)
+		if cc.users == 0 {
+			cc.conn.Close()
+		}
+		return
+	}
+	if cc.users > 0 {
+		return
+	}
+	if cc.timer == nil {
+		cc.timer = time.AfterFunc(idle, func() { c.expire(dsn, cc) })
+	} else {
+		cc.timer.Reset(idle)
+	}
+}
+
+func (c *connCache) expire(dsn string, cc *cachedConn) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.conns[dsn] != cc || cc.users > 0 {
+		return
+	}
+	delete(c.conns, dsn)
+	cc.conn.Close()
+}
+
+// closeAll closes all connections, or for connections in use, when they're
+// released.
+func (c *connCache) closeAll() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for dsn, cc := range c.conns {
+		if cc.timer != nil {
+			cc.timer.Stop()
+		}
+		if cc.users == 0 {
+			cc.conn.Close()
+		}
+		delete(c.conns, dsn)
+	}
+}
@@ -18,12 +18,23 @@
 package instance_test
 
 import (
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	mysqlDriver "github.com/go-sql-driver/mysql"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/mysql"
@@ -102,7 +113,7 @@ func (s *RepoTestSuite) TestInit(t *C) {
 	expect := &proto.MySQLInstance{
 		Id:       1,
 		Hostname: "db1",
-		DSN:      "user:host@tcp:(127.0.0.1:3306)",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
 		Distro:   "Percona Server",
 		Version:  "5.6.16",
 	}
@@ -114,216 +125,1336 @@ func (s *RepoTestSuite) TestInit(t *C) {
 	}
 }
 
-func (s *RepoTestSuite) TestAddRemove(t *C) {
+func (s *RepoTestSuite) TestInitSkipArtifacts(t *C) {
+	err := test.CopyFile(test.RootDir+"/mm/config/mysql-1.conf", s.configDir)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+
+	// Editor swap and backup files must not be loaded or cause an error.
+	for _, file := range []string{"mysql-1.conf.swp", "mysql-1.conf~", "mysql-2.conf.bak", "mysql-foo"} {
+		err := ioutil.WriteFile(s.configDir+"/"+file, data, 0600)
+		t.Assert(err, IsNil)
+	}
+
 	im := instance.NewRepo(s.logger, s.configDir, s.api)
 	t.Assert(im, NotNil)
 
-	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+	err = im.Init()
+	t.Assert(err, IsNil)
+	t.Check(im.List(), DeepEquals, []string{"mysql-1"})
 
-	mysqlIt := &proto.MySQLInstance{
-		Id:       1,
-		Hostname: "db1",
-		DSN:      "user:host@tcp:(127.0.0.1:3306)",
-		Distro:   "Percona Server",
-		Version:  "5.6.16",
+	// Names that look like configs but have an invalid id are errors.
+	for _, file := range []string{"mysql-.conf", "mysql-01.conf", "mysql-1-2.conf", "mysql-x.conf"} {
+		err := ioutil.WriteFile(s.configDir+"/"+file, data, 0600)
+		t.Assert(err, IsNil)
+
+		im := instance.NewRepo(s.logger, s.configDir, s.api)
+		err = im.Init()
+		t.Check(err, NotNil, Commentf("%s", file))
+
+		os.Remove(s.configDir + "/" + file)
 	}
-	data, err := json.Marshal(mysqlIt)
+}
+
+func (s *RepoTestSuite) TestInitSkipsCorruptFile(t *C) {
+	err := test.CopyFile(test.RootDir+"/mm/config/mysql-1.conf", s.configDir)
 	t.Assert(err, IsNil)
-	err = im.Add("mysql", 1, data, true)
+	data, err := ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+	err = ioutil.WriteFile(s.configDir+"/mysql-3.conf", []byte(`{"Id":3,"DSN":"user:pass@tcp(127.0.0.1:3307)/"}`), 0600)
 	t.Assert(err, IsNil)
 
-	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, true)
+	// Truncated by a crash mid-write.
+	err = ioutil.WriteFile(s.configDir+"/mysql-2.conf", data[:len(data)/2], 0600)
+	t.Assert(err, IsNil)
 
-	got := &proto.MySQLInstance{}
-	err = im.Get("mysql", 1, got)
+	logChan := make(chan *proto.LogEntry, 100)
+	logger := pct.NewLogger(logChan, "instance-repo-test")
+	im := instance.NewRepo(logger, s.configDir, s.api)
+	err = im.Init()
 	t.Assert(err, IsNil)
-	if same, diff := test.IsDeeply(got, mysqlIt); !same {
-		t.Error(diff)
+	got := im.List()
+	sort.Strings(got)
+	t.Check(got, DeepEquals, []string{"mysql-1", "mysql-3"})
+
+	// The bad file is logged and moved aside so it isn't loaded again.
+	logged := false
+	for _, e := range test.WaitLogChan(logChan, 100) {
+		if e.Level == proto.LOG_ERROR && strings.Contains(e.Msg, "mysql-2.conf") {
+			logged = true
+		}
 	}
+	t.Check(logged, Equals, true)
+	t.Check(test.FileExists(s.configDir+"/mysql-2.conf"), Equals, false)
+	t.Check(test.FileExists(s.configDir+"/mysql-2.conf"+instance.CORRUPT_FILE_SUFFIX), Equals, true)
 
-	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	// Configs are written atomically: no temp files are left behind.
+	err = im.Update("mysql", 3, []byte(`{"Id":3,"DSN":"user:pass@tcp(127.0.0.1:3308)/"}`), true)
 	t.Assert(err, IsNil)
-
-	got = &proto.MySQLInstance{}
-	err = json.Unmarshal(data, got)
+	files, err := filepath.Glob(s.configDir + "/.*")
 	t.Assert(err, IsNil)
-	if same, diff := test.IsDeeply(got, mysqlIt); !same {
-		t.Error(diff)
+	t.Check(files, HasLen, 0)
+}
+
+func (s *RepoTestSuite) TestInitDefaultsKeyCase(t *C) {
+	// json.Unmarshal matches keys case-insensitively, so "dsn" in the defaults
+	// is the same property as "DSN" in the instance.
+	files := map[string]string{
+		"instance-defaults.conf": `{"dsn":"default:pass@tcp(10.0.0.1:3306)/","distro":"Percona Server"}`,
+		"mysql-1.conf":           `{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
 	}
 
-	im.Remove("mysql", 1)
-	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Init()
+	t.Assert(err, IsNil)
+
+	mysqlIt := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, mysqlIt)
+	t.Assert(err, IsNil)
+	t.Check(mysqlIt, DeepEquals, &proto.MySQLInstance{
+		Id:     1,
+		DSN:    "user:pass@tcp(127.0.0.1:3306)/",
+		Distro: "Percona Server",
+	})
 }
 
-func (s *RepoTestSuite) TestErrors(t *C) {
+func (s *RepoTestSuite) TestInitDefaults(t *C) {
+	files := map[string]string{
+		"instance-defaults.conf": `{"Hostname":"default-host","Distro":"Percona Server","Version":"5.6.16"}`,
+		"mysql-1.conf":           `{"Id":1,"Hostname":"db1","DSN":"user:pass@tcp(127.0.0.1:3306)/","Version":"5.6.20"}`,
+		"server-1.conf":          `{"Id":1}`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
+	}
+
 	im := instance.NewRepo(s.logger, s.configDir, s.api)
 	t.Assert(im, NotNil)
+	err := im.Init()
+	t.Assert(err, IsNil)
 
-	mysqlIt := &proto.MySQLInstance{
-		Id:       0,
+	// Instance values override defaults, defaults fill in the rest.
+	mysqlIt := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, mysqlIt)
+	t.Assert(err, IsNil)
+	t.Check(mysqlIt, DeepEquals, &proto.MySQLInstance{
+		Id:       1,
 		Hostname: "db1",
-		DSN:      "user:host@tcp:(127.0.0.1:3306)",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
 		Distro:   "Percona Server",
-		Version:  "5.6.16",
-	}
-	data, err := json.Marshal(mysqlIt)
+		Version:  "5.6.20",
+	})
+
+	serverIt := &proto.ServerInstance{}
+	err = im.Get("server", 1, serverIt)
 	t.Assert(err, IsNil)
+	t.Check(serverIt, DeepEquals, &proto.ServerInstance{
+		Id:       1,
+		Hostname: "default-host",
+	})
 
-	// Instance ID must be > 0.
-	err = im.Add("mysql", 0, data, false)
-	t.Assert(err, NotNil)
+	// Defaults are merged at load time only, not written to instance files.
+	data, err := ioutil.ReadFile(s.configDir + "/server-1.conf")
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, files["server-1.conf"])
 
-	// Service name must be one of proto.ExternalService.
-	err = im.Add("foo", 1, data, false)
-	t.Assert(err, NotNil)
+	// Invalid defaults are an error.
+	err = ioutil.WriteFile(s.configDir+"/instance-defaults.conf", []byte("{"), 0600)
+	t.Assert(err, IsNil)
+	im = instance.NewRepo(s.logger, s.configDir, s.api)
+	err = im.Init()
+	t.Check(err, NotNil)
 }
 
-/////////////////////////////////////////////////////////////////////////////
-// Manager test suite
-/////////////////////////////////////////////////////////////////////////////
+func (s *RepoTestSuite) TestInitMissingDSN(t *C) {
+	// Valid JSON, but a MySQL instance is useless without a DSN.
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"Hostname":"db1"}`), 0600)
+	t.Assert(err, IsNil)
 
-type ManagerTestSuite struct {
-	tmpDir    string
-	logChan   chan *proto.LogEntry
-	logger    *pct.Logger
-	configDir string
-	api       *mock.API
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err = im.Init()
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "mysql: "+s.configDir+"/mysql-1.conf:Invalid instance mysql-1: DSN is not set")
+	t.Check(im.List(), HasLen, 0)
+
+	// Add rejects it, too.
+	err = im.Add("mysql", 2, []byte(`{"Id":2,"DSN":""}`), true)
+	t.Check(err, NotNil)
+	t.Check(test.FileExists(s.configDir+"/mysql-2.conf"), Equals, false)
 }
 
-var _ = Suite(&ManagerTestSuite{})
+func (s *RepoTestSuite) TestAddInvalidDSN(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
 
-func (s *ManagerTestSuite) SetUpSuite(t *C) {
-	var err error
-	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
-	t.Assert(err, IsNil)
+	// Valid DSN
+	err := im.Add("mysql", 1, []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), true)
+	t.Check(err, IsNil)
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, true)
 
-	if err := pct.Basedir.Init(s.tmpDir); err != nil {
-		t.Fatal(err)
-	}
-	s.configDir = pct.Basedir.Dir("config")
+	// Garbage DSN
+	err = im.Add("mysql", 2, []byte(`{"Id":2,"DSN":"not a dsn"}`), true)
+	t.Assert(err, NotNil)
+	t.Check(strings.HasPrefix(err.Error(), "Invalid instance mysql-2: invalid DSN"), Equals, true, Commentf("%s", err))
+	t.Check(test.FileExists(s.configDir+"/mysql-2.conf"), Equals, false)
 
-	s.logChan = make(chan *proto.LogEntry, 10)
-	s.logger = pct.NewLogger(s.logChan, "pct-it-test")
+	// DSN missing the host; the error must not reveal the password.
+	err = im.Add("mysql", 3, []byte(`{"Id":3,"DSN":"user:secret@tcp(:3306)/"}`), true)
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid instance mysql-3: invalid DSN user:"+mysql.HiddenPassword+"@tcp(:3306)/: host not set")
+	t.Check(test.FileExists(s.configDir+"/mysql-3.conf"), Equals, false)
 
-	links := map[string]string{
-		"agent":     "http://localhost/agent",
-		"instances": "http://localhost/instances",
-	}
-	s.api = mock.NewAPI("http://localhost", "http://localhost", "123", "abc-123-def", links)
+	// Nor the username if that's hidden, too.
+	mysql.HideUsername = true
+	defer func() { mysql.HideUsername = false }()
+	err = im.Add("mysql", 3, []byte(`{"Id":3,"DSN":"user:secret@tcp(:3306)/"}`), true)
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid instance mysql-3: invalid DSN "+mysql.HiddenUsername+":"+mysql.HiddenPassword+"@tcp(:3306)/: host not set")
+
+	// Server instances don't have a DSN.
+	err = im.Add("server", 1, []byte(`{"Id":1,"Hostname":"host1"}`), true)
+	t.Check(err, IsNil)
+
+	t.Check(im.List(), HasLen, 2)
 }
 
-func (s *ManagerTestSuite) SetUpTest(t *C) {
-	files, _ := filepath.Glob(s.configDir + "/*")
-	for _, file := range files {
-		if err := os.Remove(file); err != nil {
-			t.Error(err)
+func (s *RepoTestSuite) TestAddDSNValidation(t *C) {
+	logChan := make(chan *proto.LogEntry, 100)
+	logger := pct.NewLogger(logChan, "instance-repo-test")
+	im := instance.NewRepo(logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	err := im.SetDSNValidation("paranoid")
+	t.Check(err, NotNil)
+
+	// Valid but incomplete: no address, so the driver default is used.
+	borderline := []byte(`{"Id":1,"DSN":"user:pass@/"}`)
+	hidden := "user:" + mysql.HiddenPassword + "@/"
+	warnings := func() []string {
+		msgs := []string{}
+		for _, entry := range test.WaitLogChan(logChan, 100) {
+			if entry.Level == proto.LOG_WARNING {
+				msgs = append(msgs, entry.Msg)
+			}
 		}
+		return msgs
 	}
+
+	// Off: accepted without a warning, like before.
+	err = im.SetDSNValidation(instance.DSN_VALIDATION_OFF)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, borderline, true)
+	t.Check(err, IsNil)
+	t.Check(warnings(), HasLen, 0)
+	im.Remove("mysql", 1)
+
+	// Warn: accepted with a warning.
+	err = im.SetDSNValidation(instance.DSN_VALIDATION_WARN)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, borderline, true)
+	t.Check(err, IsNil)
+	t.Check(warnings(), DeepEquals, []string{"Instance mysql-1 has an incomplete DSN " + hidden + ": no address"})
+	im.Remove("mysql", 1)
+
+	// Strict: rejected.
+	err = im.SetDSNValidation(instance.DSN_VALIDATION_STRICT)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, borderline, true)
+	t.Assert(err, NotNil)
+	t.Check(err.Error(), Equals, "Invalid instance mysql-1: incomplete DSN "+hidden+": no address")
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+	err = im.Add("mysql", 1, []byte(`{"Id":1,"DSN":"@tcp(127.0.0.1:3306)/"}`), true)
+	t.Assert(err, NotNil)
+	t.Check(strings.HasSuffix(err.Error(), ": no username"), Equals, true, Commentf("%s", err))
+
+	// Complete DSNs are accepted, and garbage is rejected at every level.
+	err = im.Add("mysql", 2, []byte(`{"Id":2,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), false)
+	t.Check(err, IsNil)
+	err = im.SetDSNValidation(instance.DSN_VALIDATION_OFF)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 3, []byte(`{"Id":3,"DSN":"not a dsn"}`), false)
+	t.Check(err, NotNil)
 }
 
-func (s *ManagerTestSuite) TearDownSuite(t *C) {
-	if err := os.RemoveAll(s.tmpDir); err != nil {
-		t.Error(err)
+func (s *RepoTestSuite) TestInitDefaultAddressDSN(t *C) {
+	// The driver connects to its default address if the DSN doesn't have
+	// one, so existing configs like these must still load.
+	files := map[string]string{
+		"mysql-1.conf": `{"Id":1,"DSN":"user:pass@tcp/"}`,
+		"mysql-2.conf": `{"Id":2,"DSN":"user:pass@/"}`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
 	}
+
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Init()
+	t.Assert(err, IsNil)
+	t.Check(im.List(), HasLen, 2)
 }
 
-var dsn = os.Getenv("PCT_TEST_MYSQL_DSN")
+func (s *RepoTestSuite) TestRemoveHooks(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Add("mysql", 1, []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), true)
+	t.Assert(err, IsNil)
 
-// --------------------------------------------------------------------------
+	// A stub dependent service that must be stopped before the instance is
+	// removed.  When its hook is called, the instance must still exist.
+	stopped := map[string]bool{}
+	stubService := func(name string) instance.RemoveHook {
+		return func(service string, id uint) error {
+			it := &proto.MySQLInstance{}
+			if err := im.Get(service, id, it); err != nil {
+				return err
+			}
+			stopped[name] = true
+			return nil
+		}
+	}
+	im.AddRemoveHook("qan", stubService("qan"))
+	im.AddRemoveHook("mm", stubService("mm"))
 
-func (s *ManagerTestSuite) TestHandleGetInfoMySQL(t *C) {
-	if dsn == "" {
-		t.Fatal("PCT_TEST_MYSQL_DSN is not set")
+	// A hook that fails aborts the removal.
+	im.AddRemoveHook("bad", func(service string, id uint) error {
+		return errors.New("still running")
+	})
+	err = im.Remove("mysql", 1)
+	t.Check(err, NotNil)
+	t.Check(im.List(), DeepEquals, []string{"mysql-1"})
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, true)
+
+	im.DeleteRemoveHook("bad")
+	stopped = map[string]bool{}
+	err = im.Remove("mysql", 1)
+	t.Check(err, IsNil)
+	t.Check(stopped, DeepEquals, map[string]bool{"qan": true, "mm": true})
+	t.Check(im.List(), HasLen, 0)
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+}
+
+func (s *RepoTestSuite) TestListByType(t *C) {
+	files := map[string]string{
+		"mysql-1.conf":  `{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`,
+		"mysql-10.conf": `{"Id":10,"DSN":"user:pass@tcp(127.0.0.1:3307)/"}`,
+		"mysql-2.conf":  `{"Id":2,"DSN":"user:pass@tcp(127.0.0.1:3308)/"}`,
+		"server-1.conf": `{"Id":1,"Hostname":"db1"}`,
+		"server-3.conf": `{"Id":3,"Hostname":"db3"}`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
 	}
 
-	/**
-	 * First get MySQL info manually.  This is what GetInfo should do, too.
-	 */
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Init()
+	t.Assert(err, IsNil)
 
-	conn := mysql.NewConnection(dsn)
-	if err := conn.Connect(1); err != nil {
-		t.Fatal(err)
+	t.Check(im.ListByType("mysql"), DeepEquals, []uint{1, 2, 10})
+	t.Check(im.ListByType("server"), DeepEquals, []uint{1, 3})
+	t.Check(im.ListByType("agent"), DeepEquals, []uint{})
+
+	// Partial service names don't match.
+	t.Check(im.ListByType("my"), DeepEquals, []uint{})
+}
+
+func (s *RepoTestSuite) TestHasCount(t *C) {
+	files := map[string]string{
+		"mysql-1.conf":  `{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`,
+		"server-1.conf": `{"Id":1,"Hostname":"db1"}`,
 	}
-	var hostname, distro, version string
-	sql := "SELECT" +
-		" CONCAT_WS('.', @@hostname, IF(@@port='3306',NULL,@@port)) AS Hostname," +
-		" @@version_comment AS Distro," +
-		" @@version AS Version"
-	if err := conn.DB().QueryRow(sql).Scan(&hostname, &distro, &version); err != nil {
-		t.Fatal(err)
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
 	}
 
-	/**
-	 * Now use the instance manager and GetInfo to get MySQL info like API would.
-	 */
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	t.Check(im.Count(), Equals, 0)
+	err := im.Init()
+	t.Assert(err, IsNil)
 
-	// Create an instance manager.
-	mrm := mock.NewMrmsMonitor()
-	m := instance.NewManager(s.logger, s.configDir, s.api, mrm)
-	t.Assert(m, NotNil)
+	t.Check(im.Has("mysql", 1), Equals, true)
+	t.Check(im.Has("server", 1), Equals, true)
+	t.Check(im.Has("mysql", 2), Equals, false)
+	t.Check(im.Has("server", 2), Equals, false)
+	t.Check(im.Count(), Equals, 2)
 
-	err := m.Start()
+	// Unlike Get, Has doesn't fetch unknown instances.
+	t.Check(test.FileExists(s.configDir+"/mysql-2.conf"), Equals, false)
+	t.Check(im.Count(), Equals, 2)
+
+	err = im.Remove("mysql", 1)
 	t.Assert(err, IsNil)
+	t.Check(im.Has("mysql", 1), Equals, false)
+	t.Check(im.Count(), Equals, 1)
+}
 
-	// API sends Cmd[Service:"instance", Cmd:"GetInfo",
-	//               Data:proto.ServiceInstance[Service:"mysql",
-	//                                          Data:proto.MySQLInstance[]]]
-	// Only DSN is needed.  We set Id just to test that it's not changed.
-	mysqlIt := &proto.MySQLInstance{
-		Id:  9,
-		DSN: dsn,
-	}
-	mysqlData, err := json.Marshal(mysqlIt)
+func (s *RepoTestSuite) TestWatch(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Init()
 	t.Assert(err, IsNil)
 
-	serviceIt := &proto.ServiceInstance{
-		Service:  "mysql",
-		Instance: mysqlData,
-	}
-	serviceData, err := json.Marshal(serviceIt)
+	changeChan := make(chan instance.InstanceChange, 10)
+	err = im.Watch(func(change instance.InstanceChange) {
+		changeChan <- change
+	})
 	t.Assert(err, IsNil)
+	defer im.StopWatch()
 
-	cmd := &proto.Cmd{
-		Cmd:     "GetInfo",
-		Service: "instance",
-		Data:    serviceData,
+	waitChange := func() instance.InstanceChange {
+		select {
+		case change := <-changeChan:
+			return change
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for instance change")
+		}
+		return instance.InstanceChange{}
 	}
 
-	reply := m.Handle(cmd)
+	// Atomic write: temp file + rename.  The temp file is ignored.
+	file := s.configDir + "/mysql-1.conf"
+	write := func(data string) {
+		err := ioutil.WriteFile(file+".tmp", []byte(data), 0600)
+		t.Assert(err, IsNil)
+		err = os.Rename(file+".tmp", file)
+		t.Assert(err, IsNil)
+	}
+
+	write(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`)
+	change := waitChange()
+	t.Check(change.Service, Equals, "mysql")
+	t.Check(change.Id, Equals, uint(1))
+	t.Check(change.Old, IsNil)
+	t.Check(change.New, DeepEquals, &proto.MySQLInstance{Id: 1, DSN: "user:pass@tcp(127.0.0.1:3306)/"})
+	t.Check(im.List(), DeepEquals, []string{"mysql-1"})
 
+	write(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3307)/"}`)
+	change = waitChange()
+	t.Check(change.Old, DeepEquals, &proto.MySQLInstance{Id: 1, DSN: "user:pass@tcp(127.0.0.1:3306)/"})
+	t.Check(change.New, DeepEquals, &proto.MySQLInstance{Id: 1, DSN: "user:pass@tcp(127.0.0.1:3307)/"})
 	got := &proto.MySQLInstance{}
-	err = json.Unmarshal(reply.Data, got)
+	err = im.Get("mysql", 1, got)
 	t.Assert(err, IsNil)
+	t.Check(got.DSN, Equals, "user:pass@tcp(127.0.0.1:3307)/")
 
-	t.Check(got.Id, Equals, uint(9))        // not changed
-	t.Check(got.DSN, Equals, mysqlIt.DSN)   // not changed
-	t.Check(got.Hostname, Equals, hostname) // new
-	t.Check(got.Distro, Equals, distro)     // new
-	t.Check(got.Version, Equals, version)   // new
-}
+	// Removing the file calls the remove hooks like Remove, and the instance
+	// isn't removed if one fails.
+	hookChan := make(chan string, 10)
+	im.AddRemoveHook("bad", func(service string, id uint) error {
+		hookChan <- fmt.Sprintf("%s-%d", service, id)
+		return errors.New("still in use")
+	})
+	err = os.Remove(file)
+	t.Assert(err, IsNil)
+	select {
+	case name := <-hookChan:
+		t.Check(name, Equals, "mysql-1")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for remove hook")
+	}
+	select {
+	case change := <-changeChan:
+		t.Errorf("Got change for removed file but hook failed: %+v", change)
+	case <-time.After(200 * time.Millisecond):
+	}
+	t.Check(im.List(), DeepEquals, []string{"mysql-1"})
 
-func (s *ManagerTestSuite) TestHandleAdd(t *C) {
-	// Create an instance manager.
-	mrm := mock.NewMrmsMonitor()
-	m := instance.NewManager(s.logger, s.configDir, s.api, mrm)
-	t.Assert(m, NotNil)
+	im.DeleteRemoveHook("bad")
+	write(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3308)/"}`)
+	change = waitChange()
+	t.Check(change.New, DeepEquals, &proto.MySQLInstance{Id: 1, DSN: "user:pass@tcp(127.0.0.1:3308)/"})
+	err = os.Remove(file)
+	t.Assert(err, IsNil)
+	change = waitChange()
+	t.Check(change.Old, NotNil)
+	t.Check(change.New, IsNil)
+	t.Check(im.List(), HasLen, 0)
 
-	mysqlIt := &proto.MySQLInstance{
-		Id:  9,
-		DSN: dsn,
+	// Add and Remove write and remove files, but the repo is already in sync.
+	err = im.Add("mysql", 2, []byte(`{"Id":2,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), true)
+	t.Assert(err, IsNil)
+	err = im.Remove("mysql", 2)
+	t.Assert(err, IsNil)
+	select {
+	case change := <-changeChan:
+		t.Errorf("Got change for Add and Remove: %+v", change)
+	case <-time.After(200 * time.Millisecond):
 	}
-	mysqlData, err := json.Marshal(mysqlIt)
+}
+
+func (s *RepoTestSuite) TestExportSanitized(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Add("mysql", 1, []byte(`{"Id":1,"Hostname":"db1","DSN":"user:secret@tcp(127.0.0.1:3306)/","Version":"5.6.22"}`), false)
+	t.Assert(err, IsNil)
+	err = im.Add("server", 1, []byte(`{"Id":1,"Hostname":"db1"}`), false)
 	t.Assert(err, IsNil)
 
-	serviceIt := &proto.ServiceInstance{
-		Service:    "mysql",
-		Instance:   mysqlData,
-		InstanceId: 2,
-	}
-	serviceData, err := json.Marshal(serviceIt)
+	data, err := im.ExportSanitized()
 	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(data), "secret"), Equals, false, Commentf("%s", data))
 
-	cmd := &proto.Cmd{
+	export := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &export)
+	t.Assert(err, IsNil)
+	t.Check(export, HasLen, 2)
+
+	gotMySQL := &proto.MySQLInstance{}
+	err = json.Unmarshal(export["mysql-1"], gotMySQL)
+	t.Assert(err, IsNil)
+	t.Check(gotMySQL, DeepEquals, &proto.MySQLInstance{
+		Id:       1,
+		Hostname: "db1",
+		DSN:      "user:" + mysql.HiddenPassword + "@tcp(127.0.0.1:3306)/",
+		Version:  "5.6.22",
+	})
+
+	gotServer := &proto.ServerInstance{}
+	err = json.Unmarshal(export["server-1"], gotServer)
+	t.Assert(err, IsNil)
+	t.Check(gotServer, DeepEquals, &proto.ServerInstance{Id: 1, Hostname: "db1"})
+
+	// The repo still has the password.
+	it := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, it)
+	t.Assert(err, IsNil)
+	t.Check(it.DSN, Equals, "user:secret@tcp(127.0.0.1:3306)/")
+
+	// Passwords can have "@": none of it is exported.
+	err = im.Add("mysql", 2, []byte(`{"Id":2,"DSN":"user:s3@cr@t@tcp(127.0.0.1:3307)/"}`), false)
+	t.Assert(err, IsNil)
+	data, err = im.ExportSanitized()
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(data), "s3@"), Equals, false, Commentf("%s", data))
+	t.Check(strings.Contains(string(data), "cr@t"), Equals, false, Commentf("%s", data))
+	export = map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &export)
+	t.Assert(err, IsNil)
+	gotMySQL = &proto.MySQLInstance{}
+	err = json.Unmarshal(export["mysql-2"], gotMySQL)
+	t.Assert(err, IsNil)
+	t.Check(gotMySQL.DSN, Equals, "user:"+mysql.HiddenPassword+"@tcp(127.0.0.1:3307)/")
+}
+
+func (s *RepoTestSuite) TestExportSanitizedPassthrough(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	im.SetPassthrough(true)
+	err := im.Add("postgres", 1, []byte(`{"Id":1,"Hostname":"db1","Dsn":"user:secret@tcp(127.0.0.1:5432)/","Auth":{"Password":"secret2"},"Replicas":[{"ApiToken":"secret3"}]}`), false)
+	t.Assert(err, IsNil)
+
+	data, err := im.ExportSanitized()
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(data), "secret"), Equals, false, Commentf("%s", data))
+
+	export := map[string]map[string]interface{}{}
+	err = json.Unmarshal(data, &export)
+	t.Assert(err, IsNil)
+	t.Check(export["postgres-1"], DeepEquals, map[string]interface{}{
+		"Id":       float64(1),
+		"Hostname": "db1",
+		"Dsn":      "user:" + mysql.HiddenPassword + "@tcp(127.0.0.1:5432)/",
+		"Auth":     map[string]interface{}{"Password": mysql.HiddenPassword},
+		"Replicas": []interface{}{map[string]interface{}{"ApiToken": mysql.HiddenPassword}},
+	})
+
+	// The repo still has the password.
+	var raw json.RawMessage
+	err = im.Get("postgres", 1, &raw)
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(raw), "user:secret@"), Equals, true)
+}
+
+func (s *RepoTestSuite) TestExportImport(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	err := im.Add("mysql", 1, []byte(`{"Id":1,"Hostname":"db1","DSN":"user:secret@tcp(127.0.0.1:3306)/","Version":"5.6.22"}`), true)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 2, []byte(`{"Id":2,"Hostname":"db2","DSN":"user:secret@tcp(127.0.0.1:3307)/"}`), true)
+	t.Assert(err, IsNil)
+	err = im.Add("server", 1, []byte(`{"Id":1,"Hostname":"db1"}`), true)
+	t.Assert(err, IsNil)
+
+	data, err := im.Export()
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(data), "user:secret@"), Equals, true)
+
+	expect := map[string]interface{}{}
+	for _, name := range im.List() {
+		service, id := splitName(name)
+		if service == "mysql" {
+			it := &proto.MySQLInstance{}
+			t.Assert(im.Get(service, id, it), IsNil)
+			expect[name] = it
+		} else {
+			it := &proto.ServerInstance{}
+			t.Assert(im.Get(service, id, it), IsNil)
+			expect[name] = it
+		}
+	}
+
+	// Clear the repo.
+	for _, name := range im.List() {
+		service, id := splitName(name)
+		t.Assert(im.Remove(service, id), IsNil)
+	}
+	t.Assert(im.List(), HasLen, 0)
+
+	err = im.Import(data, false)
+	t.Assert(err, IsNil)
+	got := im.List()
+	sort.Strings(got)
+	t.Check(got, DeepEquals, []string{"mysql-1", "mysql-2", "server-1"})
+	for name, want := range expect {
+		service, id := splitName(name)
+		var it interface{}
+		if service == "mysql" {
+			it = &proto.MySQLInstance{}
+		} else {
+			it = &proto.ServerInstance{}
+		}
+		t.Assert(im.Get(service, id, it), IsNil)
+		t.Check(it, DeepEquals, want)
+		t.Check(test.FileExists(s.configDir+"/"+name+".conf"), Equals, true)
+	}
+
+	// Importing again collides unless overwriting.
+	err = im.Import(data, false)
+	t.Check(err, Equals, pct.DuplicateServiceInstanceError{Service: "mysql", Id: 1})
+
+	changed := []byte(`{"mysql-1":{"Id":1,"Hostname":"db1","DSN":"user:secret@tcp(127.0.0.1:3306)/","Version":"5.7.10"}}`)
+	err = im.Import(changed, true)
+	t.Assert(err, IsNil)
+	it := &proto.MySQLInstance{}
+	t.Assert(im.Get("mysql", 1, it), IsNil)
+	t.Check(it.Version, Equals, "5.7.10")
+	t.Check(im.List(), HasLen, 3)
+
+	// Nothing is imported if any instance is invalid.
+	err = im.Import([]byte(`{"mysql-3":{"Id":3,"DSN":"user:pass@tcp(127.0.0.1:3308)/"},"mysql-4":{"Id":4}}`), false)
+	t.Check(err, NotNil)
+	t.Check(im.List(), HasLen, 3)
+	err = im.Import([]byte(`{"mysql-x":{"Id":3}}`), false)
+	t.Check(err, NotNil)
+}
+
+// splitName splits an instance name like mysql-1.
+func splitName(name string) (string, uint) {
+	i := strings.LastIndex(name, "-")
+	id, _ := strconv.ParseUint(name[i+1:], 10, 32)
+	return name[:i], uint(id)
+}
+
+func (s *RepoTestSuite) TestLabels(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	t.Assert(im.Init(), IsNil)
+	for id := uint(1); id <= 3; id++ {
+		err := im.Add("mysql", id, []byte(fmt.Sprintf(`{"Id":%d,"DSN":"user:pass@tcp(127.0.0.1:%d)/"}`, id, 3305+id)), true)
+		t.Assert(err, IsNil)
+	}
+
+	t.Check(im.SetLabel("mysql", 1, "env", "prod"), IsNil)
+	t.Check(im.SetLabel("mysql", 1, "role", "primary"), IsNil)
+	t.Check(im.SetLabel("mysql", 2, "env", "prod"), IsNil)
+	t.Check(im.SetLabel("mysql", 2, "role", "replica"), IsNil)
+	// mysql-3 has no labels.
+
+	t.Check(im.ListByLabel("env", "prod"), DeepEquals, []string{"mysql-1", "mysql-2"})
+	t.Check(im.ListByLabel("role", "primary"), DeepEquals, []string{"mysql-1"})
+	t.Check(im.ListByLabel("env", "dev"), HasLen, 0)
+	t.Check(im.ListByLabel("dc", ""), HasLen, 0)
+	t.Check(im.Labels("mysql", 1), DeepEquals, map[string]string{"env": "prod", "role": "primary"})
+	t.Check(im.Labels("mysql", 3), DeepEquals, map[string]string{})
+
+	// Only existing instances can be labeled, and keys can't be empty.
+	t.Check(im.SetLabel("mysql", 4, "env", "prod"), Equals, pct.UnknownServiceInstanceError{Service: "mysql", Id: 4})
+	t.Check(im.SetLabel("mysql", 1, "", "prod"), NotNil)
+
+	// An empty value removes the label.
+	t.Check(im.SetLabel("mysql", 2, "role", ""), IsNil)
+	t.Check(im.Labels("mysql", 2), DeepEquals, map[string]string{"env": "prod"})
+
+	// Labels are saved.
+	im2 := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im2.Init(), IsNil)
+	t.Check(im2.ListByLabel("env", "prod"), DeepEquals, []string{"mysql-1", "mysql-2"})
+
+	// Removing an instance removes its labels.
+	t.Assert(im.Remove("mysql", 1), IsNil)
+	t.Check(im.ListByLabel("env", "prod"), DeepEquals, []string{"mysql-2"})
+	t.Check(im.Labels("mysql", 1), DeepEquals, map[string]string{})
+}
+
+func (s *RepoTestSuite) TestAddRemove(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+
+	mysqlIt := &proto.MySQLInstance{
+		Id:       1,
+		Hostname: "db1",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
+		Distro:   "Percona Server",
+		Version:  "5.6.16",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, true)
+
+	got := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	if same, diff := test.IsDeeply(got, mysqlIt); !same {
+		t.Error(diff)
+	}
+
+	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+
+	got = &proto.MySQLInstance{}
+	err = json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	if same, diff := test.IsDeeply(got, mysqlIt); !same {
+		t.Error(diff)
+	}
+
+	im.Remove("mysql", 1)
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+}
+
+func (s *RepoTestSuite) TestPathTraversal(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	data := []byte(`{"Id":1,"Hostname":"db1"}`)
+
+	// Even instances of any type can't be files outside the config dir.
+	for _, passthrough := range []bool{false, true} {
+		im.SetPassthrough(passthrough)
+		for _, service := range []string{"../../etc/passwd", "../server", "server/..", "/tmp/x"} {
+			expect := pct.InvalidServiceInstanceError{Service: service, Id: 1}
+			err := im.Add(service, 1, data, true)
+			t.Check(err, Equals, expect, Commentf("Add %s passthrough=%t", service, passthrough))
+			err = im.Update(service, 1, data, true)
+			t.Check(err, Equals, expect, Commentf("Update %s passthrough=%t", service, passthrough))
+			err = im.Remove(service, 1)
+			t.Check(err, Equals, expect, Commentf("Remove %s passthrough=%t", service, passthrough))
+		}
+	}
+	t.Check(im.List(), HasLen, 0)
+	files, err := filepath.Glob(s.configDir + "/*")
+	t.Assert(err, IsNil)
+	t.Check(files, HasLen, 0)
+}
+
+func (s *RepoTestSuite) TestUpdate(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	mysqlIt := &proto.MySQLInstance{
+		Id:       1,
+		Hostname: "db1",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
+		Distro:   "Percona Server",
+		Version:  "5.6.16",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+
+	// Can't update an instance that doesn't exist.
+	err = im.Update("mysql", 1, data, true)
+	t.Check(err, Equals, pct.UnknownServiceInstanceError{Service: "mysql", Id: 1})
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, false)
+
+	err = im.Add("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+
+	// Adding it again fails, but updating it works.
+	mysqlIt.Version = "5.6.22"
+	data, err = json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, data, true)
+	t.Check(err, NotNil)
+	err = im.Update("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+
+	got := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, mysqlIt)
+	t.Check(im.List(), DeepEquals, []string{"mysql-1"})
+
+	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+	got = &proto.MySQLInstance{}
+	err = json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, mysqlIt)
+
+	// Don't write to disk.
+	mysqlIt.Version = "5.7.10"
+	data, err = json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+	err = im.Update("mysql", 1, data, false)
+	t.Assert(err, IsNil)
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.7.10")
+	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+	got = &proto.MySQLInstance{}
+	err = json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.22")
+
+	// Invalid instances are rejected.
+	err = im.Update("mysql", 1, []byte(`{"Id":1}`), true)
+	t.Check(err, NotNil)
+	err = im.Update("mysql", 0, data, true)
+	t.Check(err, NotNil)
+}
+
+func (s *RepoTestSuite) TestErrors(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+
+	mysqlIt := &proto.MySQLInstance{
+		Id:       0,
+		Hostname: "db1",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
+		Distro:   "Percona Server",
+		Version:  "5.6.16",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+
+	// Instance ID must be > 0.
+	err = im.Add("mysql", 0, data, false)
+	t.Assert(err, NotNil)
+
+	// Service name must be one of proto.ExternalService.
+	err = im.Add("foo", 1, data, false)
+	t.Assert(err, NotNil)
+}
+
+func (s *RepoTestSuite) TestGetNotFoundTTL(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	im.SetNotFoundTTL(200 * time.Millisecond)
+
+	// The API doesn't have the instance yet.
+	s.api.GetCode = []int{404, 200}
+	s.api.GetData = [][]byte{nil, []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`)}
+	defer func() {
+		s.api.GetCode = nil
+		s.api.GetData = nil
+	}()
+
+	got := &proto.MySQLInstance{}
+	err := im.Get("mysql", 1, got)
+	t.Check(err, Equals, pct.UnknownServiceInstanceError{Service: "mysql", Id: 1})
+	t.Check(s.api.GetCode, HasLen, 1)
+
+	// Within the TTL, the API isn't asked again.
+	for i := 0; i < 5; i++ {
+		err = im.Get("mysql", 1, got)
+		t.Check(err, Equals, pct.UnknownServiceInstanceError{Service: "mysql", Id: 1})
+	}
+	t.Check(s.api.GetCode, HasLen, 1)
+
+	// After the TTL, it is, and now the API has the instance.
+	time.Sleep(300 * time.Millisecond)
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.DSN, Equals, "user:pass@tcp(127.0.0.1:3306)/")
+	t.Check(s.api.GetCode, HasLen, 0)
+}
+
+func (s *RepoTestSuite) TestGetAPIErrors(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	defer func() {
+		s.api.GetCode = nil
+		s.api.GetData = nil
+		s.api.GetError = nil
+	}()
+
+	// 404: the instance was deleted.
+	s.api.GetCode = []int{404}
+	got := &proto.MySQLInstance{}
+	err := im.Get("mysql", 1, got)
+	t.Check(err, Equals, pct.UnknownServiceInstanceError{Service: "mysql", Id: 1})
+
+	// 5xx: transient, try again later.
+	s.api.GetCode = []int{500}
+	err = im.Get("mysql", 2, got)
+	fetchErr, ok := err.(pct.InstanceFetchError)
+	t.Assert(ok, Equals, true, Commentf("%#v", err))
+	t.Check(fetchErr.Service, Equals, "mysql")
+	t.Check(fetchErr.Id, Equals, uint(2))
+	t.Check(fetchErr.Code, Equals, 500)
+	t.Check(fetchErr.Transient(), Equals, true)
+	t.Check(err, ErrorMatches, "Getting mysql-2 instance from http://localhost/instances/mysql/2 returned code 500, expected 200")
+
+	// Other 4xx: not transient.
+	s.api.GetCode = []int{403}
+	err = im.Get("mysql", 2, got)
+	fetchErr, ok = err.(pct.InstanceFetchError)
+	t.Assert(ok, Equals, true, Commentf("%#v", err))
+	t.Check(fetchErr.Code, Equals, 403)
+	t.Check(fetchErr.Transient(), Equals, false)
+
+	// 200 without data.
+	s.api.GetCode = []int{200}
+	err = im.Get("mysql", 2, got)
+	t.Check(err, ErrorMatches, "Getting mysql-2 instance from .* did not return data")
+
+	// No response: transient.
+	s.api.GetCode = []int{0}
+	s.api.GetError = []error{errors.New("connection refused")}
+	err = im.Get("mysql", 2, got)
+	fetchErr, ok = err.(pct.InstanceFetchError)
+	t.Assert(ok, Equals, true, Commentf("%#v", err))
+	t.Check(fetchErr.Code, Equals, 0)
+	t.Check(fetchErr.Transient(), Equals, true)
+	t.Check(err, ErrorMatches, "Failed to get mysql-2 instance from .*: connection refused")
+}
+
+func (s *RepoTestSuite) TestGetTTL(t *C) {
+	im := instance.NewRepo(s.logger, s.configDir, s.api)
+	t.Assert(im, NotNil)
+	im.SetTTL(200 * time.Millisecond)
+
+	mysqlIt := &proto.MySQLInstance{
+		Id:       1,
+		Hostname: "db1",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
+		Distro:   "Percona Server",
+		Version:  "5.6.16",
+	}
+	data, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+
+	// Instance isn't local yet, so it's fetched from API.
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{data}
+	got := &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.16")
+
+	// API has a newer version of the instance...
+	updatedIt := *mysqlIt
+	updatedIt.Version = "5.6.22"
+	data, err = json.Marshal(updatedIt)
+	t.Assert(err, IsNil)
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{data}
+
+	// ...but the cached instance hasn't expired yet.
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.16")
+
+	// After the TTL the instance is re-fetched and updated locally.
+	time.Sleep(300 * time.Millisecond)
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.22")
+
+	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+	got = &proto.MySQLInstance{}
+	err = json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.22")
+
+	// If the API fails, the cached instance is still returned.
+	time.Sleep(300 * time.Millisecond)
+	s.api.GetCode = []int{500}
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.22")
+
+	// And the API isn't asked again until the TTL expires again.
+	updatedIt.Version = "5.6.23"
+	data, err = json.Marshal(updatedIt)
+	t.Assert(err, IsNil)
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{data}
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.22")
+
+	// An invalid instance from the API doesn't replace the cached one.
+	time.Sleep(300 * time.Millisecond)
+	updatedIt.DSN = ""
+	data, err = json.Marshal(updatedIt)
+	t.Assert(err, IsNil)
+	s.api.GetCode = []int{200}
+	s.api.GetData = [][]byte{data}
+	got = &proto.MySQLInstance{}
+	err = im.Get("mysql", 1, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Version, Equals, "5.6.22")
+	t.Check(got.DSN, Equals, mysqlIt.DSN)
+
+	data, err = ioutil.ReadFile(s.configDir + "/mysql-1.conf")
+	t.Assert(err, IsNil)
+	got = &proto.MySQLInstance{}
+	err = json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.DSN, Equals, mysqlIt.DSN)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Manager test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ManagerTestSuite struct {
+	tmpDir    string
+	logChan   chan *proto.LogEntry
+	logger    *pct.Logger
+	configDir string
+	api       *mock.API
+}
+
+var _ = Suite(&ManagerTestSuite{})
+
+func (s *ManagerTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+
+	if err := pct.Basedir.Init(s.tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	s.configDir = pct.Basedir.Dir("config")
+
+	s.logChan = make(chan *proto.LogEntry, 10)
+	s.logger = pct.NewLogger(s.logChan, "pct-it-test")
+
+	links := map[string]string{
+		"agent":     "http://localhost/agent",
+		"instances": "http://localhost/instances",
+	}
+	s.api = mock.NewAPI("http://localhost", "http://localhost", "123", "abc-123-def", links)
+}
+
+func (s *ManagerTestSuite) SetUpTest(t *C) {
+	files, _ := filepath.Glob(s.configDir + "/*")
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func (s *ManagerTestSuite) TearDownSuite(t *C) {
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		t.Error(err)
+	}
+}
+
+var dsn = os.Getenv("PCT_TEST_MYSQL_DSN")
+
+// --------------------------------------------------------------------------
+
+func (s *ManagerTestSuite) TestHandleGetInfoMySQL(t *C) {
+	if dsn == "" {
+		t.Fatal("PCT_TEST_MYSQL_DSN is not set")
+	}
+
+	/**
+	 * First get MySQL info manually.  This is what GetInfo should do, too.
+	 */
+
+	conn := mysql.NewConnection(dsn)
+	if err := conn.Connect(1); err != nil {
+		t.Fatal(err)
+	}
+	var hostname, distro, version string
+	var port uint
+	sql := "SELECT" +
+		" @@hostname AS Hostname," +
+		" @@port AS Port," +
+		" @@version_comment AS Distro," +
+		" @@version AS Version"
+	if err := conn.DB().QueryRow(sql).Scan(&hostname, &port, &distro, &version); err != nil {
+		t.Fatal(err)
+	}
+	hostname = instance.MySQLHostname(hostname, port)
+
+	/**
+	 * Now use the instance manager and GetInfo to get MySQL info like API would.
+	 */
+
+	// Create an instance manager.
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	// API sends Cmd[Service:"instance", Cmd:"GetInfo",
+	//               Data:proto.ServiceInstance[Service:"mysql",
+	//                                          Data:proto.MySQLInstance[]]]
+	// Only DSN is needed.  We set Id just to test that it's not changed.
+	mysqlIt := &proto.MySQLInstance{
+		Id:  9,
+		DSN: dsn,
+	}
+	mysqlData, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+
+	serviceIt := &proto.ServiceInstance{
+		Service:  "mysql",
+		Instance: mysqlData,
+	}
+	serviceData, err := json.Marshal(serviceIt)
+	t.Assert(err, IsNil)
+
+	cmd := &proto.Cmd{
+		Cmd:     "GetInfo",
+		Service: "instance",
+		Data:    serviceData,
+	}
+
+	reply := m.Handle(cmd)
+
+	got := &proto.MySQLInstance{}
+	err = json.Unmarshal(reply.Data, got)
+	t.Assert(err, IsNil)
+
+	t.Check(got.Id, Equals, uint(9))        // not changed
+	t.Check(got.DSN, Equals, mysqlIt.DSN)   // not changed
+	t.Check(got.Hostname, Equals, hostname) // new
+	t.Check(got.Distro, Equals, distro)     // new
+	t.Check(got.Version, Equals, version)   // new
+}
+
+func (s *ManagerTestSuite) TestHandleGetInfoServer(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	serverIt := &proto.ServerInstance{
+		Id: 3,
+	}
+	serverData, err := json.Marshal(serverIt)
+	t.Assert(err, IsNil)
+
+	serviceIt := &proto.ServiceInstance{
+		Service:  "server",
+		Instance: serverData,
+	}
+	serviceData, err := json.Marshal(serviceIt)
+	t.Assert(err, IsNil)
+
+	cmd := &proto.Cmd{
+		Cmd:     "GetInfo",
+		Service: "instance",
+		Data:    serviceData,
+	}
+
+	reply := m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+
+	got := &instance.ServerInfo{}
+	err = json.Unmarshal(reply.Data, got)
+	t.Assert(err, IsNil)
+
+	hostname, _ := os.Hostname()
+	t.Check(got.Id, Equals, uint(3)) // not changed
+	t.Check(got.Hostname, Equals, hostname)
+	t.Check(got.Kernel, Not(Equals), "")
+	t.Check(got.CPUs > 0, Equals, true)
+	t.Check(got.MemTotal > 0, Equals, true)
+	if _, err := os.Stat("/etc/os-release"); err == nil {
+		t.Check(got.Distro, Not(Equals), "")
+	}
+}
+
+func (s *ManagerTestSuite) TestPushInstanceInfoRetry(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.PushAttempts = 3
+	m.PushBackoff = 10 * time.Millisecond
+
+	it := &proto.MySQLInstance{
+		Id:  1,
+		DSN: "user:pass@tcp(127.0.0.1:3306)/",
+	}
+
+	// 503 twice then 200: the third attempt succeeds.
+	s.api.PutCode = []int{503, 503, 200}
+	err := m.PushInstanceInfo(it)
+	t.Check(err, IsNil)
+	t.Check(s.api.PutCode, HasLen, 0)
+
+	// Connection errors are retried, too, but only PushAttempts times.
+	s.api.PutError = []error{errors.New("conn refused"), errors.New("conn refused"), errors.New("conn refused"), nil}
+	err = m.PushInstanceInfo(it)
+	t.Check(err, NotNil)
+	t.Check(s.api.PutError, HasLen, 1)
+	s.api.PutError = nil
+
+	// 4xx are not retried.
+	s.api.PutCode = []int{404, 200}
+	err = m.PushInstanceInfo(it)
+	t.Check(err, NotNil)
+	t.Check(s.api.PutCode, HasLen, 1)
+	s.api.PutCode = nil
+}
+
+func (s *ManagerTestSuite) TestStartStopWhileRetryingPush(t *C) {
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	m.PushAttempts = 3
+	m.PushBackoff = 2 * time.Second
+
+	// The API is down, so pushing the info would take 2s + 4s...
+	s.api.PutCode = []int{503, 503, 503}
+	defer func() { s.api.PutCode = nil }()
+
+	// ...but Start doesn't wait for it...
+	t0 := time.Now()
+	err = m.Start()
+	t.Assert(err, IsNil)
+	t.Check(time.Now().Sub(t0) < time.Second, Equals, true, Commentf("Start took %s", time.Now().Sub(t0)))
+
+	// ...and Stop interrupts it.
+	time.Sleep(100 * time.Millisecond)
+	t0 = time.Now()
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	t.Check(time.Now().Sub(t0) < time.Second, Equals, true, Commentf("Stop took %s", time.Now().Sub(t0)))
+}
+
+func (s *ManagerTestSuite) TestGetSQLModeInfo(t *C) {
+	sqlModes := []struct {
+		sqlMode  string
+		problems string
+	}{
+		// MySQL 5.7 default
+		{"ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ZERO_DATE,ERROR_FOR_DIVISION_BY_ZERO,NO_AUTO_CREATE_USER,NO_ENGINE_SUBSTITUTION", ""},
+		// MySQL 5.5 default
+		{"", "no NO_ENGINE_SUBSTITUTION"},
+		{"ANSI_QUOTES,NO_ENGINE_SUBSTITUTION", "ANSI_QUOTES"},
+		{"REAL_AS_FLOAT,PIPES_AS_CONCAT,ANSI_QUOTES,IGNORE_SPACE,ANSI", "ANSI_QUOTES,no NO_ENGINE_SUBSTITUTION"},
+		{"ansi,no_engine_substitution", "ANSI_QUOTES"},
+	}
+	for _, m := range sqlModes {
+		conn := mock.NewNullMySQL()
+		conn.SetGlobalVarString("sql_mode", m.sqlMode)
+		got := instance.GetSQLModeInfo(conn)
+		t.Check(got, DeepEquals, map[string]string{
+			"sql_mode":          m.sqlMode,
+			"sql_mode.problems": m.problems,
+		}, Commentf("sql_mode=%s", m.sqlMode))
+	}
+}
+
+func (s *ManagerTestSuite) TestGetBinlogInfo(t *C) {
+	// MySQL 5.7: retention is expire_logs_days.
+	conn := mock.NewNullMySQL()
+	conn.SetAtLeastVersion(false, nil)
+	conn.SetGlobalVarString("log_bin", "1")
+	conn.SetGlobalVarString("binlog_format", "ROW")
+	conn.SetGlobalVarNumber("expire_logs_days", 7)
+
+	got, err := instance.GetBinlogInfo(conn)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]string{
+		"binlog.enabled":          "true",
+		"binlog.log_bin":          "1",
+		"binlog.format":           "ROW",
+		"binlog.expire_logs_days": "7",
+		"binlog.expire_seconds":   "604800",
+	})
+	t.Check(conn.Version, Equals, instance.BINLOG_EXPIRE_SECONDS_VERSION)
+
+	// MySQL 8.0: retention is binlog_expire_logs_seconds.
+	conn = mock.NewNullMySQL()
+	conn.SetAtLeastVersion(true, nil)
+	conn.SetGlobalVarString("log_bin", "ON")
+	conn.SetGlobalVarString("binlog_format", "MIXED")
+	conn.SetGlobalVarNumber("binlog_expire_logs_seconds", 2592000)
+
+	got, err = instance.GetBinlogInfo(conn)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]string{
+		"binlog.enabled":                    "true",
+		"binlog.log_bin":                    "ON",
+		"binlog.format":                     "MIXED",
+		"binlog.binlog_expire_logs_seconds": "2592000",
+		"binlog.expire_seconds":             "2592000",
+	})
+
+	// Binary logging disabled.
+	conn = mock.NewNullMySQL()
+	conn.SetGlobalVarString("log_bin", "0")
+	got, err = instance.GetBinlogInfo(conn)
+	t.Assert(err, IsNil)
+	t.Check(got["binlog.enabled"], Equals, "false")
+}
+
+func (s *ManagerTestSuite) TestHandleAdd(t *C) {
+	// Create an instance manager.
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	// Instances must have a DSN, but MySQL isn't needed to add one.
+	itDSN := dsn
+	if itDSN == "" {
+		itDSN = "user:pass@tcp(127.0.0.1:1)/"
+	}
+	mysqlIt := &proto.MySQLInstance{
+		Id:  9,
+		DSN: itDSN,
+	}
+	mysqlData, err := json.Marshal(mysqlIt)
+	t.Assert(err, IsNil)
+
+	serviceIt := &proto.ServiceInstance{
+		Service:    "mysql",
+		Instance:   mysqlData,
+		InstanceId: 2,
+	}
+	serviceData, err := json.Marshal(serviceIt)
+	t.Assert(err, IsNil)
+
+	cmd := &proto.Cmd{
 		Cmd:     "Add",
 		Service: "mysql",
 		Data:    serviceData,
@@ -332,9 +1463,1226 @@ func (s *ManagerTestSuite) TestHandleAdd(t *C) {
 	reply := m.Handle(cmd)
 	t.Assert(reply.Error, Equals, "")
 
-	// Test GetMySQLInstances here beacause we already have a Repo with instances
-	is := m.GetMySQLInstances()
-	t.Assert(is, NotNil)
-	t.Assert(len(is), Equals, 1)
-	t.Assert(is[0].Id, Equals, uint(9))
+	// Test GetMySQLInstances here beacause we already have a Repo with instances
+	is := m.GetMySQLInstances()
+	t.Assert(is, NotNil)
+	t.Assert(len(is), Equals, 1)
+	t.Assert(is[0].Id, Equals, uint(9))
+}
+
+func (s *ManagerTestSuite) TestUnsupportedInstanceType(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	it := &proto.ServiceInstance{
+		Service:    "postgres",
+		InstanceId: 1,
+		Instance:   []byte(`{"Id":1,"Port":5432}`),
+	}
+	data, err := json.Marshal(it)
+	t.Assert(err, IsNil)
+	expect := "Unsupported instance type 'postgres': supported types are mysql, server"
+
+	// Rejected by default.
+	reply := m.Handle(&proto.Cmd{Cmd: "Add", Service: "instance", Data: data})
+	t.Check(reply.Error, Equals, expect)
+	t.Check(test.FileExists(s.configDir+"/postgres-1.conf"), Equals, false)
+
+	reply = m.Handle(&proto.Cmd{Cmd: "GetInfo", Service: "instance", Data: data})
+	t.Check(reply.Error, Equals, expect)
+
+	// Stored as-is with passthrough, but there's still no info.
+	m.Repo().SetPassthrough(true)
+	reply = m.Handle(&proto.Cmd{Cmd: "Add", Service: "instance", Data: data})
+	t.Check(reply.Error, Equals, "")
+	t.Check(test.FileExists(s.configDir+"/postgres-1.conf"), Equals, true)
+	var raw json.RawMessage
+	err = m.Repo().Get("postgres", 1, &raw)
+	t.Check(err, IsNil)
+	t.Check(string(raw), Equals, `{"Id":1,"Port":5432}`)
+
+	reply = m.Handle(&proto.Cmd{Cmd: "GetInfo", Service: "instance", Data: data})
+	t.Check(reply.Error, Equals, expect)
+
+	// Passthrough instances are loaded, too.
+	repo := instance.NewRepo(s.logger, s.configDir, s.api)
+	repo.SetPassthrough(true)
+	err = repo.Init()
+	t.Assert(err, IsNil)
+	t.Check(repo.ListByType("postgres"), DeepEquals, []uint{1})
+}
+
+func (s *ManagerTestSuite) TestStartStop(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+
+	// Stop must make monitorInstancesRestart return, else it blocks.
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- m.Stop()
+	}()
+	select {
+	case err = <-doneChan:
+		t.Check(err, IsNil)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop() did not return; monitorInstancesRestart still running")
+	}
+
+	status := m.Status()
+	t.Check(status["instance"], Equals, "Stopped")
+	t.Check(status["instance-mrms"], Equals, "Stopped")
+
+	// Stopping a stopped manager is a no-op.
+	err = m.Stop()
+	t.Check(err, IsNil)
+}
+
+func (s *ManagerTestSuite) TestResyncMRMS(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	dsn1 := "user:pass@tcp(127.0.0.1:3306)/"
+	dsn2 := "user:pass@tcp(127.0.0.1:3307)/"
+	dsn3 := "user:pass@tcp(127.0.0.1:3308)/"
+
+	// Change the repo directly, not with Handle, so the monitor doesn't know.
+	err := m.Repo().Add("mysql", 1, []byte(`{"Id":1,"DSN":"`+dsn1+`"}`), true)
+	t.Assert(err, IsNil)
+	err = m.Repo().Add("mysql", 2, []byte(`{"Id":2,"DSN":"`+dsn2+`"}`), true)
+	t.Assert(err, IsNil)
+	t.Check(mrm.Monitored(dsn1), Equals, 0)
+	t.Check(mrm.Monitored(dsn2), Equals, 0)
+
+	err = m.ResyncMRMS()
+	t.Assert(err, IsNil)
+	t.Check(mrm.Monitored(dsn1), Equals, 1)
+	t.Check(mrm.Monitored(dsn2), Equals, 1)
+
+	err = m.Repo().Remove("mysql", 2)
+	t.Assert(err, IsNil)
+	err = m.Repo().Add("mysql", 3, []byte(`{"Id":3,"DSN":"`+dsn3+`"}`), true)
+	t.Assert(err, IsNil)
+
+	// Instances still in the repo aren't monitored twice.
+	err = m.ResyncMRMS()
+	t.Assert(err, IsNil)
+	t.Check(mrm.Monitored(dsn1), Equals, 1)
+	t.Check(mrm.Monitored(dsn2), Equals, 0)
+	t.Check(mrm.Monitored(dsn3), Equals, 1)
+}
+
+func (s *ManagerTestSuite) TestStatusResourceUsage(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	status := m.Status()
+	goroutines, err := strconv.Atoi(status["agent-goroutines"])
+	t.Assert(err, IsNil)
+	t.Check(goroutines > 0, Equals, true)
+	heapAlloc, err := strconv.ParseUint(status["agent-heap-alloc"], 10, 64)
+	t.Assert(err, IsNil)
+	t.Check(heapAlloc > 0, Equals, true)
+	conns, err := strconv.ParseInt(status["agent-mysql-conns"], 10, 64)
+	t.Assert(err, IsNil)
+	t.Check(conns, Equals, mysql.OpenConnections())
+	t.Check(conns >= 0, Equals, true)
+}
+
+func (s *ManagerTestSuite) TestStatusJSON(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	err := m.Repo().Init()
+	t.Assert(err, IsNil)
+	defer func() { s.api.PutCode = nil }()
+
+	status := m.StatusInfo()
+	t.Check(status.Instances, Equals, 0)
+	t.Check(status.MySQL, HasLen, 0)
+	t.Check(status.Subscriptions, Equals, 0)
+
+	// Add a MySQL instance; its info is pushed.
+	mysqlData, err := json.Marshal(&proto.MySQLInstance{Id: 1, DSN: "user:pass@tcp(127.0.0.1:3306)/"})
+	t.Assert(err, IsNil)
+	serviceData, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: 1, Instance: mysqlData})
+	t.Assert(err, IsNil)
+	s.api.PutCode = []int{200}
+	before := time.Now().UTC()
+	reply := m.Handle(&proto.Cmd{Cmd: "Add", Service: "instance", Data: serviceData})
+	t.Assert(reply.Error, Equals, "")
+
+	// And a server instance.
+	serviceData, err = json.Marshal(&proto.ServiceInstance{Service: "server", InstanceId: 1, Instance: []byte(`{"Id":1,"Hostname":"db1"}`)})
+	t.Assert(err, IsNil)
+	reply = m.Handle(&proto.Cmd{Cmd: "Add", Service: "instance", Data: serviceData})
+	t.Assert(reply.Error, Equals, "")
+
+	status = m.StatusInfo()
+	t.Check(status.Instances, Equals, 2)
+	t.Check(status.Subscriptions, Equals, 1)
+	t.Assert(status.MySQL, HasLen, 1)
+	t.Check(status.MySQL[0].Name, Equals, "mysql-1")
+	t.Check(status.MySQL[0].DSN, Equals, "user:<password-hidden>@tcp(127.0.0.1:3306)/")
+	t.Assert(status.MySQL[0].LastInfoUpdate, NotNil)
+	t.Check(status.MySQL[0].LastInfoUpdate.Before(before), Equals, false)
+
+	data, err := m.StatusJSON()
+	t.Assert(err, IsNil)
+	got := &instance.ManagerStatus{}
+	err = json.Unmarshal(data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Instances, Equals, 2)
+	t.Check(got.Subscriptions, Equals, 1)
+	t.Assert(got.MySQL, HasLen, 1)
+	t.Check(got.MySQL[0].DSN, Equals, "user:<password-hidden>@tcp(127.0.0.1:3306)/")
+	t.Check(got.MySQL[0].LastInfoUpdate.Equal(*status.MySQL[0].LastInfoUpdate), Equals, true)
+}
+
+func (s *ManagerTestSuite) TestLastUpdate(t *C) {
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	m.PushAttempts = 1
+	err = m.Repo().Init()
+	t.Assert(err, IsNil)
+	defer func() { s.api.PutCode = nil }()
+
+	_, ok := m.GetLastUpdate("mysql-1")
+	t.Check(ok, Equals, false)
+	t.Check(m.Status()["instance-info-updated"], Equals, "None")
+
+	forcePush := func() *proto.Reply {
+		data, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+		t.Assert(err, IsNil)
+		return m.Handle(&proto.Cmd{Cmd: "ForcePush", Service: "instance", Data: data})
+	}
+
+	s.api.PutCode = []int{200}
+	reply := forcePush()
+	t.Assert(reply.Error, Equals, "")
+	first, ok := m.GetLastUpdate("mysql-1")
+	t.Assert(ok, Equals, true)
+	t.Check(m.Status()["instance-info-updated"], Equals, "mysql-1 at "+first.Format(time.RFC3339))
+
+	// A failed push doesn't change it.
+	time.Sleep(10 * time.Millisecond)
+	s.api.PutCode = []int{500}
+	reply = forcePush()
+	t.Check(reply.Error, Not(Equals), "")
+	ts, _ := m.GetLastUpdate("mysql-1")
+	t.Check(ts, Equals, first)
+
+	// A successful push advances it.
+	s.api.PutCode = []int{200}
+	reply = forcePush()
+	t.Assert(reply.Error, Equals, "")
+	ts, _ = m.GetLastUpdate("mysql-1")
+	t.Check(ts.After(first), Equals, true)
+}
+
+func (s *ManagerTestSuite) TestResyncInterval(t *C) {
+	defer capture.Set(captureRow, nil)
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	m.ResyncInterval = 20 * time.Millisecond
+	defer func() { s.api.PutCode = nil }()
+
+	// Start pushes the instance info.
+	s.api.PutCode = []int{200, 200, 200}
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	first := waitLastUpdate(m, "mysql-1", time.Time{})
+	t.Assert(first.IsZero(), Equals, false)
+
+	// Info didn't change, so resyncing doesn't push it again.
+	time.Sleep(100 * time.Millisecond)
+	ts, _ := m.GetLastUpdate("mysql-1")
+	t.Check(ts, Equals, first)
+
+	// MySQL upgraded in place: the next resync pushes the new info.
+	capture.Set([]string{"db1", "3306", "Percona Server", "5.7.10"}, nil)
+	second := waitLastUpdate(m, "mysql-1", first)
+	t.Check(second.After(first), Equals, true)
+}
+
+// waitLastUpdate waits up to 1s for the instance's last update to be after ts.
+func waitLastUpdate(m *instance.Manager, name string, ts time.Time) time.Time {
+	for i := 0; i < 100; i++ {
+		if got, ok := m.GetLastUpdate(name); ok && got.After(ts) {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return time.Time{}
+}
+
+func (s *ManagerTestSuite) TestHandleRemoveHookFails(t *C) {
+	mysqlDSN := "user:pass@tcp(127.0.0.1:3306)/"
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"`+mysqlDSN+`"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+
+	data, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{Cmd: "Remove", Service: "instance", Data: data}
+
+	// The instance isn't removed if a hook fails, so it's still monitored.
+	m.Repo().AddRemoveHook("bad", func(service string, id uint) error {
+		return errors.New("still in use")
+	})
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Not(Equals), "")
+	t.Check(m.Repo().List(), DeepEquals, []string{"mysql-1"})
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+
+	m.Repo().DeleteRemoveHook("bad")
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Equals, "")
+	t.Check(m.Repo().List(), HasLen, 0)
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 0)
+}
+
+func (s *ManagerTestSuite) TestHandleRemoveGetFails(t *C) {
+	mysqlDSN := "user:pass@tcp(127.0.0.1:3306)/"
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"`+mysqlDSN+`"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+
+	// Remove the instance from the repo behind the manager's back, so the
+	// manager can't Get it locally, but it's still monitored.
+	err = m.Repo().Remove("mysql", 1)
+	t.Assert(err, IsNil)
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+
+	// The DSN is still known from the info last pushed or the cmd, so the
+	// instance isn't monitored anymore even though the repo can't remove it.
+	data, err := json.Marshal(&proto.ServiceInstance{
+		Service:    "mysql",
+		InstanceId: 1,
+		Instance:   []byte(`{"Id":1,"DSN":"` + mysqlDSN + `"}`),
+	})
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{Cmd: "Remove", Service: "instance", Data: data}
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Not(Equals), "")
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 0)
+
+	// Without a DSN there's nothing to stop monitoring, but it doesn't panic.
+	data, err = json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+	t.Assert(err, IsNil)
+	cmd = &proto.Cmd{Cmd: "Remove", Service: "instance", Data: data}
+	reply = m.Handle(cmd)
+	t.Check(reply.Error, Not(Equals), "")
+}
+
+func (s *ManagerTestSuite) TestStartStopAgain(t *C) {
+	mysqlDSN := "user:pass@tcp(127.0.0.1:3306)/"
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"`+mysqlDSN+`"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+
+	// Start subscribes to MRMS once, so restart events aren't split
+	// between subscriptions.
+	err = m.Start()
+	t.Assert(err, IsNil)
+	t.Check(mrm.GlobalSubscribed(), Equals, true)
+	t.Check(mrm.GlobalSubscribeCount(), Equals, 1)
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+
+	// Starting a running manager is a no-op.
+	err = m.Start()
+	t.Assert(err, IsNil)
+	t.Check(mrm.GlobalSubscribeCount(), Equals, 1)
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+
+	// Stop unsubscribes from MRMS and stops monitoring the instances.
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	t.Check(mrm.GlobalSubscribed(), Equals, false)
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 0)
+
+	// The manager can be started again without re-adding the instances.
+	err = m.Start()
+	t.Assert(err, IsNil)
+	t.Check(mrm.GlobalSubscribed(), Equals, true)
+	t.Check(mrm.GlobalSubscribeCount(), Equals, 2)
+	t.Check(mrm.Monitored(mysqlDSN), Equals, 1)
+	t.Check(m.Repo().List(), DeepEquals, []string{"mysql-1"})
+
+	err = m.Stop()
+	t.Assert(err, IsNil)
+}
+
+func (s *ManagerTestSuite) TestMrmsGlobalBuffer(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 1)
+	t.Assert(m, NotNil)
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	// More restarts than the buffer holds must not block the restart monitor.
+	doneChan := make(chan bool, 1)
+	go func() {
+		for i := 0; i < 5; i++ {
+			mrm.SimulateGlobalMySQLRestart(dsn)
+		}
+		doneChan <- true
+	}()
+	select {
+	case <-doneChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Restart notifications blocked with a full global buffer")
+	}
+}
+
+// panicConnFactory panics making the next panics connections.
+type panicConnFactory struct {
+	mysql.ConnectionFactory
+	panics int
+	mux    sync.Mutex
+}
+
+func (f *panicConnFactory) Make(dsn string) mysql.Connector {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.panics > 0 {
+		f.panics--
+		panic("connection crashed")
+	}
+	return f.ConnectionFactory.Make(dsn)
+}
+
+func (s *ManagerTestSuite) TestRestartHandlerCrash(t *C) {
+	mysqlDSN := "user:pass@tcp(127.0.0.1:3306)/"
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"`+mysqlDSN+`"}`), 0600)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	factory := &panicConnFactory{ConnectionFactory: &mock.ConnectionFactory{Conn: newCaptureMySQL()}}
+	m.ConnFactory = factory
+	m.ConnIdleTimeout = 0 // make a connection every time so it can panic
+	m.RestartDelay = 50 * time.Millisecond
+	s.api.PutCode = []int{200, 200, 200, 200, 200}
+	defer func() { s.api.PutCode = nil }()
+
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	first := waitLastUpdate(m, "mysql-1", time.Time{})
+	t.Assert(first.IsZero(), Equals, false)
+
+	// Handling the restart crashes...
+	factory.mux.Lock()
+	factory.panics = 1
+	factory.mux.Unlock()
+	mrm.SimulateGlobalMySQLRestart(mysqlDSN)
+	time.Sleep(20 * time.Millisecond)
+	t.Check(m.Status()["instance-mrms"], Matches, "Crashed, restarting in .+")
+
+	// ...but restarts are handled again after the delay.
+	time.Sleep(100 * time.Millisecond)
+	t.Check(m.Status()["instance-mrms"], Equals, "Idle")
+	mrm.SimulateGlobalMySQLRestart(mysqlDSN)
+	second := waitLastUpdate(m, "mysql-1", first)
+	t.Check(second.After(first), Equals, true)
+}
+
+// countConnFactory counts the connections it makes, connects, and closes.
+type countConnFactory struct {
+	made  int
+	conns []*countMySQL
+	mux   sync.Mutex
+}
+
+type countMySQL struct {
+	*captureMySQL
+	connects int
+	closes   int
+	mux      sync.Mutex // Close is called by the idle timeout goroutine
+}
+
+func (c *countMySQL) Connect(tries uint) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.connects++
+	return nil
+}
+
+func (c *countMySQL) Close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.closes++
+}
+
+func (c *countMySQL) counts() (connects, closes int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.connects, c.closes
+}
+
+func (f *countConnFactory) Make(dsn string) mysql.Connector {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.made++
+	conn := &countMySQL{captureMySQL: newCaptureMySQL()}
+	f.conns = append(f.conns, conn)
+	return conn
+}
+
+func (s *ManagerTestSuite) TestGetInfoReusesConn(t *C) {
+	err := ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), 0600)
+	t.Assert(err, IsNil)
+
+	m := instance.NewManager(s.logger, s.configDir, s.api, mock.NewMrmsMonitor(), 0)
+	t.Assert(m, NotNil)
+	factory := &countConnFactory{}
+	m.ConnFactory = factory
+	m.PushAttempts = 1
+	err = m.Repo().Init()
+	t.Assert(err, IsNil)
+	s.api.PutCode = []int{200, 200, 200, 200}
+	defer func() { s.api.PutCode = nil }()
+
+	forcePush := func() {
+		data, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: 1})
+		t.Assert(err, IsNil)
+		reply := m.Handle(&proto.Cmd{Cmd: "ForcePush", Service: "instance", Data: data})
+		t.Assert(reply.Error, Equals, "")
+	}
+
+	// The second time reuses the connection.
+	forcePush()
+	forcePush()
+	t.Check(factory.made, Equals, 1)
+	connects, closes := factory.conns[0].counts()
+	t.Check(connects, Equals, 1)
+	t.Check(closes, Equals, 0)
+
+	// Once idle, it's closed, so the next time reconnects.
+	m.ConnIdleTimeout = 50 * time.Millisecond
+	forcePush()
+	time.Sleep(100 * time.Millisecond)
+	_, closes = factory.conns[0].counts()
+	t.Check(closes, Equals, 1)
+	forcePush()
+	t.Check(factory.made, Equals, 2)
+
+	// Stop closes it.
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	_, closes = factory.conns[1].counts()
+	t.Check(closes, Equals, 1)
+}
+
+// Makes a different connection for each DSN.
+type dsnConnFactory map[string]mysql.Connector
+
+func (f dsnConnFactory) Make(dsn string) mysql.Connector {
+	return f[dsn]
+}
+
+// slowMySQL takes delay to fail to connect, like an unreachable MySQL.
+type slowMySQL struct {
+	*mock.NullMySQL
+	delay time.Duration
+}
+
+func (c *slowMySQL) Connect(tries uint) error {
+	time.Sleep(c.delay)
+	return errors.New("connection timeout")
+}
+
+func (s *ManagerTestSuite) TestStartTimeout(t *C) {
+	for id := 1; id <= 3; id++ {
+		data := fmt.Sprintf(`{"Id":%d,"DSN":"user:pass@tcp(127.0.0.1:%d)/"}`, id, id)
+		err := ioutil.WriteFile(fmt.Sprintf("%s/mysql-%d.conf", s.configDir, id), []byte(data), 0600)
+		t.Assert(err, IsNil)
+	}
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: &slowMySQL{mock.NewNullMySQL(), 100 * time.Millisecond}}
+	m.StartTimeout = 50 * time.Millisecond
+
+	// Checking for duplicates and getting info takes 600ms, but Start returns
+	// after the timeout with the instances pending.
+	t0 := time.Now()
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	t.Check(time.Now().Sub(t0) < 300*time.Millisecond, Equals, true)
+	t.Check(m.Status()["instance-pending"], Equals, "mysql-1, mysql-2, mysql-3")
+
+	// The instances are started in the background.
+	pending := ""
+	for i := 0; i < 50; i++ {
+		if pending = m.Status()["instance-pending"]; pending == "None" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Check(pending, Equals, "None")
+}
+
+func (s *ManagerTestSuite) TestFindDuplicateMySQL(t *C) {
+	instances := []*proto.MySQLInstance{
+		{Id: 1, DSN: "user:pass@tcp(127.0.0.1:3306)/"},
+		{Id: 2, DSN: "user:pass@tcp(10.1.1.1:3306)/"},
+		{Id: 3, DSN: "user:pass@unix(/var/run/mysqld/mysqld.sock)/"},
+		{Id: 4, DSN: "user:pass@tcp(10.1.1.2:3306)/"},
+	}
+	factory := dsnConnFactory{}
+	for _, it := range instances {
+		factory[it.DSN] = mock.NewNullMySQL()
+	}
+	factory[instances[0].DSN].(*mock.NullMySQL).SetGlobalVarString("server_uuid", "uuid-a")
+	factory[instances[1].DSN].(*mock.NullMySQL).SetGlobalVarString("server_uuid", "uuid-b")
+	factory[instances[2].DSN].(*mock.NullMySQL).SetGlobalVarString("server_uuid", "uuid-a")
+	// instances[3] is MySQL < 5.6 without server_uuid.
+
+	// Distinct server_uuids aren't duplicates.
+	got := instance.FindDuplicateMySQL(instances[0:2], factory)
+	t.Check(got, HasLen, 0)
+
+	// The socket and the TCP DSN are the same server.
+	got = instance.FindDuplicateMySQL(instances, factory)
+	t.Check(got, DeepEquals, map[string][]*proto.MySQLInstance{
+		"uuid-a": {instances[0], instances[2]},
+	})
+}
+
+func (s *ManagerTestSuite) TestStartWarnsDuplicateMySQL(t *C) {
+	files := map[string]string{
+		"mysql-1.conf": `{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:1)/"}`,
+		"mysql-2.conf": `{"Id":2,"DSN":"user:pass@tcp(localhost:1)/"}`,
+	}
+	factory := dsnConnFactory{}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
+		it := &proto.MySQLInstance{}
+		err = json.Unmarshal([]byte(data), it)
+		t.Assert(err, IsNil)
+		conn := newCaptureMySQL()
+		conn.SetGlobalVarString("server_uuid", "uuid-a")
+		factory[it.DSN] = conn
+	}
+
+	logChan := make(chan *proto.LogEntry, 100)
+	logger := pct.NewLogger(logChan, "instance-test")
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = factory
+
+	err := m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	var warnings []string
+	for _, entry := range test.WaitLogChan(logChan, 100) {
+		if entry.Level == proto.LOG_WARNING && strings.Contains(entry.Msg, "same server") {
+			warnings = append(warnings, entry.Msg)
+		}
+	}
+	t.Assert(warnings, HasLen, 1)
+	hidden := "user:" + mysql.HiddenPassword
+	t.Check(warnings[0], Equals, "MySQL instances mysql-1 ("+hidden+"@tcp(127.0.0.1:1)/), mysql-2 ("+hidden+"@tcp(localhost:1)/) are the same server: server_uuid uuid-a")
+}
+
+// captureDriver is a database/sql driver that records the queries it's given
+// and returns the same row of strings, or error, for every query.  A nil row
+// returns no rows.
+type captureDriver struct {
+	mux       sync.Mutex
+	queries   []string
+	cols      []string
+	row       []string
+	err       error
+	queryRows map[string][]string
+	block     chan struct{}
+}
+
+var captureRow = []string{"db1", "3306", "Percona Server", "5.6.22"}
+
+var capture = &captureDriver{row: captureRow}
+
+func init() {
+	sql.Register("instance-capture", capture)
+}
+
+func (d *captureDriver) Open(name string) (driver.Conn, error) {
+	return &captureConn{d}, nil
+}
+
+func (d *captureDriver) Set(row []string, err error) {
+	d.SetColumns(nil, row, err)
+}
+
+// SetColumns is like Set but the columns are named, e.g. for SHOW statements.
+func (d *captureDriver) SetColumns(cols, row []string, err error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.cols = cols
+	d.row = row
+	d.err = err
+	d.queryRows = nil
+}
+
+// SetQuery returns row instead of the Set row for queries containing substr.
+func (d *captureDriver) SetQuery(substr string, row []string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.queryRows == nil {
+		d.queryRows = make(map[string][]string)
+	}
+	d.queryRows[substr] = row
+}
+
+// Block makes queries block until block is closed, like a wedged MySQL.
+func (d *captureDriver) Block(block chan struct{}) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.block = block
+}
+
+func (d *captureDriver) Queries() []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return append([]string{}, d.queries...)
+}
+
+type captureConn struct {
+	d *captureDriver
+}
+
+func (c *captureConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.mux.Lock()
+	defer c.d.mux.Unlock()
+	c.d.queries = append(c.d.queries, query)
+	return &captureStmt{c.d, query}, nil
+}
+
+func (c *captureConn) Close() error {
+	return nil
+}
+
+func (c *captureConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type captureStmt struct {
+	d     *captureDriver
+	query string
+}
+
+func (s *captureStmt) Close() error {
+	return nil
+}
+
+func (s *captureStmt) NumInput() int {
+	return -1
+}
+
+func (s *captureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.ResultNoRows, nil
+}
+
+func (s *captureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mux.Lock()
+	block := s.d.block
+	s.d.mux.Unlock()
+	if block != nil {
+		<-block
+	}
+	s.d.mux.Lock()
+	defer s.d.mux.Unlock()
+	if s.d.err != nil {
+		return nil, s.d.err
+	}
+	row := s.d.row
+	for substr, r := range s.d.queryRows {
+		if strings.Contains(s.query, substr) {
+			row = r
+		}
+	}
+	cols := s.d.cols
+	if cols == nil {
+		cols = make([]string, len(row))
+	}
+	return &captureRows{cols: cols, row: row}, nil
+}
+
+type captureRows struct {
+	cols []string
+	row  []string
+	done bool
+}
+
+func (r *captureRows) Columns() []string {
+	return r.cols
+}
+
+func (r *captureRows) Close() error {
+	return nil
+}
+
+func (r *captureRows) Next(dest []driver.Value) error {
+	if r.done || r.row == nil {
+		return io.EOF
+	}
+	for i, v := range r.row {
+		dest[i] = v
+	}
+	r.done = true
+	return nil
+}
+
+// captureMySQL is a NullMySQL with a real DB() backed by captureDriver.
+type captureMySQL struct {
+	*mock.NullMySQL
+	db *sql.DB
+}
+
+func newCaptureMySQL() *captureMySQL {
+	db, _ := sql.Open("instance-capture", "")
+	return &captureMySQL{
+		NullMySQL: mock.NewNullMySQL(),
+		db:        db,
+	}
+}
+
+func (c *captureMySQL) DB() *sql.DB {
+	return c.db
+}
+
+func (s *ManagerTestSuite) TestGetInfoQueryTag(t *C) {
+	t.Check(instance.QueryTag("", "getinfo"), Equals, "/* percona-agent getinfo */")
+	t.Check(instance.QueryTag("mysql-1", ""), Equals, "/* percona-agent mysql-1 */")
+	t.Check(instance.QueryTag("mysql-1*/ DROP", "getinfo"), Equals, "/* percona-agent mysql-1* / DROP getinfo */")
+
+	// MySQL 5.7 so the password expiry is checked, too.
+	defer capture.Set(captureRow, nil)
+	capture.Set([]string{"db1", "3306", "Percona Server", "5.7.10"}, nil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+
+	mysqlData, err := json.Marshal(&proto.MySQLInstance{Id: 9, DSN: "user:pass@tcp(127.0.0.1:3306)/"})
+	t.Assert(err, IsNil)
+	serviceData, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", Instance: mysqlData})
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		Cmd:     "GetInfo",
+		Service: "instance",
+		Data:    serviceData,
+	}
+
+	n := len(capture.Queries())
+	reply := m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+	got := &proto.MySQLInstance{}
+	err = json.Unmarshal(reply.Data, got)
+	t.Assert(err, IsNil)
+	t.Check(got.Hostname, Equals, "db1")
+
+	// All queries, not just the info query, are tagged with the instance name.
+	queries := capture.Queries()[n:]
+	t.Assert(len(queries) > 1, Equals, true)
+	t.Check(strings.HasPrefix(queries[0], "SELECT /* percona-agent mysql-9 getinfo */ "), Equals, true,
+		Commentf("%s", queries[0]))
+	for _, q := range queries {
+		t.Check(strings.Contains(q, "/* percona-agent mysql-9 getinfo */"), Equals, true, Commentf("%s", q))
+	}
+	var checked []string
+	for _, q := range queries {
+		switch {
+		case strings.Contains(q, "mysql.user"):
+			checked = append(checked, "password")
+		case strings.Contains(q, "@@GLOBAL.log_bin"):
+			checked = append(checked, "binlog")
+		case strings.Contains(q, "SLAVE STATUS"):
+			checked = append(checked, "replication")
+		}
+	}
+	t.Check(checked, DeepEquals, []string{"password", "binlog", "replication"})
+}
+
+func (s *ManagerTestSuite) TestGetMySQLInfoPort(t *C) {
+	defer capture.Set(captureRow, nil)
+	conn := newCaptureMySQL()
+
+	ports := []struct {
+		port     string
+		hostname string
+	}{
+		{"3306", "db1"},
+		{"3307", "db1.3307"},
+		{"33060", "db1.33060"},
+	}
+	for _, p := range ports {
+		capture.Set([]string{"db1", p.port, "Percona Server", "5.6.22"}, nil)
+		it := &proto.MySQLInstance{}
+		err := instance.GetMySQLInfo(conn, it, "", 0)
+		t.Assert(err, IsNil)
+		t.Check(it.Hostname, Equals, p.hostname)
+		t.Check(it.Distro, Equals, "Percona Server")
+		t.Check(it.Version, Equals, "5.6.22")
+
+		hostname, port := instance.SplitMySQLHostname(it.Hostname)
+		t.Check(hostname, Equals, "db1")
+		t.Check(fmt.Sprintf("%d", port), Equals, p.port)
+	}
+
+	// Hostname and port are separate columns, not CONCAT_WS('.', ...).
+	queries := capture.Queries()
+	t.Check(strings.Contains(queries[len(queries)-1], "@@port AS Port"), Equals, true)
+
+	// A trailing number that isn't a port is part of the hostname.
+	hostname, port := instance.SplitMySQLHostname("db.070000")
+	t.Check(hostname, Equals, "db.070000")
+	t.Check(port, Equals, uint(instance.DEFAULT_MYSQL_PORT))
+	hostname, port = instance.SplitMySQLHostname("db.3306")
+	t.Check(hostname, Equals, "db.3306")
+	t.Check(port, Equals, uint(instance.DEFAULT_MYSQL_PORT))
+}
+
+func (s *ManagerTestSuite) TestGetMySQLInfoTimeout(t *C) {
+	block := make(chan struct{})
+	capture.Block(block)
+	defer capture.Block(nil)
+	defer close(block)
+
+	// MySQL never responds: the info isn't changed.
+	it := &proto.MySQLInstance{Hostname: "old"}
+	t0 := time.Now()
+	err := instance.GetMySQLInfo(newCaptureMySQL(), it, "", 100*time.Millisecond)
+	d := time.Now().Sub(t0)
+	t.Check(err, NotNil)
+	t.Check(d >= 100*time.Millisecond && d < 1*time.Second, Equals, true, Commentf("took %s", d))
+	t.Check(it.Hostname, Equals, "old")
+
+	// Start doesn't wait for it either.
+	err = ioutil.WriteFile(s.configDir+"/mysql-1.conf", []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`), 0600)
+	t.Assert(err, IsNil)
+	m := instance.NewManager(s.logger, s.configDir, s.api, mock.NewMrmsMonitor(), 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	m.InfoTimeout = 100 * time.Millisecond
+	m.StartTimeout = 0 // wait for all instances
+	t0 = time.Now()
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	d = time.Now().Sub(t0)
+	t.Check(d < 1*time.Second, Equals, true, Commentf("Start took %s", d))
+}
+
+func (s *ManagerTestSuite) TestPasswordExpiry(t *C) {
+	defer capture.Set(captureRow, nil)
+	conn := newCaptureMySQL()
+
+	// MySQL < 5.7.4 doesn't expire passwords.
+	conn.SetAtLeastVersion(false, nil)
+	got, err := instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, IsNil)
+
+	conn.SetAtLeastVersion(true, nil)
+
+	// Never expires.
+	capture.Set([]string{"N", "0", "500"}, nil)
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, &instance.PasswordExpiry{})
+	t.Check(got.Warning(), Equals, "")
+
+	// Expires, but not soon.
+	capture.Set([]string{"N", "360", "30"}, nil)
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, &instance.PasswordExpiry{Lifetime: 360, DaysLeft: 330})
+	t.Check(got.Warning(), Equals, "")
+
+	// Soon to expire.
+	capture.Set([]string{"N", "360", "357"}, nil)
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, &instance.PasswordExpiry{Lifetime: 360, DaysLeft: 3})
+	t.Check(got.Warning(), Equals, "MySQL password expires in 3 days")
+
+	// Lifetime passed, but MySQL hasn't set password_expired yet.
+	capture.Set([]string{"N", "360", "400"}, nil)
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, &instance.PasswordExpiry{Expired: true, Lifetime: 360})
+	t.Check(got.Warning(), Equals, "MySQL password has expired")
+
+	// Expired manually (ALTER USER ... PASSWORD EXPIRE).
+	capture.Set([]string{"Y", "0", "10"}, nil)
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got.Warning(), Equals, "MySQL password has expired")
+
+	// No privs to read mysql.user isn't an error.
+	capture.Set(nil, &mysqlDriver.MySQLError{Number: mysql.ER_USER_DENIED, Message: "SELECT command denied"})
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, IsNil)
+
+	// Other errors are.
+	capture.Set(nil, errors.New("lost connection"))
+	got, err = instance.GetPasswordExpiry(conn, "")
+	t.Check(err, NotNil)
+	t.Check(got, IsNil)
+}
+
+func (s *ManagerTestSuite) TestGetInfoWarnsPasswordExpiry(t *C) {
+	defer capture.Set(captureRow, nil)
+
+	logChan := make(chan *proto.LogEntry, 100)
+	logger := pct.NewLogger(logChan, "instance-test")
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	conn := newCaptureMySQL()
+	m.ConnFactory = &mock.ConnectionFactory{Conn: conn}
+
+	mysqlData, err := json.Marshal(&proto.MySQLInstance{Id: 9, DSN: "user:pass@tcp(127.0.0.1:3306)/"})
+	t.Assert(err, IsNil)
+	serviceData, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", Instance: mysqlData})
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		Cmd:     "GetInfo",
+		Service: "instance",
+		Data:    serviceData,
+	}
+
+	capture.Set([]string{"Y", "0", "10"}, nil)
+	// Password expiry is only checked on MySQL 5.7 and newer.
+	capture.SetQuery("@@hostname", []string{"db1", "3306", "Percona Server", "5.7.10"})
+	conn.SetAtLeastVersion(true, nil)
+	reply := m.Handle(cmd)
+	t.Assert(reply.Error, Equals, "")
+
+	var warnings []string
+	for _, entry := range test.WaitLogChan(logChan, 100) {
+		if entry.Level == proto.LOG_WARNING {
+			warnings = append(warnings, entry.Msg)
+		}
+	}
+	t.Check(warnings, DeepEquals, []string{"MySQL password has expired: user:" + mysql.HiddenPassword + "@tcp(127.0.0.1:3306)/"})
+}
+
+func (s *ManagerTestSuite) TestForcePush(t *C) {
+	files := map[string]string{
+		"mysql-1.conf": `{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`,
+		"mysql-2.conf": `{"Id":2,"DSN":"user:pass@tcp(127.0.0.1:3307)/"}`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
+	}
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+	err := m.Repo().Init()
+	t.Assert(err, IsNil)
+	defer func() { s.api.PutCode = nil }()
+
+	forcePush := func(id uint) *proto.Reply {
+		data, err := json.Marshal(&proto.ServiceInstance{Service: "mysql", InstanceId: id})
+		t.Assert(err, IsNil)
+		return m.Handle(&proto.Cmd{Cmd: "ForcePush", Service: "instance", Data: data})
+	}
+
+	// Info doesn't change, but every ForcePush pushes it.
+	s.api.PutCode = []int{200, 200, 200}
+	reply := forcePush(1)
+	t.Check(reply.Error, Equals, "")
+	reply = forcePush(1)
+	t.Check(reply.Error, Equals, "")
+	t.Check(s.api.PutCode, HasLen, 1)
+
+	// Zero ID pushes all instances, even if one fails.
+	s.api.PutCode = []int{404, 200}
+	reply = forcePush(0)
+	t.Check(reply.Error, Matches, "Failed to push mysql-1: .*404.*")
+	t.Check(s.api.PutCode, HasLen, 0)
+
+	// Unknown instance.
+	reply = forcePush(3)
+	t.Check(reply.Error, Not(Equals), "")
+}
+
+func (s *ManagerTestSuite) TestGetReplicationInfo(t *C) {
+	defer capture.Set(captureRow, nil)
+	conn := newCaptureMySQL()
+
+	// Not a replica: SHOW SLAVE STATUS returns no rows.
+	capture.Set(nil, nil)
+	got, err := instance.GetReplicationInfo(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]string{
+		"read_only": "false",
+		"replica":   "false",
+	})
+
+	// Read-only replica.
+	conn.SetGlobalVarNumber("read_only", 1)
+	capture.SetColumns(
+		[]string{"Slave_IO_State", "Master_Host", "Master_User", "Master_Port"},
+		[]string{"Waiting for master to send event", "10.1.1.1", "repl", "3306"},
+		nil,
+	)
+	got, err = instance.GetReplicationInfo(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]string{
+		"read_only":   "true",
+		"replica":     "true",
+		"master_host": "10.1.1.1",
+	})
+
+	// super_read_only implies read_only.
+	conn.SetGlobalVarNumber("read_only", 0)
+	conn.SetGlobalVarNumber("super_read_only", 1)
+	got, err = instance.GetReplicationInfo(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got["read_only"], Equals, "true")
+
+	// No privs for SHOW SLAVE STATUS: replica is unknown.
+	capture.Set(nil, &mysqlDriver.MySQLError{Number: mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, Message: "Access denied"})
+	got, err = instance.GetReplicationInfo(conn, "")
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, map[string]string{
+		"read_only": "true",
+	})
+
+	// Other errors are errors.
+	capture.Set(nil, errors.New("lost connection"))
+	got, err = instance.GetReplicationInfo(conn, "")
+	t.Check(err, NotNil)
+	t.Check(got, IsNil)
+}
+
+func (s *ManagerTestSuite) TestHandleAddBatch(t *C) {
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+	m.ConnFactory = &mock.ConnectionFactory{Conn: newCaptureMySQL()}
+
+	its := []proto.ServiceInstance{
+		{Service: "mysql", InstanceId: 1, Instance: []byte(`{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`)},
+		{Service: "mysql", InstanceId: 2, Instance: []byte(`{"Id":2,"DSN":""}`)}, // invalid
+		{Service: "mysql", InstanceId: 3, Instance: []byte(`{"Id":3,"DSN":"user:pass@tcp(127.0.0.1:3307)/"}`)},
+	}
+	data, err := json.Marshal(its)
+	t.Assert(err, IsNil)
+	cmd := &proto.Cmd{
+		Cmd:     "Add",
+		Service: "instance",
+		Data:    data,
+	}
+
+	reply := m.Handle(cmd)
+	t.Check(reply.Error, Equals, "mysql-2: Invalid instance mysql-2: DSN is not set")
+
+	var got []instance.AddResult
+	err = json.Unmarshal(reply.Data, &got)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, []instance.AddResult{
+		{Service: "mysql", InstanceId: 1},
+		{Service: "mysql", InstanceId: 2, Error: "Invalid instance mysql-2: DSN is not set"},
+		{Service: "mysql", InstanceId: 3},
+	})
+
+	// The bad instance doesn't stop the others from being added.
+	t.Check(m.Repo().ListByType("mysql"), DeepEquals, []uint{1, 3})
+	t.Check(test.FileExists(s.configDir+"/mysql-1.conf"), Equals, true)
+	t.Check(test.FileExists(s.configDir+"/mysql-2.conf"), Equals, false)
+	t.Check(test.FileExists(s.configDir+"/mysql-3.conf"), Equals, true)
+}
+
+func (s *ManagerTestSuite) TestServicesForInstance(t *C) {
+	files := map[string]string{
+		"mysql-1.conf":           `{"Id":1,"DSN":"user:pass@tcp(127.0.0.1:3306)/"}`,
+		"mysql-2.conf":           `{"Id":2,"DSN":"user:pass@tcp(127.0.0.1:3307)/"}`,
+		"agent.conf":             `{"AgentUuid":"abc-123-def"}`,
+		"qan.conf":               `{"Service":"mysql","InstanceId":1,"CollectFrom":"slowlog"}`,
+		"mm-mysql-1.conf":        `{"Service":"mysql","InstanceId":1}`,
+		"sysconfig-mysql-1.conf": `{"Service":"mysql","InstanceId":1}`,
+		"mm-mysql-2.conf":        `{"Service":"mysql","InstanceId":2}`,
+		"mm-server-1.conf":       `{"Service":"server","InstanceId":1}`,
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(s.configDir+"/"+file, []byte(data), 0600)
+		t.Assert(err, IsNil)
+	}
+
+	mrm := mock.NewMrmsMonitor()
+	m := instance.NewManager(s.logger, s.configDir, s.api, mrm, 0)
+	t.Assert(m, NotNil)
+
+	t.Check(m.ServicesForInstance("mysql", 1), DeepEquals, []string{"mm", "qan", "sysconfig"})
+	t.Check(m.ServicesForInstance("mysql", 2), DeepEquals, []string{"mm"})
+	t.Check(m.ServicesForInstance("server", 1), DeepEquals, []string{"mm"})
+	t.Check(m.ServicesForInstance("mysql", 3), DeepEquals, []string{})
+
+	// Stopping a service removes its config.
+	err := os.Remove(s.configDir + "/mm-mysql-1.conf")
+	t.Assert(err, IsNil)
+	t.Check(m.ServicesForInstance("mysql", 1), DeepEquals, []string{"qan", "sysconfig"})
+
+	// Starting one writes it.
+	err = ioutil.WriteFile(s.configDir+"/qan.conf", []byte(`{"Service":"mysql","InstanceId":2}`), 0600)
+	t.Assert(err, IsNil)
+	t.Check(m.ServicesForInstance("mysql", 1), DeepEquals, []string{"sysconfig"})
+	t.Check(m.ServicesForInstance("mysql", 2), DeepEquals, []string{"mm", "qan"})
 }
@@ -0,0 +1,121 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/percona/percona-agent/pct"
+)
+
+// Instance labels, like env=prod or role=primary, group instances so other
+// services can select them with ListByLabel.  Instance configs are defined by
+// the API, so labels are saved separately in this file, keyed on instance name.
+const LABELS_FILE = "instance-labels.conf"
+
+func (r *Repo) loadLabels() error {
+	r.labels = make(map[string]map[string]string)
+	file := filepath.Join(r.configDir, LABELS_FILE)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, &r.labels); err != nil {
+		return errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+	}
+	r.logger.Info("Loaded " + file)
+	return nil
+}
+
+func (r *Repo) writeLabels() error {
+	// Do NOT lock here.  Expect caller to lock.
+	data, err := json.MarshalIndent(r.labels, "", "    ")
+	if err != nil {
+		return err
+	}
+	return pct.WriteFileAtomic(filepath.Join(r.configDir, LABELS_FILE), data, 0600)
+}
+
+// SetLabel sets the instance label key to value, or removes it if value is
+// empty, and saves the labels to LABELS_FILE.
+func (r *Repo) SetLabel(service string, id uint, key, value string) error {
+	if key == "" {
+		return errors.New("Label key is empty")
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	name := r.Name(service, id)
+	if _, ok := r.it[name]; !ok {
+		return pct.UnknownServiceInstanceError{Service: service, Id: id}
+	}
+	labels := r.labels[name]
+	if value == "" {
+		if _, ok := labels[key]; !ok {
+			return nil
+		}
+		delete(labels, key)
+		if len(labels) == 0 {
+			delete(r.labels, name)
+		}
+	} else {
+		if labels == nil {
+			labels = make(map[string]string)
+			r.labels[name] = labels
+		}
+		labels[key] = value
+	}
+	return r.writeLabels()
+}
+
+// Labels returns a copy of the instance's labels.
+func (r *Repo) Labels(service string, id uint) map[string]string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	labels := make(map[string]string)
+	for k, v := range r.labels[r.Name(service, id)] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// ListByLabel returns the names, sorted, of instances with the label key set
+// to value.  Instances without the label are not returned.
+func (r *Repo) ListByLabel(key, value string) []string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	names := []string{}
+	for name, labels := range r.labels {
+		if _, ok := r.it[name]; !ok {
+			continue
+		}
+		if v, ok := labels[key]; ok && v == value {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
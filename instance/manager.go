@@ -18,10 +18,18 @@
 package instance
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/percona/percona-agent/agent"
 
@@ -33,6 +41,18 @@ import (
 	"github.com/percona/percona-agent/pct"
 )
 
+const (
+	DEFAULT_PUSH_ATTEMPTS      = 3
+	DEFAULT_PUSH_BACKOFF       = 1 * time.Second
+	DEFAULT_MRMS_GLOBAL_BUFFER = 100
+	DEFAULT_MYSQL_PORT         = 3306
+	DEFAULT_START_TIMEOUT      = 30 * time.Second
+	DEFAULT_MRMS_RESTART_DELAY = 5 * time.Second
+	MAX_MRMS_RESTARTS          = 5
+	DEFAULT_CONN_IDLE_TIMEOUT  = 5 * time.Minute
+	DEFAULT_INFO_TIMEOUT       = 10 * time.Second
+)
+
 type empty struct{}
 
 type Manager struct {
@@ -42,25 +62,90 @@ type Manager struct {
 	// --
 	status         *pct.Status
 	repo           *Repo
-	stopChan       chan empty
+	stopChan       chan empty // closed by Stop, see stop
+	doneChan       chan empty
+	running        bool
+	runMux         *sync.Mutex // stopChan and running
 	mrm            mrms.Monitor
-	mrmChans       map[string]<-chan bool
-	mrmsGlobalChan chan string
+	mrmChans       map[string]<-chan mrms.RestartEvent
+	mrmMux         *sync.Mutex
+	mrmsGlobalChan chan mrms.RestartEvent
 	agentConfig    *agent.Config
+	repoLoaded     bool
+	// Retry PushInstanceInfo this many times, starting with this backoff.
+	PushAttempts int
+	PushBackoff  time.Duration
+	// Makes the connections used to get MySQL info and detect duplicates.
+	ConnFactory mysql.ConnectionFactory
+	// Connections used to get MySQL info are reused until they're idle this
+	// long.  Zero closes them after each use.
+	ConnIdleTimeout time.Duration
+	conns           *connCache
+	// Getting MySQL info fails after this long so a wedged MySQL doesn't stall
+	// the manager, e.g. Start.  Zero waits for MySQL.
+	InfoTimeout time.Duration
+	// Start returns after this long, leaving the instances it hasn't started
+	// to start in the background.  Zero waits for all instances.
+	StartTimeout time.Duration
+	// Get and push the info of all MySQL instances this often, if it changed,
+	// e.g. after MySQL is upgraded in place.  Zero disables it; instance info
+	// is still pushed on start and when MySQL restarts.
+	ResyncInterval time.Duration
+	// If handling MySQL restarts crashes, start again after this long, up to
+	// MAX_MRMS_RESTARTS times.
+	RestartDelay time.Duration
+	// When and what info was last pushed for each instance, keyed on instance name.
+	infoUpdated map[string]time.Time
+	infoPushed  map[string]proto.MySQLInstance
+	infoMux     *sync.Mutex
+}
+
+// ManagerStatus is the structured form of Manager.Status for tools that
+// parse agent status.
+type ManagerStatus struct {
+	Instances     int           // all instances, any type
+	MySQL         []MySQLStatus // sorted by ID
+	Subscriptions int           // MySQL restart monitor subscriptions
+	Monitor       string        // restart monitor goroutine state, e.g. "Idle"
+}
+
+type MySQLStatus struct {
+	Name           string     // e.g. mysql-1
+	DSN            string     // password hidden
+	LastInfoUpdate *time.Time `json:",omitempty"` // nil if not pushed yet
 }
 
-func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm mrms.Monitor) *Manager {
+// globalBuffer is how many MySQL restart events can be queued while the manager
+// is busy updating instance info, DEFAULT_MRMS_GLOBAL_BUFFER if zero.  When the
+// buffer is full, the restart monitor blocks up to 1s per event, then drops it.
+func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm mrms.Monitor, globalBuffer int) *Manager {
+	if globalBuffer <= 0 {
+		globalBuffer = DEFAULT_MRMS_GLOBAL_BUFFER
+	}
 	repo := NewRepo(pct.NewLogger(logger.LogChan(), "instance-repo"), configDir, api)
 	m := &Manager{
 		logger:    logger,
 		configDir: configDir,
 		api:       api,
 		// --
-		status:         pct.NewStatus([]string{"instance", "instance-repo", "instance-mrms"}),
-		repo:           repo,
-		mrm:            mrm,
-		mrmChans:       make(map[string]<-chan bool),
-		mrmsGlobalChan: make(chan string, 100), // monitor up to 100 instances
+		status:          pct.NewStatus([]string{"instance", "instance-repo", "instance-mrms", "instance-pending", "instance-info-updated", "agent-goroutines", "agent-heap-alloc", "agent-mysql-conns"}),
+		repo:            repo,
+		mrm:             mrm,
+		mrmChans:        make(map[string]<-chan mrms.RestartEvent),
+		mrmMux:          &sync.Mutex{},
+		runMux:          &sync.Mutex{},
+		mrmsGlobalChan:  make(chan mrms.RestartEvent, globalBuffer),
+		PushAttempts:    DEFAULT_PUSH_ATTEMPTS,
+		PushBackoff:     DEFAULT_PUSH_BACKOFF,
+		ConnFactory:     &mysql.RealConnectionFactory{},
+		StartTimeout:    DEFAULT_START_TIMEOUT,
+		RestartDelay:    DEFAULT_MRMS_RESTART_DELAY,
+		ConnIdleTimeout: DEFAULT_CONN_IDLE_TIMEOUT,
+		conns:           newConnCache(),
+		InfoTimeout:     DEFAULT_INFO_TIMEOUT,
+		infoUpdated:     make(map[string]time.Time),
+		infoPushed:      make(map[string]proto.MySQLInstance),
+		infoMux:         &sync.Mutex{},
 	}
 	return m
 }
@@ -71,50 +156,154 @@ func NewManager(logger *pct.Logger, configDir string, api pct.APIConnector, mrm
 
 // @goroutine[0]
 func (m *Manager) Start() error {
+	if m.isRunning() {
+		return nil
+	}
 	m.status.Update("instance", "Starting")
-	if err := m.repo.Init(); err != nil {
-		return err
+	// The repo keeps its instances when the manager stops, so load them only
+	// once, else restarting the manager re-adds them.
+	if !m.repoLoaded {
+		if err := m.repo.Init(); err != nil {
+			return err
+		}
+		m.repoLoaded = true
 	}
 	m.logger.Info("Started")
 	m.status.Update("instance", "Running")
 
-	mrmsGlobalChan, err := m.mrm.GlobalSubscribe()
-	if err != nil {
+	if err := m.mrm.GlobalSubscribe(m.mrmsGlobalChan); err != nil {
 		return err
 	}
 
-	for _, instance := range m.GetMySQLInstances() {
-		ch, err := m.mrm.Add(instance.DSN)
-		if err != nil {
+	// Getting MySQL info can be slow, so start the instances in the background
+	// and wait at most StartTimeout for them.  Stop interrupts it.
+	instances := m.GetMySQLInstances()
+	m.setPending(instances)
+	m.runMux.Lock()
+	m.stopChan = make(chan empty)
+	m.running = true
+	m.runMux.Unlock()
+	m.doneChan = make(chan empty)
+	started := make(chan empty)
+	go m.monitorInstancesRestart(m.mrmsGlobalChan, instances, started)
+	if m.StartTimeout > 0 {
+		select {
+		case <-started:
+		case <-time.After(m.StartTimeout):
+			m.logger.Warn(fmt.Sprintf("Instances not started after %s, starting them in the background: %s",
+				m.StartTimeout, m.status.Get("instance-pending")))
+		}
+	} else {
+		<-started
+	}
+
+	// Pick up instance files added, changed, or removed by admins.
+	if err := m.repo.Watch(m.instanceChanged); err != nil {
+		m.logger.Warn("Cannot watch instance files:", err)
+	}
+
+	return nil
+}
+
+// startInstances monitors the MySQL instances and gets their info, updating
+// instance-pending as each is started, and returns the ones to push.  It
+// returns early if the manager is stopped.
+func (m *Manager) startInstances(instances []*proto.MySQLInstance) []*proto.MySQLInstance {
+	if len(instances) > 1 {
+		m.status.Update("instance-mrms", "Checking for duplicate MySQL instances")
+		m.warnDuplicateMySQL(instances)
+	}
+
+	push := []*proto.MySQLInstance{}
+	for i, instance := range instances {
+		select {
+		case <-m.stop():
+			return push
+		default:
+		}
+		m.setPending(instances[i:])
+		if err := m.addMonitor(instance.DSN); err != nil {
 			m.logger.Error("Cannot add instance to the monitor:", err)
 			continue
 		}
-		safeDSN := mysql.HideDSNPassword(instance.DSN)
-		m.status.Update("instance", "Getting info "+safeDSN)
-		if err := GetMySQLInfo(instance); err != nil {
-			m.logger.Warn(fmt.Sprintf("Failed to get MySQL info %s: %s", safeDSN, err))
+		safeDSN := mysql.HideDSN(instance.DSN)
+		m.status.Update("instance-mrms", "Getting info "+safeDSN)
+		if err := m.getMySQLInfo(instance); err != nil {
+			m.warnMySQLInfo(safeDSN, err)
 			continue
 		}
-		m.status.Update("instance", "Updating info "+safeDSN)
-		m.pushInstanceInfo(instance)
-		// Store the channel to be able to remove it from mrms
-		m.mrmChans[instance.DSN] = ch
+		push = append(push, instance)
 	}
-	go m.monitorInstancesRestart(mrmsGlobalChan)
-	return nil
+	m.setPending(nil)
+	return push
+}
+
+// setPending reports the instances not started yet, see startInstances.
+func (m *Manager) setPending(instances []*proto.MySQLInstance) {
+	if len(instances) == 0 {
+		m.status.Update("instance-pending", "None")
+		return
+	}
+	names := make([]string, len(instances))
+	for i, it := range instances {
+		names[i] = m.repo.Name("mysql", it.Id)
+	}
+	m.status.Update("instance-pending", strings.Join(names, ", "))
 }
 
 // @goroutine[0]
 func (m *Manager) Stop() error {
-	// Can't stop the instance manager.
+	defer m.conns.closeAll()
+	if !m.isRunning() {
+		return nil
+	}
+	m.status.Update("instance", "Stopping")
+	m.repo.StopWatch()
+
+	// Unsubscribe first so MRMS doesn't block on events nobody will read,
+	// and stop monitoring the instances; Start adds them again.
+	m.mrm.GlobalUnsubscribe(m.mrmsGlobalChan)
+	m.mrmMux.Lock()
+	for dsn, ch := range m.mrmChans {
+		m.mrm.Remove(dsn, ch)
+		delete(m.mrmChans, dsn)
+	}
+	m.mrmMux.Unlock()
+
+	close(m.stop())
+	<-m.doneChan
+	m.runMux.Lock()
+	m.running = false
+	m.runMux.Unlock()
+	m.logger.Info("Stopped")
+	m.status.Update("instance", "Stopped")
 	return nil
 }
 
+func (m *Manager) isRunning() bool {
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	return m.running
+}
+
+// stop returns the chan that Stop closes.  It stays closed after Stop, so waits
+// like PushInstanceInfo retries from Handle return, until Start makes a new one.
+func (m *Manager) stop() chan empty {
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	return m.stopChan
+}
+
 // @goroutine[0]
 func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 	m.status.UpdateRe("instance", "Handling", cmd)
 	defer m.status.Update("instance", "Running")
 
+	// Add can have a list of instances.
+	if cmd.Cmd == "Add" && isJSONArray(cmd.Data) {
+		return m.handleAddBatch(cmd)
+	}
+
 	it := &proto.ServiceInstance{}
 	if err := json.Unmarshal(cmd.Data, it); err != nil {
 		return cmd.Reply(nil, err)
@@ -122,61 +311,32 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 	switch cmd.Cmd {
 	case "Add":
-		err := m.repo.Add(it.Service, it.InstanceId, it.Instance, true) // true = write to disk
-		if err != nil {
-			return cmd.Reply(nil, err)
-		}
-		if it.Service == "mysql" {
-			// Get the instance as type proto.MySQLInstance instead of proto.ServiceInstance
-			// because we need the dsn field
-			// We only return errors for repo.Add, not for mrm so all returns within this block
-			// will return nil, nil
-			iit := &proto.MySQLInstance{}
-			err := m.repo.Get(it.Service, it.InstanceId, iit)
-			if err != nil {
-				m.logger.Error(err)
-				return cmd.Reply(nil, nil)
-			}
-			ch, err := m.mrm.Add(iit.DSN)
-			if err != nil {
-				m.logger.Error(err)
-				return cmd.Reply(nil, nil)
-			}
-			m.mrmChans[iit.DSN] = ch
-
-			safeDSN := mysql.HideDSNPassword(iit.DSN)
-			m.status.Update("instance", "Getting info "+safeDSN)
-			if err := GetMySQLInfo(iit); err != nil {
-				m.logger.Warn(fmt.Sprintf("Failed to get MySQL info %s: %s", safeDSN, err))
-				return cmd.Reply(nil, nil)
-			}
-
-			m.status.Update("instance", "Updating info "+safeDSN)
-			err = m.pushInstanceInfo(iit)
-			if err != nil {
-				m.logger.Error(err)
-				return cmd.Reply(nil, nil)
-			}
-		}
-		return cmd.Reply(nil, nil)
+		err := m.handleAdd(it)
+		return cmd.Reply(nil, err)
 	case "Remove":
+		// Stop monitoring the instance before removing it.  mrms is keyed on
+		// DSN, so it's needed even if the instance can't be read from the repo.
+		dsn := ""
 		if it.Service == "mysql" {
-			// Get the instance as type proto.MySQLInstance instead of proto.ServiceInstance
-			// because we need the dsn field
-			iit := &proto.MySQLInstance{}
-			err := m.repo.Get(it.Service, it.InstanceId, iit)
-			// Don't return an error. This is just a remove from mrms
-			if err != nil {
-				m.logger.Error(err)
-			} else {
-				m.mrm.Remove(iit.DSN, m.mrmChans[iit.DSN])
+			dsn = m.removeDSN(it)
+		}
+		monitored := dsn != "" && m.removeMonitor(dsn)
+		if err := m.repo.Remove(it.Service, it.InstanceId); err != nil {
+			// A remove hook can fail and the instance is kept, so keep monitoring it.
+			if monitored && m.repo.Has(it.Service, it.InstanceId) {
+				if err := m.addMonitor(dsn); err != nil {
+					m.logger.Error("Cannot add instance to the monitor:", err)
+				}
 			}
+			return cmd.Reply(nil, err)
 		}
-		err := m.repo.Remove(it.Service, it.InstanceId)
-		return cmd.Reply(nil, err)
+		return cmd.Reply(nil)
 	case "GetInfo":
 		info, err := m.handleGetInfo(it.Service, it.Instance)
 		return cmd.Reply(info, err)
+	case "ForcePush":
+		err := m.forcePush(it.Service, it.InstanceId)
+		return cmd.Reply(nil, err)
 	default:
 		return cmd.Reply(nil, pct.UnknownCmdError{Cmd: cmd.Cmd})
 	}
@@ -184,9 +344,78 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 
 func (m *Manager) Status() map[string]string {
 	m.status.Update("instance-repo", strings.Join(m.repo.List(), " "))
+	m.status.Update("instance-info-updated", m.infoUpdatedStatus())
+
+	// The agent's own resource usage, to see if it leaks goroutines, memory,
+	// or MySQL connections.  ReadMemStats stops the world, but only briefly.
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	m.status.Update("agent-goroutines", fmt.Sprintf("%d", runtime.NumGoroutine()))
+	m.status.Update("agent-heap-alloc", fmt.Sprintf("%d", memStats.HeapAlloc))
+	m.status.Update("agent-mysql-conns", fmt.Sprintf("%d", mysql.OpenConnections()))
+
 	return m.status.All()
 }
 
+// GetLastUpdate returns when the info for the named instance, e.g. "mysql-1",
+// was last pushed to the API successfully, and false if it hasn't been pushed
+// since the manager was created.
+func (m *Manager) GetLastUpdate(name string) (time.Time, bool) {
+	m.infoMux.Lock()
+	defer m.infoMux.Unlock()
+	ts, ok := m.infoUpdated[name]
+	return ts, ok
+}
+
+// infoUpdatedStatus returns when each instance's info was last pushed, like
+// "mysql-1 at 2015-01-02T03:04:05Z, mysql-2 at ...", or "None".
+func (m *Manager) infoUpdatedStatus() string {
+	m.infoMux.Lock()
+	defer m.infoMux.Unlock()
+	if len(m.infoUpdated) == 0 {
+		return "None"
+	}
+	names := make([]string, 0, len(m.infoUpdated))
+	for name := range m.infoUpdated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	updated := make([]string, len(names))
+	for i, name := range names {
+		updated[i] = name + " at " + m.infoUpdated[name].Format(time.RFC3339)
+	}
+	return strings.Join(updated, ", ")
+}
+
+// StatusInfo returns the manager status as a struct instead of text.
+func (m *Manager) StatusInfo() *ManagerStatus {
+	status := &ManagerStatus{
+		Instances: len(m.repo.List()),
+		MySQL:     []MySQLStatus{},
+		Monitor:   m.status.Get("instance-mrms"),
+	}
+	for _, it := range m.GetMySQLInstances() {
+		name := m.repo.Name("mysql", it.Id)
+		mysqlStatus := MySQLStatus{
+			Name: name,
+			DSN:  mysql.HideDSN(it.DSN),
+		}
+		if ts, ok := m.GetLastUpdate(name); ok {
+			mysqlStatus.LastInfoUpdate = &ts
+		}
+		status.MySQL = append(status.MySQL, mysqlStatus)
+	}
+	m.mrmMux.Lock()
+	status.Subscriptions = len(m.mrmChans)
+	m.mrmMux.Unlock()
+	return status
+}
+
+// StatusJSON returns StatusInfo as JSON.
+func (m *Manager) StatusJSON() ([]byte, error) {
+	return json.Marshal(m.StatusInfo())
+}
+
 func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return nil, nil
 }
@@ -195,10 +424,256 @@ func (m *Manager) Repo() *Repo {
 	return m.repo
 }
 
+// Per-instance service configs are <service>-<instance service>-<id>.conf,
+// e.g. mm-mysql-1.conf.
+var serviceConfigRe = regexp.MustCompile(`^([a-z]+)-([a-z]+)-([1-9][0-9]*)$`)
+
+// ServicesForInstance returns the sorted names of the services, like qan and mm,
+// configured for the instance.  The config dir is the source of truth, so the
+// list is current as services write and remove their configs.  Other configs,
+// like qan.conf, are for the instance if their InstanceId is.
+func (m *Manager) ServicesForInstance(service string, id uint) []string {
+	files, err := filepath.Glob(filepath.Join(m.configDir, "*"+pct.CONFIG_FILE_SUFFIX))
+	if err != nil {
+		m.logger.Warn(err)
+		return nil
+	}
+	services := []string{}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), pct.CONFIG_FILE_SUFFIX)
+		if part := serviceConfigRe.FindStringSubmatch(name); part != nil {
+			if part[2] == service && part[3] == strconv.FormatUint(uint64(id), 10) {
+				services = append(services, part[1])
+			}
+			continue
+		}
+		if instanceFileRe.MatchString(filepath.Base(file)) {
+			continue // the instance itself
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		it := proto.ServiceInstance{}
+		if err := json.Unmarshal(data, &it); err != nil {
+			continue
+		}
+		if it.Service == service && it.InstanceId == id {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
 
+// An AddResult is returned for each instance in a batch Add.  Error is empty
+// if the instance was added.
+type AddResult struct {
+	Service    string
+	InstanceId uint
+	Error      string `json:",omitempty"`
+}
+
+func isJSONArray(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// handleAddBatch adds every instance in the list, even if some fail.  The reply
+// has an AddResult for every instance and the errors of the failed ones.
+func (m *Manager) handleAddBatch(cmd *proto.Cmd) *proto.Reply {
+	its := []proto.ServiceInstance{}
+	if err := json.Unmarshal(cmd.Data, &its); err != nil {
+		return cmd.Reply(nil, err)
+	}
+	results := make([]AddResult, len(its))
+	errs := []error{}
+	for i := range its {
+		results[i] = AddResult{Service: its[i].Service, InstanceId: its[i].InstanceId}
+		if err := m.handleAdd(&its[i]); err != nil {
+			results[i].Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %s", m.repo.Name(its[i].Service, its[i].InstanceId), err))
+		}
+	}
+	return cmd.Reply(results, errs...)
+}
+
+// handleAdd returns an error only if the instance can't be added to the repo.
+// Monitoring MySQL restarts and pushing MySQL info are best-effort.  Instances
+// of unsupported types are rejected unless the repo allows passthrough, in which
+// case they're only stored.
+func (m *Manager) handleAdd(it *proto.ServiceInstance) error {
+	_, supported := proto.ExternalService[it.Service]
+	if !supported && !m.repo.Passthrough() {
+		return unsupportedServiceError(it.Service)
+	}
+	err := m.repo.Add(it.Service, it.InstanceId, it.Instance, true) // true = write to disk
+	if err != nil {
+		return err
+	}
+	if !supported {
+		m.logger.Info(fmt.Sprintf("Stored %s without monitoring: unsupported instance type %s",
+			m.repo.Name(it.Service, it.InstanceId), it.Service))
+		return nil
+	}
+	if it.Service != "mysql" {
+		return nil
+	}
+
+	// Get the instance as type proto.MySQLInstance instead of proto.ServiceInstance
+	// because we need the dsn field
+	iit := &proto.MySQLInstance{}
+	if err := m.repo.Get(it.Service, it.InstanceId, iit); err != nil {
+		m.logger.Error(err)
+		return nil
+	}
+	if err := m.addMonitor(iit.DSN); err != nil {
+		m.logger.Error(err)
+		return nil
+	}
+
+	safeDSN := mysql.HideDSN(iit.DSN)
+	m.status.Update("instance", "Getting info "+safeDSN)
+	if err := m.getMySQLInfo(iit); err != nil {
+		m.warnMySQLInfo(safeDSN, err)
+		return nil
+	}
+
+	m.status.Update("instance", "Updating info "+safeDSN)
+	if err := m.PushInstanceInfo(iit); err != nil {
+		m.logger.Error(err)
+	}
+	return nil
+}
+
+func (m *Manager) addMonitor(dsn string) error {
+	m.mrmMux.Lock()
+	defer m.mrmMux.Unlock()
+	if _, ok := m.mrmChans[dsn]; ok {
+		return nil // already monitored
+	}
+	ch, err := m.mrm.Add(dsn)
+	if err != nil {
+		return err
+	}
+	// Store the channel to be able to remove it from mrms
+	m.mrmChans[dsn] = ch
+	return nil
+}
+
+// removeMonitor stops monitoring the DSN and returns true if it was monitored.
+func (m *Manager) removeMonitor(dsn string) bool {
+	m.mrmMux.Lock()
+	defer m.mrmMux.Unlock()
+	ch, ok := m.mrmChans[dsn]
+	if !ok {
+		return false
+	}
+	m.mrm.Remove(dsn, ch)
+	delete(m.mrmChans, dsn)
+	return true
+}
+
+// removeDSN returns the DSN of the MySQL instance being removed: from the repo,
+// else from the info last pushed, else from the Remove cmd.  It returns an
+// empty string if the DSN isn't known.  An instance the repo doesn't have isn't
+// Get from the API.
+func (m *Manager) removeDSN(it *proto.ServiceInstance) string {
+	if m.repo.Has(it.Service, it.InstanceId) {
+		iit := &proto.MySQLInstance{}
+		if err := m.repo.Get(it.Service, it.InstanceId, iit); err != nil {
+			m.logger.Error(err)
+		} else if iit.DSN != "" {
+			return iit.DSN
+		}
+	}
+	m.infoMux.Lock()
+	pushed, ok := m.infoPushed[m.repo.Name(it.Service, it.InstanceId)]
+	m.infoMux.Unlock()
+	if ok && pushed.DSN != "" {
+		return pushed.DSN
+	}
+	if len(it.Instance) > 0 {
+		iit := &proto.MySQLInstance{}
+		if err := json.Unmarshal(it.Instance, iit); err == nil {
+			return iit.DSN
+		}
+	}
+	return ""
+}
+
+// ResyncMRMS makes the MRMS monitored set match the MySQL instances in the repo,
+// adding and removing monitors as needed, for instances added or removed
+// without Handle, e.g. by editing the repo directly.
+func (m *Manager) ResyncMRMS() error {
+	m.logger.Debug("ResyncMRMS:call")
+	defer m.logger.Debug("ResyncMRMS:return")
+
+	inRepo := make(map[string]bool)
+	for _, it := range m.GetMySQLInstances() {
+		inRepo[it.DSN] = true
+	}
+
+	m.mrmMux.Lock()
+	monitored := []string{}
+	for dsn := range m.mrmChans {
+		monitored = append(monitored, dsn)
+	}
+	m.mrmMux.Unlock()
+
+	for _, dsn := range monitored {
+		if !inRepo[dsn] {
+			m.removeMonitor(dsn)
+		}
+	}
+
+	dsns := []string{}
+	for dsn := range inRepo {
+		dsns = append(dsns, dsn)
+	}
+	sort.Strings(dsns)
+	errs := []string{}
+	for _, dsn := range dsns {
+		if err := m.addMonitor(dsn); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", mysql.HideDSN(dsn), err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("Cannot add instances to the monitor: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// instanceChanged is called by the repo watcher to keep MRMS in sync with
+// instance files changed outside the agent.
+func (m *Manager) instanceChanged(change InstanceChange) {
+	if change.Service != "mysql" {
+		return
+	}
+	var oldDSN, newDSN string
+	if it, ok := change.Old.(*proto.MySQLInstance); ok {
+		oldDSN = it.DSN
+	}
+	if it, ok := change.New.(*proto.MySQLInstance); ok {
+		newDSN = it.DSN
+	}
+	if oldDSN == newDSN {
+		return
+	}
+	if oldDSN != "" {
+		m.removeMonitor(oldDSN)
+	}
+	if newDSN != "" {
+		if err := m.addMonitor(newDSN); err != nil {
+			m.logger.Error("Cannot add instance to the monitor:", err)
+		}
+	}
+}
+
 func (m *Manager) handleGetInfo(service string, data []byte) (interface{}, error) {
 	switch service {
 	case "mysql":
@@ -209,33 +684,222 @@ func (m *Manager) handleGetInfo(service string, data []byte) (interface{}, error
 		if it.DSN == "" {
 			return nil, fmt.Errorf("MySQL instance DSN is not set")
 		}
-		if err := GetMySQLInfo(it); err != nil {
+		conn := m.ConnFactory.Make(it.DSN)
+		if err := conn.Connect(1); err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		tag := m.queryTag(it)
+		if err := GetMySQLInfo(conn, it, tag, m.InfoTimeout); err != nil {
+			return nil, err
+		}
+		tconn := newTaggedConn(conn, tag, it.Version)
+		m.warnPasswordExpiry(tconn, tag, it)
+		info := &MySQLInfo{MySQLInstance: *it, Properties: map[string]string{}}
+		// Binlog and replication info are optional: don't fail GetInfo if they
+		// can't be gathered.
+		props, err := GetBinlogInfo(tconn)
+		if err != nil {
+			m.logger.Warn(fmt.Sprintf("Failed to get binlog info for %s: %s", mysql.HideDSN(it.DSN), err))
+		}
+		for k, v := range props {
+			info.Properties[k] = v
+		}
+		for k, v := range GetSQLModeInfo(tconn) {
+			info.Properties[k] = v
+		}
+		props, err = GetReplicationInfo(tconn, tag)
+		if err != nil {
+			m.logger.Warn(fmt.Sprintf("Failed to get replication info for %s: %s", mysql.HideDSN(it.DSN), err))
+		}
+		for k, v := range props {
+			info.Properties[k] = v
+		}
+		return info, nil
+	case "server":
+		it := &proto.ServerInstance{}
+		if err := json.Unmarshal(data, it); err != nil {
+			return nil, errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+		}
+		info := &ServerInfo{ServerInstance: *it}
+		if err := GetServerInfo(info); err != nil {
 			return nil, err
 		}
-		return it, nil
+		return info, nil
 	default:
-		return nil, fmt.Errorf("Don't know how to get info for %s service", service)
+		return nil, unsupportedServiceError(service)
 	}
 }
 
-func GetMySQLInfo(it *proto.MySQLInstance) error {
-	conn := mysql.NewConnection(it.DSN)
-	if err := conn.Connect(1); err != nil {
+// unsupportedServiceError returns an error naming the unsupported instance type
+// and the supported ones, i.e. proto.ExternalService.
+func unsupportedServiceError(service string) error {
+	supported := []string{}
+	for s, _ := range proto.ExternalService {
+		supported = append(supported, s)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("Unsupported instance type '%s': supported types are %s", service, strings.Join(supported, ", "))
+}
+
+// MySQLInfo is a MySQL instance plus the extra properties returned by GetInfo,
+// e.g. binlog.* from GetBinlogInfo, sql_mode from GetSQLModeInfo, and read_only
+// from GetReplicationInfo.
+type MySQLInfo struct {
+	proto.MySQLInstance
+	Properties map[string]string `json:",omitempty"`
+}
+
+func (m *Manager) getMySQLInfo(it *proto.MySQLInstance) error {
+	cc, err := m.conns.get(m.ConnFactory, it.DSN)
+	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	sql := "SELECT /* percona-agent */" +
-		" CONCAT_WS('.', @@hostname, IF(@@port='3306',NULL,@@port)) AS Hostname," +
+	conn := cc.conn
+	tag := m.queryTag(it)
+	if err := GetMySQLInfo(conn, it, tag, m.InfoTimeout); err != nil {
+		// The connection may be broken, e.g. MySQL restarted, so don't reuse it.
+		m.conns.release(it.DSN, cc, m.ConnIdleTimeout, true)
+		return err
+	}
+	m.warnPasswordExpiry(newTaggedConn(conn, tag, it.Version), tag, it)
+	m.conns.release(it.DSN, cc, m.ConnIdleTimeout, false)
+	return nil
+}
+
+// queryTag returns the QueryTag for getting info about the MySQL instance.
+// Instances not added yet have no ID, so they have no name in the tag.
+func (m *Manager) queryTag(it *proto.MySQLInstance) string {
+	name := ""
+	if it.Id != 0 {
+		name = m.Repo().Name("mysql", it.Id)
+	}
+	return QueryTag(name, "getinfo")
+}
+
+// warnPasswordExpiry warns if the agent can't connect to MySQL soon because its
+// password expires.  Failing to check isn't an error.
+func (m *Manager) warnPasswordExpiry(conn mysql.Connector, tag string, it *proto.MySQLInstance) {
+	safeDSN := mysql.HideDSN(it.DSN)
+	expiry, err := GetPasswordExpiry(conn, tag)
+	if err != nil {
+		m.logger.Debug(fmt.Sprintf("Cannot check password expiry for %s: %s", safeDSN, err))
+		return
+	}
+	if expiry == nil {
+		return
+	}
+	if warning := expiry.Warning(); warning != "" {
+		m.logger.Warn(warning + ": " + safeDSN)
+	}
+}
+
+// warnMySQLInfo logs that getMySQLInfo failed, with the class of the error and
+// a hint how to fix it if it's a common connection error.
+func (m *Manager) warnMySQLInfo(safeDSN string, err error) {
+	fields := map[string]interface{}{"dsn": safeDSN, "error": err}
+	if connErr := mysql.ClassifyConnError(err); connErr.Class != "" {
+		fields["class"] = connErr.Class
+		fields["hint"] = connErr.Hint
+	}
+	m.logger.WithFields(fields).Warn("Failed to get MySQL info")
+}
+
+// GetMySQLInfo sets the hostname, distro, and version of the MySQL instance
+// conn is connected to.  tag is the QueryTag for the query.  If MySQL doesn't
+// return the info within timeout, it returns an error and it isn't changed.
+// Zero timeout waits for MySQL.
+func GetMySQLInfo(conn mysql.Connector, it *proto.MySQLInstance, tag string, timeout time.Duration) error {
+	sql := "SELECT " + tag +
+		" @@hostname AS Hostname," +
+		" @@port AS Port," +
 		" @@version_comment AS Distro," +
 		" @@version AS Version"
-	err := conn.DB().QueryRow(sql).Scan(
-		&it.Hostname,
-		&it.Distro,
-		&it.Version,
-	)
+	type info struct {
+		hostname string
+		port     uint
+		distro   string
+		version  string
+		err      error
+	}
+	infoChan := make(chan info, 1)
+	go func() {
+		var i info
+		i.err = conn.DB().QueryRow(sql).Scan(
+			&i.hostname,
+			&i.port,
+			&i.distro,
+			&i.version,
+		)
+		infoChan <- i
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case i := <-infoChan:
+		if i.err != nil {
+			return i.err
+		}
+		it.Hostname = MySQLHostname(i.hostname, i.port)
+		it.Distro = i.distro
+		it.Version = i.version
+		return nil
+	case <-expired:
+		return fmt.Errorf("Timeout getting MySQL info after %s", timeout)
+	}
+}
+
+// MySQLHostname returns the name of a MySQL instance: its hostname, plus
+// ".port" if the port isn't DEFAULT_MYSQL_PORT, e.g. "db1" or "db1.3307".
+func MySQLHostname(hostname string, port uint) string {
+	if port == 0 || port == DEFAULT_MYSQL_PORT {
+		return hostname
+	}
+	return fmt.Sprintf("%s.%d", hostname, port)
+}
+
+// SplitMySQLHostname is the inverse of MySQLHostname.  The port is
+// DEFAULT_MYSQL_PORT if name doesn't end with one.
+func SplitMySQLHostname(name string) (string, uint) {
+	i := strings.LastIndex(name, ".")
+	if i <= 0 {
+		return name, DEFAULT_MYSQL_PORT
+	}
+	port, err := strconv.ParseUint(name[i+1:], 10, 16)
+	if err != nil || port == 0 || port == DEFAULT_MYSQL_PORT || strings.HasPrefix(name[i+1:], "0") {
+		return name, DEFAULT_MYSQL_PORT
+	}
+	return name[:i], uint(port)
+}
+
+// ServerInfo is a server instance plus the OS info returned by GetInfo.
+type ServerInfo struct {
+	proto.ServerInstance
+	FQDN      string
+	OS        string // runtime.GOOS
+	Distro    string // PRETTY_NAME from /etc/os-release
+	Kernel    string // uname -r
+	CPUs      int
+	MemTotal  uint64 // bytes
+	Container string // docker, lxc, kubernetes, or empty if not in a container
+}
+
+// GetServerInfo sets the info of the local system, see pct.SystemInfo.
+func GetServerInfo(info *ServerInfo) error {
+	sys, err := pct.SystemInfo()
 	if err != nil {
 		return err
 	}
+	info.Hostname = sys.Hostname
+	info.FQDN = sys.FQDN
+	info.OS = sys.OS
+	info.Distro = sys.Distro
+	info.Kernel = sys.Kernel
+	info.CPUs = sys.CPUs
+	info.MemTotal = sys.MemTotal
+	info.Container = sys.Container
 	return nil
 }
 
@@ -244,89 +908,308 @@ func (m *Manager) GetMySQLInstances() []*proto.MySQLInstance {
 	defer m.logger.Debug("getMySQLInstances:return")
 
 	var instances []*proto.MySQLInstance
-	for _, name := range m.Repo().List() {
-		parts := strings.Split(name, "-") // mysql-1 or server-12
-		if len(parts) != 2 {
-			m.logger.Error("Invalid instance name: %s: expected 2 parts, got %d", name, len(parts))
+	for _, id := range m.Repo().ListByType("mysql") {
+		it := &proto.MySQLInstance{}
+		if err := m.Repo().Get("mysql", id, it); err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to get instance mysql-%d: %s", id, err))
 			continue
 		}
-		if parts[0] == "mysql" {
-			id, err := strconv.ParseInt(parts[1], 10, 64)
-			if err != nil {
-				m.logger.Error("Invalid instance ID: %s: %s", name, err)
-				continue
-			}
-			it := &proto.MySQLInstance{}
-			if err := m.Repo().Get(parts[0], uint(id), it); err != nil {
-				m.logger.Error("Failed to get instance %s: %s", name, err)
-				continue
-			}
-			instances = append(instances, it)
-		}
+		instances = append(instances, it)
 	}
 	return instances
 }
 
-func (m *Manager) monitorInstancesRestart(ch chan string) {
+// instances are started, see startInstances, and pushed before waiting for
+// restarts.  started is closed when they're started.
+func (m *Manager) monitorInstancesRestart(ch chan mrms.RestartEvent, instances []*proto.MySQLInstance, started chan empty) {
 	m.logger.Debug("monitorInstancesRestart:call")
+	gaveUp := false
 	defer func() {
 		if err := recover(); err != nil {
 			m.logger.Error("MySQL connection crashed: ", err)
 			m.status.Update("instance-mrms", "Crashed")
-		} else {
+		} else if !gaveUp {
 			m.status.Update("instance-mrms", "Stopped")
 		}
+		select {
+		case <-started:
+		default:
+			close(started) // crashed while starting
+		}
 		m.logger.Debug("monitorInstancesRestart:return")
+		close(m.doneChan)
 	}()
 
-	ch, err := m.mrm.GlobalSubscribe()
-	if err != nil {
-		m.logger.Error(fmt.Sprintf("Failed to get MySQL restart monitor global channel: %s", err))
-		return
+	push := m.startInstances(instances)
+	close(started)
+
+	for _, instance := range push {
+		safeDSN := mysql.HideDSN(instance.DSN)
+		m.status.Update("instance-mrms", "Updating info "+safeDSN)
+		if err := m.PushInstanceInfo(instance); err != nil {
+			m.logger.Warn(err)
+		}
+		select {
+		case <-m.stop():
+			return
+		default:
+		}
+	}
+
+	// If handling restarts crashes, e.g. a MySQL connection panics, start
+	// again so restarts are still handled for the rest of the agent's life.
+	for restarts := 0; m.handleRestarts(ch); restarts++ {
+		if restarts >= MAX_MRMS_RESTARTS {
+			m.logger.Error(fmt.Sprintf("Handling MySQL restarts crashed %d times, giving up", restarts+1))
+			m.status.Update("instance-mrms", "Crashed")
+			gaveUp = true
+			return
+		}
+		m.logger.Warn(fmt.Sprintf("Handling MySQL restarts crashed, restarting in %s", m.RestartDelay))
+		m.status.Update("instance-mrms", fmt.Sprintf("Crashed, restarting in %s", m.RestartDelay))
+		select {
+		case <-time.After(m.RestartDelay):
+		case <-m.stop():
+			return
+		}
+	}
+}
+
+// handleRestarts updates the info of MySQL instances that restart, and
+// resyncs all instances every ResyncInterval, until the manager is stopped.
+// It returns true if it crashed.
+func (m *Manager) handleRestarts(ch chan mrms.RestartEvent) (crashed bool) {
+	m.logger.Debug("handleRestarts:call")
+	defer m.logger.Debug("handleRestarts:return")
+	defer func() {
+		if err := recover(); err != nil {
+			m.logger.Error("MySQL connection crashed: ", err)
+			crashed = true
+		}
+	}()
+
+	var resync <-chan time.Time
+	if m.ResyncInterval > 0 {
+		ticker := time.NewTicker(m.ResyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
 	}
 
 	for {
 		m.status.Update("instance-mrms", "Idle")
 		select {
-		case dsn := <-ch:
-			safeDSN := mysql.HideDSNPassword(dsn)
-			m.logger.Debug("mrms:restart:" + safeDSN)
-			m.status.Update("instance-mrms", "Updating "+safeDSN)
-
-			// Get the updated instances list. It should be updated every time since
-			// the Add method can add new instances to the list.
-			for _, instance := range m.GetMySQLInstances() {
-				if instance.DSN != dsn {
-					continue
+		case <-resync:
+			m.resyncInstances()
+		case event := <-ch:
+			// Drain the chan so the restart monitor isn't blocked while we
+			// update instances, which can take a while.  Only the latest
+			// event per instance matters.
+			events := []mrms.RestartEvent{event}
+			seen := map[string]int{event.DSN: 0}
+		DRAIN:
+			for {
+				select {
+				case event := <-ch:
+					if i, ok := seen[event.DSN]; ok {
+						events[i] = event
+					} else {
+						seen[event.DSN] = len(events)
+						events = append(events, event)
+					}
+				default:
+					break DRAIN
 				}
-				m.status.Update("instance-mrms", "Getting info "+safeDSN)
-				if err := GetMySQLInfo(instance); err != nil {
-					m.logger.Warn(fmt.Sprintf("Failed to get MySQL info %s: %s", safeDSN, err))
-					break
-				}
-				m.status.Update("instance-mrms", "Updating info "+safeDSN)
-				err := m.pushInstanceInfo(instance)
-				if err != nil {
-					m.logger.Warn(err)
-				}
-				break
 			}
+			for _, event := range events {
+				m.updateRestartedInstance(event)
+			}
+		case <-m.stop():
+			return
 		}
 	}
 }
 
-func (m *Manager) pushInstanceInfo(instance *proto.MySQLInstance) error {
+func (m *Manager) updateRestartedInstance(event mrms.RestartEvent) {
+	dsn := event.DSN
+	safeDSN := mysql.HideDSN(dsn)
+	m.logger.Debug(fmt.Sprintf("mrms:restart:%s:detected %s, uptime %ds",
+		safeDSN, event.DetectedAt, event.Uptime))
+	m.status.Update("instance-mrms", "Updating "+safeDSN)
 
+	// Get the updated instances list. It should be updated every time since
+	// the Add method can add new instances to the list.
+	for _, instance := range m.GetMySQLInstances() {
+		if instance.DSN != dsn {
+			continue
+		}
+		m.status.Update("instance-mrms", "Getting info "+safeDSN)
+		if err := m.getMySQLInfo(instance); err != nil {
+			m.warnMySQLInfo(safeDSN, err)
+			break
+		}
+		m.status.Update("instance-mrms", "Updating info "+safeDSN)
+		err := m.PushInstanceInfo(instance)
+		if err != nil {
+			m.logger.Warn(err)
+		}
+		break
+	}
+}
+
+// resyncInstances gets the info of all MySQL instances and pushes the info
+// that changed since it was last pushed.
+func (m *Manager) resyncInstances() {
+	m.logger.Debug("resyncInstances:call")
+	defer m.logger.Debug("resyncInstances:return")
+	for _, it := range m.GetMySQLInstances() {
+		name := m.repo.Name("mysql", it.Id)
+		m.status.Update("instance-mrms", "Resyncing "+name)
+		if err := m.getMySQLInfo(it); err != nil {
+			m.warnMySQLInfo(mysql.HideDSN(it.DSN), err)
+			continue
+		}
+		m.infoMux.Lock()
+		pushed, ok := m.infoPushed[name]
+		m.infoMux.Unlock()
+		if ok && pushed == *it {
+			continue // no change
+		}
+		m.logger.Info("Info changed, pushing " + name)
+		if err := m.PushInstanceInfo(it); err != nil {
+			m.logger.Warn(err)
+		}
+		select {
+		case <-m.stop():
+			return
+		default:
+		}
+	}
+}
+
+// forcePush gets and pushes info for the MySQL instance, or all MySQL instances
+// if id is zero, even if the info hasn't changed, e.g. after the API lost it.
+func (m *Manager) forcePush(service string, id uint) error {
+	if service != "mysql" {
+		return fmt.Errorf("Cannot push %s instances, only mysql", service)
+	}
+	var instances []*proto.MySQLInstance
+	if id == 0 {
+		instances = m.GetMySQLInstances()
+	} else {
+		it := &proto.MySQLInstance{}
+		if err := m.repo.Get(service, id, it); err != nil {
+			return err
+		}
+		instances = append(instances, it)
+	}
+
+	// Push all instances even if some fail.
+	errs := []string{}
+	for _, it := range instances {
+		name := m.repo.Name(service, it.Id)
+		m.status.Update("instance", "Getting info "+name)
+		if err := m.getMySQLInfo(it); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		m.status.Update("instance", "Pushing info "+name)
+		if err := m.PushInstanceInfo(it); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to push %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// FindDuplicateMySQL returns, keyed on @@server_uuid, the instances that connect
+// to the same MySQL server as another instance.  Comparing DSNs isn't reliable
+// because different hostnames, IPs, and sockets can reach the same server.
+// Instances that can't be connected to or don't have a server_uuid (MySQL < 5.6)
+// are ignored.
+func FindDuplicateMySQL(instances []*proto.MySQLInstance, factory mysql.ConnectionFactory) map[string][]*proto.MySQLInstance {
+	byUUID := make(map[string][]*proto.MySQLInstance)
+	for _, it := range instances {
+		conn := factory.Make(it.DSN)
+		if err := conn.Connect(1); err != nil {
+			continue
+		}
+		uuid := conn.GetGlobalVarString("server_uuid")
+		conn.Close()
+		if uuid == "" {
+			continue
+		}
+		byUUID[uuid] = append(byUUID[uuid], it)
+	}
+	for uuid, its := range byUUID {
+		if len(its) < 2 {
+			delete(byUUID, uuid)
+		}
+	}
+	return byUUID
+}
+
+func (m *Manager) warnDuplicateMySQL(instances []*proto.MySQLInstance) {
+	for uuid, its := range FindDuplicateMySQL(instances, m.ConnFactory) {
+		names := make([]string, len(its))
+		for i, it := range its {
+			names[i] = fmt.Sprintf("%s (%s)", m.repo.Name("mysql", it.Id), mysql.HideDSN(it.DSN))
+		}
+		m.logger.Warn(fmt.Sprintf("MySQL instances %s are the same server: server_uuid %s",
+			strings.Join(names, ", "), uuid))
+	}
+}
+
+// PushInstanceInfo PUTs the instance to the API.  5xx responses and connection
+// errors are retried up to PushAttempts times, doubling PushBackoff after each
+// failed attempt, see pct.RetryingAPI.  4xx responses are not retried.
+// Retrying stops if the manager is stopped.
+func (m *Manager) PushInstanceInfo(instance *proto.MySQLInstance) error {
 	uri := fmt.Sprintf("%s/%s/%d", m.api.EntryLink("instances"), "mysql", instance.Id)
 	data, err := json.Marshal(instance)
 	if err != nil {
 		m.logger.Error(err)
 		return err
 	}
-	resp, body, err := m.api.Put(m.api.ApiKey(), uri, data)
-	if err != nil {
+	if err := m.putInstanceInfo(uri, data); err != nil {
 		return err
 	}
+	name := m.repo.Name("mysql", instance.Id)
+	m.infoMux.Lock()
+	m.infoUpdated[name] = time.Now().UTC()
+	m.infoPushed[name] = *instance
+	m.infoMux.Unlock()
+	return nil
+}
+
+func (m *Manager) putInstanceInfo(uri string, data []byte) error {
+	// The API replaces the instance, so a duplicate PUT is harmless.
+	stop := m.stop()
+	api := pct.NewRetryingAPI(m.api, pct.RetryOptions{
+		Attempts:  m.PushAttempts,
+		Wait:      m.PushBackoff,
+		RetryPuts: true,
+		Sleep: func(d time.Duration) {
+			m.logger.Warn(fmt.Sprintf("Failed to push instance info, retrying in %s", d))
+			select {
+			case <-time.After(d):
+			case <-stop:
+			}
+		},
+		Cancel: func() bool {
+			select {
+			case <-stop:
+				return true
+			default:
+				return false
+			}
+		},
+	})
+	resp, body, err := api.Put(api.ApiKey(), uri, data)
+	if err != nil {
+		return err // connection error
+	}
 	// Sometimes the API returns only a status code for an error, without a message
 	// so body = nil and in that case string(body) will fail.
 	if body == nil {
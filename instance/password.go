@@ -0,0 +1,96 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+const (
+	// MySQL 5.7.4 added password_lifetime and default_password_lifetime.
+	PASSWORD_LIFETIME_VERSION = "5.7.4"
+	// Warn if the password expires within this many days.
+	PASSWORD_EXPIRY_WARN_DAYS = 7
+)
+
+type PasswordExpiry struct {
+	Expired  bool
+	Lifetime int64 // days, 0 if the password never expires
+	DaysLeft int64 // days until the password expires if Lifetime > 0
+}
+
+// GetPasswordExpiry returns if and when the password of the user conn is
+// connected as expires.  It returns nil if MySQL doesn't support password
+// expiration or the user can't read mysql.user.  tag is the QueryTag for the
+// query.
+func GetPasswordExpiry(conn mysql.Connector, tag string) (*PasswordExpiry, error) {
+	ok, err := conn.AtLeastVersion(PASSWORD_LIFETIME_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	// password_lifetime is NULL if the user uses default_password_lifetime.
+	query := "SELECT " + tag +
+		" password_expired," +
+		" IFNULL(password_lifetime, @@default_password_lifetime)," +
+		" IFNULL(DATEDIFF(NOW(), password_last_changed), 0)" +
+		" FROM mysql.user WHERE CONCAT(user, '@', host) = CURRENT_USER()"
+	var expired string
+	var lifetime, age int64
+	err = conn.DB().QueryRow(query).Scan(&expired, &lifetime, &age)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case mysql.MySQLErrorCode(err) == mysql.ER_USER_DENIED:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	e := &PasswordExpiry{
+		Expired:  expired == "Y",
+		Lifetime: lifetime,
+	}
+	if lifetime > 0 {
+		e.DaysLeft = lifetime - age
+		// MySQL doesn't set password_expired until the user connects again.
+		if e.DaysLeft <= 0 {
+			e.Expired = true
+			e.DaysLeft = 0
+		}
+	}
+	return e, nil
+}
+
+// Warning returns why the password needs to be changed, or an empty string if
+// it doesn't expire within PASSWORD_EXPIRY_WARN_DAYS.
+func (e *PasswordExpiry) Warning() string {
+	switch {
+	case e.Expired:
+		return "MySQL password has expired"
+	case e.Lifetime > 0 && e.DaysLeft <= PASSWORD_EXPIRY_WARN_DAYS:
+		return fmt.Sprintf("MySQL password expires in %d days", e.DaysLeft)
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// GetReplicationInfo returns read_only (true if read_only or super_read_only is
+// on), replica (true if SHOW SLAVE STATUS returns a row), and master_host if the
+// instance is a replica.  replica and master_host aren't returned if the user
+// lacks the privileges for SHOW SLAVE STATUS.  tag is the QueryTag for the
+// query.
+func GetReplicationInfo(conn mysql.Connector, tag string) (map[string]string, error) {
+	// super_read_only is MySQL 5.7.8+ and 0 if it doesn't exist.
+	readOnly := conn.GetGlobalVarNumber("read_only") != 0 || conn.GetGlobalVarNumber("super_read_only") != 0
+	props := map[string]string{
+		"read_only": fmt.Sprintf("%t", readOnly),
+	}
+
+	rows, err := conn.DB().Query("SHOW " + tag + " SLAVE STATUS")
+	if err != nil {
+		switch mysql.MySQLErrorCode(err) {
+		case mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, mysql.ER_USER_DENIED:
+			return props, nil // needs REPLICATION CLIENT or SUPER
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		props["replica"] = "false"
+		return props, nil
+	}
+
+	// The number of columns depends on the MySQL version, so scan them all
+	// and pick the ones we need by name.
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	props["replica"] = "true"
+	for i, col := range columns {
+		if col == "Master_Host" && values[i].Valid && values[i].String != "" {
+			props["master_host"] = values[i].String
+		}
+	}
+	return props, nil
+}
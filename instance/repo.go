@@ -22,15 +22,38 @@ import (
 	"errors"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// A RemoveHook is called before an instance is removed.  It must stop anything
+// using the instance and return when done, or return an error to abort the
+// removal.
+type RemoveHook func(service string, id uint) error
+
+// Get doesn't ask the API again for an instance it doesn't have for this long.
+const DEFAULT_NOT_FOUND_TTL = 30 * time.Second
+
+// How strictly Add checks MySQL instance DSNs, see SetDSNValidation.  DSNs that
+// can't be parsed are always rejected.
+const (
+	DSN_VALIDATION_OFF    = "off"    // don't check if the DSN is complete (default)
+	DSN_VALIDATION_WARN   = "warn"   // warn if the DSN is incomplete
+	DSN_VALIDATION_STRICT = "strict" // reject incomplete DSNs
 )
 
 type Repo struct {
@@ -38,8 +61,20 @@ type Repo struct {
 	configDir string
 	api       pct.APIConnector
 	// --
-	it  map[string]interface{}
-	mux *sync.RWMutex
+	it          map[string]interface{}
+	fetched     map[string]time.Time
+	defaults    map[string]interface{}
+	labels      map[string]map[string]string // keyed on instance name
+	ttl         time.Duration
+	notFound    map[string]time.Time
+	notFoundTTL time.Duration
+	hooks       map[string]RemoveHook
+	validation  string
+	passthrough bool
+	mux         *sync.RWMutex
+	// Watch
+	watcher   *fsnotify.Watcher
+	watchDone chan struct{}
 }
 
 func NewRepo(logger *pct.Logger, configDir string, api pct.APIConnector) *Repo {
@@ -48,14 +83,84 @@ func NewRepo(logger *pct.Logger, configDir string, api pct.APIConnector) *Repo {
 		configDir: configDir,
 		api:       api,
 		// --
-		it:  make(map[string]interface{}),
-		mux: &sync.RWMutex{},
+		it:          make(map[string]interface{}),
+		fetched:     make(map[string]time.Time),
+		notFound:    make(map[string]time.Time),
+		labels:      make(map[string]map[string]string),
+		notFoundTTL: DEFAULT_NOT_FOUND_TTL,
+		hooks:       make(map[string]RemoveHook),
+		validation:  DSN_VALIDATION_OFF,
+		mux:         &sync.RWMutex{},
 	}
 	return m
 }
 
+// SetTTL sets how long a cached instance is used before Get re-fetches it
+// from the API. Zero (the default) caches instances forever.
+func (r *Repo) SetTTL(ttl time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.ttl = ttl
+}
+
+// SetNotFoundTTL sets how long Get returns UnknownServiceInstanceError for an
+// instance the API doesn't have (404) before asking the API again.  Zero
+// disables caching, i.e. every Get asks the API.
+func (r *Repo) SetNotFoundTTL(ttl time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.notFoundTTL = ttl
+}
+
+// SetDSNValidation sets how strictly Add checks the DSN of MySQL instances:
+// DSN_VALIDATION_OFF, DSN_VALIDATION_WARN, or DSN_VALIDATION_STRICT.  A DSN is
+// incomplete if it has no username or no address, so the driver default
+// 127.0.0.1:3306 is used.
+func (r *Repo) SetDSNValidation(level string) error {
+	switch level {
+	case DSN_VALIDATION_OFF, DSN_VALIDATION_WARN, DSN_VALIDATION_STRICT:
+	default:
+		return fmt.Errorf("Invalid DSN validation %s: expected %s, %s, or %s",
+			level, DSN_VALIDATION_OFF, DSN_VALIDATION_WARN, DSN_VALIDATION_STRICT)
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.validation = level
+	return nil
+}
+
+// SetPassthrough allows instances of types other than proto.ExternalService,
+// e.g. from a newer API.  They're stored as-is, as *json.RawMessage, without
+// any checks.  Call it before Init because it's not safe to change while the
+// repo is used.
+func (r *Repo) SetPassthrough(allow bool) {
+	r.passthrough = allow
+}
+
+// Passthrough returns true if the repo stores instances of unknown types, see
+// SetPassthrough.
+func (r *Repo) Passthrough() bool {
+	return r.passthrough
+}
+
+// Properties in this file are used for every instance that doesn't set them.
+const DEFAULTS_FILE = "instance-defaults.conf"
+
+// Init renames instance files that aren't valid JSON to file+CORRUPT_FILE_SUFFIX.
+const CORRUPT_FILE_SUFFIX = ".corrupt"
+
 func (r *Repo) Init() error {
-	for service, _ := range proto.ExternalService {
+	if err := r.loadDefaults(); err != nil {
+		return fmt.Errorf("%s: %s", DEFAULTS_FILE, err)
+	}
+	if err := r.loadLabels(); err != nil {
+		return fmt.Errorf("%s: %s", LABELS_FILE, err)
+	}
+	services, err := r.services()
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
 		if err := r.loadInstances(service); err != nil {
 			return fmt.Errorf("%s: %s", service, err)
 		}
@@ -63,27 +168,65 @@ func (r *Repo) Init() error {
 	return nil
 }
 
+// service-id.conf where id is a positive integer without leading zeros.
+var instanceFileRe = regexp.MustCompile(`^([a-z]+)-([1-9][0-9]*)\.conf$`)
+
+// services returns the instance types to load: proto.ExternalService plus, if
+// passthrough, the other types of instance files in the config dir.
+func (r *Repo) services() ([]string, error) {
+	services := []string{}
+	for service, _ := range proto.ExternalService {
+		services = append(services, service)
+	}
+	if !r.passthrough {
+		return services, nil
+	}
+	files, err := filepath.Glob(r.configDir + "/*.conf")
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, file := range files {
+		part := instanceFileRe.FindStringSubmatch(filepath.Base(file))
+		if part == nil || seen[part[1]] {
+			continue
+		}
+		seen[part[1]] = true
+		if _, ok := proto.ExternalService[part[1]]; !ok {
+			services = append(services, part[1])
+		}
+	}
+	return services, nil
+}
+
 func (r *Repo) loadInstances(service string) error {
-	files, err := filepath.Glob(r.configDir + "/" + service + "-*.conf")
+	files, err := filepath.Glob(r.configDir + "/" + service + "-*")
 	if err != nil {
 		return err
 	}
 
 	for _, file := range files {
+		// Editors and admins leave files like mysql-1.conf.swp, mysql-1.conf~,
+		// and mysql-1.conf.bak next to real configs.  Skip them.
+		base := filepath.Base(file)
+		if !strings.HasSuffix(base, ".conf") {
+			r.logger.Debug("Skipping " + file)
+			continue
+		}
+
 		r.logger.Debug("Reading " + file)
 
 		// 0       1
 		// service-id
-		part := strings.Split(strings.TrimSuffix(filepath.Base(file), ".conf"), "-")
-		if len(part) != 2 {
+		part := instanceFileRe.FindStringSubmatch(base)
+		if len(part) != 3 || part[1] != service {
 			return errors.New("Invalid instance file name: " + file)
 		}
-		service := part[0]
-		id, err := strconv.ParseUint(part[1], 10, 32)
+		id, err := strconv.ParseUint(part[2], 10, 32)
 		if err != nil {
-			return err
+			return errors.New("Invalid instance file name: " + file)
 		}
-		if !valid(service, uint(id)) {
+		if !r.valid(service, uint(id)) {
 			return pct.InvalidServiceInstanceError{Service: service, Id: uint(id)}
 		}
 
@@ -91,6 +234,20 @@ func (r *Repo) loadInstances(service string) error {
 		if err != nil {
 			return errors.New(file + ":" + err.Error())
 		}
+		// A file that isn't JSON, e.g. truncated by a crash before configs
+		// were written atomically, can't be fixed by retrying, so move it
+		// aside and load the other instances.
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			r.logger.Error(fmt.Sprintf("Skipping invalid instance file %s: %s", file, err))
+			if err := os.Rename(file, file+CORRUPT_FILE_SUFFIX); err != nil {
+				r.logger.Warn(err)
+			}
+			continue
+		}
+		if data, err = r.mergeDefaults(data); err != nil {
+			return errors.New(file + ":" + err.Error())
+		}
 
 		if err := r.Add(service, uint(id), data, false); err != nil {
 			return errors.New(file + ":" + err.Error())
@@ -101,11 +258,57 @@ func (r *Repo) loadInstances(service string) error {
 	return nil
 }
 
+func (r *Repo) loadDefaults() error {
+	r.defaults = nil
+	file := filepath.Join(r.configDir, DEFAULTS_FILE)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defaults := make(map[string]interface{})
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+	}
+	r.defaults = defaults
+	r.logger.Info("Loaded " + file)
+	return nil
+}
+
+// mergeDefaults returns the instance config with the default properties it
+// doesn't set itself.  Keys are compared case-insensitively like json.Unmarshal
+// does, so "dsn" in the defaults doesn't override "DSN" in the instance.
+func (r *Repo) mergeDefaults(data []byte) ([]byte, error) {
+	if len(r.defaults) == 0 {
+		return data, nil
+	}
+	props := make(map[string]interface{})
+	if err := json.Unmarshal(data, &props); err != nil {
+		return nil, errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+	}
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+DEFAULTS:
+	for k, v := range r.defaults {
+		for _, key := range keys {
+			if strings.EqualFold(k, key) {
+				continue DEFAULTS
+			}
+		}
+		props[k] = v
+	}
+	return json.Marshal(props)
+}
+
 func (r *Repo) Add(service string, id uint, data []byte, writeToDisk bool) error {
 	r.logger.Debug("Add:call")
 	defer r.logger.Debug("Add:return")
 
-	if !valid(service, id) {
+	if !r.valid(service, id) {
 		return pct.InvalidServiceInstanceError{Service: service, Id: id}
 	}
 
@@ -119,40 +322,162 @@ func (r *Repo) add(service string, id uint, data []byte, writeToDisk bool) error
 	r.logger.Debug("add:call")
 	defer r.logger.Debug("add:return")
 
-	var info interface{}
-	switch service {
-	case "server":
-		it := &proto.ServerInstance{}
-		if err := json.Unmarshal(data, it); err != nil {
-			return errors.New("instance.Repo:json.Unmarshal:" + err.Error())
-		}
-		info = it
-	case "mysql":
-		it := &proto.MySQLInstance{}
-		if err := json.Unmarshal(data, it); err != nil {
-			return errors.New("instance.Repo:json.Unmarshal:" + err.Error())
-		}
-		info = it
-	default:
-		return errors.New(fmt.Sprintf("Invalid service name: %s", service))
+	info, err := r.unmarshal(service, data)
+	if err != nil {
+		return err
 	}
 
 	name := r.Name(service, id)
+	if err := r.validate(name, info); err != nil {
+		return err
+	}
+	if err := r.validateDSN(name, info, r.validation); err != nil {
+		return err
+	}
 	if _, ok := r.it[name]; ok {
 		return pct.DuplicateServiceInstanceError{Service: service, Id: id}
 	}
 
 	if writeToDisk {
-		if err := pct.Basedir.WriteConfig(name, info); err != nil {
+		file, err := r.configName(service, id)
+		if err != nil {
+			return err
+		}
+		if err := pct.Basedir.WriteConfig(file, info); err != nil {
 			return err
 		}
 		r.logger.Info("Added " + name)
 	}
 
 	r.it[name] = info
+	r.fetched[name] = time.Now()
+	delete(r.notFound, name)
+	return nil
+}
+
+// Update replaces an existing instance, unlike Add which fails if the instance
+// exists.  The instance is replaced while locked, so Get and List never see it
+// missing, like they would between Remove and Add.  If writeToDisk is true,
+// its config file is rewritten too.
+func (r *Repo) Update(service string, id uint, data []byte, writeToDisk bool) error {
+	r.logger.Debug("Update:call")
+	defer r.logger.Debug("Update:return")
+
+	if !r.valid(service, id) {
+		return pct.InvalidServiceInstanceError{Service: service, Id: id}
+	}
+
+	info, err := r.unmarshal(service, data)
+	if err != nil {
+		return err
+	}
+	name := r.Name(service, id)
+	if err := r.validate(name, info); err != nil {
+		return err
+	}
+	if err := r.validateDSN(name, info, r.dsnValidation()); err != nil {
+		return err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if _, ok := r.it[name]; !ok {
+		return pct.UnknownServiceInstanceError{Service: service, Id: id}
+	}
+	if writeToDisk {
+		file, err := r.configName(service, id)
+		if err != nil {
+			return err
+		}
+		if err := pct.Basedir.WriteConfig(file, info); err != nil {
+			return err
+		}
+	}
+	r.it[name] = info
+	r.fetched[name] = time.Now()
+	r.logger.Info("Updated " + name)
+	return nil
+}
+
+// validate returns an error if the instance is missing info required to use it,
+// so a bad instance is rejected when added instead of failing later.
+func (r *Repo) validate(name string, info interface{}) error {
+	switch it := info.(type) {
+	case *proto.MySQLInstance:
+		if it.DSN == "" {
+			return fmt.Errorf("Invalid instance %s: DSN is not set", name)
+		}
+		if _, err := mysql.ParseDSN(it.DSN); err != nil {
+			return fmt.Errorf("Invalid instance %s: invalid DSN %s: %s", name, mysql.HideDSN(it.DSN), err)
+		}
+	}
+	return nil
+}
+
+// dsnValidation returns the DSN validation level for callers that don't lock
+// the repo.
+func (r *Repo) dsnValidation() string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.validation
+}
+
+// validateDSN checks that a valid MySQL instance DSN is complete, depending on
+// the DSN validation level, which the caller reads while locked, e.g. with
+// dsnValidation.
+func (r *Repo) validateDSN(name string, info interface{}, level string) error {
+	it, ok := info.(*proto.MySQLInstance)
+	if !ok || level == DSN_VALIDATION_OFF {
+		return nil
+	}
+	dsn, err := mysql.ParseDSN(it.DSN)
+	if err != nil {
+		return err // shouldn't happen; validate checks this
+	}
+	problems := []string{}
+	if dsn.Username == "" {
+		problems = append(problems, "no username")
+	}
+	if dsn.Protocol == "tcp" && !strings.Contains(it.DSN, "(") {
+		problems = append(problems, "no address")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("incomplete DSN %s: %s", mysql.HideDSN(it.DSN), strings.Join(problems, ", "))
+	if level == DSN_VALIDATION_STRICT {
+		return fmt.Errorf("Invalid instance %s: %s", name, msg)
+	}
+	r.logger.Warn(fmt.Sprintf("Instance %s has an %s", name, msg))
 	return nil
 }
 
+func (r *Repo) unmarshal(service string, data []byte) (interface{}, error) {
+	var info interface{}
+	switch service {
+	case "server":
+		it := &proto.ServerInstance{}
+		if err := json.Unmarshal(data, it); err != nil {
+			return nil, errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+		}
+		info = it
+	case "mysql":
+		it := &proto.MySQLInstance{}
+		if err := json.Unmarshal(data, it); err != nil {
+			return nil, errors.New("instance.Repo:json.Unmarshal:" + err.Error())
+		}
+		info = it
+	default:
+		if !r.passthrough {
+			return nil, errors.New(fmt.Sprintf("Invalid service name: %s", service))
+		}
+		raw := json.RawMessage(data)
+		info = &raw
+	}
+	return info, nil
+}
+
 func (r *Repo) Get(service string, id uint, info interface{}) error {
 	r.logger.Debug("Get:call")
 	defer r.logger.Debug("Get:return")
@@ -171,7 +496,7 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 		log.Fatal("info arg is not a pointer; need &T{}")
 	}
 
-	if !valid(service, id) {
+	if !r.valid(service, id) {
 		return pct.InvalidServiceInstanceError{Service: service, Id: id}
 	}
 
@@ -179,29 +504,33 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 	name := r.Name(service, id)
 	it, ok := r.it[name]
 	if !ok {
+		// Don't ask the API again for an instance it just said it doesn't have.
+		if t, ok := r.notFound[name]; ok && time.Now().Sub(t) < r.notFoundTTL {
+			return pct.UnknownServiceInstanceError{Service: service, Id: id}
+		}
 		// Get instance info from API.
-		link := r.api.EntryLink("instances")
-		if link == "" {
-			r.logger.Warn("No 'instance' API link")
+		code, data, err := r.download(service, id)
+		if code == http.StatusNotFound {
+			if r.notFoundTTL > 0 {
+				r.notFound[name] = time.Now()
+			}
 			return pct.UnknownServiceInstanceError{Service: service, Id: id}
 		}
-		url := fmt.Sprintf("%s/%s/%d", link, service, id)
-		r.logger.Info("GET", url)
-		code, data, err := r.api.Get(r.api.ApiKey(), url)
 		if err != nil {
-			return fmt.Errorf("Failed to get %s instance from %s: %s", name, link, err)
-		} else if code != 200 {
-			return fmt.Errorf("Getting %s instance from %s returned code %d, expected 200", name, link, code)
-		} else if data == nil {
-			return fmt.Errorf("Getting %s instance from %s did not return data")
-		} else {
-			// Save new instance locally.
-			if err := r.add(service, uint(id), data, true); err != nil {
-				return fmt.Errorf("Failed to add new instance: %s", err)
-			}
-			// Recurse to re-get and return new instance.
-			return r.get(service, id, info)
+			return err
+		}
+		// Save new instance locally.
+		if err := r.add(service, uint(id), data, true); err != nil {
+			return fmt.Errorf("Failed to add new instance: %s", err)
 		}
+		// Recurse to re-get and return new instance.
+		return r.get(service, id, info)
+	} else if r.ttl > 0 && time.Now().Sub(r.fetched[name]) > r.ttl {
+		// Cached instance is stale, try to refresh it from API.
+		if err := r.refresh(service, id); err != nil {
+			r.logger.Warn(fmt.Sprintf("Using cached %s instance: %s", name, err))
+		}
+		it = r.it[name]
 	}
 
 	/**
@@ -220,37 +549,157 @@ func (r *Repo) get(service string, id uint, info interface{}) error {
 	return nil
 }
 
+func (r *Repo) download(service string, id uint) (int, []byte, error) {
+	link := r.api.EntryLink("instances")
+	if link == "" {
+		r.logger.Warn("No 'instance' API link")
+		return 0, nil, pct.UnknownServiceInstanceError{Service: service, Id: id}
+	}
+	url := fmt.Sprintf("%s/%s/%d", link, service, id)
+	r.logger.Info("GET", url)
+	code, data, err := r.api.Get(r.api.ApiKey(), url)
+	if err != nil {
+		return code, nil, pct.InstanceFetchError{Service: service, Id: id, URL: url, Code: code, Err: err}
+	} else if code != 200 || data == nil {
+		return code, nil, pct.InstanceFetchError{Service: service, Id: id, URL: url, Code: code}
+	}
+	return code, data, nil
+}
+
+func (r *Repo) refresh(service string, id uint) error {
+	// Do NOT lock here.  Expect caller to lock.
+	name := r.Name(service, id)
+
+	// Wait another TTL before trying again even if this fails, else every Get
+	// waits on the API while it's down.
+	r.fetched[name] = time.Now()
+
+	_, data, err := r.download(service, id)
+	if err != nil {
+		return err
+	}
+
+	// Same as loading the instance from disk, so the API can't replace a good
+	// cached instance with one that won't load next time.
+	if data, err = r.mergeDefaults(data); err != nil {
+		return err
+	}
+	info, err := r.unmarshal(service, data)
+	if err != nil {
+		return err
+	}
+	if err := r.validate(name, info); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(info, r.it[name]) {
+		return nil
+	}
+	file, err := r.configName(service, id)
+	if err != nil {
+		return err
+	}
+	if err := pct.Basedir.WriteConfig(file, info); err != nil {
+		return err
+	}
+	r.it[name] = info
+	r.logger.Info("Updated " + name)
+	return nil
+}
+
+// AddRemoveHook registers a hook, by name, called by Remove before removing an
+// instance.  A hook with the same name is replaced.
+func (r *Repo) AddRemoveHook(name string, hook RemoveHook) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.hooks[name] = hook
+}
+
+func (r *Repo) DeleteRemoveHook(name string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.hooks, name)
+}
+
 func (r *Repo) Remove(service string, id uint) error {
 	r.logger.Debug("Remove:call")
 	defer r.logger.Debug("Remove:return")
 
-	// todo: API --> agent --> side.Remove()
-	// Agent should stop all services using the instance before call this.
-	if !valid(service, id) {
+	if !r.valid(service, id) {
 		return pct.InvalidServiceInstanceError{Service: service, Id: id}
 	}
 
+	name := r.Name(service, id)
+
+	r.mux.RLock()
+	_, ok := r.it[name]
+	r.mux.RUnlock()
+	if !ok {
+		return pct.UnknownServiceInstanceError{Service: service, Id: id}
+	}
+
+	if err := r.runRemoveHooks(service, id); err != nil {
+		return err
+	}
+
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
-	name := r.Name(service, id)
 	if _, ok := r.it[name]; !ok {
 		return pct.UnknownServiceInstanceError{Service: service, Id: id}
 	}
 
-	file := r.configDir + "/" + name + ".conf"
+	fileName, err := r.configName(service, id)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(r.configDir, fileName+".conf")
 	r.logger.Info("Removing", file)
 	if err := os.Remove(file); err != nil {
 		return err
 	}
 
 	delete(r.it, name)
+	delete(r.fetched, name)
+	if _, ok := r.labels[name]; ok {
+		delete(r.labels, name)
+		if err := r.writeLabels(); err != nil {
+			r.logger.Warn(err)
+		}
+	}
 	r.logger.Info("Removed " + name)
 	return nil
 }
 
-func valid(service string, id uint) bool {
-	if _, ok := proto.ExternalService[service]; !ok {
+// runRemoveHooks calls the remove hooks in name order and returns the first
+// error.  Services using the instance must stop before it's removed.  Hooks are
+// called without the lock because they may Get the instance, so don't lock
+// before calling.
+func (r *Repo) runRemoveHooks(service string, id uint) error {
+	r.mux.RLock()
+	hookNames := []string{}
+	for hookName := range r.hooks {
+		hookNames = append(hookNames, hookName)
+	}
+	sort.Strings(hookNames)
+	hooks := make([]RemoveHook, len(hookNames))
+	for i, hookName := range hookNames {
+		hooks[i] = r.hooks[hookName]
+	}
+	r.mux.RUnlock()
+
+	for i, hook := range hooks {
+		r.logger.Debug("Remove:hook:" + hookNames[i])
+		if err := hook(service, id); err != nil {
+			return fmt.Errorf("Cannot remove %s: %s: %s", r.Name(service, id), hookNames[i], err)
+		}
+	}
+	return nil
+}
+
+// valid returns true if the service is a proto.ExternalService, or any name
+// if passthrough, and the id is set.
+func (r *Repo) valid(service string, id uint) bool {
+	if _, ok := proto.ExternalService[service]; !ok && !(r.passthrough && serviceNameRe.MatchString(service)) {
 		return false
 	}
 	if id == 0 {
@@ -259,10 +708,25 @@ func valid(service string, id uint) bool {
 	return true
 }
 
+// Instance types are lowercase letters, like the service in instance file names.
+var serviceNameRe = regexp.MustCompile(`^[a-z]+$`)
+
 func (r *Repo) Name(service string, id uint) string {
 	return fmt.Sprintf("%s-%d", service, id)
 }
 
+// configName returns the name of the instance config file, without the
+// .conf suffix.  The service and id are checked again, even if the caller
+// did, so a bad service name like "../x" can never make a path outside the
+// config dir.
+func (r *Repo) configName(service string, id uint) (string, error) {
+	name := r.Name(service, id)
+	if !r.valid(service, id) || name != filepath.Base(name) || strings.Contains(name, "..") {
+		return "", pct.InvalidServiceInstanceError{Service: service, Id: id}
+	}
+	return name, nil
+}
+
 func (r *Repo) List() []string {
 	r.mux.Lock()
 	defer r.mux.Unlock()
@@ -272,3 +736,207 @@ func (r *Repo) List() []string {
 	}
 	return instances
 }
+
+// Has returns true if the instance is in the repo.  Unlike Get, it never asks
+// the API for an instance the repo doesn't have.
+func (r *Repo) Has(service string, id uint) bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	_, ok := r.it[r.Name(service, id)]
+	return ok
+}
+
+// Count returns the number of instances in the repo.
+func (r *Repo) Count() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return len(r.it)
+}
+
+// ListByType returns the IDs of all instances of the given service type, like
+// "mysql" or "server", in ascending order.
+func (r *Repo) ListByType(service string) []uint {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	ids := []uint{}
+	prefix := service + "-"
+	for name, _ := range r.it {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint(id))
+	}
+	sort.Sort(uintSlice(ids))
+	return ids
+}
+
+type uintSlice []uint
+
+func (s uintSlice) Len() int           { return len(s) }
+func (s uintSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uintSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ExportSanitized returns all instances as JSON, keyed on name like mysql-1,
+// with secrets like DSN passwords masked, so configs can be shared safely.
+func (r *Repo) ExportSanitized() ([]byte, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	export := make(map[string]interface{}, len(r.it))
+	for name, info := range r.it {
+		switch it := info.(type) {
+		case *proto.MySQLInstance:
+			safe := *it
+			if safe.DSN != "" {
+				safe.DSN = mysql.HideDSN(safe.DSN)
+			}
+			export[name] = &safe
+		case *json.RawMessage:
+			// Passthrough instances can have DSNs and secrets, too, but their
+			// fields are unknown, so mask them by name.  One that isn't a JSON
+			// object can't be checked, so it's left out.
+			var v interface{}
+			if err := json.Unmarshal(*it, &v); err != nil {
+				continue
+			}
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			export[name] = sanitizeProps(props)
+		default:
+			export[name] = info
+		}
+	}
+	return json.MarshalIndent(export, "", "    ")
+}
+
+// Passthrough instance properties whose names contain these, case-insensitive,
+// are masked by ExportSanitized.  DSN properties keep the rest of the DSN.
+var secretProps = []string{"password", "passwd", "secret", "token", "apikey", "api_key"}
+
+// sanitizeProps masks DSN and secret properties, including in nested objects
+// and arrays.  props is changed and returned.
+func sanitizeProps(props map[string]interface{}) map[string]interface{} {
+PROPS:
+	for k, v := range props {
+		key := strings.ToLower(k)
+		if str, ok := v.(string); ok && strings.Contains(key, "dsn") {
+			if str != "" {
+				props[k] = mysql.HideDSN(str)
+			}
+			continue
+		}
+		for _, secret := range secretProps {
+			if strings.Contains(key, secret) {
+				props[k] = mysql.HiddenPassword
+				continue PROPS
+			}
+		}
+		props[k] = sanitizeValue(v)
+	}
+	return props
+}
+
+func sanitizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return sanitizeProps(val)
+	case []interface{}:
+		for i := range val {
+			val[i] = sanitizeValue(val[i])
+		}
+	}
+	return v
+}
+
+// Export returns all instances as JSON, keyed on name like mysql-1, with all
+// info including DSN passwords, to back up or migrate them with Import.  Use
+// ExportSanitized to share configs.
+func (r *Repo) Export() ([]byte, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	export := make(map[string]interface{}, len(r.it))
+	for name, info := range r.it {
+		export[name] = info
+	}
+	return json.MarshalIndent(export, "", "    ")
+}
+
+// Import adds the instances in data, which is JSON from Export, and writes
+// their config files.  If an instance already exists, it's replaced if
+// overwrite is true, else Import returns DuplicateServiceInstanceError.
+// All instances are checked before any are imported, so an invalid or
+// duplicate instance doesn't leave a partial import.
+func (r *Repo) Import(data []byte, overwrite bool) error {
+	r.logger.Debug("Import:call")
+	defer r.logger.Debug("Import:return")
+
+	export := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return err
+	}
+
+	type importInstance struct {
+		name    string
+		service string
+		id      uint
+		info    interface{}
+	}
+	names := make([]string, 0, len(export))
+	for name := range export {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	instances := make([]importInstance, 0, len(names))
+	validation := r.dsnValidation()
+	for _, name := range names {
+		part := instanceFileRe.FindStringSubmatch(name + ".conf")
+		if len(part) != 3 {
+			return errors.New("Invalid instance name: " + name)
+		}
+		id, err := strconv.ParseUint(part[2], 10, 32)
+		if err != nil {
+			return errors.New("Invalid instance name: " + name)
+		}
+		service := part[1]
+		if !r.valid(service, uint(id)) {
+			return pct.InvalidServiceInstanceError{Service: service, Id: uint(id)}
+		}
+		info, err := r.unmarshal(service, export[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if err := r.validate(name, info); err != nil {
+			return err
+		}
+		if err := r.validateDSN(name, info, validation); err != nil {
+			return err
+		}
+		instances = append(instances, importInstance{name, service, uint(id), info})
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !overwrite {
+		for _, it := range instances {
+			if _, ok := r.it[it.name]; ok {
+				return pct.DuplicateServiceInstanceError{Service: it.service, Id: it.id}
+			}
+		}
+	}
+	for _, it := range instances {
+		if err := pct.Basedir.WriteConfig(it.name, it.info); err != nil {
+			return err
+		}
+		r.it[it.name] = it.info
+		r.fetched[it.name] = time.Now()
+		delete(r.notFound, it.name)
+		r.logger.Info("Imported " + it.name)
+	}
+	return nil
+}
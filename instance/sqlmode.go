@@ -0,0 +1,51 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"strings"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// GetSQLModeInfo returns the global sql_mode as property sql_mode, and the
+// modes that can break agent queries as sql_mode.problems, a comma-separated
+// list that's empty if there are none: ANSI_QUOTES, because then double quotes
+// quote identifiers, not strings, and "no NO_ENGINE_SUBSTITUTION", because then
+// MySQL silently uses the default engine if the one given isn't available.
+func GetSQLModeInfo(conn mysql.Connector) map[string]string {
+	sqlMode := conn.GetGlobalVarString("sql_mode")
+	modes := map[string]bool{}
+	for _, mode := range strings.Split(sqlMode, ",") {
+		modes[strings.ToUpper(strings.TrimSpace(mode))] = true
+	}
+
+	// ANSI is a combination of modes, including ANSI_QUOTES.
+	problems := []string{}
+	if modes["ANSI_QUOTES"] || modes["ANSI"] {
+		problems = append(problems, "ANSI_QUOTES")
+	}
+	if !modes["NO_ENGINE_SUBSTITUTION"] {
+		problems = append(problems, "no NO_ENGINE_SUBSTITUTION")
+	}
+
+	return map[string]string{
+		"sql_mode":          sqlMode,
+		"sql_mode.problems": strings.Join(problems, ","),
+	}
+}
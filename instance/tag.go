@@ -0,0 +1,83 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"strings"
+
+	"github.com/percona/percona-agent/mysql"
+)
+
+// QueryTag returns the comment that identifies queries issued by the agent,
+// like "/* percona-agent mysql-1 getinfo */", so DBAs can tell which instance
+// a query is for and why it was issued.
+func QueryTag(name, purpose string) string {
+	tag := "/* percona-agent"
+	for _, s := range []string{name, purpose} {
+		if s != "" {
+			// A "*/" would end the comment and the rest would be SQL.
+			tag += " " + strings.Replace(s, "*/", "* /", -1)
+		}
+	}
+	return tag + " */"
+}
+
+// taggedConn is a Connector whose global variable queries have a QueryTag.
+// Functions that query conn.DB() directly must add the tag themselves.
+type taggedConn struct {
+	mysql.Connector
+	tag     string
+	version string // @@version if already known, else queried
+}
+
+func newTaggedConn(conn mysql.Connector, tag, version string) *taggedConn {
+	c := &taggedConn{
+		Connector: conn,
+		tag:       tag,
+		version:   version,
+	}
+	return c
+}
+
+func (c *taggedConn) GetGlobalVarString(varName string) string {
+	if c.DB() == nil {
+		return c.Connector.GetGlobalVarString(varName)
+	}
+	var varValue string
+	c.DB().QueryRow("SELECT " + c.tag + " @@GLOBAL." + varName).Scan(&varValue)
+	return varValue
+}
+
+func (c *taggedConn) GetGlobalVarNumber(varName string) float64 {
+	if c.DB() == nil {
+		return c.Connector.GetGlobalVarNumber(varName)
+	}
+	var varValue float64
+	c.DB().QueryRow("SELECT " + c.tag + " @@GLOBAL." + varName).Scan(&varValue)
+	return varValue
+}
+
+func (c *taggedConn) AtLeastVersion(v string) (bool, error) {
+	if c.version == "" {
+		if c.DB() == nil {
+			return c.Connector.AtLeastVersion(v)
+		}
+		c.version = c.GetGlobalVarString("version")
+	}
+	return mysql.AtLeastVersion(c.version, v)
+}
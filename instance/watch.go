@@ -0,0 +1,188 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// An InstanceChange is passed to the Watch callback when an instance file is
+// added, modified, or removed.  Old is nil if the instance was added; New is nil
+// if it was removed.
+type InstanceChange struct {
+	Service string
+	Id      uint
+	Old     interface{}
+	New     interface{}
+}
+
+type WatchFunc func(change InstanceChange)
+
+// Watch reloads instance files in the config dir when they're added, modified,
+// or removed, and calls f after each change.  Call StopWatch to stop watching.
+// Remove hooks are called for removed files like Remove; if one fails, the
+// instance is kept until the file is removed again or the agent restarts.
+func (r *Repo) Watch(f WatchFunc) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.watcher != nil {
+		return errors.New("Already watching " + r.configDir)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the dir, not the files, to see new files and files replaced by
+	// rename, i.e. write temp file + rename to mysql-1.conf.
+	if err := watcher.Add(r.configDir); err != nil {
+		watcher.Close()
+		return err
+	}
+	r.watcher = watcher
+	r.watchDone = make(chan struct{})
+	go r.watch(watcher, r.watchDone, f)
+	return nil
+}
+
+func (r *Repo) StopWatch() {
+	r.mux.Lock()
+	watcher := r.watcher
+	done := r.watchDone
+	r.watcher = nil
+	r.mux.Unlock()
+	if watcher == nil {
+		return
+	}
+	watcher.Close()
+	<-done
+}
+
+func (r *Repo) watch(watcher *fsnotify.Watcher, doneChan chan struct{}, f WatchFunc) {
+	r.logger.Debug("watch:call")
+	defer r.logger.Debug("watch:return")
+	defer close(doneChan)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			r.logger.Debug(fmt.Sprintf("watch:event:%s", event))
+			change, err := r.reload(event.Name)
+			if err != nil {
+				r.logger.Warn(err)
+				continue
+			}
+			if change != nil && f != nil {
+				f(*change)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Warn("Error watching " + r.configDir + ": " + err.Error())
+		}
+	}
+}
+
+// reload syncs the instance in the file with the repo: the instance is added
+// or updated if the file exists, else it's removed.  The event op (create,
+// write, rename, etc.) isn't used because the file is the source of truth and
+// atomic writes cause several events.  It returns nil if nothing changed.
+func (r *Repo) reload(file string) (*InstanceChange, error) {
+	part := instanceFileRe.FindStringSubmatch(filepath.Base(file))
+	if len(part) != 3 {
+		return nil, nil // not an instance file, e.g. mysql-1.conf.tmp
+	}
+	service := part[1]
+	id64, err := strconv.ParseUint(part[2], 10, 32)
+	if err != nil {
+		return nil, nil
+	}
+	id := uint(id64)
+	if !r.valid(service, id) {
+		return nil, nil
+	}
+	name := r.Name(service, id)
+
+	var info interface{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New(file + ":" + err.Error())
+	}
+	if err == nil {
+		r.mux.RLock()
+		data, err = r.mergeDefaults(data)
+		r.mux.RUnlock()
+		if err != nil {
+			return nil, errors.New(file + ":" + err.Error())
+		}
+		if info, err = r.unmarshal(service, data); err != nil {
+			return nil, errors.New(file + ":" + err.Error())
+		}
+		if err := r.validate(name, info); err != nil {
+			return nil, errors.New(file + ":" + err.Error())
+		}
+	}
+
+	if info == nil {
+		r.mux.RLock()
+		_, ok := r.it[name]
+		r.mux.RUnlock()
+		if !ok {
+			return nil, nil // removed by Remove
+		}
+		if err := r.runRemoveHooks(service, id); err != nil {
+			return nil, errors.New(file + " was removed: " + err.Error())
+		}
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	old, ok := r.it[name]
+	if info == nil {
+		if !ok {
+			return nil, nil // removed by Remove while running the hooks
+		}
+		delete(r.it, name)
+		delete(r.fetched, name)
+		r.logger.Info("Removed " + name + ": " + file + " was removed")
+		return &InstanceChange{Service: service, Id: id, Old: old}, nil
+	}
+	if ok && reflect.DeepEqual(old, info) {
+		return nil, nil // written by Add
+	}
+	r.it[name] = info
+	r.fetched[name] = time.Now()
+	delete(r.notFound, name)
+	if ok {
+		r.logger.Info("Reloaded " + file)
+		return &InstanceChange{Service: service, Id: id, Old: old, New: info}, nil
+	}
+	r.logger.Info("Loaded " + file)
+	return &InstanceChange{Service: service, Id: id, New: info}, nil
+}
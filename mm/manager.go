@@ -124,6 +124,9 @@ func (m *Manager) Start() error {
 		m.logger.Info("Started " + configFile)
 	}
 
+	// Stop monitors before the instances they monitor are removed.
+	m.im.AddRemoveHook("mm", m.removeInstance)
+
 	m.running = true
 
 	m.logger.Info("Started")
@@ -133,6 +136,8 @@ func (m *Manager) Start() error {
 
 // @goroutine[0]
 func (m *Manager) Stop() error {
+	m.im.DeleteRemoveHook("mm")
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	for name, monitor := range m.monitors {
@@ -329,3 +334,26 @@ func (m *Manager) getMonitorConfig(cmd *proto.Cmd) (*Config, string, error) {
 
 	return mm, name, nil
 }
+
+// instance.RemoveHook: stop and remove the monitor for the instance, if any.
+func (m *Manager) removeInstance(service string, id uint) error {
+	name := "mm-" + m.im.Name(service, id)
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	monitor, ok := m.monitors[name]
+	if !ok {
+		return nil
+	}
+	m.logger.Info("Stopping " + name + " because the instance is being removed")
+	if err := monitor.Stop(); err != nil {
+		return errors.New("Stop " + name + ": " + err.Error())
+	}
+	m.clock.Remove(monitor.TickChan())
+	delete(m.monitors, name)
+	if err := pct.Basedir.RemoveConfig(name); err != nil {
+		m.logger.Warn("Remove " + name + ": " + err.Error())
+	}
+	return nil
+}
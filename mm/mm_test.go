@@ -538,7 +538,7 @@ func (s *ManagerTestSuite) SetUpSuite(t *C) {
 	s.im = instance.NewRepo(pct.NewLogger(s.logChan, "im"), s.configDir, s.api)
 	data, err := json.Marshal(&proto.MySQLInstance{
 		Hostname: "db1",
-		DSN:      "user:host@tcp:(127.0.0.1:3306)",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
 	})
 	t.Assert(err, IsNil)
 	s.im.Add("mysql", 1, data, false)
@@ -806,6 +806,56 @@ func (s *ManagerTestSuite) TestRestartMonitor(t *C) {
 	t.Check(reply.Error, Not(Equals), "")
 }
 
+func (s *ManagerTestSuite) TestRemoveInstanceStopsMonitor(t *C) {
+	// Use a repo of our own because the instance is removed.
+	im := instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), s.configDir, s.api)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "db1",
+		DSN:      "user:host@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+
+	mrm := mock.NewMrmsMonitor()
+	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, im, mrm)
+	t.Assert(m, NotNil)
+	err = m.Start()
+	t.Assert(err, IsNil)
+	defer m.Stop()
+
+	mmConfig := &mysql.Config{
+		Config: mm.Config{
+			ServiceInstance: proto.ServiceInstance{
+				Service:    "mysql",
+				InstanceId: 1,
+			},
+			Collect: 1,
+			Report:  60,
+		},
+	}
+	mmConfigData, err := json.Marshal(mmConfig)
+	t.Assert(err, IsNil)
+	s.mysqlMonitor.SetConfig(mmConfig)
+	reply := m.Handle(&proto.Cmd{
+		Service: "mm",
+		Cmd:     "StartService",
+		Data:    mmConfigData,
+	})
+	t.Assert(reply.Error, Equals, "")
+	t.Check(m.Status()["monitor"], Equals, "Running")
+	file := s.configDir + "/mm-mysql-1.conf"
+	t.Check(pct.FileExists(file), Equals, true)
+
+	// Removing the instance stops its monitor and removes its config first,
+	// like StopService.
+	err = im.Remove("mysql", 1)
+	t.Assert(err, IsNil)
+	t.Check(m.Status()["monitor"], Equals, "")
+	t.Check(s.clock.Removed, HasLen, 1)
+	t.Check(pct.FileExists(file), Equals, false)
+}
+
 func (s *ManagerTestSuite) TestGetConfig(t *C) {
 	mrm := mock.NewMrmsMonitor()
 	m := mm.NewManager(s.logger, s.factory, s.clock, s.spool, s.im, mrm)
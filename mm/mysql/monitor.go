@@ -49,7 +49,7 @@ type Monitor struct {
 	tickChan       chan time.Time
 	collectionChan chan *mm.Collection
 	connectedChan  chan bool
-	restartChan    <-chan bool
+	restartChan    <-chan mrms.RestartEvent
 	status         *pct.Status
 	sync           *pct.SyncChan
 	running        bool
@@ -21,12 +21,59 @@ import (
 	"time"
 )
 
+// RestartEvent types.
+const (
+	EVENT_RESTART  = "restart"  // MySQL uptime went down
+	EVENT_FAILOVER = "failover" // server_uuid changed, e.g. a VIP moved to another server
+)
+
+// RestartEvent is sent to subscribers when a MySQL restart is detected.
+type RestartEvent struct {
+	DSN        string
+	DetectedAt time.Time
+	Uptime     int64  // MySQL uptime (seconds) when the restart was detected
+	Type       string // EVENT_RESTART or EVENT_FAILOVER
+}
+
+// Metrics is a snapshot of Monitor counters since it was created.
+type Metrics struct {
+	ChecksRun          uint64 // instance checks, including failed ones
+	RestartsDetected   uint64 // restart and failover events
+	CheckErrors        uint64 // instance checks that failed
+	InstancesMonitored uint64
+}
+
 type Monitor interface {
 	Start(interval time.Duration) error
+	// Stop waits up to the stop grace period for an in-progress Check.
 	Stop() error
+	SetStopGracePeriod(d time.Duration)
+	// SetCheckTimeout sets how long Check waits for each instance.
+	SetCheckTimeout(d time.Duration)
+	// SetCheckConcurrency sets how many instances Check checks at once.
+	SetCheckConcurrency(n int)
+	// SetDetectFailover enables EVENT_FAILOVER: if server_uuid changes, the DSN
+	// points to a different server, which is a failover, not a restart.
+	SetDetectFailover(detect bool)
+	// Pause stops notifying subscribers until Resume, but instances are
+	// still checked.
+	Pause()
+	Resume()
 	Status() map[string]string
-	Add(dsn string) (c <-chan bool, err error)
-	Remove(dsn string, c <-chan bool)
+	Metrics() Metrics
+	// Healthy returns true if the monitor loop ran within 2x its interval,
+	// and when it last ran.
+	Healthy() (bool, time.Time)
+	// Add subscribes to restart events for dsn.  If an interval is given,
+	// dsn is checked at that interval instead of the monitor interval.
+	Add(dsn string, interval ...time.Duration) (c <-chan RestartEvent, err error)
+	Remove(dsn string, c <-chan RestartEvent)
+	// SubscriberCounts returns the number of subscribers for each DSN.
+	SubscriberCounts() map[string]int
 	Check()
-	GlobalSubscribe() (chan string, error)
+	// GlobalSubscribe sends restart events for all instances, including ones
+	// added later, to c.  If c is full, the event is dropped after 1s.
+	GlobalSubscribe(c chan RestartEvent) error
+	// GlobalUnsubscribe stops sending restart events to c.
+	GlobalUnsubscribe(c chan RestartEvent)
 }
@@ -19,20 +19,38 @@ package monitor
 
 import (
 	"fmt"
+	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	MIN_CONNECT_BACKOFF = 1 * time.Second
+	MAX_CONNECT_BACKOFF = 60 * time.Second
+)
+
 type MysqlInstance struct {
 	logger      *pct.Logger
 	mysqlConn   mysql.Connector
 	Subscribers *Subscribers
+	NowFunc     func() time.Time
 	// --
 	lastUptime      int64
 	lastUptimeCheck time.Time
+	lastServerUUID  string
+	detectFailover  bool
+	connectFailures uint
+	connectBackoff  time.Duration
+	nextConnect     time.Time
 	sync.Mutex
+	// Scheduling has its own lock so a hung check doesn't block the monitor.
+	checkInterval time.Duration // 0 = monitor interval
+	nextCheck     time.Time
+	checking      int32 // 1 while a check is running, see TryCheck
+	schedMux      sync.Mutex
 }
 
 func NewMysqlInstance(logger *pct.Logger, mysqlConn mysql.Connector, subscribers *Subscribers) (mi *MysqlInstance, err error) {
@@ -53,63 +71,172 @@ func NewMysqlInstance(logger *pct.Logger, mysqlConn mysql.Connector, subscribers
 	}
 	lastUptimeCheck := time.Now()
 
+	// Empty if MySQL doesn't have it (< 5.6), so failovers can't be detected.
+	lastServerUUID := mysqlConn.GetGlobalVarString("server_uuid")
+
 	mi = &MysqlInstance{
 		logger:          logger,
 		mysqlConn:       mysqlConn,
 		Subscribers:     subscribers,
+		NowFunc:         time.Now,
 		lastUptime:      lastUptime,
 		lastUptimeCheck: lastUptimeCheck,
+		lastServerUUID:  lastServerUUID,
 	}
 
 	return mi, nil
 }
 
+// SetDetectFailover enables checking server_uuid, see CheckRestart.
+func (m *MysqlInstance) SetDetectFailover(detect bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.detectFailover = detect
+}
+
+// SetCheckInterval sets how often the monitor checks this instance.  Zero
+// means at the monitor interval.
+func (m *MysqlInstance) SetCheckInterval(interval time.Duration) {
+	m.schedMux.Lock()
+	defer m.schedMux.Unlock()
+	m.checkInterval = interval
+	m.nextCheck = time.Time{}
+}
+
+func (m *MysqlInstance) CheckInterval() time.Duration {
+	m.schedMux.Lock()
+	defer m.schedMux.Unlock()
+	return m.checkInterval
+}
+
+// due returns true and schedules the next check if the instance is due to
+// be checked at now.  defaultInterval is used if the instance doesn't have
+// its own check interval.
+func (m *MysqlInstance) due(now time.Time, defaultInterval time.Duration) bool {
+	m.schedMux.Lock()
+	defer m.schedMux.Unlock()
+	if now.Before(m.nextCheck) {
+		return false
+	}
+	interval := m.checkInterval
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	m.nextCheck = now.Add(interval)
+	return true
+}
+
+// NextCheck returns when the instance is due to be checked next.
+func (m *MysqlInstance) NextCheck() time.Time {
+	m.schedMux.Lock()
+	defer m.schedMux.Unlock()
+	return m.nextCheck
+}
+
+// TryCheck returns true if no check is running, in which case the caller must
+// call CheckDone when its check is done.
+func (m *MysqlInstance) TryCheck() bool {
+	return atomic.CompareAndSwapInt32(&m.checking, 0, 1)
+}
+
+func (m *MysqlInstance) CheckDone() {
+	atomic.StoreInt32(&m.checking, 0)
+}
+
 func (m *MysqlInstance) CheckIfMysqlRestarted() (bool, error) {
+	eventType, err := m.CheckRestart()
+	return eventType != "", err
+}
+
+// CheckRestart returns mrms.EVENT_RESTART if MySQL was restarted since the
+// last check, or mrms.EVENT_FAILOVER if failover detection is enabled and
+// server_uuid changed, i.e. the DSN points to a different server.  It returns
+// an empty string if neither happened.
+func (m *MysqlInstance) CheckRestart() (string, error) {
 	m.Lock()
 	defer m.Unlock()
 
+	// While MySQL is unreachable, don't try to connect on every check.
+	now := m.NowFunc()
+	if now.Before(m.nextConnect) {
+		m.logger.Debug(fmt.Sprintf("Unreachable, next connect in %s", m.nextConnect.Sub(now)))
+		return "", nil
+	}
+
 	if err := m.mysqlConn.Connect(1); err != nil {
-		return false, err
+		m.connectFailed(now)
+		return "", err
 	}
 	defer m.mysqlConn.Close()
+	m.connectFailures = 0
+	m.connectBackoff = 0
+	m.nextConnect = time.Time{}
 
 	lastUptime := m.lastUptime
 	lastUptimeCheck := m.lastUptimeCheck
 	currentUptime, err := m.mysqlConn.Uptime()
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	m.logger.Debug(fmt.Sprintf("lastUptime=%d lastUptimeCheck=%s currentUptime=%d",
 		lastUptime, lastUptimeCheck.UTC(), currentUptime))
 
-	// Calculate expected uptime
-	//   This protects against situation where after restarting MySQL
-	//   we are unable to connect to it for period longer than last registered uptime
-	//
-	// Steps to reproduce:
-	// * currentUptime=60 lastUptime=0
-	// * Restart MySQL
-	// * QAN connection problem for 120s
-	// * currentUptime=120 lastUptime=60 (new uptime (120s) is higher than last registered (60s))
-	// * elapsedTime=120s (time elapsed since last check)
-	// * expectedUptime= 60s + 120s = 180s
-	// * 120s < 180s (currentUptime < expectedUptime) => server was restarted
-	elapsedTime := time.Now().Unix() - lastUptimeCheck.Unix()
-	expectedUptime := lastUptime + elapsedTime
-	m.logger.Debug(fmt.Sprintf("elapsedTime=%d expectedUptime=%d", elapsedTime, expectedUptime))
-
 	// Save uptime from last check
 	m.lastUptime = currentUptime
 	m.lastUptimeCheck = time.Now()
 
-	// If current server uptime is lower than last registered uptime
-	// then we can assume that server was restarted
-	if currentUptime < expectedUptime {
-		return true, nil
+	// A different server may have any uptime, so check this first.
+	if m.detectFailover {
+		serverUUID := m.mysqlConn.GetGlobalVarString("server_uuid")
+		lastServerUUID := m.lastServerUUID
+		if serverUUID != "" {
+			m.lastServerUUID = serverUUID
+		}
+		if lastServerUUID != "" && serverUUID != "" && serverUUID != lastServerUUID {
+			m.logger.Debug(fmt.Sprintf("server_uuid changed from %s to %s", lastServerUUID, serverUUID))
+			return mrms.EVENT_FAILOVER, nil
+		}
+	}
+
+	// Uptime only goes down if the server was restarted.  Being able to
+	// reconnect says nothing: a firewall or proxy may have only dropped the
+	// TCP connection, so don't treat a reconnect as a restart.
+	if currentUptime < lastUptime {
+		return mrms.EVENT_RESTART, nil
 	}
 
-	return false, nil
+	return "", nil
+}
+
+// Uptime returns the MySQL uptime from the last successful check.
+func (m *MysqlInstance) Uptime() int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.lastUptime
+}
+
+// ConnectBackoff returns how long to wait before the next connect attempt,
+// zero if the last attempt succeeded.
+func (m *MysqlInstance) ConnectBackoff() time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return m.connectBackoff
+}
+
+func (m *MysqlInstance) connectFailed(now time.Time) {
+	// 1s, 2s, 4s, ... up to MAX_CONNECT_BACKOFF
+	m.connectFailures++
+	if m.connectBackoff == 0 {
+		m.connectBackoff = MIN_CONNECT_BACKOFF
+	} else {
+		m.connectBackoff *= 2
+	}
+	if m.connectBackoff > MAX_CONNECT_BACKOFF {
+		m.connectBackoff = MAX_CONNECT_BACKOFF
+	}
+	m.nextConnect = now.Add(m.connectBackoff)
+	m.logger.Debug(fmt.Sprintf("Connect failed %d times, next connect in %s", m.connectFailures, m.connectBackoff))
 }
 
 func (m *MysqlInstance) DSN() string {
@@ -18,27 +18,53 @@
 package monitor
 
 import (
+	"fmt"
 	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	MONITOR_NAME = "mrms-monitor"
+	MONITOR_NAME              = "mrms-monitor"
+	DEFAULT_STOP_GRACE_PERIOD = 10 * time.Second
+	DEFAULT_CHECK_TIMEOUT     = 10 * time.Second
+	DEFAULT_CHECK_CONCURRENCY = 10
+	// More subscribers than this for one DSN probably means they're leaking,
+	// i.e. not removed, so Add logs a warning.
+	SUBSCRIBER_WARN_COUNT = 10
 )
 
 type Monitor struct {
+	// Metrics, first for 64-bit alignment of atomic ops
+	checksRun          uint64
+	restartsDetected   uint64
+	checkErrors        uint64
+	instancesMonitored uint64
+	// --
 	logger           *pct.Logger
 	mysqlConnFactory mysql.ConnectionFactory
 	// --
 	mysqlInstances map[string]*MysqlInstance
 	sync.RWMutex
 	// --
-	status     *pct.Status
-	sync       *pct.SyncChan
-	globalChan chan string
+	status      *pct.Status
+	sync        *pct.SyncChan
+	globalChans []chan mrms.RestartEvent
+	// Stop waits this long for an in-progress Check to finish.
+	stopGracePeriod  time.Duration
+	checkTimeout     time.Duration
+	checkConcurrency int
+	detectFailover   bool
+	paused           bool
+	state            string // status without ", paused"
+	running          bool
+	runDone          chan struct{} // closed when run returns
+	interval         time.Duration
+	lastCheck        time.Time // when the last Check finished
+	runMux           sync.Mutex
 }
 
 func NewMonitor(logger *pct.Logger, mysqlConnFactory mysql.ConnectionFactory) mrms.Monitor {
@@ -48,9 +74,12 @@ func NewMonitor(logger *pct.Logger, mysqlConnFactory mysql.ConnectionFactory) mr
 		// --
 		mysqlInstances: make(map[string]*MysqlInstance),
 		// --
-		status:     pct.NewStatus([]string{MONITOR_NAME}),
-		sync:       pct.NewSyncChan(),
-		globalChan: make(chan string, 100),
+		status: pct.NewStatus([]string{MONITOR_NAME}),
+		sync:   pct.NewSyncChan(),
+		// --
+		stopGracePeriod:  DEFAULT_STOP_GRACE_PERIOD,
+		checkTimeout:     DEFAULT_CHECK_TIMEOUT,
+		checkConcurrency: DEFAULT_CHECK_CONCURRENCY,
 	}
 	return m
 }
@@ -66,26 +95,160 @@ func (m *Monitor) Start(interval time.Duration) error {
 	m.logger.Debug("Start:call")
 	defer m.logger.Debug("Start:return")
 
-	go m.run(interval)
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	if m.running {
+		return nil
+	}
+	m.running = true
+	m.interval = interval
+	m.sync = pct.NewSyncChan()
+	m.runDone = make(chan struct{})
+	go m.run(interval, m.sync, m.runDone)
 	return nil
 }
 
+// Stop waits up to the stop grace period for an in-progress Check to finish.
+// It returns an error if the monitor did not stop in time, in which case it
+// stops as soon as the Check finishes.  Stopping a monitor that isn't running
+// is a no-op.
 func (m *Monitor) Stop() error {
 	m.logger.Debug("Stop:call")
 	defer m.logger.Debug("Stop:return")
 
-	m.sync.Stop()
-	m.sync.Wait()
+	m.runMux.Lock()
+	running := m.running
+	syncChan := m.sync
+	runDone := m.runDone
+	gracePeriod := m.stopGracePeriod
+	m.runMux.Unlock()
+	if !running {
+		return nil
+	}
+
+	m.setStatus("Stopping")
+	timeout := time.After(gracePeriod)
+	select {
+	case syncChan.StopChan <- true:
+	case <-runDone: // crashed
+		return nil
+	case <-timeout:
+		// Stop as soon as the Check finishes, unless run returns first.
+		go func() {
+			select {
+			case syncChan.StopChan <- true:
+			case <-runDone:
+			}
+		}()
+		return fmt.Errorf("Timeout waiting %s for %s to stop", gracePeriod, MONITOR_NAME)
+	}
+	select {
+	case <-runDone:
+	case <-timeout:
+		return fmt.Errorf("Timeout waiting %s for %s to stop", gracePeriod, MONITOR_NAME)
+	}
 	return nil
 }
 
+// SetStopGracePeriod sets how long Stop waits for an in-progress Check,
+// DEFAULT_STOP_GRACE_PERIOD by default.
+func (m *Monitor) SetStopGracePeriod(d time.Duration) {
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	m.stopGracePeriod = d
+}
+
+// SetCheckTimeout sets how long Check waits for each instance,
+// DEFAULT_CHECK_TIMEOUT by default.  An instance that doesn't respond in time,
+// e.g. because the network is partitioned, is skipped until its check returns.
+func (m *Monitor) SetCheckTimeout(d time.Duration) {
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	m.checkTimeout = d
+}
+
+// SetCheckConcurrency sets how many instances Check checks at once,
+// DEFAULT_CHECK_CONCURRENCY by default.  Values less than 1 mean 1.
+func (m *Monitor) SetCheckConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	m.checkConcurrency = n
+}
+
+// SetDetectFailover enables checking server_uuid so that a different server
+// behind a DSN is reported as EVENT_FAILOVER, not EVENT_RESTART.  It's off by
+// default.
+func (m *Monitor) SetDetectFailover(detect bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.detectFailover = detect
+	for _, mysqlInstance := range m.mysqlInstances {
+		mysqlInstance.SetDetectFailover(detect)
+	}
+}
+
 func (m *Monitor) Status() map[string]string {
 	return m.status.All()
 }
 
-func (m *Monitor) Add(dsn string) (c <-chan bool, err error) {
-	m.logger.Debug("Add:call:" + mysql.HideDSNPassword(dsn))
-	defer m.logger.Debug("Add:return:" + mysql.HideDSNPassword(dsn))
+// Pause stops notifying subscribers, e.g. during planned MySQL maintenance.
+// Instances are still checked so that a restart while paused isn't reported
+// after Resume.
+func (m *Monitor) Pause() {
+	m.logger.Debug("Pause:call")
+	defer m.logger.Debug("Pause:return")
+	m.runMux.Lock()
+	m.paused = true
+	state := m.state
+	m.runMux.Unlock()
+	if state != "" {
+		m.setStatus(state)
+	}
+}
+
+// Resume notifies subscribers again after Pause.
+func (m *Monitor) Resume() {
+	m.logger.Debug("Resume:call")
+	defer m.logger.Debug("Resume:return")
+	m.runMux.Lock()
+	m.paused = false
+	state := m.state
+	m.runMux.Unlock()
+	if state != "" {
+		m.setStatus(state)
+	}
+}
+
+// Metrics returns a snapshot of the monitor counters.
+func (m *Monitor) Metrics() mrms.Metrics {
+	return mrms.Metrics{
+		ChecksRun:          atomic.LoadUint64(&m.checksRun),
+		RestartsDetected:   atomic.LoadUint64(&m.restartsDetected),
+		CheckErrors:        atomic.LoadUint64(&m.checkErrors),
+		InstancesMonitored: atomic.LoadUint64(&m.instancesMonitored),
+	}
+}
+
+// Healthy returns true if the last Check finished within 2x the interval
+// given to Start, and when that was.  It returns false if the monitor was
+// never started, or if it was stopped or a Check hung.
+func (m *Monitor) Healthy() (bool, time.Time) {
+	m.runMux.Lock()
+	defer m.runMux.Unlock()
+	if m.interval == 0 || m.lastCheck.IsZero() {
+		return false, m.lastCheck
+	}
+	return time.Now().Sub(m.lastCheck) <= 2*m.interval, m.lastCheck
+}
+
+// Add subscribes to restart events for dsn.  If an interval is given, the
+// instance is checked at that interval instead of the monitor interval.
+func (m *Monitor) Add(dsn string, interval ...time.Duration) (c <-chan mrms.RestartEvent, err error) {
+	m.logger.Debug("Add:call:" + mysql.HideDSN(dsn))
+	defer m.logger.Debug("Add:return:" + mysql.HideDSN(dsn))
 
 	m.Lock()
 	defer m.Unlock()
@@ -96,33 +259,77 @@ func (m *Monitor) Add(dsn string) (c <-chan bool, err error) {
 		if err != nil {
 			return nil, err
 		}
+		mysqlInstance.SetDetectFailover(m.detectFailover)
+		for _, globalChan := range m.globalChans {
+			if err := mysqlInstance.Subscribers.GlobalAdd(globalChan, dsn); err != nil {
+				return nil, err
+			}
+		}
 		m.mysqlInstances[dsn] = mysqlInstance
+		atomic.StoreUint64(&m.instancesMonitored, uint64(len(m.mysqlInstances)))
+	}
+	if len(interval) > 0 && interval[0] > 0 {
+		mysqlInstance.SetCheckInterval(interval[0])
 	}
 
 	c = mysqlInstance.Subscribers.Add()
+	if n := mysqlInstance.Subscribers.Count(); n > SUBSCRIBER_WARN_COUNT {
+		m.logger.Warn(fmt.Sprintf("MySQL %s has %d subscribers, expected at most %d; are subscribers not being removed?",
+			mysql.HideDSN(dsn), n, SUBSCRIBER_WARN_COUNT))
+	}
 	return c, nil
 }
 
-func (m *Monitor) GlobalSubscribe() (chan string, error) {
+// SubscriberCounts returns the number of subscribers for each DSN, not
+// including global subscribers.
+func (m *Monitor) SubscriberCounts() map[string]int {
+	m.RLock()
+	defer m.RUnlock()
+
+	counts := make(map[string]int, len(m.mysqlInstances))
+	for dsn, mysqlInstance := range m.mysqlInstances {
+		counts[dsn] = mysqlInstance.Subscribers.Count()
+	}
+	return counts
+}
+
+func (m *Monitor) GlobalSubscribe(c chan mrms.RestartEvent) error {
 	m.logger.Debug("GlobalSusbcribe:call")
 	defer m.logger.Debug("GlobalSubscribe:return")
 
 	m.Lock()
 	defer m.Unlock()
-	var err error
 
 	for _, instance := range m.mysqlInstances {
-		err = instance.Subscribers.GlobalAdd(m.globalChan, instance.mysqlConn.DSN())
-		if err != nil {
-			return nil, err
+		if err := instance.Subscribers.GlobalAdd(c, instance.mysqlConn.DSN()); err != nil {
+			return err
+		}
+	}
+	m.globalChans = append(m.globalChans, c)
+	return nil
+}
+
+func (m *Monitor) GlobalUnsubscribe(c chan mrms.RestartEvent) {
+	m.logger.Debug("GlobalUnsubscribe:call")
+	defer m.logger.Debug("GlobalUnsubscribe:return")
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, instance := range m.mysqlInstances {
+		instance.Subscribers.GlobalRemoveChan(c)
+	}
+	for i, globalChan := range m.globalChans {
+		if globalChan == c {
+			m.globalChans = append(m.globalChans[:i], m.globalChans[i+1:]...)
+			break
 		}
 	}
-	return m.globalChan, nil
 }
 
-func (m *Monitor) Remove(dsn string, c <-chan bool) {
-	m.logger.Debug("Remove:call:" + mysql.HideDSNPassword(dsn))
-	defer m.logger.Debug("Remove:return:" + mysql.HideDSNPassword(dsn))
+func (m *Monitor) Remove(dsn string, c <-chan mrms.RestartEvent) {
+	m.logger.Debug("Remove:call:" + mysql.HideDSN(dsn))
+	defer m.logger.Debug("Remove:return:" + mysql.HideDSN(dsn))
 
 	m.Lock()
 	defer m.Unlock()
@@ -131,6 +338,7 @@ func (m *Monitor) Remove(dsn string, c <-chan bool) {
 		mysqlInstance.Subscribers.Remove(c)
 		if mysqlInstance.Subscribers.Empty() {
 			delete(m.mysqlInstances, dsn)
+			atomic.StoreUint64(&m.instancesMonitored, uint64(len(m.mysqlInstances)))
 		}
 		mysqlInstance.Subscribers.GlobalRemove(dsn)
 	}
@@ -140,19 +348,78 @@ func (m *Monitor) Check() {
 	m.logger.Debug("Check:call")
 	defer m.logger.Debug("Check:return")
 
-	m.RLock()
-	defer m.RUnlock()
+	defer func() {
+		m.runMux.Lock()
+		m.lastCheck = time.Now()
+		m.runMux.Unlock()
+	}()
+
+	m.runMux.Lock()
+	defaultInterval := m.interval
+	checkTimeout := m.checkTimeout
+	concurrency := m.checkConcurrency
+	paused := m.paused
+	m.runMux.Unlock()
 
+	// Only check instances that are due, see Add.  The instances are checked
+	// without holding the lock so a slow check doesn't block Add and Remove.
+	m.RLock()
+	now := time.Now()
+	due := []*MysqlInstance{}
 	for _, mysqlInstance := range m.mysqlInstances {
-		wasRestarted, err := mysqlInstance.CheckIfMysqlRestarted()
-		if err != nil {
-			m.logger.Error(err)
+		if mysqlInstance.due(now, defaultInterval) {
+			due = append(due, mysqlInstance)
+		}
+	}
+	m.RUnlock()
+
+	// Check up to concurrency instances at once...
+	eventTypes := make([]string, len(due))
+	if concurrency > len(due) {
+		concurrency = len(due)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				atomic.AddUint64(&m.checksRun, 1)
+				eventType, err := m.checkInstance(due[n], checkTimeout)
+				if err != nil {
+					atomic.AddUint64(&m.checkErrors, 1)
+					m.logger.Error(err)
+					continue
+				}
+				eventTypes[n] = eventType
+			}
+		}()
+	}
+	for n := range due {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+
+	// ...then notify subscribers.
+	for n, eventType := range eventTypes {
+		if eventType == "" {
 			continue
 		}
-		if wasRestarted {
-			m.logger.Debug("Check:restarted:" + mysql.HideDSNPassword(mysqlInstance.DSN()))
-			mysqlInstance.Subscribers.Notify()
+		atomic.AddUint64(&m.restartsDetected, 1)
+		mysqlInstance := due[n]
+		m.logger.Debug("Check:" + eventType + ":" + mysql.HideDSN(mysqlInstance.DSN()))
+		if paused {
+			m.logger.Info("Paused, not reporting MySQL " + eventType + ": " + mysql.HideDSN(mysqlInstance.DSN()))
+			continue
 		}
+		mysqlInstance.Subscribers.Notify(mrms.RestartEvent{
+			DSN:        mysqlInstance.DSN(),
+			DetectedAt: time.Now().UTC(),
+			Uptime:     mysqlInstance.Uptime(),
+			Type:       eventType,
+		})
 	}
 }
 
@@ -160,7 +427,7 @@ func (m *Monitor) Check() {
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
 
-func (m *Monitor) run(interval time.Duration) {
+func (m *Monitor) run(interval time.Duration, syncChan *pct.SyncChan, runDone chan struct{}) {
 	m.logger.Debug("run:call")
 	defer m.logger.Debug("run:return")
 
@@ -168,29 +435,89 @@ func (m *Monitor) run(interval time.Duration) {
 		if err := recover(); err != nil {
 			m.logger.Error("MySQL Restart Monitor Service (MRMS) crashsed: ", err)
 		}
-		m.status.Update(MONITOR_NAME, "Stopped")
-		m.sync.Done()
+		m.setStatus("Stopped")
+		m.runMux.Lock()
+		m.running = false
+		m.runMux.Unlock()
+		close(runDone)
+		syncChan.Done()
 	}()
 
 	for {
 		// Immediately run first check...
-		m.status.Update(MONITOR_NAME, "Checking")
+		m.setStatus("Checking")
 		m.Check()
 
-		// ...and after that idle for *interval* until next check,
-		// or until monitor is stopped
-		m.status.Update(MONITOR_NAME, "Idle")
+		// ...and after that idle until the next instance is due, at most
+		// *interval*, or until monitor is stopped
+		m.setStatus("Idle")
 		select {
-		case <-time.After(interval):
-		case <-m.sync.StopChan:
+		case <-time.After(m.nextWait(interval)):
+		case <-syncChan.StopChan:
 			return
 		}
 	}
 }
 
+// checkInstance runs mysqlInstance.CheckRestart but waits at most timeout for
+// it.  If the check hangs, it keeps running in the background and the instance
+// isn't checked again until it returns.
+func (m *Monitor) checkInstance(mysqlInstance *MysqlInstance, timeout time.Duration) (string, error) {
+	if !mysqlInstance.TryCheck() {
+		return "", fmt.Errorf("Previous check of MySQL %s is still running", mysql.HideDSN(mysqlInstance.DSN()))
+	}
+	type result struct {
+		eventType string
+		err       error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		defer mysqlInstance.CheckDone()
+		eventType, err := mysqlInstance.CheckRestart()
+		resultChan <- result{eventType, err}
+	}()
+	select {
+	case r := <-resultChan:
+		return r.eventType, r.err
+	case <-time.After(timeout):
+		return "", fmt.Errorf("Timeout checking MySQL %s after %s", mysql.HideDSN(mysqlInstance.DSN()), timeout)
+	}
+}
+
+// setStatus updates the monitor status to state, adding ", paused" if the
+// monitor is paused.
+func (m *Monitor) setStatus(state string) {
+	m.runMux.Lock()
+	m.state = state
+	paused := m.paused
+	m.runMux.Unlock()
+	if paused {
+		state += ", paused"
+	}
+	m.status.Update(MONITOR_NAME, state)
+}
+
+// nextWait returns how long until the next instance is due to be checked,
+// at most interval.
+func (m *Monitor) nextWait(interval time.Duration) time.Duration {
+	m.RLock()
+	defer m.RUnlock()
+	wait := interval
+	now := time.Now()
+	for _, mysqlInstance := range m.mysqlInstances {
+		if d := mysqlInstance.NextCheck().Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
 func (m *Monitor) createMysqlInstance(dsn string) (mi *MysqlInstance, err error) {
-	m.logger.Debug("createMysqlInstance:call:" + mysql.HideDSNPassword(dsn))
-	defer m.logger.Debug("createMysqlInstance:return:" + mysql.HideDSNPassword(dsn))
+	m.logger.Debug("createMysqlInstance:call:" + mysql.HideDSN(dsn))
+	defer m.logger.Debug("createMysqlInstance:return:" + mysql.HideDSN(dsn))
 
 	mysqlConn := m.mysqlConnFactory.Make(dsn)
 	// todo: fix
@@ -18,10 +18,14 @@
 package monitor_test
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mrms/monitor"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
@@ -83,7 +87,7 @@ func (s *TestSuite) TestStartStop(t *C) {
 	// After max 1 second it should notify subscriber about MySQL restart
 	var notified bool
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	case <-time.After(1 * time.Second):
 	}
 	t.Assert(notified, Equals, true, Commentf("MySQL was restarted but MRMS didn't notify subscribers"))
@@ -106,26 +110,403 @@ func (s *TestSuite) TestStartStop(t *C) {
 	// After stopping service it should not notify subscribers anymore
 	time.Sleep(2 * time.Second)
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	default:
 	}
 	t.Assert(notified, Equals, true, Commentf("MRMS notified subscribers after being stopped"))
 }
 
+// slowMySQL makes Check slow by delaying Uptime.
+type slowMySQL struct {
+	*mock.NullMySQL
+	delay time.Duration
+}
+
+func (c *slowMySQL) Uptime() (int64, error) {
+	time.Sleep(c.delay)
+	return c.NullMySQL.Uptime()
+}
+
+func (s *TestSuite) TestStopGracePeriod(t *C) {
+	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
+
+	/**
+	 * Stop waits for the in-progress Check if it finishes within the grace period.
+	 */
+	mockConn := &slowMySQL{NullMySQL: mock.NewNullMySQL()}
+	m := monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mockConn})
+	m.SetStopGracePeriod(2 * time.Second)
+	_, err := m.Add(dsn)
+	t.Assert(err, IsNil)
+
+	mockConn.delay = 500 * time.Millisecond
+	err = m.Start(1 * time.Hour)
+	t.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond) // let the first Check start
+
+	t0 := time.Now()
+	err = m.Stop()
+	t.Check(err, IsNil)
+	t.Check(time.Now().Sub(t0) >= 300*time.Millisecond, Equals, true, Commentf("Stop did not wait for Check"))
+	t.Check(m.Status(), DeepEquals, map[string]string{
+		monitor.MONITOR_NAME: "Stopped",
+	})
+
+	/**
+	 * Stop returns an error if Check takes longer than the grace period.
+	 */
+	mockConn = &slowMySQL{NullMySQL: mock.NewNullMySQL()}
+	m = monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mockConn})
+	m.SetStopGracePeriod(100 * time.Millisecond)
+	_, err = m.Add(dsn)
+	t.Assert(err, IsNil)
+
+	mockConn.delay = 1 * time.Second
+	err = m.Start(1 * time.Hour)
+	t.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+
+	t0 = time.Now()
+	err = m.Stop()
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) < 1*time.Second, Equals, true, Commentf("Stop did not time out"))
+}
+
+func (s *TestSuite) TestStopNotRunning(t *C) {
+	m := monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mock.NewNullMySQL()})
+	m.SetStopGracePeriod(2 * time.Second)
+
+	// Never started: Stop returns immediately, not after the grace period.
+	t0 := time.Now()
+	err := m.Stop()
+	t.Check(err, IsNil)
+	t.Check(time.Now().Sub(t0) < 500*time.Millisecond, Equals, true, Commentf("Stop waited %s", time.Now().Sub(t0)))
+
+	// Already stopped, too.
+	err = m.Start(1 * time.Hour)
+	t.Assert(err, IsNil)
+	err = m.Stop()
+	t.Check(err, IsNil)
+	t0 = time.Now()
+	err = m.Stop()
+	t.Check(err, IsNil)
+	t.Check(time.Now().Sub(t0) < 500*time.Millisecond, Equals, true, Commentf("Stop waited %s", time.Now().Sub(t0)))
+
+	// It can be started again.
+	err = m.Start(1 * time.Hour)
+	t.Assert(err, IsNil)
+	err = m.Stop()
+	t.Check(err, IsNil)
+}
+
+func (s *TestSuite) TestHealthy(t *C) {
+	m := monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mock.NewNullMySQL()})
+	_, err := m.Add("fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true")
+	t.Assert(err, IsNil)
+
+	// Never started.
+	healthy, lastCheck := m.Healthy()
+	t.Check(healthy, Equals, false)
+	t.Check(lastCheck.IsZero(), Equals, true)
+
+	interval := 100 * time.Millisecond
+	err = m.Start(interval)
+	t.Assert(err, IsNil)
+	time.Sleep(250 * time.Millisecond)
+	healthy, lastCheck = m.Healthy()
+	t.Check(healthy, Equals, true)
+	t.Check(time.Now().Sub(lastCheck) <= 2*interval, Equals, true, Commentf("lastCheck %s", lastCheck))
+
+	// Once stopped, the loop doesn't run, so it's unhealthy after 2x interval.
+	err = m.Stop()
+	t.Assert(err, IsNil)
+	time.Sleep(2*interval + 50*time.Millisecond)
+	healthy, lastCheck2 := m.Healthy()
+	t.Check(healthy, Equals, false)
+	t.Check(lastCheck2.Before(lastCheck), Equals, false)
+}
+
+// dsnFactory makes a different connection for each DSN.
+type dsnFactory map[string]mysql.Connector
+
+func (f dsnFactory) Make(dsn string) mysql.Connector {
+	return f[dsn]
+}
+
+func (s *TestSuite) TestCheckInterval(t *C) {
+	fastDSN := "fast:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
+	slowDSN := "slow:dsn@tcp(127.0.0.1:3307)/?parseTime=true"
+	fastConn := mock.NewNullMySQL()
+	slowConn := mock.NewNullMySQL()
+	m := monitor.NewMonitor(s.logger, dsnFactory{fastDSN: fastConn, slowDSN: slowConn})
+
+	_, err := m.Add(fastDSN, 50*time.Millisecond)
+	t.Assert(err, IsNil)
+	_, err = m.Add(slowDSN) // monitor interval
+	t.Assert(err, IsNil)
+	fast0 := fastConn.GetUptimeCount()
+	slow0 := slowConn.GetUptimeCount()
+
+	err = m.Start(400 * time.Millisecond)
+	t.Assert(err, IsNil)
+	time.Sleep(1 * time.Second)
+	err = m.Stop()
+	t.Assert(err, IsNil)
+
+	// Fast: checked every 50ms, so about 20 times.  Slow: checked at
+	// 0, 400ms, and 800ms.
+	fast := fastConn.GetUptimeCount() - fast0
+	slow := slowConn.GetUptimeCount() - slow0
+	t.Check(slow >= 2 && slow <= 4, Equals, true, Commentf("slow checked %d times", slow))
+	t.Check(fast >= 10, Equals, true, Commentf("fast checked %d times", fast))
+}
+
+// hangMySQL blocks Connect until hang is closed, like a partitioned network.
+type hangMySQL struct {
+	*mock.NullMySQL
+	hang chan struct{}
+}
+
+func (c *hangMySQL) Connect(tries uint) error {
+	if c.hang != nil {
+		<-c.hang
+	}
+	return c.NullMySQL.Connect(tries)
+}
+
+func (s *TestSuite) TestCheckTimeout(t *C) {
+	mockConn := &hangMySQL{NullMySQL: mock.NewNullMySQL()}
+	m := monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mockConn})
+	m.SetCheckTimeout(200 * time.Millisecond)
+	_, err := m.Add("fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true")
+	t.Assert(err, IsNil)
+
+	// Check returns by the timeout even though MySQL never responds...
+	mockConn.hang = make(chan struct{})
+	t0 := time.Now()
+	m.Check()
+	d := time.Now().Sub(t0)
+	t.Check(d >= 200*time.Millisecond && d < 1*time.Second, Equals, true, Commentf("Check took %s", d))
+
+	// ...and while it still hasn't, the instance is skipped.
+	t0 = time.Now()
+	m.Check()
+	d = time.Now().Sub(t0)
+	t.Check(d < 100*time.Millisecond, Equals, true, Commentf("Check took %s", d))
+
+	// Once MySQL responds, the instance is checked again.
+	uptimeCount := mockConn.GetUptimeCount()
+	close(mockConn.hang)
+	time.Sleep(100 * time.Millisecond)
+	t.Check(mockConn.GetUptimeCount(), Equals, uptimeCount+1) // the hung check
+	m.Check()
+	t.Check(mockConn.GetUptimeCount(), Equals, uptimeCount+2)
+}
+
+func (s *TestSuite) TestCheckConcurrency(t *C) {
+	// 20 instances that take 100ms each to check.
+	factory := dsnFactory{}
+	conns := []*slowMySQL{}
+	for i := 0; i < 20; i++ {
+		conn := &slowMySQL{NullMySQL: mock.NewNullMySQL()}
+		factory[fmt.Sprintf("fake:dsn@tcp(127.0.0.1:%d)/", 4000+i)] = conn
+		conns = append(conns, conn)
+	}
+	m := monitor.NewMonitor(s.logger, factory)
+	for dsn := range factory {
+		_, err := m.Add(dsn)
+		t.Assert(err, IsNil)
+	}
+	for _, conn := range conns {
+		conn.delay = 100 * time.Millisecond
+	}
+
+	checkTime := func(concurrency int) time.Duration {
+		m.SetCheckConcurrency(concurrency)
+		t0 := time.Now()
+		m.Check()
+		return time.Now().Sub(t0)
+	}
+
+	// 10 at once: 2 rounds of 100ms.
+	d := checkTime(10)
+	t.Check(d >= 200*time.Millisecond && d < 600*time.Millisecond, Equals, true, Commentf("Check took %s", d))
+
+	// 20 at once: 1 round.
+	d = checkTime(20)
+	t.Check(d >= 100*time.Millisecond && d < 400*time.Millisecond, Equals, true, Commentf("Check took %s", d))
+
+	// Every instance was checked every time: once by Add, twice by Check.
+	for i, conn := range conns {
+		t.Check(conn.GetUptimeCount(), Equals, uint(3), Commentf("conn %d", i))
+	}
+}
+
+func (s *TestSuite) TestMetrics(t *C) {
+	mockConn := &downMySQL{NullMySQL: mock.NewNullMySQL()}
+	m := monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mockConn})
+	t.Check(m.Metrics(), Equals, mrms.Metrics{})
+
+	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
+	mockConn.SetUptime(10)
+	c, err := m.Add(dsn)
+	t.Assert(err, IsNil)
+	t.Check(m.Metrics(), Equals, mrms.Metrics{InstancesMonitored: 1})
+
+	// No restart.
+	mockConn.SetUptime(11)
+	m.Check()
+	t.Check(m.Metrics(), Equals, mrms.Metrics{ChecksRun: 1, InstancesMonitored: 1})
+
+	// Restart.
+	mockConn.SetUptime(1)
+	m.Check()
+	t.Check(m.Metrics(), Equals, mrms.Metrics{ChecksRun: 2, RestartsDetected: 1, InstancesMonitored: 1})
+
+	// Failed check.
+	mockConn.fail = 1
+	m.Check()
+	t.Check(m.Metrics(), Equals, mrms.Metrics{ChecksRun: 3, RestartsDetected: 1, CheckErrors: 1, InstancesMonitored: 1})
+
+	m.Remove(dsn, c)
+	t.Check(m.Metrics(), Equals, mrms.Metrics{ChecksRun: 3, RestartsDetected: 1, CheckErrors: 1})
+}
+
+func (s *TestSuite) TestPauseResume(t *C) {
+	mockConn := mock.NewNullMySQL()
+	m := monitor.NewMonitor(s.logger, &mock.ConnectionFactory{Conn: mockConn})
+	mockConn.SetUptime(100)
+	c, err := m.Add("fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true")
+	t.Assert(err, IsNil)
+
+	m.Pause()
+	err = m.Start(50 * time.Millisecond)
+	t.Assert(err, IsNil)
+	defer m.Stop()
+	time.Sleep(100 * time.Millisecond)
+	t.Check(strings.HasSuffix(m.Status()[monitor.MONITOR_NAME], ", paused"), Equals, true, Commentf("%+v", m.Status()))
+
+	// Restart while paused: detected but not reported.
+	mockConn.SetUptime(1)
+	select {
+	case e := <-c:
+		t.Errorf("Got restart event while paused: %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+	t.Check(m.Metrics().RestartsDetected, Equals, uint64(1))
+
+	// After resume, the restart during maintenance isn't reported...
+	m.Resume()
+	t.Check(strings.HasSuffix(m.Status()[monitor.MONITOR_NAME], ", paused"), Equals, false, Commentf("%+v", m.Status()))
+	mockConn.SetUptime(2)
+	select {
+	case e := <-c:
+		t.Errorf("Got restart event after resume: %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// ...but new ones are.
+	mockConn.SetUptime(1)
+	select {
+	case e := <-c:
+		t.Check(e.Type, Equals, mrms.EVENT_RESTART)
+	case <-time.After(1 * time.Second):
+		t.Error("No restart event after resume")
+	}
+}
+
+// downMySQL fails to connect while fail > 0, counting every connect attempt.
+type downMySQL struct {
+	*mock.NullMySQL
+	fail     int
+	attempts int
+}
+
+func (c *downMySQL) Connect(tries uint) error {
+	c.attempts++
+	if c.fail > 0 {
+		c.fail--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (s *TestSuite) TestConnectBackoff(t *C) {
+	mockConn := &downMySQL{NullMySQL: mock.NewNullMySQL()}
+	mockConn.SetUptime(100)
+	mi, err := monitor.NewMysqlInstance(s.logger, mockConn, monitor.NewSubscribers(s.logger))
+	t.Assert(err, IsNil)
+	now := time.Now()
+	mi.NowFunc = func() time.Time { return now }
+
+	// MySQL goes down for 8 connect attempts.
+	mockConn.fail = 8
+	mockConn.attempts = 0
+	expect := []time.Duration{1, 2, 4, 8, 16, 32, 60, 60}
+	for i, backoff := range expect {
+		restarted, err := mi.CheckIfMysqlRestarted()
+		t.Check(err, NotNil)
+		t.Check(restarted, Equals, false)
+		t.Check(mi.ConnectBackoff(), Equals, backoff*time.Second, Commentf("failure %d", i+1))
+
+		// Checks during the backoff don't try to connect.
+		now = now.Add(backoff*time.Second - time.Millisecond)
+		restarted, err = mi.CheckIfMysqlRestarted()
+		t.Check(err, IsNil)
+		t.Check(restarted, Equals, false)
+		t.Check(mockConn.attempts, Equals, i+1)
+		now = now.Add(time.Millisecond)
+	}
+
+	// MySQL is back with a lower uptime: it was restarted, and backoff is reset.
+	mockConn.SetUptime(5)
+	restarted, err := mi.CheckIfMysqlRestarted()
+	t.Check(err, IsNil)
+	t.Check(restarted, Equals, true)
+	t.Check(mi.ConnectBackoff(), Equals, time.Duration(0))
+	t.Check(mockConn.attempts, Equals, len(expect)+1)
+
+	// Next check connects right away.
+	mockConn.SetUptime(6)
+	restarted, err = mi.CheckIfMysqlRestarted()
+	t.Check(err, IsNil)
+	t.Check(restarted, Equals, false)
+	t.Check(mockConn.attempts, Equals, len(expect)+2)
+}
+
 func (s *TestSuite) TestGlobalSubscribe(t *C) {
 	mockConn := mock.NewNullMySQL()
 	mockConnFactory := &mock.ConnectionFactory{
 		Conn: mockConn,
 	}
+	mockConn.SetUptime(10)
 	m := monitor.NewMonitor(s.logger, mockConnFactory)
 	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
 	subChan, err := m.Add(dsn)
 	t.Assert(err, IsNil)
 	t.Assert(subChan, NotNil)
 
-	gc, err := m.GlobalSubscribe()
+	gc := make(chan mrms.RestartEvent, 2)
+	err = m.GlobalSubscribe(gc)
+	t.Assert(err, IsNil)
+
+	// Instances added after subscribing notify the global chan too.
+	dsn2 := "fake:dsn@tcp(127.0.0.2:3306)/?parseTime=true"
+	subChan2, err := m.Add(dsn2)
 	t.Assert(err, IsNil)
-	t.Assert(gc, NotNil)
+	t.Assert(subChan2, NotNil)
+
+	mockConn.SetUptime(1)
+	m.Check()
+
+	// Both instances share mockConn, so both were restarted.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-gc:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Global subscriber not notified for instance %d", i+1)
+		}
+	}
 }
 func (s *TestSuite) TestNotifications(t *C) {
 	mockConn := mock.NewNullMySQL()
@@ -148,7 +529,7 @@ func (s *TestSuite) TestNotifications(t *C) {
 	 */
 	var notified bool
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	default:
 	}
 	t.Assert(notified, Equals, false, Commentf("MySQL was not restarted (first check of MySQL server), but MRMS notified subscribers"))
@@ -161,7 +542,7 @@ func (s *TestSuite) TestNotifications(t *C) {
 	m.Check()
 	notified = false
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	default:
 	}
 	t.Assert(notified, Equals, true, Commentf("MySQL was restarted, but MRMS didn't notify subscribers"))
@@ -174,28 +555,26 @@ func (s *TestSuite) TestNotifications(t *C) {
 	m.Check()
 	notified = false
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	default:
 	}
 	t.Assert(notified, Equals, false, Commentf("MySQL was not restarted, but MRMS notified subscribers"))
 
 	/**
-	 * Now let's imitate MySQL server restart and let's wait 3 seconds before next check.
-	 * Since MySQL server was restarted and we waited 3s then uptime=3s
-	 * which is higher than last registered uptime=2s
-	 *
-	 * However we expect in this test that this is properly detected as MySQL restart
-	 * and the MRMS notifies subscribers
+	 * Uptime is only compared to the last registered value, so time passing
+	 * between checks (e.g. while the connection was down) doesn't matter:
+	 * uptime=3s is higher than last registered uptime=2s, so no restart.
 	 */
 	waitTime := int64(3)
 	time.Sleep(time.Duration(waitTime) * time.Second)
 	mockConn.SetUptime(waitTime)
 	m.Check()
+	notified = false
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	default:
 	}
-	t.Assert(notified, Equals, true, Commentf("MySQL was restarted (uptime overlaped last registered uptime), but MRMS didn't notify subscribers"))
+	t.Assert(notified, Equals, false, Commentf("MySQL uptime increased, but MRMS notified subscribers"))
 
 	/**
 	 * After removing subscriber MRMS should not notify it anymore about MySQL restarts
@@ -206,15 +585,138 @@ func (s *TestSuite) TestNotifications(t *C) {
 	m.Check()
 	notified = false
 	select {
-	case notified = <-subChan:
+	case _, notified = <-subChan:
 	default:
 	}
 	t.Assert(notified, Equals, false, Commentf("Subscriber was removed but MRMS still notified it about MySQL restart"))
 }
 
+func (s *TestSuite) TestRestartEvent(t *C) {
+	mockConn := mock.NewNullMySQL()
+	mockConnFactory := &mock.ConnectionFactory{
+		Conn: mockConn,
+	}
+	m := monitor.NewMonitor(s.logger, mockConnFactory)
+
+	mockConn.SetUptime(10)
+	subChan, err := m.Add(mockConn.DSN())
+	t.Assert(err, IsNil)
+	globalChan := make(chan mrms.RestartEvent, 1)
+	err = m.GlobalSubscribe(globalChan)
+	t.Assert(err, IsNil)
+
+	t0 := time.Now().UTC()
+	mockConn.SetUptime(3)
+	m.Check()
+
+	var event mrms.RestartEvent
+	select {
+	case event = <-subChan:
+	default:
+		t.Fatal("MySQL was restarted, but MRMS didn't notify subscriber")
+	}
+	t.Check(event.DSN, Equals, mockConn.DSN())
+	t.Check(event.Uptime, Equals, int64(3))
+	t.Check(event.Type, Equals, mrms.EVENT_RESTART)
+	t.Check(event.DetectedAt.Before(t0), Equals, false)
+	t.Check(event.DetectedAt.After(time.Now().UTC()), Equals, false)
+
+	// Global subscribers get the same event.
+	select {
+	case globalEvent := <-globalChan:
+		t.Check(globalEvent, DeepEquals, event)
+	default:
+		t.Error("MySQL was restarted, but MRMS didn't notify global subscriber")
+	}
+}
+
+func (s *TestSuite) TestFailoverEvent(t *C) {
+	mockConn := mock.NewNullMySQL()
+	mockConnFactory := &mock.ConnectionFactory{
+		Conn: mockConn,
+	}
+	m := monitor.NewMonitor(s.logger, mockConnFactory)
+
+	mockConn.SetUptime(10)
+	mockConn.SetGlobalVarString("server_uuid", "uuid-a")
+	subChan, err := m.Add(mockConn.DSN())
+	t.Assert(err, IsNil)
+
+	getEvent := func() *mrms.RestartEvent {
+		select {
+		case event := <-subChan:
+			return &event
+		default:
+			return nil
+		}
+	}
+
+	// Failover detection is off by default, so a different server with
+	// greater uptime isn't noticed.
+	mockConn.SetUptime(20)
+	mockConn.SetGlobalVarString("server_uuid", "uuid-b")
+	m.Check()
+	t.Check(getEvent(), IsNil)
+
+	// With it on, a different server is a failover, even though its uptime
+	// is less, which looks like a restart.
+	m.SetDetectFailover(true)
+	mockConn.SetUptime(5)
+	mockConn.SetGlobalVarString("server_uuid", "uuid-c")
+	m.Check()
+	event := getEvent()
+	t.Assert(event, NotNil)
+	t.Check(event.Type, Equals, mrms.EVENT_FAILOVER)
+	t.Check(event.Uptime, Equals, int64(5))
+
+	// Same server, uptime decreased: a restart.
+	mockConn.SetUptime(1)
+	m.Check()
+	event = getEvent()
+	t.Assert(event, NotNil)
+	t.Check(event.Type, Equals, mrms.EVENT_RESTART)
+
+	// Same server, uptime increased: nothing.
+	mockConn.SetUptime(2)
+	m.Check()
+	t.Check(getEvent(), IsNil)
+
+	// MySQL < 5.6 doesn't have server_uuid, which isn't a failover.
+	mockConn.SetGlobalVarString("server_uuid", "")
+	mockConn.SetUptime(3)
+	m.Check()
+	t.Check(getEvent(), IsNil)
+}
+
+func (s *TestSuite) TestNotifyOnceOnUptimeDecrease(t *C) {
+	mockConn := mock.NewNullMySQL()
+	mockConnFactory := &mock.ConnectionFactory{
+		Conn: mockConn,
+	}
+	m := monitor.NewMonitor(s.logger, mockConnFactory)
+	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
+
+	mockConn.SetUptime(100)
+	subChan, err := m.Add(dsn)
+	t.Assert(err, IsNil)
+
+	// Uptime drops once (restart), then keeps increasing.
+	notifications := 0
+	for _, uptime := range []int64{50, 51, 60, 60, 1000} {
+		mockConn.SetUptime(uptime)
+		m.Check()
+		select {
+		case <-subChan:
+			notifications++
+		default:
+		}
+	}
+	t.Check(notifications, Equals, 1)
+}
+
 func (s *TestSuite) TestSubscribers(t *C) {
 	subs := monitor.NewSubscribers(s.logger)
-	rwChan := make(chan string, 100)
+	rwChan := make(chan mrms.RestartEvent, 100)
 	dsn := "fake:dsn@tcp(127.0.0.1:3306)/?parseTime=true"
 	err := subs.GlobalAdd(rwChan, dsn)
 	t.Assert(err, Equals, nil)
@@ -223,6 +725,50 @@ func (s *TestSuite) TestSubscribers(t *C) {
 	t.Assert(err, NotNil)
 }
 
+func (s *TestSuite) TestSubscriberCounts(t *C) {
+	logChan := make(chan *proto.LogEntry, 100)
+	m := monitor.NewMonitor(pct.NewLogger(logChan, "mrms-monitor-test"), &mock.ConnectionFactory{Conn: mock.NewNullMySQL()})
+	dsn1 := "fake:dsn@tcp(127.0.0.1:3306)/"
+	dsn2 := "fake:dsn@tcp(127.0.0.1:3307)/"
+	t.Check(m.SubscriberCounts(), DeepEquals, map[string]int{})
+
+	c1, err := m.Add(dsn1)
+	t.Assert(err, IsNil)
+	c2, err := m.Add(dsn1)
+	t.Assert(err, IsNil)
+	c3, err := m.Add(dsn2)
+	t.Assert(err, IsNil)
+	t.Check(m.SubscriberCounts(), DeepEquals, map[string]int{dsn1: 2, dsn2: 1})
+
+	m.Remove(dsn1, c1)
+	t.Check(m.SubscriberCounts(), DeepEquals, map[string]int{dsn1: 1, dsn2: 1})
+	m.Remove(dsn1, c2)
+	m.Remove(dsn2, c3)
+	t.Check(m.SubscriberCounts(), DeepEquals, map[string]int{})
+
+	// Too many subscribers for one DSN logs a warning.
+	for i := 0; i < monitor.SUBSCRIBER_WARN_COUNT; i++ {
+		_, err := m.Add(dsn1)
+		t.Assert(err, IsNil)
+	}
+	t.Check(m.SubscriberCounts()[dsn1], Equals, monitor.SUBSCRIBER_WARN_COUNT)
+	warned := false
+	for len(logChan) > 0 {
+		if e := <-logChan; e.Level == proto.LOG_WARNING {
+			warned = true
+		}
+	}
+	t.Check(warned, Equals, false)
+	_, err = m.Add(dsn1)
+	t.Assert(err, IsNil)
+	for len(logChan) > 0 {
+		if e := <-logChan; e.Level == proto.LOG_WARNING {
+			warned = true
+		}
+	}
+	t.Check(warned, Equals, true)
+}
+
 func (s *TestSuite) Test2Subscribers(t *C) {
 	mockConn := mock.NewNullMySQL()
 	mockConnFactory := &mock.ConnectionFactory{
@@ -242,12 +788,12 @@ func (s *TestSuite) Test2Subscribers(t *C) {
 	mockConn.SetUptime(1)
 	m.Check()
 	select {
-	case notified = <-c1:
+	case _, notified = <-c1:
 	default:
 	}
 	t.Check(notified, Equals, false)
 	select {
-	case notified = <-c2:
+	case _, notified = <-c2:
 	default:
 	}
 	t.Check(notified, Equals, false)
@@ -255,12 +801,12 @@ func (s *TestSuite) Test2Subscribers(t *C) {
 	mockConn.SetUptime(2)
 	m.Check()
 	select {
-	case notified = <-c1:
+	case _, notified = <-c1:
 	default:
 	}
 	t.Check(notified, Equals, false)
 	select {
-	case notified = <-c2:
+	case _, notified = <-c2:
 	default:
 	}
 	t.Check(notified, Equals, false)
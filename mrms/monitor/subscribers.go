@@ -22,14 +22,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/pct"
 )
 
 type Subscribers struct {
 	logger *pct.Logger
 	// --
-	subscribers       map[<-chan bool]chan bool
-	globalSubscribers map[chan string]string
+	subscribers       map[<-chan mrms.RestartEvent]chan mrms.RestartEvent
+	globalSubscribers map[chan mrms.RestartEvent]string
 
 	sync.RWMutex
 }
@@ -37,23 +38,23 @@ type Subscribers struct {
 func NewSubscribers(logger *pct.Logger) *Subscribers {
 	return &Subscribers{
 		logger:            logger,
-		subscribers:       make(map[<-chan bool]chan bool),
-		globalSubscribers: make(map[chan string]string),
+		subscribers:       make(map[<-chan mrms.RestartEvent]chan mrms.RestartEvent),
+		globalSubscribers: make(map[chan mrms.RestartEvent]string),
 	}
 }
 
-func (s *Subscribers) Add() (rChan <-chan bool) {
+func (s *Subscribers) Add() (rChan <-chan mrms.RestartEvent) {
 	s.Lock()
 	defer s.Unlock()
 
-	rwChan := make(chan bool, 1)
+	rwChan := make(chan mrms.RestartEvent, 1)
 	rChan = rwChan
 	s.subscribers[rChan] = rwChan
 
 	return rChan
 }
 
-func (s *Subscribers) GlobalAdd(rwChan chan string, dsn string) error {
+func (s *Subscribers) GlobalAdd(rwChan chan mrms.RestartEvent, dsn string) error {
 	if rwChan == nil {
 		return fmt.Errorf("Invalid global channel")
 	}
@@ -73,7 +74,14 @@ func (s *Subscribers) GlobalRemove(inDsn string) {
 	return
 }
 
-func (s *Subscribers) Remove(rChan <-chan bool) {
+func (s *Subscribers) GlobalRemoveChan(rwChan chan mrms.RestartEvent) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.globalSubscribers, rwChan)
+}
+
+func (s *Subscribers) Remove(rChan <-chan mrms.RestartEvent) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -82,6 +90,14 @@ func (s *Subscribers) Remove(rChan <-chan bool) {
 	}
 }
 
+// Count returns the number of subscribers, not including global subscribers.
+func (s *Subscribers) Count() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.subscribers)
+}
+
 func (s *Subscribers) Empty() bool {
 	s.RLock()
 	defer s.RUnlock()
@@ -89,24 +105,24 @@ func (s *Subscribers) Empty() bool {
 	return len(s.subscribers) == 0
 }
 
-func (s *Subscribers) Notify() {
+func (s *Subscribers) Notify(event mrms.RestartEvent) {
 	s.RLock()
 	defer s.RUnlock()
 
 	for _, rwChan := range s.subscribers {
 		select {
-		case rwChan <- true:
+		case rwChan <- event:
 		case <-time.After(1 * time.Second):
 			s.logger.Warn("Unable to notify subscriber")
 		}
 	}
-	s.notifyGlobalSubscribers()
+	s.notifyGlobalSubscribers(event)
 }
 
-func (s *Subscribers) notifyGlobalSubscribers() {
-	for globalChan, dsn := range s.globalSubscribers {
+func (s *Subscribers) notifyGlobalSubscribers(event mrms.RestartEvent) {
+	for globalChan := range s.globalSubscribers {
 		select {
-		case globalChan <- dsn:
+		case globalChan <- event:
 
 		case <-time.After(1 * time.Second):
 			s.logger.Warn("Unable to notify global subscriber")
@@ -3,6 +3,7 @@ package mysql
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
 )
@@ -28,7 +29,89 @@ func FormatError(err error) string {
 
 // MySQL error codes
 const (
+	ER_CON_COUNT_ERROR              = 1040
+	ER_ACCESS_DENIED_ERROR          = 1045
+	ER_TOO_MANY_USER_CONNECTIONS    = 1203
 	ER_SPECIFIC_ACCESS_DENIED_ERROR = 1227
 	ER_SYNTAX_ERROR                 = 1064
 	ER_USER_DENIED                  = 1142
+	ER_SECURE_TRANSPORT_REQUIRED    = 3159
 )
+
+// Classes of MySQL connection errors, see ClassifyConnError.
+const (
+	CONN_ERR_AUTH_FAILED          = "AuthFailed"
+	CONN_ERR_HOST_UNREACHABLE     = "HostUnreachable"
+	CONN_ERR_UNKNOWN_HOST         = "UnknownHost"
+	CONN_ERR_TLS_REQUIRED         = "TLSRequired"
+	CONN_ERR_TOO_MANY_CONNECTIONS = "TooManyConnections"
+)
+
+var connErrorHints = map[string]string{
+	CONN_ERR_AUTH_FAILED:          "check the MySQL user, password, and that the user is granted access from this host",
+	CONN_ERR_HOST_UNREACHABLE:     "check that MySQL is running and that its host, port, or socket is correct and not blocked by a firewall",
+	CONN_ERR_UNKNOWN_HOST:         "check that the MySQL host name is correct and resolves in DNS or /etc/hosts",
+	CONN_ERR_TLS_REQUIRED:         "MySQL requires a secure connection: use TLS mode " + TLS_REQUIRED + " or " + TLS_VERIFY_CA,
+	CONN_ERR_TOO_MANY_CONNECTIONS: "MySQL max_connections or the user's max_user_connections is reached: close idle connections or raise the limit",
+}
+
+// Driver and network error messages for each class, checked in this order
+// because wrapped errors are only strings, e.g. "Cannot connect to MySQL ...".
+var connErrorMessages = []struct {
+	class    string
+	messages []string
+}{
+	{CONN_ERR_TLS_REQUIRED, []string{"require_secure_transport", "SSL connection is required"}},
+	{CONN_ERR_AUTH_FAILED, []string{"Access denied for user"}},
+	{CONN_ERR_TOO_MANY_CONNECTIONS, []string{"Too many connections", "max_user_connections"}},
+	{CONN_ERR_UNKNOWN_HOST, []string{"no such host"}},
+	{CONN_ERR_HOST_UNREACHABLE, []string{"connection refused", "no route to host", "network is unreachable", "i/o timeout", "no such file or directory"}},
+}
+
+// ConnError is a MySQL connection error classified by ClassifyConnError.
+type ConnError struct {
+	Class string // CONN_ERR_*, or empty if unknown
+	Hint  string // how to fix it, or empty if unknown
+	Err   error  // original error
+}
+
+func (e *ConnError) Error() string {
+	if e.Hint == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + " (" + e.Hint + ")"
+}
+
+// ClassifyConnError returns the class of the MySQL connection error and a hint
+// how to fix it.  The class and hint are empty if the error isn't a common
+// connection error.  It returns nil if err is nil.
+func ClassifyConnError(err error) *ConnError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*ConnError); ok {
+		return e
+	}
+	class := ""
+	switch MySQLErrorCode(err) {
+	case ER_ACCESS_DENIED_ERROR:
+		class = CONN_ERR_AUTH_FAILED
+	case ER_CON_COUNT_ERROR, ER_TOO_MANY_USER_CONNECTIONS:
+		class = CONN_ERR_TOO_MANY_CONNECTIONS
+	case ER_SECURE_TRANSPORT_REQUIRED:
+		class = CONN_ERR_TLS_REQUIRED
+	}
+	if class == "" {
+		msg := err.Error()
+	CLASSES:
+		for _, c := range connErrorMessages {
+			for _, m := range c.messages {
+				if strings.Contains(msg, m) {
+					class = c.class
+					break CLASSES
+				}
+			}
+		}
+	}
+	return &ConnError{Class: class, Hint: connErrorHints[class], Err: err}
+}
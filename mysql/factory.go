@@ -17,13 +17,21 @@
 
 package mysql
 
+import (
+	"time"
+)
+
 type ConnectionFactory interface {
 	Make(dsn string) Connector
 }
 
 type RealConnectionFactory struct {
+	// Timeout for connecting to MySQL, see Connection.SetTimeout.
+	Timeout time.Duration
 }
 
 func (f *RealConnectionFactory) Make(dsn string) Connector {
-	return NewConnection(dsn)
+	c := NewConnection(dsn)
+	c.SetTimeout(f.Timeout)
+	return c
 }
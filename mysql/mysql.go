@@ -22,13 +22,15 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqlDriver "github.com/go-sql-driver/mysql"
 	"github.com/hashicorp/go-version"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/pct"
 	"regexp"
+	"strings"
 )
 
 type Query struct {
@@ -41,6 +43,7 @@ type Connector interface {
 	DB() *sql.DB
 	DSN() string
 	Connect(tries uint) error
+	Ping() error
 	Close()
 	Explain(q string, db string) (explain *proto.ExplainResult, err error)
 	Set([]Query) error
@@ -50,12 +53,22 @@ type Connector interface {
 	AtLeastVersion(v string) (bool, error)
 }
 
+// Number of Connections connected to MySQL, see OpenConnections.
+var openConnections int64
+
+// OpenConnections returns the number of Connections in this process connected
+// to MySQL, i.e. Connect succeeded and Close has not closed the connection.
+func OpenConnections() int64 {
+	return atomic.LoadInt64(&openConnections)
+}
+
 type Connection struct {
 	dsn             string
 	conn            *sql.DB
 	backoff         *pct.Backoff
 	connectedAmount uint
 	connectionMux   *sync.Mutex
+	timeout         time.Duration
 }
 
 func NewConnection(dsn string) *Connection {
@@ -67,6 +80,14 @@ func NewConnection(dsn string) *Connection {
 	return c
 }
 
+// SetTimeout sets the driver timeout param, i.e. how long Connect waits to
+// dial MySQL, if the DSN doesn't set it.  Zero (the default) means no timeout.
+func (c *Connection) SetTimeout(timeout time.Duration) {
+	c.connectionMux.Lock()
+	defer c.connectionMux.Unlock()
+	c.timeout = timeout
+}
+
 func (c *Connection) DB() *sql.DB {
 	return c.conn
 }
@@ -86,33 +107,103 @@ func (c *Connection) Connect(tries uint) error {
 		c.connectedAmount++
 		return nil
 	}
-	var err error
+	dsn, plainDSN, tlsMode, err := driverDSN(c.dsn)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSN(c.dsn), err)
+	}
+	if c.timeout > 0 {
+		dsn = withTimeout(dsn, c.timeout)
+		plainDSN = withTimeout(plainDSN, c.timeout)
+	}
 	var db *sql.DB
 	for i := tries; i > 0; i-- {
 		// Wait before attempt.
 		time.Sleep(c.backoff.Wait())
 
-		// Open connection to MySQL but...
-		db, err = sql.Open("mysql", c.dsn)
-		if err != nil {
-			continue
+		db, err = open(dsn)
+		if err == mysqlDriver.ErrNoTLS && tlsMode == TLS_PREFERRED {
+			// TLS is only preferred, so connect without it from now on.
+			dsn = plainDSN
+			db, err = open(dsn)
 		}
-
-		// ...try to use the connection for real.
-		if err = db.Ping(); err != nil {
-			// Connection failed.  Wrong username or password?
-			db.Close()
+		if err != nil {
 			continue
 		}
 
 		// Connected
 		c.conn = db
+		atomic.AddInt64(&openConnections, 1)
 		c.backoff.Success()
 		c.connectedAmount++
 		return nil
 	}
 
-	return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSNPassword(c.dsn), FormatError(err))
+	return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSN(c.dsn), FormatError(err))
+}
+
+// Ping checks that MySQL is reachable and accepts the DSN credentials.  Unlike
+// Connect it does not retry or back off, and it needs no privileges because it
+// only does a driver-level ping, no queries.  The existing connection is used
+// if there is one, else a temporary one is opened and closed.  Set the DSN
+// timeout parameter, e.g. timeout=10s, or SetTimeout, to fail fast if MySQL
+// is unreachable.
+func (c *Connection) Ping() error {
+	c.connectionMux.Lock()
+	db := c.conn
+	timeout := c.timeout
+	c.connectionMux.Unlock()
+	if db != nil {
+		if err := db.Ping(); err != nil {
+			return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSN(c.dsn), FormatError(err))
+		}
+		return nil
+	}
+	dsn, plainDSN, tlsMode, err := driverDSN(c.dsn)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSN(c.dsn), err)
+	}
+	if timeout > 0 {
+		dsn = withTimeout(dsn, timeout)
+		plainDSN = withTimeout(plainDSN, timeout)
+	}
+	db, err = open(dsn)
+	if err == mysqlDriver.ErrNoTLS && tlsMode == TLS_PREFERRED {
+		db, err = open(plainDSN)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot connect to MySQL %s: %s", HideDSN(c.dsn), FormatError(err))
+	}
+	db.Close()
+	return nil
+}
+
+// withTimeout adds the timeout param to dsn unless it already has one.
+func withTimeout(dsn string, timeout time.Duration) string {
+	q := strings.Index(dsn, "?")
+	if q < 0 {
+		return dsn + "?timeout=" + timeout.String()
+	}
+	for _, param := range strings.Split(dsn[q+1:], "&") {
+		if strings.HasPrefix(param, "timeout=") {
+			return dsn
+		}
+	}
+	return dsn + "&timeout=" + timeout.String()
+}
+
+// open opens a connection to MySQL and pings it to use the connection for real
+// because sql.Open only validates the DSN.
+func open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		// Connection failed.  Wrong username or password?
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
 func (c *Connection) Close() {
@@ -126,6 +217,7 @@ func (c *Connection) Close() {
 	if c.connectedAmount == 0 && c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
+		atomic.AddInt64(&openConnections, -1)
 	}
 }
 
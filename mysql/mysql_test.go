@@ -18,13 +18,16 @@
 package mysql_test
 
 import (
+	"errors"
 	"fmt"
+	mysqlDriver "github.com/go-sql-driver/mysql"
 	"github.com/percona/percona-agent/mysql"
 	. "gopkg.in/check.v1"
 	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -69,6 +72,45 @@ func (s *MysqlTestSuite) TestConnection(t *C) {
 	t.Assert(conn.DB(), IsNil)
 }
 
+func (s *MysqlTestSuite) TestPing(t *C) {
+	conn := mysql.NewConnection(s.dsn)
+	err := conn.Ping()
+	t.Check(err, IsNil)
+	t.Check(conn.DB(), IsNil) // temporary connection closed
+
+	// Ping uses the existing connection.
+	err = conn.Connect(1)
+	t.Assert(err, IsNil)
+	err = conn.Ping()
+	t.Check(err, IsNil)
+	t.Check(conn.DB(), NotNil)
+	conn.Close()
+
+	// Nothing listening: fails right away.
+	conn = mysql.NewConnection("percona:percona@unix(/foo/bar/my.sock)/")
+	err = conn.Ping()
+	t.Check(err, NotNil)
+
+	// Unroutable address: the dial fails by the DSN timeout.
+	conn = mysql.NewConnection("percona:percona@tcp(10.255.255.1:3306)/?timeout=200ms")
+	t0 := time.Now()
+	err = conn.Ping()
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) < 2*time.Second, Equals, true, Commentf("Ping did not fail fast"))
+
+	// Same with a factory timeout.
+	factory := &mysql.RealConnectionFactory{Timeout: 200 * time.Millisecond}
+	c := factory.Make("percona:percona@tcp(10.255.255.1:3306)/")
+	t0 = time.Now()
+	err = c.Ping()
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) < 2*time.Second, Equals, true, Commentf("Ping did not fail fast"))
+	t0 = time.Now()
+	err = c.Connect(1)
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) < 2*time.Second, Equals, true, Commentf("Connect did not fail fast"))
+}
+
 func (s *MysqlTestSuite) TestDSNString(t *C) {
 	dsn := mysql.DSN{
 		Username: "root",
@@ -110,6 +152,39 @@ func (s *MysqlTestSuite) TestErrorFormatting(t *C) {
 	t.Check(mysql.FormatError(e1), Equals, "connection refused: 127.0.0.1:3306")
 }
 
+func (s *MysqlTestSuite) TestClassifyConnError(t *C) {
+	t.Check(mysql.ClassifyConnError(nil), IsNil)
+
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{&mysqlDriver.MySQLError{Number: 1045, Message: "Access denied for user 'percona'@'localhost' (using password: YES)"}, mysql.CONN_ERR_AUTH_FAILED},
+		{errors.New("Cannot connect to MySQL percona:<password-hidden>@tcp(127.0.0.1:3306)/: Error 1045: Access denied for user 'percona'@'localhost' (using password: YES)"), mysql.CONN_ERR_AUTH_FAILED},
+		{errors.New("Cannot connect to MySQL percona:<password-hidden>@tcp(127.0.0.1:3306)/: connection refused: 127.0.0.1:3306"), mysql.CONN_ERR_HOST_UNREACHABLE},
+		{errors.New("dial tcp 10.0.0.1:3306: i/o timeout"), mysql.CONN_ERR_HOST_UNREACHABLE},
+		{errors.New("Cannot connect to MySQL percona:<password-hidden>@unix(/foo/bar/my.sock)/: no such file or directory: /foo/bar/my.sock"), mysql.CONN_ERR_HOST_UNREACHABLE},
+		{errors.New("dial tcp: lookup db.example.invalid: no such host"), mysql.CONN_ERR_UNKNOWN_HOST},
+		{&mysqlDriver.MySQLError{Number: 3159, Message: "Connections using insecure transport are prohibited while --require_secure_transport=ON."}, mysql.CONN_ERR_TLS_REQUIRED},
+		{errors.New("Error 3159: Connections using insecure transport are prohibited while --require_secure_transport=ON."), mysql.CONN_ERR_TLS_REQUIRED},
+		{&mysqlDriver.MySQLError{Number: 1040, Message: "Too many connections"}, mysql.CONN_ERR_TOO_MANY_CONNECTIONS},
+		{errors.New("Error 1203: User percona already has more than 'max_user_connections' active connections"), mysql.CONN_ERR_TOO_MANY_CONNECTIONS},
+		{errors.New("Error 1146: Table 'foo.bar' doesn't exist"), ""},
+	}
+	for _, test := range tests {
+		got := mysql.ClassifyConnError(test.err)
+		t.Check(got.Class, Equals, test.class, Commentf("%s", test.err))
+		t.Check(got.Err, Equals, test.err)
+		if test.class == "" {
+			t.Check(got.Hint, Equals, "")
+			t.Check(got.Error(), Equals, test.err.Error())
+		} else {
+			t.Check(got.Hint, Not(Equals), "")
+			t.Check(strings.HasPrefix(got.Error(), test.err.Error()+" ("), Equals, true)
+		}
+	}
+}
+
 func (s *MysqlTestSuite) TestIsSupportedMySQLVersion(t *C) {
 	var got bool
 	var err error
@@ -0,0 +1,211 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+)
+
+// TLS modes, like the mysql client --ssl-mode option.
+const (
+	TLS_PREFERRED = "preferred" // TLS if the server supports it, server cert not verified
+	TLS_REQUIRED  = "required"  // TLS, server cert not verified
+	TLS_VERIFY_CA = "verify-ca" // TLS, server cert signed by the CA and matching the host name
+)
+
+// DSN params for the TLS options.  The driver doesn't know them, so driverDSN
+// replaces them with the driver tls param before connecting.
+const (
+	tlsModeParam = "tls-mode"
+	tlsCAParam   = "tls-ca"
+	tlsCertParam = "tls-cert"
+	tlsKeyParam  = "tls-key"
+)
+
+// ValidTLSMode returns true if mode is one of the TLS_* modes or empty (no TLS).
+func ValidTLSMode(mode string) bool {
+	switch mode {
+	case "", TLS_PREFERRED, TLS_REQUIRED, TLS_VERIFY_CA:
+		return true
+	}
+	return false
+}
+
+// tlsParams returns the DSN params for the TLS options, or "" if TLS is off.
+func (dsn DSN) tlsParams() string {
+	if dsn.TLS == "" {
+		return ""
+	}
+	params := "&" + tlsModeParam + "=" + url.QueryEscape(dsn.TLS)
+	if dsn.TLSCA != "" {
+		params += "&" + tlsCAParam + "=" + url.QueryEscape(dsn.TLSCA)
+	}
+	if dsn.TLSCert != "" {
+		params += "&" + tlsCertParam + "=" + url.QueryEscape(dsn.TLSCert)
+	}
+	if dsn.TLSKey != "" {
+		params += "&" + tlsKeyParam + "=" + url.QueryEscape(dsn.TLSKey)
+	}
+	return params
+}
+
+// parseTLSParams sets the DSN TLS options from the DSN params, i.e. the part
+// after "?".
+func (dsn *DSN) parseTLSParams(params string) {
+	for _, param := range strings.Split(params, "&") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			v = kv[1]
+		}
+		switch kv[0] {
+		case tlsModeParam:
+			dsn.TLS = v
+		case tlsCAParam:
+			dsn.TLSCA = v
+		case tlsCertParam:
+			dsn.TLSCert = v
+		case tlsKeyParam:
+			dsn.TLSKey = v
+		}
+	}
+}
+
+var (
+	tlsConfigMux = &sync.Mutex{}
+	tlsConfigs   = make(map[string]string) // options => registered config name
+)
+
+// driverDSN returns the DSN for the driver: the TLS options are replaced by the
+// tls param for a tls.Config registered with the driver.  It also returns the
+// DSN without TLS, for TLS_PREFERRED, and the TLS mode.  A DSN without TLS
+// options is returned as-is.
+func driverDSN(dsnString string) (tlsDSN, plainDSN, mode string, err error) {
+	q := strings.Index(dsnString, "?")
+	if q < 0 {
+		return dsnString, dsnString, "", nil
+	}
+	dsn := DSN{}
+	dsn.parseTLSParams(dsnString[q+1:])
+	if dsn.TLS == "" {
+		return dsnString, dsnString, "", nil
+	}
+
+	params := []string{}
+	for _, param := range strings.Split(dsnString[q+1:], "&") {
+		switch strings.SplitN(param, "=", 2)[0] {
+		case tlsModeParam, tlsCAParam, tlsCertParam, tlsKeyParam:
+		default:
+			params = append(params, param)
+		}
+	}
+	plainDSN = dsnString[0:q]
+	if len(params) > 0 {
+		plainDSN += "?" + strings.Join(params, "&")
+	}
+
+	// The server name is the host name, used to verify the server certificate.
+	host := ""
+	if parsed, err := ParseDSN(plainDSN); err == nil {
+		host = parsed.Hostname
+	}
+	name, err := registerTLS(dsn, host)
+	if err != nil {
+		return "", "", "", err
+	}
+	sep := "&"
+	if len(params) == 0 {
+		sep = "?"
+	}
+	return plainDSN + sep + "tls=" + name, plainDSN, dsn.TLS, nil
+}
+
+// registerTLS registers a tls.Config with the driver for the DSN TLS options,
+// once per options and host, and returns its name for the tls param.
+func registerTLS(dsn DSN, host string) (string, error) {
+	key := strings.Join([]string{dsn.TLS, dsn.TLSCA, dsn.TLSCert, dsn.TLSKey, host}, "|")
+
+	tlsConfigMux.Lock()
+	defer tlsConfigMux.Unlock()
+	if name, ok := tlsConfigs[key]; ok {
+		return name, nil
+	}
+
+	config, err := newTLSConfig(dsn, host)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("percona-agent-%d", len(tlsConfigs)+1)
+	if err := mysqlDriver.RegisterTLSConfig(name, config); err != nil {
+		return "", err
+	}
+	tlsConfigs[key] = name
+	return name, nil
+}
+
+func newTLSConfig(dsn DSN, host string) (*tls.Config, error) {
+	config := &tls.Config{}
+	switch dsn.TLS {
+	case TLS_PREFERRED, TLS_REQUIRED:
+		config.InsecureSkipVerify = true
+	case TLS_VERIFY_CA:
+		if dsn.TLSCA == "" {
+			return nil, errors.New("TLS mode " + TLS_VERIFY_CA + " requires a CA certificate")
+		}
+		config.ServerName = host
+	default:
+		return nil, fmt.Errorf("invalid TLS mode '%s': expected %s, %s, or %s", dsn.TLS, TLS_PREFERRED, TLS_REQUIRED, TLS_VERIFY_CA)
+	}
+
+	if dsn.TLSCA != "" {
+		pem, err := ioutil.ReadFile(dsn.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", dsn.TLSCA)
+		}
+		config.RootCAs = pool
+	}
+
+	if dsn.TLSCert != "" || dsn.TLSKey != "" {
+		if dsn.TLSCert == "" || dsn.TLSKey == "" {
+			return nil, errors.New("a TLS client certificate requires both the cert and key files")
+		}
+		cert, err := tls.LoadX509KeyPair(dsn.TLSCert, dsn.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
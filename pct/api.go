@@ -28,7 +28,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -36,9 +38,22 @@ import (
 
 var requiredEntryLinks = []string{"agents", "instances", "download"}
 var requiredAgentLinks = []string{"cmd", "log", "data"}
+var headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// At most this many requests to the API are in flight at once, by default.
+// Others wait their turn.
+const DEFAULT_MAX_API_REQUESTS = 10
+
+// With compression enabled, PUT and POST bodies this size or larger are gzipped.
+const DEFAULT_COMPRESS_MIN_SIZE = 1024 // bytes
+
+// API requests fail if connecting, or the whole request, takes longer than this,
+// by default.
+const DEFAULT_API_TIMEOUT = 10 * time.Second
+
 var timeoutClientConfig = &TimeoutClientConfig{
-	ConnectTimeout:   10 * time.Second,
-	ReadWriteTimeout: 10 * time.Second,
+	ConnectTimeout:   DEFAULT_API_TIMEOUT,
+	ReadWriteTimeout: DEFAULT_API_TIMEOUT,
 }
 
 type APIConnector interface {
@@ -47,8 +62,10 @@ type APIConnector interface {
 	Get(apiKey, url string) (int, []byte, error)
 	Post(apiKey, url string, data []byte) (*http.Response, []byte, error)
 	Put(apiKey, url string, data []byte) (*http.Response, []byte, error)
+	Delete(apiKey, url string) (*http.Response, []byte, error)
 	EntryLink(resource string) string
 	AgentLink(resource string) string
+	Headers() map[string]string
 	Origin() string
 	Hostname() string
 	ApiKey() string
@@ -63,8 +80,12 @@ type API struct {
 	agentUuid  string
 	entryLinks map[string]string
 	agentLinks map[string]string
+	headers    map[string]string
 	mux        *sync.RWMutex
 	client     *http.Client
+	sem        chan struct{}
+	gzipMin    int // gzip bodies this size or larger, 0 = no compression
+	timeout    time.Duration
 }
 
 type TimeoutClientConfig struct {
@@ -82,13 +103,25 @@ func NewAPI() *API {
 	a := &API{
 		origin:     "http://" + hostname,
 		agentLinks: make(map[string]string),
+		headers:    make(map[string]string),
 		mux:        new(sync.RWMutex),
 		client:     client,
+		sem:        make(chan struct{}, DEFAULT_MAX_API_REQUESTS),
+		timeout:    DEFAULT_API_TIMEOUT,
 	}
 	return a
 }
 
 func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: TimeoutDialer(timeoutClientConfig),
+		},
+	}
+	return ping(client, hostname, apiKey, headers)
+}
+
+func ping(client *http.Client, hostname, apiKey string, headers map[string]string) (int, error) {
 	url := URL(hostname, "ping")
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -101,11 +134,6 @@ func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
 		}
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(timeoutClientConfig),
-		},
-	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return 0, err
@@ -118,6 +146,101 @@ func Ping(hostname, apiKey string, headers map[string]string) (int, error) {
 	return resp.StatusCode, nil
 }
 
+// LARGE_RESPONSE_LINK is the entry link to fetch to check large responses.
+// The instance list is usually the largest response the agent gets.
+const LARGE_RESPONSE_LINK = "instances"
+
+// ResponseCheck is the result of CheckLargeResponse.
+type ResponseCheck struct {
+	URL           string
+	Code          int
+	ContentLength int64 // -1 if the API didn't send Content-Length
+	Received      int64
+	Elapsed       time.Duration
+	Truncated     bool
+	Timeout       bool
+}
+
+// Ok returns true if the API returned 200 and the full body was received.
+func (c *ResponseCheck) Ok() bool {
+	return c.Code == http.StatusOK && !c.Truncated && !c.Timeout
+}
+
+func (c *ResponseCheck) String() string {
+	switch {
+	case c.Timeout:
+		return fmt.Sprintf("GET %s timed out after %s (received %d bytes)", c.URL, c.Elapsed, c.Received)
+	case c.Truncated:
+		return fmt.Sprintf("GET %s response truncated: received %d of %d bytes", c.URL, c.Received, c.ContentLength)
+	case c.Code != http.StatusOK:
+		return fmt.Sprintf("GET %s returned code %d (received %d bytes)", c.URL, c.Code, c.Received)
+	}
+	return fmt.Sprintf("GET %s OK: received %d bytes in %s", c.URL, c.Received, c.Elapsed)
+}
+
+// CheckLargeResponse fetches a large resource from the API and verifies that
+// the full body is received.  Small requests like Ping can succeed on a network
+// path with a broken MTU while large responses stall or are cut off, so this
+// helps diagnose MTU blackholes.  url is usually the LARGE_RESPONSE_LINK entry
+// link.  The error is non-nil only if the request could not be sent; the code,
+// truncation, and timeouts are reported in the check.
+func CheckLargeResponse(url, apiKey string, headers map[string]string) (*ResponseCheck, error) {
+	check := &ResponseCheck{
+		URL:           url,
+		ContentLength: -1,
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return check, fmt.Errorf("GET %s error: http.NewRequest: %s", url, err)
+	}
+	req.Header.Add("X-Percona-API-Key", apiKey)
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: TimeoutDialer(timeoutClientConfig),
+		},
+	}
+	t0 := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		check.Elapsed = time.Since(t0)
+		if isTimeout(err) {
+			check.Timeout = true
+			return check, nil
+		}
+		return check, err
+	}
+	defer resp.Body.Close()
+	check.Code = resp.StatusCode
+	check.ContentLength = resp.ContentLength
+
+	// Read with io.Copy so we know how many bytes arrived even on error.
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	check.Elapsed = time.Since(t0)
+	check.Received = n
+	if err != nil {
+		if isTimeout(err) {
+			check.Timeout = true
+		} else {
+			check.Truncated = true
+		}
+	} else if check.ContentLength >= 0 && n < check.ContentLength {
+		check.Truncated = true
+	}
+	return check, nil
+}
+
+func isTimeout(err error) bool {
+	if urlErr, ok := err.(*neturl.Error); ok {
+		err = urlErr.Err
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 func URL(hostname string, paths ...string) string {
 	schema := "https://"
 	httpPrefix := "http://"
@@ -171,7 +294,12 @@ func (a *API) Connect(hostname, apiKey, agentUuid string) error {
 }
 
 func (a *API) Init(hostname string, apiKey string, headers map[string]string) (int, error) {
-	code, err := Ping(hostname, apiKey, headers)
+	// Extra headers first so caller's headers take precedence.
+	allHeaders := a.Headers()
+	for k, v := range headers {
+		allHeaders[k] = v
+	}
+	code, err := ping(a.client, hostname, apiKey, allHeaders)
 	if code == 200 && err == nil {
 		a.mux.Lock()
 		defer a.mux.Unlock()
@@ -217,8 +345,10 @@ func (a *API) Get(apiKey, url string) (int, []byte, error) {
 		return 0, nil, err
 	}
 	req.Header.Add("X-Percona-API-Key", apiKey)
+	a.addHeaders(req.Header)
 
 	// todo: timeout
+	defer a.release(a.acquire())
 	resp, err := a.client.Do(req)
 	if err != nil {
 		return 0, nil, fmt.Errorf("GET %s error: client.Do: %s", url, err)
@@ -285,6 +415,41 @@ func (a *API) AgentUuid() string {
 	return a.agentUuid
 }
 
+// SetHeaders sets extra HTTP headers sent with every request, e.g. a tenant
+// ID or auth token required by a gateway in front of the API.
+func (a *API) SetHeaders(headers map[string]string) error {
+	for name := range headers {
+		if !ValidHeaderName(name) {
+			return fmt.Errorf("Invalid HTTP header name: '%s'", name)
+		}
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.headers = make(map[string]string)
+	for k, v := range headers {
+		a.headers[k] = v
+	}
+	return nil
+}
+
+func (a *API) Headers() map[string]string {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	headers := make(map[string]string)
+	for k, v := range a.headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+func (a *API) addHeaders(header http.Header) {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	for k, v := range a.headers {
+		header.Set(k, v)
+	}
+}
+
 func (a *API) Post(apiKey, url string, data []byte) (*http.Response, []byte, error) {
 	return a.send("POST", apiKey, url, data)
 }
@@ -293,12 +458,39 @@ func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, erro
 	return a.send("PUT", apiKey, url, data)
 }
 
+func (a *API) Delete(apiKey, url string) (*http.Response, []byte, error) {
+	return a.send("DELETE", apiKey, url, nil)
+}
+
 func (a *API) send(method, apiKey, url string, data []byte) (*http.Response, []byte, error) {
-	req, err := http.NewRequest(method, url, bytes.NewReader(data))
 	header := http.Header{}
 	header.Set("X-Percona-API-Key", apiKey)
+	a.addHeaders(header)
+
+	body := data
+	a.mux.RLock()
+	gzipMin := a.gzipMin
+	a.mux.RUnlock()
+	if gzipMin > 0 && len(data) >= gzipMin {
+		buf := new(bytes.Buffer)
+		gz := gzip.NewWriter(buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, nil, fmt.Errorf("%s %s error: gzip: %s", method, url, err)
+		}
+		if err := gz.Close(); err != nil {
+			return nil, nil, fmt.Errorf("%s %s error: gzip: %s", method, url, err)
+		}
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
 	req.Header = header
 
+	defer a.release(a.acquire())
 	resp, err := a.client.Do(req)
 	if err != nil {
 		return resp, nil, err
@@ -311,6 +503,76 @@ func (a *API) send(method, apiKey, url string, data []byte) (*http.Response, []b
 	return resp, content, nil
 }
 
+// SetCompression enables gzip compression of PUT and POST bodies that are
+// minSize bytes or larger; minSize 0 disables it.  Responses don't need it:
+// the HTTP client asks for gzip and decompresses responses transparently.
+func (a *API) SetCompression(minSize int) error {
+	if minSize < 0 {
+		return fmt.Errorf("Invalid compression min size: %d: must be zero or greater", minSize)
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.gzipMin = minSize
+	return nil
+}
+
+// SetTimeout sets how long connecting to the API, and each whole request, can
+// take, DEFAULT_API_TIMEOUT by default.  Call it before using the API.
+func (a *API) SetTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("Invalid API timeout: %s: must be greater than zero", timeout)
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.timeout = timeout
+	a.client = &http.Client{
+		Transport: &http.Transport{
+			Dial: TimeoutDialer(&TimeoutClientConfig{
+				ConnectTimeout:   timeout,
+				ReadWriteTimeout: timeout,
+			}),
+		},
+	}
+	return nil
+}
+
+func (a *API) Timeout() time.Duration {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.timeout
+}
+
+// SetMaxRequests sets how many requests can be in flight at once.  Requests
+// over the limit block until others finish.
+func (a *API) SetMaxRequests(n int) error {
+	if n < 1 {
+		return fmt.Errorf("Invalid max API requests: %d: must be greater than zero", n)
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.sem = make(chan struct{}, n)
+	return nil
+}
+
+// acquire blocks until a request can be sent.  The returned chan must be
+// passed to release when the request is done; it's returned because
+// SetMaxRequests can replace a.sem while the request is in flight.
+func (a *API) acquire() chan struct{} {
+	a.mux.RLock()
+	sem := a.sem
+	a.mux.RUnlock()
+	sem <- struct{}{}
+	return sem
+}
+
+func (a *API) release(sem chan struct{}) {
+	<-sem
+}
+
+func ValidHeaderName(name string) bool {
+	return headerNameRe.MatchString(name)
+}
+
 func TimeoutDialer(config *TimeoutClientConfig) func(net, addr string) (c net.Conn, err error) {
 	return func(netw, addr string) (net.Conn, error) {
 		conn, err := net.DialTimeout(netw, addr, config.ConnectTimeout)
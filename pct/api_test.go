@@ -0,0 +1,392 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/percona/percona-agent/pct"
+	"github.com/percona/percona-agent/test/fakeapi"
+	"github.com/percona/percona-agent/test/mock"
+	. "gopkg.in/check.v1"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// api.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type APITestSuite struct {
+	fakeApi *fakeapi.FakeApi
+	headers chan http.Header
+}
+
+var _ = Suite(&APITestSuite{})
+
+func (s *APITestSuite) SetUpSuite(t *C) {
+	s.headers = make(chan http.Header, 10)
+	s.fakeApi = fakeapi.NewFakeApi()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		s.headers <- r.Header
+		w.WriteHeader(http.StatusOK)
+	}
+	s.fakeApi.Append("/ping", handler)
+	s.fakeApi.Append("/instances/mysql/1", handler)
+}
+
+func (s *APITestSuite) TearDownSuite(t *C) {
+	s.fakeApi.Close()
+}
+
+// --------------------------------------------------------------------------
+
+func (s *APITestSuite) TestCustomHeaders(t *C) {
+	api := pct.NewAPI()
+	err := api.SetHeaders(map[string]string{
+		"X-Tenant-Id":  "tenant-1",
+		"X-Gateway-Id": "gw",
+	})
+	t.Assert(err, IsNil)
+
+	// Init pings the API with the custom headers and the caller's headers.
+	code, err := api.Init(s.fakeApi.URL(), "123", map[string]string{"X-Percona-Agent-Version": "1.0.0"})
+	t.Assert(err, IsNil)
+	t.Check(code, Equals, http.StatusOK)
+	header := <-s.headers
+	t.Check(header.Get("X-Tenant-Id"), Equals, "tenant-1")
+	t.Check(header.Get("X-Gateway-Id"), Equals, "gw")
+	t.Check(header.Get("X-Percona-Agent-Version"), Equals, "1.0.0")
+	t.Check(header.Get("X-Percona-API-Key"), Equals, "123")
+
+	resp, _, err := api.Put("123", s.fakeApi.URL()+"/instances/mysql/1", []byte("{}"))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	header = <-s.headers
+	t.Check(header.Get("X-Tenant-Id"), Equals, "tenant-1")
+	t.Check(header.Get("X-Gateway-Id"), Equals, "gw")
+	t.Check(header.Get("X-Percona-API-Key"), Equals, "123")
+
+	code, _, err = api.Get("123", s.fakeApi.URL()+"/instances/mysql/1")
+	t.Assert(err, IsNil)
+	t.Check(code, Equals, http.StatusOK)
+	header = <-s.headers
+	t.Check(header.Get("X-Tenant-Id"), Equals, "tenant-1")
+}
+
+func (s *APITestSuite) TestInvalidHeaderName(t *C) {
+	api := pct.NewAPI()
+	err := api.SetHeaders(map[string]string{"X-Ok": "1", "Bad Header": "2"})
+	t.Check(err, NotNil)
+	err = api.SetHeaders(map[string]string{"X-Bad:": "1"})
+	t.Check(err, NotNil)
+	err = api.SetHeaders(map[string]string{"": "1"})
+	t.Check(err, NotNil)
+
+	// Invalid headers are not set.
+	t.Check(api.Headers(), DeepEquals, map[string]string{})
+}
+
+func (s *APITestSuite) TestMaxRequests(t *C) {
+	// Count requests in flight at the API.
+	var mux sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	fakeApi.Append("/slow", func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mux.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mux.Lock()
+		inFlight--
+		mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	api := pct.NewAPI()
+	err := api.SetMaxRequests(0)
+	t.Check(err, NotNil)
+	err = api.SetMaxRequests(3)
+	t.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				api.Get("123", fakeApi.URL()+"/slow")
+			} else {
+				api.Put("123", fakeApi.URL()+"/slow", []byte("{}"))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mux.Lock()
+	defer mux.Unlock()
+	t.Check(maxInFlight <= 3, Equals, true, Commentf("max in flight: %d", maxInFlight))
+	t.Check(maxInFlight > 1, Equals, true, Commentf("max in flight: %d", maxInFlight))
+}
+
+func (s *APITestSuite) TestCheckLargeResponse(t *C) {
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	body := bytes.Repeat([]byte("x"), 1024*1024)
+	fakeApi.Append("/instances", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+
+	check, err := pct.CheckLargeResponse(fakeApi.URL()+"/instances", "123", nil)
+	t.Assert(err, IsNil)
+	t.Check(check.Code, Equals, http.StatusOK)
+	t.Check(check.ContentLength, Equals, int64(len(body)))
+	t.Check(check.Received, Equals, int64(len(body)))
+	t.Check(check.Truncated, Equals, false)
+	t.Check(check.Timeout, Equals, false)
+	t.Check(check.Ok(), Equals, true)
+}
+
+func (s *APITestSuite) TestCheckLargeResponseTruncated(t *C) {
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	body := bytes.Repeat([]byte("x"), 1024*1024)
+	fakeApi.Append("/instances", func(w http.ResponseWriter, r *http.Request) {
+		// Promise the full body but send only half, like a path that drops
+		// large packets.
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body[0 : len(body)/2])
+	})
+
+	check, err := pct.CheckLargeResponse(fakeApi.URL()+"/instances", "123", nil)
+	t.Assert(err, IsNil)
+	t.Check(check.Code, Equals, http.StatusOK)
+	t.Check(check.ContentLength, Equals, int64(len(body)))
+	t.Check(check.Received < int64(len(body)), Equals, true, Commentf("received %d", check.Received))
+	t.Check(check.Truncated, Equals, true)
+	t.Check(check.Ok(), Equals, false)
+}
+
+func (s *APITestSuite) TestCheckLargeResponseError(t *C) {
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	fakeApi.Append("/instances", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("error"))
+	})
+
+	// The full body is received, but it's not the response we need.
+	check, err := pct.CheckLargeResponse(fakeApi.URL()+"/instances", "123", map[string]string{"X-Test": "1"})
+	t.Assert(err, IsNil)
+	t.Check(check.Code, Equals, http.StatusInternalServerError)
+	t.Check(check.Truncated, Equals, false)
+	t.Check(check.Ok(), Equals, false)
+	t.Check(check.String(), Matches, ".* returned code 500 .*")
+}
+
+func (s *APITestSuite) TestTimeout(t *C) {
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}
+	fakeApi.Append("/ping", slow)
+	fakeApi.Append("/slow", slow)
+
+	api := pct.NewAPI()
+	t.Check(api.Timeout(), Equals, pct.DEFAULT_API_TIMEOUT)
+	t.Check(api.SetTimeout(0), NotNil)
+	err := api.SetTimeout(100 * time.Millisecond)
+	t.Assert(err, IsNil)
+	t.Check(api.Timeout(), Equals, 100*time.Millisecond)
+
+	// Both Init and requests use the timeout.
+	t0 := time.Now()
+	_, err = api.Init(fakeApi.URL(), "123", nil)
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) < 400*time.Millisecond, Equals, true, Commentf("Init took %s", time.Now().Sub(t0)))
+
+	t0 = time.Now()
+	_, _, err = api.Get("123", fakeApi.URL()+"/slow")
+	t.Check(err, NotNil)
+	t.Check(time.Now().Sub(t0) < 400*time.Millisecond, Equals, true, Commentf("Get took %s", time.Now().Sub(t0)))
+
+	// A longer timeout lets slow requests finish.
+	err = api.SetTimeout(2 * time.Second)
+	t.Assert(err, IsNil)
+	code, _, err := api.Get("123", fakeApi.URL()+"/slow")
+	t.Check(err, IsNil)
+	t.Check(code, Equals, http.StatusOK)
+}
+
+func (s *APITestSuite) TestCompression(t *C) {
+	// Echo the request body, gzipped, and record its encoding.
+	encodings := make(chan string, 10)
+	fakeApi := fakeapi.NewFakeApi()
+	defer fakeApi.Close()
+	fakeApi.Append("/instances/mysql/1", func(w http.ResponseWriter, r *http.Request) {
+		encodings <- r.Header.Get("Content-Encoding")
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		data, _ := ioutil.ReadAll(body)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		gz := gzip.NewWriter(w)
+		gz.Write(data)
+		gz.Close()
+	})
+
+	api := pct.NewAPI()
+	t.Check(api.SetCompression(-1), NotNil)
+	err := api.SetCompression(pct.DEFAULT_COMPRESS_MIN_SIZE)
+	t.Assert(err, IsNil)
+
+	large := bytes.Repeat([]byte(`{"Hostname":"db1","Distro":"Percona Server"}`), 1000)
+	resp, data, err := api.Put("123", fakeApi.URL()+"/instances/mysql/1", large)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(<-encodings, Equals, "gzip")
+	t.Check(data, DeepEquals, large) // response decompressed transparently
+
+	// Small bodies aren't worth compressing.
+	_, data, err = api.Put("123", fakeApi.URL()+"/instances/mysql/1", []byte("{}"))
+	t.Assert(err, IsNil)
+	t.Check(<-encodings, Equals, "")
+	t.Check(string(data), Equals, "{}")
+
+	// Disabled by default.
+	api = pct.NewAPI()
+	_, data, err = api.Post("123", fakeApi.URL()+"/instances/mysql/1", large)
+	t.Assert(err, IsNil)
+	t.Check(<-encodings, Equals, "")
+	t.Check(data, DeepEquals, large)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// retry_api.go test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type RetryingAPITestSuite struct {
+	api   *mock.API
+	waits []time.Duration
+	opts  pct.RetryOptions
+}
+
+var _ = Suite(&RetryingAPITestSuite{})
+
+func (s *RetryingAPITestSuite) SetUpTest(t *C) {
+	s.api = mock.NewAPI("http://localhost", "localhost", "123", "abc", nil)
+	s.waits = []time.Duration{}
+	s.opts = pct.RetryOptions{
+		Attempts: 3,
+		Wait:     time.Second,
+		Sleep:    func(d time.Duration) { s.waits = append(s.waits, d) },
+	}
+}
+
+func (s *RetryingAPITestSuite) TestGetRetries5xx(t *C) {
+	s.api.GetCode = []int{500, 200}
+	s.api.GetData = [][]byte{nil, []byte("ok")}
+	a := pct.NewRetryingAPI(s.api, s.opts)
+	code, data, err := a.Get("123", "http://localhost/instances")
+	t.Check(err, IsNil)
+	t.Check(code, Equals, 200)
+	t.Check(string(data), Equals, "ok")
+	t.Check(s.waits, DeepEquals, []time.Duration{time.Second})
+}
+
+func (s *RetryingAPITestSuite) TestGetRetriesNetworkError(t *C) {
+	s.api.GetCode = []int{0, 0, 200}
+	s.api.GetError = []error{errors.New("connection refused"), errors.New("connection refused"), nil}
+	a := pct.NewRetryingAPI(s.api, s.opts)
+	code, _, err := a.Get("123", "http://localhost/instances")
+	t.Check(err, IsNil)
+	t.Check(code, Equals, 200)
+	// Wait doubles.
+	t.Check(s.waits, DeepEquals, []time.Duration{time.Second, 2 * time.Second})
+}
+
+func (s *RetryingAPITestSuite) TestGetGivesUp(t *C) {
+	s.api.GetCode = []int{500, 502, 503, 200}
+	a := pct.NewRetryingAPI(s.api, s.opts)
+	code, _, err := a.Get("123", "http://localhost/instances")
+	t.Check(err, IsNil)
+	t.Check(code, Equals, 503)  // last response
+	t.Check(s.waits, HasLen, 2) // no wait after the last try
+	t.Check(s.api.GetCode, DeepEquals, []int{200})
+}
+
+func (s *RetryingAPITestSuite) TestGetDoesNotRetry4xx(t *C) {
+	s.api.GetCode = []int{404, 200}
+	a := pct.NewRetryingAPI(s.api, s.opts)
+	code, _, err := a.Get("123", "http://localhost/instances")
+	t.Check(err, IsNil)
+	t.Check(code, Equals, 404)
+	t.Check(s.waits, HasLen, 0)
+}
+
+func (s *RetryingAPITestSuite) TestPut(t *C) {
+	// PUTs aren't retried by default.
+	s.api.PutCode = []int{500, 200}
+	a := pct.NewRetryingAPI(s.api, s.opts)
+	resp, _, err := a.Put("123", "http://localhost/instances/mysql/1", []byte("{}"))
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, 500)
+	t.Check(s.waits, HasLen, 0)
+
+	s.api.PutCode = []int{500, 200}
+	s.opts.RetryPuts = true
+	a = pct.NewRetryingAPI(s.api, s.opts)
+	resp, _, err = a.Put("123", "http://localhost/instances/mysql/1", []byte("{}"))
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, 200)
+	t.Check(s.waits, DeepEquals, []time.Duration{time.Second})
+}
+
+func (s *RetryingAPITestSuite) TestCancel(t *C) {
+	s.api.GetCode = []int{500, 500, 200}
+	s.opts.Cancel = func() bool { return true }
+	a := pct.NewRetryingAPI(s.api, s.opts)
+	code, _, err := a.Get("123", "http://localhost/instances")
+	t.Check(err, IsNil)
+	t.Check(code, Equals, 500)
+	t.Check(s.waits, HasLen, 1)
+	t.Check(s.api.GetCode, DeepEquals, []int{500, 200})
+}
@@ -127,12 +127,12 @@ func (b *basedir) WriteConfig(service string, config interface{}) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(configFile, data, 0600)
+	return WriteFileAtomic(configFile, data, 0600)
 }
 
 func (b *basedir) WriteConfigString(service, config string) error {
 	configFile := filepath.Join(b.configDir, service+CONFIG_FILE_SUFFIX)
-	return ioutil.WriteFile(configFile, []byte(config), 0600)
+	return WriteFileAtomic(configFile, []byte(config), 0600)
 }
 
 func (b *basedir) RemoveConfig(service string) error {
@@ -126,3 +126,32 @@ type DuplicateServiceInstanceError struct {
 func (e DuplicateServiceInstanceError) Error() string {
 	return fmt.Sprintf("Duplicate %s instance: %d", e.Service, e.Id)
 }
+
+/////////////////////////////////////////////////////////////////////////////
+
+// InstanceFetchError is returned when getting an instance from the API fails
+// other than with 404, which is UnknownServiceInstanceError.  Code is zero if
+// there was no response, e.g. a connection error; then Err is set.
+type InstanceFetchError struct {
+	Service string
+	Id      uint
+	URL     string
+	Code    int
+	Err     error
+}
+
+func (e InstanceFetchError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Failed to get %s-%d instance from %s: %s", e.Service, e.Id, e.URL, e.Err)
+	}
+	if e.Code != 200 {
+		return fmt.Sprintf("Getting %s-%d instance from %s returned code %d, expected 200", e.Service, e.Id, e.URL, e.Code)
+	}
+	return fmt.Sprintf("Getting %s-%d instance from %s did not return data", e.Service, e.Id, e.URL)
+}
+
+// Transient returns true if retrying might work: there was no response, or
+// the API returned a 5xx error.
+func (e InstanceFetchError) Transient() bool {
+	return e.Code == 0 || e.Code >= 500
+}
@@ -18,8 +18,11 @@
 package pct
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/percona/cloud-protocol/proto"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,16 +30,70 @@ type Logger struct {
 	logChan chan *proto.LogEntry
 	service string
 	cmd     *proto.Cmd
+	level   *logLevel
+	fields  map[string]interface{}
 }
 
+// json.Marshal escapes <, > and & for HTML, which makes messages like
+// "<password-hidden>" hard to read.  The unescaped JSON is still valid.
+var unescapeHTML = strings.NewReplacer(`\u003c`, "<", `\u003e`, ">", `\u0026`, "&")
+
+// logLevel is shared by a logger and the loggers returned by its WithFields.
+type logLevel struct {
+	sync.RWMutex
+	level byte // proto.LOG_*, entries less severe are dropped
+}
+
+// NewLogger returns a logger that sends all entries, including debug, to
+// logChan.  Call SetLevel to drop less severe entries.
 func NewLogger(logChan chan *proto.LogEntry, service string) *Logger {
 	l := &Logger{
 		logChan: logChan,
 		service: service,
+		level:   &logLevel{level: proto.LOG_DEBUG},
 	}
 	return l
 }
 
+// WithFields returns a logger that appends the fields, as a JSON object, to
+// every message, e.g. "Failed to get MySQL info {"dsn":"...","error":"..."}",
+// so log processing can extract them.  The fields are added to this logger's
+// fields, if any.  Both loggers share the same log channel and level.
+func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
+	allFields := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		allFields[k] = v
+	}
+	for k, v := range fields {
+		if err, ok := v.(error); ok && err != nil {
+			v = err.Error() // errors marshal as {}
+		}
+		allFields[k] = v
+	}
+	return &Logger{
+		logChan: l.logChan,
+		service: l.service,
+		cmd:     l.cmd,
+		level:   l.level,
+		fields:  allFields,
+	}
+}
+
+// SetLevel sets the minimum severity, a proto.LOG_* level, of entries sent to
+// the log channel. For example, proto.LOG_INFO drops debug entries.  It is
+// safe to call while other goroutines are logging.
+func (l *Logger) SetLevel(level byte) {
+	l.level.Lock()
+	defer l.level.Unlock()
+	l.level.level = level
+}
+
+func (l *Logger) Level() byte {
+	l.level.RLock()
+	defer l.level.RUnlock()
+	return l.level.level
+}
+
 func (l *Logger) Service() string {
 	return l.service
 }
@@ -71,6 +128,10 @@ func (l *Logger) Fatal(entry ...interface{}) {
 }
 
 func (l *Logger) log(offline bool, level byte, entry []interface{}) {
+	// Levels are syslog severities: lower is more severe.
+	if level > l.Level() {
+		return
+	}
 	fullMsg := ""
 	for i, str := range entry {
 		if i > 0 {
@@ -78,6 +139,13 @@ func (l *Logger) log(offline bool, level byte, entry []interface{}) {
 		}
 		fullMsg += fmt.Sprintf("%v", str)
 	}
+	if len(l.fields) > 0 {
+		if fields, err := json.Marshal(l.fields); err == nil {
+			fullMsg += " " + unescapeHTML.Replace(string(fields))
+		} else {
+			fullMsg += fmt.Sprintf(" %v", l.fields)
+		}
+	}
 	logEntry := &proto.LogEntry{
 		Ts:      time.Now().UTC(),
 		Level:   level,
@@ -0,0 +1,158 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/percona/cloud-protocol/proto"
+	"github.com/percona/percona-agent/pct"
+	. "gopkg.in/check.v1"
+)
+
+type LoggerTestSuite struct {
+	logChan chan *proto.LogEntry
+}
+
+var _ = Suite(&LoggerTestSuite{})
+
+func (s *LoggerTestSuite) SetUpTest(t *C) {
+	s.logChan = make(chan *proto.LogEntry, 100)
+}
+
+// drain returns the entries in the log channel.  Logger sends synchronously,
+// so there's no need to wait.
+func (s *LoggerTestSuite) drain() []*proto.LogEntry {
+	entries := []*proto.LogEntry{}
+	for {
+		select {
+		case e := <-s.logChan:
+			entries = append(entries, e)
+		default:
+			return entries
+		}
+	}
+}
+
+func (s *LoggerTestSuite) levels(logger *pct.Logger) []byte {
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+	logger.Fatal("fatal")
+	levels := []byte{}
+	for _, e := range s.drain() {
+		levels = append(levels, e.Level)
+	}
+	return levels
+}
+
+func (s *LoggerTestSuite) TestDefaultLevel(t *C) {
+	logger := pct.NewLogger(s.logChan, "test")
+	t.Check(logger.Level(), Equals, proto.LOG_DEBUG)
+	t.Check(s.levels(logger), DeepEquals, []byte{
+		proto.LOG_DEBUG,
+		proto.LOG_INFO,
+		proto.LOG_WARNING,
+		proto.LOG_ERROR,
+		proto.LOG_CRITICAL,
+	})
+}
+
+func (s *LoggerTestSuite) TestSetLevel(t *C) {
+	logger := pct.NewLogger(s.logChan, "test")
+
+	logger.SetLevel(proto.LOG_INFO)
+	t.Check(s.levels(logger), DeepEquals, []byte{
+		proto.LOG_INFO,
+		proto.LOG_WARNING,
+		proto.LOG_ERROR,
+		proto.LOG_CRITICAL,
+	})
+
+	logger.SetLevel(proto.LOG_ERROR)
+	t.Check(s.levels(logger), DeepEquals, []byte{
+		proto.LOG_ERROR,
+		proto.LOG_CRITICAL,
+	})
+
+	// Offline debug entries are filtered too.
+	logger.DebugOffline("debug")
+	t.Check(s.drain(), HasLen, 0)
+
+	logger.SetLevel(proto.LOG_DEBUG)
+	logger.DebugOffline("debug")
+	t.Check(s.drain(), HasLen, 1)
+}
+
+func (s *LoggerTestSuite) TestSetLevelConcurrent(t *C) {
+	logger := pct.NewLogger(s.logChan, "test")
+	logger.SetLevel(proto.LOG_WARNING)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				logger.Debug("debug")
+				logger.SetLevel(proto.LOG_WARNING)
+			}
+		}()
+	}
+	wg.Wait()
+	t.Check(s.drain(), HasLen, 0)
+}
+
+func (s *LoggerTestSuite) TestWithFields(t *C) {
+	logger := pct.NewLogger(s.logChan, "test")
+	fieldLogger := logger.WithFields(map[string]interface{}{
+		"dsn":   "user:<password-hidden>@tcp(127.0.0.1:3306)/",
+		"error": errors.New("connection refused"),
+	})
+	fieldLogger.Warn("Failed to get MySQL info")
+	entries := s.drain()
+	t.Assert(entries, HasLen, 1)
+	t.Check(entries[0].Level, Equals, proto.LOG_WARNING)
+	t.Check(entries[0].Service, Equals, "test")
+	t.Check(entries[0].Msg, Equals,
+		`Failed to get MySQL info {"dsn":"user:<password-hidden>@tcp(127.0.0.1:3306)/","error":"connection refused"}`)
+
+	// The fields are in the message as JSON.
+	msg := entries[0].Msg
+	fields := map[string]interface{}{}
+	err := json.Unmarshal([]byte(msg[strings.Index(msg, "{"):]), &fields)
+	t.Assert(err, IsNil)
+	t.Check(fields["error"], Equals, "connection refused")
+
+	// Fields accumulate, and the original logger has none.
+	fieldLogger.WithFields(map[string]interface{}{"id": 1}).Info("hello")
+	logger.Info("hello")
+	entries = s.drain()
+	t.Assert(entries, HasLen, 2)
+	t.Check(entries[0].Msg, Equals,
+		`hello {"dsn":"user:<password-hidden>@tcp(127.0.0.1:3306)/","error":"connection refused","id":1}`)
+	t.Check(entries[1].Msg, Equals, "hello")
+
+	// Loggers with fields share the level.
+	logger.SetLevel(proto.LOG_INFO)
+	fieldLogger.Debug("debug")
+	t.Check(s.drain(), HasLen, 0)
+}
@@ -20,9 +20,13 @@ package pct
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 )
 
 type PidFile struct {
@@ -75,11 +79,21 @@ func (p *PidFile) Set(pidFile string) error {
 		pidFile = filepath.Join(Basedir.Path(), pidFile)
 	}
 
-	// Create new PID file, success only if it doesn't already exist.
+	// Create new PID file, success only if it doesn't already exist or it's
+	// stale, i.e. left by a process that's no longer running.
 	flags := os.O_CREATE | os.O_EXCL | os.O_WRONLY
 	file, err := os.OpenFile(pidFile, flags, 0644)
 	if err != nil {
-		return err
+		if !os.IsExist(err) {
+			return err
+		}
+		if err := removeStale(pidFile); err != nil {
+			return err
+		}
+		// Another process could reclaim it first, so O_EXCL again.
+		if file, err = os.OpenFile(pidFile, flags, 0644); err != nil {
+			return err
+		}
 	}
 
 	// Write PID to new PID file and close.
@@ -118,3 +132,25 @@ func (p *PidFile) remove() error {
 	p.name = ""
 	return nil
 }
+
+// removeStale removes the PID file if the process with its PID isn't running.
+// It returns an error if the process is running or the file doesn't have a PID.
+func removeStale(pidFile string) error {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("PID file %s exists but does not have a PID", pidFile)
+	}
+	// Signal 0 checks if the process exists without signaling it.  EPERM means
+	// it exists but is owned by another user.
+	if err := syscall.Kill(pid, syscall.Signal(0)); err != syscall.ESRCH {
+		return fmt.Errorf("PID file %s exists and process %d is running", pidFile, pid)
+	}
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
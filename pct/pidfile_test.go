@@ -23,6 +23,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/percona/percona-agent/pct"
 	. "gopkg.in/check.v1"
@@ -128,6 +129,40 @@ func (s *TestSuite) TestSetExistsRel(t *C) {
 	t.Assert(s.testPidFile.Set(tmpFile.Name()), NotNil)
 }
 
+func (s *TestSuite) TestSetExistsStale(t *C) {
+	// PID file left by a process that's no longer running, e.g. after a crash.
+	// Find a PID that doesn't exist; PIDs are < 2^22 on Linux.
+	pid := 4194303
+	for ; pid > 1; pid-- {
+		if err := syscall.Kill(pid, syscall.Signal(0)); err == syscall.ESRCH {
+			break
+		}
+	}
+	pidFileName := filepath.Join(pct.Basedir.Path(), getTmpFileName())
+	err := ioutil.WriteFile(pidFileName, []byte(fmt.Sprintf("%d\n", pid)), 0644)
+	t.Assert(err, IsNil)
+
+	// Set should succeed, the stale pidfile is reclaimed
+	t.Assert(s.testPidFile.Set(pidFileName), IsNil)
+	data, err := ioutil.ReadFile(pidFileName)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, fmt.Sprintf("%d\n", os.Getpid()))
+	t.Check(s.testPidFile.Remove(), IsNil)
+}
+
+func (s *TestSuite) TestSetExistsRunning(t *C) {
+	// PID file of a running process: this one.
+	pidFileName := filepath.Join(pct.Basedir.Path(), getTmpFileName())
+	err := ioutil.WriteFile(pidFileName, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	t.Assert(err, IsNil)
+	defer removeTmpFile(pidFileName, t)
+
+	// Set should fail, pidfile is owned by a running process
+	t.Check(s.testPidFile.Set(pidFileName), NotNil)
+	t.Check(s.testPidFile.Get(), Equals, "")
+	t.Check(pct.FileExists(pidFileName), Equals, true)
+}
+
 func (s *TestSuite) TestRemoveEmpty(t *C) {
 	t.Check(s.testPidFile.Set(""), Equals, nil)
 	// Remove should succeed, empty pidfile string provided
@@ -0,0 +1,132 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package pct
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_ATTEMPTS = 3
+	DEFAULT_RETRY_WAIT     = 1 * time.Second
+	DEFAULT_RETRY_MAX_WAIT = 30 * time.Second
+)
+
+type RetryOptions struct {
+	Attempts  int           // total tries, DEFAULT_RETRY_ATTEMPTS if zero
+	Wait      time.Duration // before the 1st retry, doubled for each retry, DEFAULT_RETRY_WAIT if zero
+	MaxWait   time.Duration // max wait between retries, DEFAULT_RETRY_MAX_WAIT if zero
+	RetryPuts bool          // retry PUTs too; only if the API handles duplicate PUTs
+	Sleep     func(time.Duration)
+	Cancel    func() bool // if it returns true after a wait, stop retrying, e.g. on Stop
+}
+
+// RetryingAPI is an APIConnector that retries GETs, and PUTs if RetryPuts is
+// true, on network errors and 5xx responses.  Other responses, like 4xx, are
+// returned as-is because retrying won't change them.  POSTs and DELETEs are
+// never retried because they might not be idempotent.  All other methods
+// are the inner connector's.
+type RetryingAPI struct {
+	APIConnector
+	opts RetryOptions
+}
+
+func NewRetryingAPI(inner APIConnector, opts RetryOptions) *RetryingAPI {
+	if opts.Attempts <= 0 {
+		opts.Attempts = DEFAULT_RETRY_ATTEMPTS
+	}
+	if opts.Wait <= 0 {
+		opts.Wait = DEFAULT_RETRY_WAIT
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = DEFAULT_RETRY_MAX_WAIT
+	}
+	if opts.Sleep == nil {
+		opts.Sleep = time.Sleep
+	}
+	a := &RetryingAPI{
+		APIConnector: inner,
+		opts:         opts,
+	}
+	return a
+}
+
+func (a *RetryingAPI) Get(apiKey, url string) (int, []byte, error) {
+	var code int
+	var data []byte
+	var err error
+	wait := a.opts.Wait
+	for try := 1; try <= a.opts.Attempts; try++ {
+		code, data, err = a.APIConnector.Get(apiKey, url)
+		if !retry(code, err) {
+			break
+		}
+		var ok bool
+		if wait, ok = a.wait(try, wait); !ok {
+			break
+		}
+	}
+	return code, data, err
+}
+
+func (a *RetryingAPI) Put(apiKey, url string, data []byte) (*http.Response, []byte, error) {
+	if !a.opts.RetryPuts {
+		return a.APIConnector.Put(apiKey, url, data)
+	}
+	var resp *http.Response
+	var body []byte
+	var err error
+	wait := a.opts.Wait
+	for try := 1; try <= a.opts.Attempts; try++ {
+		resp, body, err = a.APIConnector.Put(apiKey, url, data)
+		code := 0
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		if !retry(code, err) {
+			break
+		}
+		var ok bool
+		if wait, ok = a.wait(try, wait); !ok {
+			break
+		}
+	}
+	return resp, body, err
+}
+
+// wait sleeps before the next try, if any, and returns how long to wait
+// before the try after that, or false if there's no next try.
+func (a *RetryingAPI) wait(try int, wait time.Duration) (time.Duration, bool) {
+	if try == a.opts.Attempts {
+		return wait, false // no more tries
+	}
+	a.opts.Sleep(wait)
+	if a.opts.Cancel != nil && a.opts.Cancel() {
+		return wait, false
+	}
+	wait *= 2
+	if wait > a.opts.MaxWait {
+		wait = a.opts.MaxWait
+	}
+	return wait, true
+}
+
+func retry(code int, err error) bool {
+	return err != nil || code >= 500
+}
@@ -19,7 +19,13 @@ package pct
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -67,6 +73,41 @@ func RemoveFile(file string) error {
 	return nil
 }
 
+// WriteFileAtomic writes a temp file in the same dir, then renames it to file,
+// so file is never partially written, e.g. if the agent crashes while writing.
+// The temp file name starts with "." so globs like "mysql-*" don't match it.
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(file)
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpFile := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Chmod(tmpFile, perm); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
 func FileExists(file string) bool {
 	_, err := os.Stat(file)
 	if err == nil {
@@ -172,3 +213,138 @@ func Duration(s float64) string {
 func TimeString(t time.Time) string {
 	return t.UTC().Format("2006-01-02 15:04:05 MST")
 }
+
+// SysInfo is the local system info returned by SystemInfo.
+type SysInfo struct {
+	Hostname  string
+	FQDN      string // fully qualified hostname, or Hostname if it doesn't resolve
+	OS        string // runtime.GOOS
+	Distro    string // PRETTY_NAME from /etc/os-release
+	Kernel    string // uname -r
+	CPUs      int
+	MemTotal  uint64 // bytes
+	Container string // docker, lxc, kubernetes, or empty if not in a container
+}
+
+// SystemInfo returns the local system info.  Only the hostname is required;
+// other info that can't be read, e.g. Distro and MemTotal on systems other
+// than Linux, is left empty.
+func SystemInfo() (*SysInfo, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	info := &SysInfo{
+		Hostname: hostname,
+		FQDN:     fqdn(hostname),
+		OS:       runtime.GOOS,
+		CPUs:     runtime.NumCPU(),
+	}
+
+	// Not every system has /etc/os-release, so Distro can be empty.
+	if content, err := ioutil.ReadFile("/etc/os-release"); err == nil {
+		info.Distro = ParseOSRelease(string(content))
+	}
+
+	if content, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		info.Kernel = strings.TrimSpace(string(content))
+	} else if out, err := exec.Command("uname", "-r").Output(); err == nil {
+		info.Kernel = strings.TrimSpace(string(out))
+	}
+
+	if content, err := ioutil.ReadFile("/proc/meminfo"); err == nil {
+		info.MemTotal = ParseMemTotal(string(content))
+	}
+
+	if FileExists("/.dockerenv") {
+		info.Container = "docker"
+	} else if content, err := ioutil.ReadFile("/proc/1/cgroup"); err == nil {
+		info.Container = ParseCgroupContainer(string(content))
+	}
+
+	return info, nil
+}
+
+// fqdn returns the first fully qualified name of the host's addresses, or
+// hostname if none is found.
+func fqdn(hostname string) string {
+	if strings.Contains(hostname, ".") {
+		return hostname
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return hostname
+	}
+	for _, addr := range addrs {
+		names, err := net.LookupAddr(addr)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.HasPrefix(name, hostname+".") {
+				return name
+			}
+		}
+	}
+	return hostname
+}
+
+// ParseOSRelease returns PRETTY_NAME, or NAME if PRETTY_NAME is not set,
+// from the contents of /etc/os-release.
+func ParseOSRelease(content string) string {
+	name := ""
+	for _, line := range strings.Split(content, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.Trim(kv[1], `"'`)
+		switch kv[0] {
+		case "PRETTY_NAME":
+			return val
+		case "NAME":
+			name = val
+		}
+	}
+	return name
+}
+
+// ParseMemTotal returns MemTotal in bytes from the contents of /proc/meminfo.
+func ParseMemTotal(content string) uint64 {
+	for _, line := range strings.Split(content, "\n") {
+		// MemTotal:        8046892 kB
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
+
+// ParseCgroupContainer returns the container type, docker, lxc, or kubernetes,
+// from the contents of /proc/1/cgroup, or an empty string if init isn't in
+// a container.
+func ParseCgroupContainer(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		// 4:memory:/docker/3601745b3bd54d9780436faa5f0e4f72bb46231663bb99a6bb892764917832c2
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch path := parts[2]; {
+		case strings.Contains(path, "kubepods"):
+			return "kubernetes"
+		case strings.HasPrefix(path, "/docker") || strings.Contains(path, "/docker-"):
+			return "docker"
+		case strings.HasPrefix(path, "/lxc"):
+			return "lxc"
+		}
+	}
+	return ""
+}
@@ -132,3 +132,36 @@ func (s *SysTestSuite) TestDuration(t *C) {
 	t.Check(pct.Duration(4000), Equals, "1h6m40s")
 	t.Check(pct.Duration(100000), Equals, "1d3h46m40s")
 }
+
+func (s *SysTestSuite) TestParseSystemInfo(t *C) {
+	osRelease := "NAME=\"Ubuntu\"\nVERSION=\"14.04.1 LTS, Trusty Tahr\"\nPRETTY_NAME=\"Ubuntu 14.04.1 LTS\"\n"
+	t.Check(pct.ParseOSRelease(osRelease), Equals, "Ubuntu 14.04.1 LTS")
+	t.Check(pct.ParseOSRelease("NAME=CentOS\n"), Equals, "CentOS")
+	t.Check(pct.ParseOSRelease(""), Equals, "")
+
+	meminfo := "MemTotal:        8046892 kB\nMemFree:         5273644 kB\n"
+	t.Check(pct.ParseMemTotal(meminfo), Equals, uint64(8046892*1024))
+	t.Check(pct.ParseMemTotal("MemTotal: x kB\n"), Equals, uint64(0))
+	t.Check(pct.ParseMemTotal(""), Equals, uint64(0))
+
+	host := "4:memory:/\n3:cpu,cpuacct:/\n1:name=systemd:/init.scope\n"
+	t.Check(pct.ParseCgroupContainer(host), Equals, "")
+	docker := "4:memory:/docker/3601745b3bd54d9780436faa5f0e4f72bb46231663bb99a6bb892764917832c2\n"
+	t.Check(pct.ParseCgroupContainer(docker), Equals, "docker")
+	systemdDocker := "1:name=systemd:/system.slice/docker-3601745b3bd5.scope\n"
+	t.Check(pct.ParseCgroupContainer(systemdDocker), Equals, "docker")
+	lxc := "2:cpu:/lxc/db1\n"
+	t.Check(pct.ParseCgroupContainer(lxc), Equals, "lxc")
+	k8s := "3:cpu,cpuacct:/kubepods/besteffort/pod1234/3601745b3bd5\n"
+	t.Check(pct.ParseCgroupContainer(k8s), Equals, "kubernetes")
+	t.Check(pct.ParseCgroupContainer(""), Equals, "")
+}
+
+func (s *SysTestSuite) TestSystemInfo(t *C) {
+	info, err := pct.SystemInfo()
+	t.Assert(err, IsNil)
+	hostname, _ := os.Hostname()
+	t.Check(info.Hostname, Equals, hostname)
+	t.Check(info.FQDN, Not(Equals), "")
+	t.Check(info.CPUs > 0, Equals, true)
+}
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/ticker"
@@ -58,7 +59,7 @@ type Analyzer interface {
 
 // An AnalyzerFactory makes an Analyzer, real or mock.
 type AnalyzerFactory interface {
-	Make(config Config, name string, mysqlConn mysql.Connector, restartChan <-chan bool, tickChan chan time.Time) Analyzer
+	Make(config Config, name string, mysqlConn mysql.Connector, restartChan <-chan mrms.RestartEvent, tickChan chan time.Time) Analyzer
 }
 
 // --------------------------------------------------------------------------
@@ -68,7 +69,7 @@ type RealAnalyzer struct {
 	config      Config
 	iter        IntervalIter
 	mysqlConn   mysql.Connector
-	restartChan <-chan bool
+	restartChan <-chan mrms.RestartEvent
 	worker      Worker
 	clock       ticker.Manager
 	spool       data.Spooler
@@ -83,7 +84,7 @@ type RealAnalyzer struct {
 	mux                 *sync.RWMutex
 }
 
-func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysqlConn mysql.Connector, restartChan <-chan bool, worker Worker, clock ticker.Manager, spool data.Spooler) *RealAnalyzer {
+func NewRealAnalyzer(logger *pct.Logger, config Config, iter IntervalIter, mysqlConn mysql.Connector, restartChan <-chan mrms.RestartEvent, worker Worker, clock ticker.Manager, spool data.Spooler) *RealAnalyzer {
 	name := logger.Service()
 	a := &RealAnalyzer{
 		logger:      logger,
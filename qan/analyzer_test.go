@@ -26,6 +26,7 @@ import (
 	. "github.com/go-test/test"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/instance"
+	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/qan"
@@ -42,7 +43,7 @@ type AnalyzerTestSuite struct {
 	clock         *mock.Clock
 	api           *mock.API
 	worker        *mock.QanWorker
-	restartChan   chan bool
+	restartChan   chan mrms.RestartEvent
 	logChan       chan *proto.LogEntry
 	logger        *pct.Logger
 	intervalChan  chan *qan.Interval
@@ -85,7 +86,7 @@ func (s *AnalyzerTestSuite) SetUpSuite(t *C) {
 	data, err := json.Marshal(&proto.MySQLInstance{
 		Hostname: "bm-cloud-db01",
 		Alias:    "db01",
-		DSN:      "user:pass@tcp/",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
 	})
 	t.Assert(err, IsNil)
 	s.im.Add("mysql", 1, data, false)
@@ -97,7 +98,7 @@ func (s *AnalyzerTestSuite) SetUpSuite(t *C) {
 	}
 	s.api = mock.NewAPI("http://localhost", "http://localhost", "123", "abc-123-def", links)
 
-	s.restartChan = make(chan bool, 1)
+	s.restartChan = make(chan mrms.RestartEvent, 1)
 }
 
 func (s *AnalyzerTestSuite) SetUpTest(t *C) {
@@ -258,7 +259,7 @@ func (s *AnalyzerTestSuite) TestMySQLRestart(t *C) {
 	// Simulate a MySQL restart. This causes the analyzer to re-configure MySQL
 	// using the same Start queries.
 	s.nullmysql.Reset()
-	s.restartChan <- true
+	s.restartChan <- mrms.RestartEvent{}
 	if !test.WaitState(s.nullmysql.SetChan) {
 		t.Error("Timeout waiting for <-s.nullmysql.SetChan")
 	}
@@ -275,7 +276,7 @@ func (s *AnalyzerTestSuite) TestMySQLRestart(t *C) {
 	s.nullmysql.Reset()
 	// Enable slowlog DB rotation by setting max_slowlog_size to a value > 4096 and simulate MySQL restart
 	s.nullmysql.SetGlobalVarNumber("max_slowlog_size", 100000)
-	s.restartChan <- true
+	s.restartChan <- mrms.RestartEvent{}
 	if !test.WaitState(s.nullmysql.SetChan) {
 		t.Error("Timeout waiting for <-s.nullmysql.SetChan")
 	}
@@ -18,23 +18,183 @@
 package qan
 
 import (
+	"errors"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/mysql"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_COLLECT_FROM         = "slowlog"
+	DEFAULT_INTERVAL             = 60         // 1 minute
+	DEFAULT_MAX_SLOW_LOG_SIZE    = 1073741824 // 1 GiB
+	DEFAULT_MAX_WORKERS          = 2
+	DEFAULT_WORKER_RUNTIME       = 55 // seconds, less than DEFAULT_INTERVAL
+	DEFAULT_REPORT_LIMIT         = 200
+	DEFAULT_LONG_QUERY_TIME      = "0"
+	DEFAULT_STOP_LONG_QUERY_TIME = "10" // MySQL default, restored on stop
 )
 
 type Config struct {
 	proto.ServiceInstance
 	// Manager
-	CollectFrom       string // "slowlog" or "perfschema"
+	CollectFrom       string // "slowlog" (default) or "perfschema"
 	Start             []mysql.Query
 	Stop              []mysql.Query
 	MaxWorkers        int
-	Interval          uint  // minutes, "How often to report"
-	MaxSlowLogSize    int64 // bytes, 0 = no max
-	RemoveOldSlowLogs bool  // after rotating for MaxSlowLogSize
+	Interval          uint  // seconds, "How often to report"
+	MaxSlowLogSize    int64 // bytes, 0 = no max; slowlog only
+	RemoveOldSlowLogs bool  // after rotating for MaxSlowLogSize; slowlog only
 	// Worker
 	ExampleQueries bool // only fingerprints if false
 	WorkerRunTime  uint // seconds
 	// Report
 	ReportLimit uint
 }
+
+var longQueryTimeRe = regexp.MustCompile(`(?i)long_query_time\s*=\s*([^\s,;]+)`)
+
+// DefaultConfig returns a config that collects from the slow log, or from
+// performance_schema if the DSN is not local because the agent cannot read
+// a remote MySQL's slow log.  Callers set ServiceInstance.
+func DefaultConfig(dsn string) *Config {
+	c := &Config{
+		CollectFrom:    DEFAULT_COLLECT_FROM,
+		MaxWorkers:     DEFAULT_MAX_WORKERS,
+		Interval:       DEFAULT_INTERVAL,
+		ExampleQueries: true,
+		WorkerRunTime:  DEFAULT_WORKER_RUNTIME,
+		ReportLimit:    DEFAULT_REPORT_LIMIT,
+	}
+	if !isLocalDSN(dsn) {
+		// Don't change MySQL, only check that performance_schema is enabled.
+		c.CollectFrom = "perfschema"
+		c.Start = []mysql.Query{
+			mysql.Query{Verify: "performance_schema", Expect: "1"},
+		}
+		c.Stop = []mysql.Query{
+			mysql.Query{Verify: "performance_schema", Expect: "1"},
+		}
+		return c
+	}
+	c.Start = []mysql.Query{
+		mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"},
+		mysql.Query{Set: "SET GLOBAL long_query_time=" + DEFAULT_LONG_QUERY_TIME},
+		mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+	}
+	c.Stop = []mysql.Query{
+		mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"},
+		mysql.Query{Set: "SET GLOBAL long_query_time=" + DEFAULT_STOP_LONG_QUERY_TIME},
+	}
+	c.MaxSlowLogSize = DEFAULT_MAX_SLOW_LOG_SIZE
+	c.RemoveOldSlowLogs = true
+	return c
+}
+
+// Validate returns an error if the config is not usable.  An empty
+// CollectFrom is set to DEFAULT_COLLECT_FROM for backwards-compatibility.
+func (c *Config) Validate() error {
+	if c.CollectFrom == "" {
+		// Before perf schema, CollectFrom didn't exist, so existing default QAN configs
+		// don't have it.  To be backwards-compatible, no CollectFrom == slowlog.
+		c.CollectFrom = DEFAULT_COLLECT_FROM
+	}
+	if c.CollectFrom != "slowlog" && c.CollectFrom != "perfschema" {
+		return fmt.Errorf("Invalid CollectFrom: '%s'.  Expected 'perfschema' or 'slowlog'.", c.CollectFrom)
+	}
+	if c.Start == nil || len(c.Start) == 0 {
+		return errors.New("qan.Config.Start array is empty")
+	}
+	if c.Stop == nil || len(c.Stop) == 0 {
+		return errors.New("qan.Config.Stop array is empty")
+	}
+	for _, q := range c.Start {
+		if err := validLongQueryTime(q.Set); err != nil {
+			return err
+		}
+	}
+	if c.MaxWorkers < 1 {
+		return errors.New("MaxWorkers must be > 0")
+	}
+	if c.MaxWorkers > 4 {
+		return errors.New("MaxWorkers must be <= 4")
+	}
+	if c.Interval == 0 {
+		return errors.New("Interval must be > 0")
+	}
+	if c.Interval > 3600 {
+		return errors.New("Interval must be <= 3600 (1 hour)")
+	}
+	if c.WorkerRunTime == 0 {
+		return errors.New("WorkerRuntime must be > 0")
+	}
+	if c.WorkerRunTime > 1200 {
+		return errors.New("WorkerRuntime must be <= 1200 (20 minutes)")
+	}
+	if c.MaxSlowLogSize < 0 {
+		return errors.New("MaxSlowLogSize must be >= 0")
+	}
+	if c.CollectFrom == "perfschema" {
+		// Slow log settings do nothing with perfschema, so they're a mistake,
+		// e.g. a slowlog config with only CollectFrom changed.
+		if c.MaxSlowLogSize > 0 {
+			return errors.New("MaxSlowLogSize is only valid with CollectFrom=slowlog; set it to 0 for CollectFrom=perfschema")
+		}
+		if c.RemoveOldSlowLogs {
+			return errors.New("RemoveOldSlowLogs is only valid with CollectFrom=slowlog; set it to false for CollectFrom=perfschema")
+		}
+		return nil
+	}
+	if c.RemoveOldSlowLogs && c.MaxSlowLogSize == 0 {
+		return errors.New("RemoveOldSlowLogs requires MaxSlowLogSize > 0 because slow logs are only rotated at MaxSlowLogSize")
+	}
+	return nil
+}
+
+// Normalize lowers MaxWorkers to cpus, usually runtime.NumCPU(), because more
+// workers than CPUs contend while parsing slow logs.  It returns MaxWorkers and
+// a warning if it was lowered or if one worker can run past the next interval,
+// else an empty string.  Call it after Validate.
+func (c *Config) Normalize(cpus int) (int, string) {
+	warnings := []string{}
+	if cpus > 0 && c.MaxWorkers > cpus {
+		warnings = append(warnings, fmt.Sprintf("MaxWorkers %d is greater than the number of CPUs, using %d", c.MaxWorkers, cpus))
+		c.MaxWorkers = cpus
+	}
+	if c.MaxWorkers == 1 && c.WorkerRunTime >= c.Interval {
+		warnings = append(warnings, fmt.Sprintf("WorkerRunTime %ds is not less than Interval %ds, so with 1 worker some intervals may not be analyzed", c.WorkerRunTime, c.Interval))
+	}
+	return c.MaxWorkers, strings.Join(warnings, "; ")
+}
+
+// validLongQueryTime returns an error if the query sets long_query_time to
+// something other than a number >= 0.
+func validLongQueryTime(query string) error {
+	m := longQueryTimeRe.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+	value := strings.Trim(m[1], "'\"")
+	if t, err := strconv.ParseFloat(value, 64); err != nil || t < 0 {
+		return fmt.Errorf("long_query_time must be a number >= 0: %s", query)
+	}
+	return nil
+}
+
+// isLocalDSN returns true if the DSN is a socket or a loopback address.
+// An invalid DSN is treated as local; the MySQL connection reports the error.
+func isLocalDSN(dsnString string) bool {
+	dsn, err := mysql.ParseDSN(dsnString)
+	if err != nil || dsn.Socket != "" {
+		return true
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(dsn.Hostname, "["), "]")
+	switch host {
+	case "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
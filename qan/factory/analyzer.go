@@ -22,6 +22,7 @@ import (
 
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/data"
+	"github.com/percona/percona-agent/mrms"
 	"github.com/percona/percona-agent/mysql"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/qan"
@@ -62,7 +63,7 @@ func (f *RealAnalyzerFactory) Make(
 	config qan.Config,
 	name string,
 	mysqlConn mysql.Connector,
-	restartChan <-chan bool,
+	restartChan <-chan mrms.RestartEvent,
 	tickChan chan time.Time,
 ) qan.Analyzer {
 	var worker qan.Worker
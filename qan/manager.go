@@ -19,9 +19,9 @@ package qan
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"os"
+	"runtime"
 	"sync"
 	"time"
 
@@ -37,7 +37,7 @@ import (
 // as configured.
 type AnalyzerInstance struct {
 	mysqlConn   mysql.Connector
-	restartChan <-chan bool
+	restartChan <-chan mrms.RestartEvent
 	tickChan    chan time.Time
 	analyzer    Analyzer
 }
@@ -95,6 +95,9 @@ func (m *Manager) Start() error {
 		return pct.ServiceIsRunningError{Service: "qan"}
 	}
 
+	// Stop analyzers before the instances they analyze are removed.
+	m.im.AddRemoveHook("qan", m.removeInstance)
+
 	// Manager ("qan" in status) runs independent from qan-parser.
 	m.status.Update("qan", "Starting")
 	defer func() {
@@ -135,6 +138,8 @@ func (m *Manager) Stop() error {
 	m.logger.Debug("Stop:call")
 	defer m.logger.Debug("Stop:return")
 
+	m.im.DeleteRemoveHook("qan")
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	if !m.running {
@@ -241,40 +246,9 @@ func (m *Manager) GetConfig() ([]proto.AgentConfig, []error) {
 	return configs, nil
 }
 
+// ValidateConfig is the same as config.Validate().
 func ValidateConfig(config *Config) error {
-	if config.CollectFrom == "" {
-		// Before perf schema, CollectFrom didn't exist, so existing default QAN configs
-		// don't have it.  To be backwards-compatible, no CollectFrom == slowlog.
-		config.CollectFrom = "slowlog"
-	}
-	if config.CollectFrom != "slowlog" && config.CollectFrom != "perfschema" {
-		return fmt.Errorf("Invalid CollectFrom: '%s'.  Expected 'perfschema' or 'slowlog'.", config.CollectFrom)
-	}
-	if config.Start == nil || len(config.Start) == 0 {
-		return errors.New("qan.Config.Start array is empty")
-	}
-	if config.Stop == nil || len(config.Stop) == 0 {
-		return errors.New("qan.Config.Stop array is empty")
-	}
-	if config.MaxWorkers < 1 {
-		return errors.New("MaxWorkers must be > 0")
-	}
-	if config.MaxWorkers > 4 {
-		return errors.New("MaxWorkers must be < 4")
-	}
-	if config.Interval == 0 {
-		return errors.New("Interval must be > 0")
-	}
-	if config.Interval > 3600 {
-		return errors.New("Interval must be <= 3600 (1 hour)")
-	}
-	if config.WorkerRunTime == 0 {
-		return errors.New("WorkerRuntime must be > 0")
-	}
-	if config.WorkerRunTime > 1200 {
-		return errors.New("WorkerRuntime must be <= 1200 (20 minutes)")
-	}
-	return nil
+	return config.Validate()
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -293,6 +267,9 @@ func (m *Manager) startAnalyzer(config Config) error {
 	if err := ValidateConfig(&config); err != nil {
 		return fmt.Errorf("Invalid qan.Config: %s", err)
 	}
+	if _, warning := config.Normalize(runtime.NumCPU()); warning != "" {
+		m.logger.Warn(warning)
+	}
 
 	// Check if an analyzer for this MySQL instance already exists.
 	if a, ok := m.analyzers[config.InstanceId]; ok {
@@ -381,3 +358,28 @@ func (m *Manager) stopAnalyzer(instanceId uint) error {
 
 	return nil // success
 }
+
+// instance.RemoveHook: stop the analyzer for the MySQL instance, if any, and remove
+// its config.
+func (m *Manager) removeInstance(service string, id uint) error {
+	if service != "mysql" {
+		return nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.analyzers[id]; !ok {
+		return nil
+	}
+	if err := m.stopAnalyzer(id); err != nil {
+		return err
+	}
+	// Remove qan.conf like StopService so agent doesn't run qan for the
+	// removed instance on restart.
+	config := &Config{}
+	if err := pct.Basedir.ReadConfig("qan", config); err == nil && config.InstanceId == id {
+		if err := pct.Basedir.RemoveConfig("qan"); err != nil {
+			m.logger.Warn("Remove qan: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -77,7 +77,7 @@ func (s *ManagerTestSuite) SetUpSuite(t *C) {
 	data, err := json.Marshal(&proto.MySQLInstance{
 		Hostname: "bm-cloud-db01",
 		Alias:    "db01",
-		DSN:      "user:pass@tcp/",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
 	})
 	t.Assert(err, IsNil)
 	s.im.Add("mysql", 1, data, false)
@@ -223,6 +223,61 @@ func (s *ManagerTestSuite) TestStartWithConfig(t *C) {
 	}
 }
 
+func (s *ManagerTestSuite) TestRemoveInstanceStopsAnalyzer(t *C) {
+	// Use a repo of our own because the instance is removed.
+	im := instance.NewRepo(pct.NewLogger(s.logChan, "im-test"), s.configDir, s.api)
+	data, err := json.Marshal(&proto.MySQLInstance{
+		Hostname: "bm-cloud-db01",
+		DSN:      "user:pass@tcp(127.0.0.1:3306)/",
+	})
+	t.Assert(err, IsNil)
+	err = im.Add("mysql", 1, data, true)
+	t.Assert(err, IsNil)
+
+	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
+	a := mock.NewQanAnalyzer()
+	f := mock.NewQanAnalyzerFactory(a)
+	m := qan.NewManager(s.logger, s.clock, im, s.mrmsMonitor, mockConnFactory, f)
+	t.Assert(m, NotNil)
+
+	config := qan.Config{
+		ServiceInstance: s.mysqlInstance,
+		CollectFrom:     "slowlog",
+		Interval:        300,
+		MaxWorkers:      1,
+		WorkerRunTime:   600,
+		Start: []mysql.Query{
+			mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+		},
+		Stop: []mysql.Query{
+			mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"},
+		},
+	}
+	err = pct.Basedir.WriteConfig("qan", &config)
+	t.Assert(err, IsNil)
+
+	err = m.Start()
+	t.Check(err, IsNil)
+	if !test.WaitState(a.StartChan) {
+		t.Fatal("Timeout waiting for <-a.StartChan")
+	}
+
+	// Removing the instance stops its analyzer first.
+	err = im.Remove("mysql", 1)
+	t.Assert(err, IsNil)
+	select {
+	case <-a.StopChan:
+	default:
+		t.Error("Instance removed but analyzer not stopped")
+	}
+	_, ok := m.Status()["qan-analyzer"]
+	t.Check(ok, Equals, false)
+	t.Check(test.FileExists(pct.Basedir.ConfigFile("qan")), Equals, false)
+
+	err = m.Stop()
+	t.Assert(err, IsNil)
+}
+
 func (s *ManagerTestSuite) TestGetConfig(t *C) {
 	// Make a qan.Manager with mock factories.
 	mockConnFactory := &mock.ConnectionFactory{Conn: s.nullmysql}
@@ -347,6 +402,173 @@ func (s *ManagerTestSuite) TestValidateConfig(t *C) {
 	t.Check(config.CollectFrom, Equals, "slowlog")
 }
 
+func (s *ManagerTestSuite) TestValidateConfigRules(t *C) {
+	valid := func() *qan.Config {
+		c := qan.DefaultConfig("percona:percona@unix(/var/run/mysqld/mysqld.sock)/")
+		c.ServiceInstance = proto.ServiceInstance{Service: "mysql", InstanceId: 1}
+		return c
+	}
+	t.Assert(valid().Validate(), IsNil)
+
+	c := valid()
+	c.Interval = 0
+	t.Check(c.Validate(), ErrorMatches, "Interval must be > 0")
+
+	c = valid()
+	c.Interval = 3601
+	t.Check(c.Validate(), ErrorMatches, `Interval must be <= 3600 \(1 hour\)`)
+
+	c = valid()
+	c.MaxWorkers = 0
+	t.Check(c.Validate(), ErrorMatches, "MaxWorkers must be > 0")
+
+	c = valid()
+	c.MaxWorkers = 5
+	t.Check(c.Validate(), ErrorMatches, "MaxWorkers must be <= 4")
+
+	c = valid()
+	c.WorkerRunTime = 0
+	t.Check(c.Validate(), ErrorMatches, "WorkerRuntime must be > 0")
+
+	c = valid()
+	c.WorkerRunTime = 1201
+	t.Check(c.Validate(), ErrorMatches, `WorkerRuntime must be <= 1200 \(20 minutes\)`)
+
+	c = valid()
+	c.Start[1] = mysql.Query{Set: "SET GLOBAL long_query_time=-1"}
+	t.Check(c.Validate(), ErrorMatches, "long_query_time must be a number >= 0: .*")
+
+	c = valid()
+	c.Start[1] = mysql.Query{Set: "SET GLOBAL long_query_time=fast"}
+	t.Check(c.Validate(), ErrorMatches, "long_query_time must be a number >= 0: .*")
+
+	c = valid()
+	c.Start[1] = mysql.Query{Set: "SET GLOBAL long_query_time=0.5"}
+	t.Check(c.Validate(), IsNil)
+
+	c = valid()
+	c.MaxSlowLogSize = -1
+	t.Check(c.Validate(), ErrorMatches, "MaxSlowLogSize must be >= 0")
+
+	c = valid()
+	c.MaxSlowLogSize = 0
+	t.Check(c.Validate(), ErrorMatches, "RemoveOldSlowLogs requires MaxSlowLogSize > 0.*")
+	c.RemoveOldSlowLogs = false
+	t.Check(c.Validate(), IsNil)
+
+	c = valid()
+	c.CollectFrom = "tcpdump"
+	t.Check(c.Validate(), ErrorMatches, "Invalid CollectFrom: 'tcpdump'.*")
+}
+
+func (s *ManagerTestSuite) TestNormalizeConfig(t *C) {
+	config := func(maxWorkers int) *qan.Config {
+		c := qan.DefaultConfig("percona:percona@unix(/var/run/mysqld/mysqld.sock)/")
+		c.MaxWorkers = maxWorkers
+		return c
+	}
+
+	// More workers than CPUs are lowered to the number of CPUs.
+	c := config(4)
+	n, warning := c.Normalize(2)
+	t.Check(n, Equals, 2)
+	t.Check(c.MaxWorkers, Equals, 2)
+	t.Check(warning, Equals, "MaxWorkers 4 is greater than the number of CPUs, using 2")
+
+	// Fewer or as many workers as CPUs aren't changed.
+	c = config(2)
+	n, warning = c.Normalize(4)
+	t.Check(n, Equals, 2)
+	t.Check(warning, Equals, "")
+
+	c = config(2)
+	n, warning = c.Normalize(2)
+	t.Check(n, Equals, 2)
+	t.Check(warning, Equals, "")
+
+	// Unknown number of CPUs.
+	c = config(3)
+	n, warning = c.Normalize(0)
+	t.Check(n, Equals, 3)
+	t.Check(warning, Equals, "")
+
+	// Lowered to 1 worker, which can run past the next interval.
+	c = config(2)
+	c.WorkerRunTime = 60
+	n, warning = c.Normalize(1)
+	t.Check(n, Equals, 1)
+	t.Check(warning, Equals, "MaxWorkers 2 is greater than the number of CPUs, using 1; "+
+		"WorkerRunTime 60s is not less than Interval 60s, so with 1 worker some intervals may not be analyzed")
+}
+
+func (s *ManagerTestSuite) TestValidateCollectFrom(t *C) {
+	// slowlog with slow log rotation.
+	c := qan.DefaultConfig("percona:percona@tcp(127.0.0.1:3306)/")
+	t.Check(c.CollectFrom, Equals, "slowlog")
+	t.Check(c.Validate(), IsNil)
+
+	// Empty is slowlog.
+	c.CollectFrom = ""
+	t.Check(c.Validate(), IsNil)
+	t.Check(c.CollectFrom, Equals, "slowlog")
+
+	// perfschema without slow log settings.
+	c = qan.DefaultConfig("percona:percona@tcp(db1.example.com:3306)/")
+	t.Check(c.CollectFrom, Equals, "perfschema")
+	t.Check(c.Validate(), IsNil)
+
+	// perfschema with slowlog-only settings is invalid.
+	c.MaxSlowLogSize = qan.DEFAULT_MAX_SLOW_LOG_SIZE
+	t.Check(c.Validate(), ErrorMatches, "MaxSlowLogSize is only valid with CollectFrom=slowlog.*")
+	c.MaxSlowLogSize = 0
+	c.RemoveOldSlowLogs = true
+	t.Check(c.Validate(), ErrorMatches, "RemoveOldSlowLogs is only valid with CollectFrom=slowlog.*")
+
+	// A slowlog config switched to perfschema is invalid too.
+	c = qan.DefaultConfig("percona:percona@tcp(127.0.0.1:3306)/")
+	c.CollectFrom = "perfschema"
+	t.Check(c.Validate(), NotNil)
+}
+
+func (s *ManagerTestSuite) TestDefaultConfig(t *C) {
+	// Local MySQL: collect from the slow log.
+	for _, dsn := range []string{
+		"percona:percona@unix(/var/run/mysqld/mysqld.sock)/",
+		"percona:percona@tcp(localhost:3306)/",
+		"percona:percona@tcp(127.0.0.1:3306)/",
+		"percona:percona@tcp([::1]:3306)/",
+	} {
+		c := qan.DefaultConfig(dsn)
+		t.Check(c.CollectFrom, Equals, "slowlog", Commentf("%s", dsn))
+		t.Check(c.Interval, Equals, uint(qan.DEFAULT_INTERVAL))
+		t.Check(c.MaxWorkers, Equals, qan.DEFAULT_MAX_WORKERS)
+		t.Check(c.WorkerRunTime, Equals, uint(qan.DEFAULT_WORKER_RUNTIME))
+		t.Check(c.ReportLimit, Equals, uint(qan.DEFAULT_REPORT_LIMIT))
+		t.Check(c.MaxSlowLogSize, Equals, int64(qan.DEFAULT_MAX_SLOW_LOG_SIZE))
+		t.Check(c.RemoveOldSlowLogs, Equals, true)
+		t.Check(c.Start, DeepEquals, []mysql.Query{
+			mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"},
+			mysql.Query{Set: "SET GLOBAL long_query_time=0"},
+			mysql.Query{Set: "SET GLOBAL slow_query_log=ON"},
+		})
+		t.Check(c.Stop, DeepEquals, []mysql.Query{
+			mysql.Query{Set: "SET GLOBAL slow_query_log=OFF"},
+			mysql.Query{Set: "SET GLOBAL long_query_time=10"},
+		})
+		t.Check(c.Validate(), IsNil)
+	}
+
+	// Remote MySQL: the slow log isn't readable, so use performance_schema.
+	c := qan.DefaultConfig("percona:percona@tcp(db1.example.com:3306)/")
+	t.Check(c.CollectFrom, Equals, "perfschema")
+	t.Check(c.MaxSlowLogSize, Equals, int64(0))
+	t.Check(c.RemoveOldSlowLogs, Equals, false)
+	t.Check(c.Start, DeepEquals, []mysql.Query{
+		mysql.Query{Verify: "performance_schema", Expect: "1"},
+	})
+	t.Check(c.Validate(), IsNil)
+}
+
 /*
 	Handler tests
 */
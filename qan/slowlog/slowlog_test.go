@@ -318,6 +318,8 @@ func (s *WorkerTestSuite) TestRotateAndRemoveSlowLog(t *C) {
 		CollectFrom: "slowlog",
 	}
 	w := slowlog.NewWorker(s.logger, config, s.nullmysql)
+	w.MinOldSlowLogAge = 0 // remove the old slow log right away
+	s.nullmysql.SetGlobalVarString("slow_query_log_file", "/tmp/"+slowlogFile)
 
 	// Make copy of slow log because test will mv/rename it.
 	cp := exec.Command("cp", inputDir+slowlogFile, "/tmp/"+slowlogFile)
@@ -513,6 +515,45 @@ func (s *WorkerTestSuite) TestRotateSlowLog(t *C) {
 	}
 }
 
+func (s *WorkerTestSuite) TestCheckOldSlowLog(t *C) {
+	tmpDir, err := ioutil.TempDir("/tmp", "agent-test")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now()
+	old := now.Add(-1 * time.Hour)
+	active := filepath.Join(tmpDir, "slow.log")
+	rotated := filepath.Join(tmpDir, "slow.log-1") // rotated an hour ago
+	justRotated := filepath.Join(tmpDir, "slow.log-2")
+	for _, file := range []string{active, rotated, justRotated} {
+		err := ioutil.WriteFile(file, []byte("# Time: 071015 21:45:10\n"), 0644)
+		t.Assert(err, IsNil)
+	}
+	t.Assert(os.Chtimes(active, old, old), IsNil)
+	t.Assert(os.Chtimes(rotated, old, old), IsNil)
+
+	minAge := time.Minute
+
+	// Only the old, rotated slow log is safe to remove.
+	t.Check(slowlog.CheckOldSlowLog(rotated, active, minAge, now), IsNil)
+	t.Check(slowlog.CheckOldSlowLog(active, active, minAge, now), Equals, slowlog.ErrActiveSlowLog)
+	t.Check(slowlog.CheckOldSlowLog(justRotated, active, minAge, now), ErrorMatches, "last written .* ago, less than 1m0s")
+
+	// Not removed if it's the active slow log by another name, e.g. a link.
+	link := filepath.Join(tmpDir, "mysql-slow.log")
+	t.Assert(os.Link(rotated, link), IsNil)
+	t.Check(slowlog.CheckOldSlowLog(rotated, link, minAge, now), Equals, slowlog.ErrActiveSlowLog)
+
+	// Without the active slow log, only the age is checked.
+	t.Check(slowlog.CheckOldSlowLog(active, "", minAge, now), IsNil)
+	t.Check(slowlog.CheckOldSlowLog(justRotated, "", minAge, now), NotNil)
+	t.Check(slowlog.CheckOldSlowLog(justRotated, "", 0, now), IsNil)
+
+	// Already removed.
+	err = slowlog.CheckOldSlowLog(filepath.Join(tmpDir, "slow.log-3"), active, minAge, now)
+	t.Check(os.IsNotExist(err), Equals, true)
+}
+
 func (s *WorkerTestSuite) TestStop(t *C) {
 	config := qan.Config{
 		ServiceInstance:   s.mysqlInstance,
@@ -18,8 +18,10 @@
 package slowlog
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/percona/cloud-protocol/proto"
@@ -32,6 +34,10 @@ import (
 	"github.com/percona/percona-agent/qan"
 )
 
+// Old slow logs aren't removed until they haven't been written for this long,
+// in case MySQL is still flushing to one that was just rotated.
+const DEFAULT_MIN_OLD_SLOW_LOG_AGE = 30 * time.Second
+
 type WorkerFactory interface {
 	Make(name string, config qan.Config, mysqlConn mysql.Connector) *Worker
 }
@@ -71,7 +77,8 @@ type Worker struct {
 	config    qan.Config
 	mysqlConn mysql.Connector
 	// --
-	ZeroRunTime bool // testing
+	ZeroRunTime      bool          // testing
+	MinOldSlowLogAge time.Duration // see DEFAULT_MIN_OLD_SLOW_LOG_AGE
 	// --
 	name            string
 	status          *pct.Status
@@ -112,6 +119,8 @@ func NewWorker(logger *pct.Logger, config qan.Config, mysqlConn mysql.Connector)
 		oldSlowLogs:     make(map[int]string),
 		sync:            pct.NewSyncChan(),
 		utcOffset:       utcOffset,
+		// --
+		MinOldSlowLogAge: DEFAULT_MIN_OLD_SLOW_LOG_AGE,
 	}
 	return w
 }
@@ -318,10 +327,29 @@ func (w *Worker) Stop() error {
 	return nil
 }
 
+// Cleanup removes the old slow logs that are safe to remove, see
+// CheckOldSlowLog.  The others are kept until the next Cleanup, unless MySQL
+// is writing to one, in which case it's never removed.
 func (w *Worker) Cleanup() error {
 	w.logger.Debug("Cleanup:call")
 	defer w.logger.Debug("Cleanup:return")
+	if len(w.oldSlowLogs) == 0 {
+		return nil
+	}
+	activeSlowLog := w.activeSlowLog()
+	now := time.Now()
 	for i, file := range w.oldSlowLogs {
+		if err := CheckOldSlowLog(file, activeSlowLog, w.MinOldSlowLogAge, now); err != nil {
+			if err == ErrActiveSlowLog {
+				w.logger.Warn("Not removing " + file + ": " + err.Error())
+				delete(w.oldSlowLogs, i)
+			} else if os.IsNotExist(err) {
+				delete(w.oldSlowLogs, i)
+			} else {
+				w.logger.Debug("Not removing " + file + " yet: " + err.Error())
+			}
+			continue
+		}
 		w.status.Update(w.name, "Removing slow log "+file)
 		if err := os.Remove(file); err != nil {
 			w.logger.Warn(err)
@@ -333,6 +361,42 @@ func (w *Worker) Cleanup() error {
 	return nil
 }
 
+var ErrActiveSlowLog = errors.New("MySQL is writing to it (slow_query_log_file)")
+
+// CheckOldSlowLog returns nil if the rotated slow log file can be removed:
+// it's not the activeSlowLog that MySQL is writing to, if known, and it
+// hasn't been written for at least minAge.  Else it returns ErrActiveSlowLog,
+// a stat error, or why the file is too new.
+func CheckOldSlowLog(file, activeSlowLog string, minAge time.Duration, now time.Time) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if activeSlowLog != "" {
+		if filepath.Clean(file) == filepath.Clean(activeSlowLog) {
+			return ErrActiveSlowLog
+		}
+		if same, err := pct.SameFile(file, activeSlowLog); err == nil && same {
+			return ErrActiveSlowLog
+		}
+	}
+	if age := now.Sub(stat.ModTime()); age < minAge {
+		return fmt.Errorf("last written %s ago, less than %s", age, minAge)
+	}
+	return nil
+}
+
+// activeSlowLog returns MySQL's slow_query_log_file, or an empty string if
+// it can't be determined.
+func (w *Worker) activeSlowLog() string {
+	if err := w.mysqlConn.Connect(1); err != nil {
+		w.logger.Warn("Cannot get slow_query_log_file:", err)
+		return ""
+	}
+	defer w.mysqlConn.Close()
+	return w.mysqlConn.GetGlobalVarString("slow_query_log_file")
+}
+
 func (w *Worker) Status() map[string]string {
 	return w.status.All()
 }
@@ -23,5 +23,7 @@ import (
 
 type Config struct {
 	proto.ServiceInstance
-	Report uint // how often to collect and send config (seconds)
+	Report   uint     // how often to collect and send config (seconds)
+	DiffOnly bool     `json:",omitempty"` // send only changed settings after the first report
+	Deny     []string // glob patterns of settings to omit from reports (nil = monitor defaults)
 }
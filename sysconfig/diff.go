@@ -0,0 +1,99 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package sysconfig
+
+import (
+	"sort"
+)
+
+// A SettingChange is a setting whose value differs between two reports.
+type SettingChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// A ReportDiff is the difference between two reports: settings that are only
+// in the current report (Added), only in the previous report (Removed), and
+// in both but with different values (Changed).  Each list is sorted by name.
+type ReportDiff struct {
+	Added   []Setting
+	Removed []Setting
+	Changed []SettingChange
+}
+
+// Empty returns true if the reports had the same settings and values.
+func (d *ReportDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff compares the settings of two reports.  The order of settings in the
+// reports does not matter.  If a report has a setting more than once, the
+// last value wins.  A nil report, or one that's not Full, has no settings,
+// so Diff(nil, curr) returns all of curr's settings as added.
+func Diff(prev, curr *Report) *ReportDiff {
+	prevSettings := settingsMap(prev)
+	currSettings := settingsMap(curr)
+
+	d := &ReportDiff{
+		Added:   []Setting{},
+		Removed: []Setting{},
+		Changed: []SettingChange{},
+	}
+	for name, value := range currSettings {
+		oldValue, ok := prevSettings[name]
+		if !ok {
+			d.Added = append(d.Added, Setting{name, value})
+		} else if oldValue != value {
+			d.Changed = append(d.Changed, SettingChange{Name: name, Old: oldValue, New: value})
+		}
+	}
+	for name, value := range prevSettings {
+		if _, ok := currSettings[name]; !ok {
+			d.Removed = append(d.Removed, Setting{name, value})
+		}
+	}
+
+	sort.Sort(byName(d.Added))
+	sort.Sort(byName(d.Removed))
+	sort.Sort(changesByName(d.Changed))
+	return d
+}
+
+func settingsMap(r *Report) map[string]string {
+	settings := make(map[string]string)
+	if r == nil || !r.Full() {
+		return settings
+	}
+	for _, s := range r.Settings {
+		settings[s[0]] = s[1]
+	}
+	return settings
+}
+
+type byName []Setting
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i][0] < s[j][0] }
+
+type changesByName []SettingChange
+
+func (s changesByName) Len() int           { return len(s) }
+func (s changesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s changesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -0,0 +1,59 @@
+/*
+   Copyright (c) 2014-2015, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package sysconfig
+
+import (
+	"fmt"
+	"path"
+)
+
+// Denied returns true if the setting name matches one of the deny patterns.
+// Patterns are globs as in path.Match, e.g. "ssl_*".  Invalid patterns never
+// match; use ValidPatterns to check them first.
+func Denied(name string, deny []string) bool {
+	for _, pattern := range deny {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the settings whose names do not match any deny pattern.
+func Filter(settings []Setting, deny []string) []Setting {
+	if len(deny) == 0 {
+		return settings
+	}
+	allowed := []Setting{}
+	for _, s := range settings {
+		if !Denied(s[0], deny) {
+			allowed = append(allowed, s)
+		}
+	}
+	return allowed
+}
+
+// ValidPatterns returns an error for the first invalid deny pattern.
+func ValidPatterns(deny []string) error {
+	for _, pattern := range deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid deny pattern '%s': %s", pattern, err)
+		}
+	}
+	return nil
+}
@@ -26,6 +26,7 @@ package sysconfig
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/data"
 	"github.com/percona/percona-agent/instance"
@@ -176,6 +177,7 @@ func (m *Manager) Handle(cmd *proto.Cmd) *proto.Reply {
 		m.clock.Add(tickChan, c.Report, false)
 
 		// Start the monitor.
+		monitor.SetDiffOnly(c.DiffOnly)
 		if err = monitor.Start(tickChan, m.reportChan); err != nil {
 			return cmd.Reply(nil, errors.New("Start "+name+": "+err.Error()))
 		}
@@ -289,6 +291,10 @@ func (m *Manager) spooler() {
 	}()
 	m.status.Update("sysconfig-spooler", "Running")
 	for s := range m.reportChan {
+		if s.SchemaVersion() > REPORT_VERSION {
+			m.logger.Warn(fmt.Sprintf("Lost report: unknown version %d, expected <= %d", s.Version, REPORT_VERSION))
+			continue
+		}
 		if err := m.spool.Write("sysconfig", s); err != nil {
 			m.logger.Warn("Lost report:", err)
 		}
@@ -18,6 +18,7 @@
 package sysconfig
 
 import (
+	"encoding/json"
 	"github.com/percona/cloud-protocol/proto"
 	"time"
 )
@@ -28,6 +29,7 @@ type Monitor interface {
 	Status() map[string]string
 	TickChan() chan time.Time
 	Config() interface{}
+	SetDiffOnly(diffOnly bool) // report only changes after the first report
 }
 
 type MonitorFactory interface {
@@ -37,9 +39,43 @@ type MonitorFactory interface {
 // ["variable", "value"]
 type Setting [2]string
 
+// Report versions, see Report.Version.
+const (
+	REPORT_VERSION_SETTINGS = 1 // only Settings; reports without a version
+	REPORT_VERSION_DIFF     = 2 // Settings, or Diff in diff-only mode
+	REPORT_VERSION          = REPORT_VERSION_DIFF
+)
+
 type Report struct {
 	proto.ServiceInstance
+	Version  int   // REPORT_VERSION_*, zero if the report predates versions
 	Ts       int64 // UTC Unix timestamp
 	System   string
 	Settings []Setting
+	Diff     *ReportDiff `json:",omitempty"` // set instead of Settings in diff-only mode
+}
+
+// MarshalJSON encodes the report with its Version, REPORT_VERSION if not set.
+func (r Report) MarshalJSON() ([]byte, error) {
+	type report Report // without MarshalJSON
+	v := report(r)
+	if v.Version == 0 {
+		v.Version = REPORT_VERSION
+	}
+	return json.Marshal(v)
+}
+
+// SchemaVersion returns the report Version, or REPORT_VERSION_SETTINGS for a
+// report without one.
+func (r *Report) SchemaVersion() int {
+	if r.Version == 0 {
+		return REPORT_VERSION_SETTINGS
+	}
+	return r.Version
+}
+
+// Full returns true if the report has all settings, i.e. it's not only the
+// Diff since the last report.
+func (r *Report) Full() bool {
+	return r.SchemaVersion() < REPORT_VERSION_DIFF || r.Diff == nil
 }
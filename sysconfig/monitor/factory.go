@@ -26,8 +26,38 @@ import (
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/sysconfig"
 	"github.com/percona/percona-agent/sysconfig/mysql"
+	"sync"
 )
 
+// MonitorConstructor makes a sysconfig monitor for the instance of a service
+// from the monitor config data.
+type MonitorConstructor func(logChan chan *proto.LogEntry, ir *instance.Repo, instanceId uint, data []byte) (sysconfig.Monitor, error)
+
+var (
+	monitors   = make(map[string]MonitorConstructor)
+	monitorMux = &sync.RWMutex{}
+)
+
+func init() {
+	RegisterMonitor("mysql", makeMySQLMonitor)
+}
+
+// RegisterMonitor makes Factory.Make use ctor to make monitors for the
+// service, e.g. "mysql".  It returns an error if the service is already
+// registered.
+func RegisterMonitor(service string, ctor MonitorConstructor) error {
+	if ctor == nil {
+		return errors.New("Nil sysconfig monitor constructor for " + service)
+	}
+	monitorMux.Lock()
+	defer monitorMux.Unlock()
+	if _, ok := monitors[service]; ok {
+		return errors.New("Sysconfig monitor type already registered: " + service)
+	}
+	monitors[service] = ctor
+	return nil
+}
+
 type Factory struct {
 	logChan chan *proto.LogEntry
 	ir      *instance.Repo
@@ -42,33 +72,40 @@ func NewFactory(logChan chan *proto.LogEntry, ir *instance.Repo) *Factory {
 }
 
 func (f *Factory) Make(service string, instanceId uint, data []byte) (sysconfig.Monitor, error) {
-	var monitor sysconfig.Monitor
-	switch service {
-	case "mysql":
-		// Load the MySQL instance info (DSN, name, etc.).
-		mysqlIt := &proto.MySQLInstance{}
-		if err := f.ir.Get(service, instanceId, mysqlIt); err != nil {
-			return nil, err
-		}
-
-		// Parse the MySQL sysconfig config.
-		config := &mysql.Config{}
-		if err := json.Unmarshal(data, config); err != nil {
-			return nil, err
-		}
-
-		// The user-friendly name of the service, e.g. sysconfig-mysql-db101:
-		alias := "sysconfig-mysql-" + mysqlIt.Hostname
-
-		// Make a MySQL sysconfig monitor.
-		monitor = mysql.NewMonitor(
-			alias,
-			config,
-			pct.NewLogger(f.logChan, alias),
-			mysqlConn.NewConnection(mysqlIt.DSN),
-		)
-	default:
+	monitorMux.RLock()
+	ctor, ok := monitors[service]
+	monitorMux.RUnlock()
+	if !ok {
 		return nil, errors.New("Unknown sysconfig monitor type: " + service)
 	}
+	return ctor(f.logChan, f.ir, instanceId, data)
+}
+
+func makeMySQLMonitor(logChan chan *proto.LogEntry, ir *instance.Repo, instanceId uint, data []byte) (sysconfig.Monitor, error) {
+	// Load the MySQL instance info (DSN, name, etc.).
+	mysqlIt := &proto.MySQLInstance{}
+	if err := ir.Get("mysql", instanceId, mysqlIt); err != nil {
+		return nil, err
+	}
+
+	// Parse the MySQL sysconfig config.
+	config := &mysql.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := sysconfig.ValidPatterns(config.Deny); err != nil {
+		return nil, err
+	}
+
+	// The user-friendly name of the service, e.g. sysconfig-mysql-db101:
+	alias := "sysconfig-mysql-" + mysqlIt.Hostname
+
+	// Make a MySQL sysconfig monitor.
+	monitor := mysql.NewMonitor(
+		alias,
+		config,
+		pct.NewLogger(logChan, alias),
+		mysqlConn.NewConnection(mysqlIt.DSN),
+	)
 	return monitor, nil
 }
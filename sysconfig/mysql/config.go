@@ -24,3 +24,23 @@ import (
 type Config struct {
 	sysconfig.Config
 }
+
+// Sensitive MySQL variables omitted from reports when Config.Deny is not set.
+// Set Deny to an empty list to report all variables.
+var DEFAULT_DENY = []string{
+	"init_file",
+	"plugin_dir",
+	"secure_file_priv",
+	"ssl_*",
+	"*password*",
+	"*_auth",
+}
+
+// DenyPatterns returns the configured deny patterns, or DEFAULT_DENY if none
+// are configured.
+func (c *Config) DenyPatterns() []string {
+	if c.Deny == nil {
+		return DEFAULT_DENY
+	}
+	return c.Deny
+}
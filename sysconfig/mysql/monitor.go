@@ -26,6 +26,7 @@ import (
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/sysconfig"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,6 +41,9 @@ type Monitor struct {
 	status     *pct.Status
 	sync       *pct.SyncChan
 	running    bool
+	diffOnly   bool
+	mux        *sync.Mutex // guards diffOnly
+	last       *sysconfig.Report
 }
 
 func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Connector) *Monitor {
@@ -51,6 +55,7 @@ func NewMonitor(name string, config *Config, logger *pct.Logger, conn mysql.Conn
 		// --
 		sync:   pct.NewSyncChan(),
 		status: pct.NewStatus([]string{name, name + "-mysql"}),
+		mux:    &sync.Mutex{},
 	}
 	return m
 }
@@ -106,6 +111,13 @@ func (m *Monitor) Config() interface{} {
 	return m.config
 }
 
+// @goroutine[0]
+func (m *Monitor) SetDiffOnly(diffOnly bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.diffOnly = diffOnly
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Implementation
 /////////////////////////////////////////////////////////////////////////////
@@ -144,6 +156,7 @@ func (m *Monitor) run() {
 					Service:    m.config.Service,
 					InstanceId: m.config.InstanceId,
 				},
+				Version:  sysconfig.REPORT_VERSION,
 				Ts:       now.UTC().Unix(),
 				System:   "mysql global variables",
 				Settings: []sysconfig.Setting{},
@@ -159,9 +172,16 @@ func (m *Monitor) run() {
 			m.status.Update(m.name+"-mysql", "Disconnected (OK)")
 
 			if len(c.Settings) > 0 {
+				r := m.report(c)
+				if r == nil {
+					m.logger.Debug("No changes")
+					m.logger.Debug("run:collect:stop")
+					continue
+				}
 				select {
-				case m.reportChan <- c:
+				case m.reportChan <- r:
 					lastTs = c.Ts
+					m.last = c
 				case <-time.After(500 * time.Millisecond):
 					// lost sysconfig
 					m.logger.Debug("Lost MySQL settings; timeout spooling after 500ms")
@@ -178,6 +198,30 @@ func (m *Monitor) run() {
 	}
 }
 
+// report returns the report to send: c itself, or in diff-only mode a report
+// with only the changes since the last report that was sent, or nil if
+// nothing changed.  The first report is always full.
+// @goroutine[2]
+func (m *Monitor) report(c *sysconfig.Report) *sysconfig.Report {
+	m.mux.Lock()
+	diffOnly := m.diffOnly
+	m.mux.Unlock()
+	if !diffOnly || m.last == nil {
+		return c
+	}
+	d := sysconfig.Diff(m.last, c)
+	if d.Empty() {
+		return nil
+	}
+	return &sysconfig.Report{
+		ServiceInstance: c.ServiceInstance,
+		Version:         c.Version,
+		Ts:              c.Ts,
+		System:          c.System,
+		Diff:            d,
+	}
+}
+
 // @goroutine[2]
 func (m *Monitor) GetGlobalVariables(conn *sql.DB, c *sysconfig.Report) error {
 	m.logger.Debug("Getting global variables")
@@ -190,6 +234,7 @@ func (m *Monitor) GetGlobalVariables(conn *sql.DB, c *sysconfig.Report) error {
 		return err
 	}
 	defer rows.Close()
+	deny := m.config.DenyPatterns()
 	for rows.Next() {
 		var varName string
 		var varValue string
@@ -197,6 +242,9 @@ func (m *Monitor) GetGlobalVariables(conn *sql.DB, c *sysconfig.Report) error {
 			return err
 		}
 		varName = strings.ToLower(varName)
+		if sysconfig.Denied(varName, deny) {
+			continue
+		}
 		c.Settings = append(c.Settings, sysconfig.Setting{varName, varValue})
 	}
 	err = rows.Err()
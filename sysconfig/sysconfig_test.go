@@ -24,6 +24,7 @@ import (
 	"github.com/percona/percona-agent/instance"
 	"github.com/percona/percona-agent/pct"
 	"github.com/percona/percona-agent/sysconfig"
+	sysconfigMonitor "github.com/percona/percona-agent/sysconfig/monitor"
 	"github.com/percona/percona-agent/sysconfig/mysql"
 	"github.com/percona/percona-agent/test"
 	"github.com/percona/percona-agent/test/mock"
@@ -339,3 +340,194 @@ func (s *ManagerTestSuite) TestGetConfig(t *C) {
 		t.Error(diff)
 	}
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Factory test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type FactoryTestSuite struct {
+}
+
+var _ = Suite(&FactoryTestSuite{})
+
+func (s *FactoryTestSuite) TestRegisterMonitor(t *C) {
+	fakeMonitor := mock.NewSysconfigMonitor()
+	var gotId uint
+	var gotData []byte
+	makeFake := func(logChan chan *proto.LogEntry, ir *instance.Repo, instanceId uint, data []byte) (sysconfig.Monitor, error) {
+		gotId = instanceId
+		gotData = data
+		return fakeMonitor, nil
+	}
+	err := sysconfigMonitor.RegisterMonitor("fake", makeFake)
+	t.Assert(err, IsNil)
+
+	f := sysconfigMonitor.NewFactory(make(chan *proto.LogEntry, 10), nil)
+	monitor, err := f.Make("fake", 3, []byte(`{"Deny":[]}`))
+	t.Assert(err, IsNil)
+	t.Check(monitor, Equals, sysconfig.Monitor(fakeMonitor))
+	t.Check(gotId, Equals, uint(3))
+	t.Check(string(gotData), Equals, `{"Deny":[]}`)
+
+	// A service can't be registered twice, including the built-in mysql.
+	err = sysconfigMonitor.RegisterMonitor("fake", makeFake)
+	t.Check(err, ErrorMatches, "Sysconfig monitor type already registered: fake")
+	err = sysconfigMonitor.RegisterMonitor("mysql", makeFake)
+	t.Check(err, NotNil)
+
+	_, err = f.Make("postgresql", 1, []byte(`{}`))
+	t.Check(err, ErrorMatches, "Unknown sysconfig monitor type: postgresql")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Report test suite
+/////////////////////////////////////////////////////////////////////////////
+
+type ReportTestSuite struct {
+}
+
+var _ = Suite(&ReportTestSuite{})
+
+func (s *ReportTestSuite) TestVersion(t *C) {
+	r := &sysconfig.Report{
+		ServiceInstance: proto.ServiceInstance{Service: "mysql", InstanceId: 1},
+		Ts:              1,
+		System:          "mysql global variables",
+		Settings:        []sysconfig.Setting{{"a", "1"}},
+	}
+
+	// The current version is always encoded, even if not set.
+	bytes, err := json.Marshal(r)
+	t.Assert(err, IsNil)
+	t.Check(string(bytes), Matches, `.*"Version":2,.*`)
+
+	got := &sysconfig.Report{}
+	err = json.Unmarshal(bytes, got)
+	t.Assert(err, IsNil)
+	expect := *r
+	expect.Version = sysconfig.REPORT_VERSION
+	t.Check(got, DeepEquals, &expect)
+	t.Check(got.SchemaVersion(), Equals, sysconfig.REPORT_VERSION)
+	t.Check(got.Full(), Equals, true)
+
+	// A report from before versions is version 1, which only has Settings.
+	old := &sysconfig.Report{}
+	err = json.Unmarshal([]byte(`{"Service":"mysql","InstanceId":1,"Ts":1,"Settings":[["a","1"]]}`), old)
+	t.Assert(err, IsNil)
+	t.Check(old.Version, Equals, 0)
+	t.Check(old.SchemaVersion(), Equals, sysconfig.REPORT_VERSION_SETTINGS)
+	t.Check(old.Full(), Equals, true)
+
+	// A diff-only report isn't full, so it has no settings to diff.
+	d := &sysconfig.Report{Version: sysconfig.REPORT_VERSION, Diff: sysconfig.Diff(nil, r)}
+	t.Check(d.Full(), Equals, false)
+	t.Check(sysconfig.Diff(d, r).Added, DeepEquals, []sysconfig.Setting{{"a", "1"}})
+}
+
+func (s *ReportTestSuite) TestDiff(t *C) {
+	prev := &sysconfig.Report{
+		Settings: []sysconfig.Setting{
+			{"max_connections", "100"},
+			{"autocommit", "ON"},
+			{"query_cache_size", "0"},
+			{"innodb_log_file_size", "5242880"},
+		},
+	}
+	// Different order, one removed (query_cache_size), one added (log_bin),
+	// one changed (max_connections).
+	curr := &sysconfig.Report{
+		Settings: []sysconfig.Setting{
+			{"log_bin", "ON"},
+			{"innodb_log_file_size", "5242880"},
+			{"max_connections", "500"},
+			{"autocommit", "ON"},
+		},
+	}
+	d := sysconfig.Diff(prev, curr)
+	t.Check(d.Added, DeepEquals, []sysconfig.Setting{{"log_bin", "ON"}})
+	t.Check(d.Removed, DeepEquals, []sysconfig.Setting{{"query_cache_size", "0"}})
+	t.Check(d.Changed, DeepEquals, []sysconfig.SettingChange{
+		{Name: "max_connections", Old: "100", New: "500"},
+	})
+	t.Check(d.Empty(), Equals, false)
+
+	// Same settings in a different order is no diff.
+	d = sysconfig.Diff(curr, &sysconfig.Report{
+		Settings: []sysconfig.Setting{
+			{"autocommit", "ON"},
+			{"max_connections", "500"},
+			{"innodb_log_file_size", "5242880"},
+			{"log_bin", "ON"},
+		},
+	})
+	t.Check(d.Empty(), Equals, true)
+
+	// No previous report: everything is added, sorted by name.
+	d = sysconfig.Diff(nil, prev)
+	t.Check(d.Added, DeepEquals, []sysconfig.Setting{
+		{"autocommit", "ON"},
+		{"innodb_log_file_size", "5242880"},
+		{"max_connections", "100"},
+		{"query_cache_size", "0"},
+	})
+	t.Check(d.Removed, HasLen, 0)
+	t.Check(d.Changed, HasLen, 0)
+}
+
+func (s *ReportTestSuite) TestDiffDuplicateKeys(t *C) {
+	// The last value of a duplicate setting wins.
+	prev := &sysconfig.Report{
+		Settings: []sysconfig.Setting{
+			{"max_connections", "100"},
+			{"max_connections", "200"},
+		},
+	}
+	curr := &sysconfig.Report{
+		Settings: []sysconfig.Setting{
+			{"max_connections", "200"},
+		},
+	}
+	d := sysconfig.Diff(prev, curr)
+	t.Check(d.Empty(), Equals, true)
+
+	curr.Settings = append(curr.Settings, sysconfig.Setting{"max_connections", "300"})
+	d = sysconfig.Diff(prev, curr)
+	t.Check(d.Changed, DeepEquals, []sysconfig.SettingChange{
+		{Name: "max_connections", Old: "200", New: "300"},
+	})
+	t.Check(d.Added, HasLen, 0)
+	t.Check(d.Removed, HasLen, 0)
+}
+
+func (s *ReportTestSuite) TestFilter(t *C) {
+	settings := []sysconfig.Setting{
+		{"autocommit", "ON"},
+		{"init_file", "/etc/mysql/init.sql"},
+		{"max_connections", "100"},
+		{"plugin_dir", "/usr/lib/mysql/plugin/"},
+		{"ssl_key", "/etc/mysql/server-key.pem"},
+		{"ssl_ca", "/etc/mysql/ca.pem"},
+		{"report_password", "secret"},
+		{"wsrep_sst_auth", "root:secret"},
+		{"have_ssl", "YES"},
+	}
+	config := &mysql.Config{}
+	got := sysconfig.Filter(settings, config.DenyPatterns())
+	t.Check(got, DeepEquals, []sysconfig.Setting{
+		{"autocommit", "ON"},
+		{"max_connections", "100"},
+		{"have_ssl", "YES"},
+	})
+
+	// An empty deny list reports all settings.
+	config.Deny = []string{}
+	got = sysconfig.Filter(settings, config.DenyPatterns())
+	t.Check(got, DeepEquals, settings)
+
+	config.Deny = []string{"max_*"}
+	got = sysconfig.Filter(settings, config.DenyPatterns())
+	t.Check(got, HasLen, len(settings)-1)
+
+	t.Check(sysconfig.ValidPatterns([]string{"ssl_*"}), IsNil)
+	t.Check(sysconfig.ValidPatterns([]string{"ssl_["}), NotNil)
+}
@@ -64,6 +64,10 @@ func (f *FakeApi) AppendPing() {
 
 func (f *FakeApi) AppendInstancesServer(id uint, serverInstance *proto.ServerInstance) {
 	f.Append("/instances/server", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte("[]")) // no existing server instances
+			return
+		}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			panic(err)
@@ -30,6 +30,9 @@ type API struct {
 	GetCode   []int
 	GetData   [][]byte
 	GetError  []error
+	PutCode   []int
+	PutData   [][]byte
+	PutError  []error
 }
 
 func NewAPI(origin, hostname, apiKey, agentUuid string, links map[string]string) *API {
@@ -66,6 +69,10 @@ func (a *API) EntryLink(resource string) string {
 	return a.links[resource]
 }
 
+func (a *API) Headers() map[string]string {
+	return map[string]string{}
+}
+
 func (a *API) Origin() string {
 	return a.origin
 }
@@ -106,7 +113,26 @@ func (a *API) Post(apiKey, url string, data []byte) (*http.Response, []byte, err
 }
 
 func (a *API) Put(apiKey, url string, data []byte) (*http.Response, []byte, error) {
-	return nil, nil, nil
+	var resp *http.Response
+	var body []byte
+	var err error
+	if len(a.PutCode) > 0 {
+		resp = &http.Response{StatusCode: a.PutCode[0]}
+		a.PutCode = a.PutCode[1:len(a.PutCode)]
+	}
+	if len(a.PutData) > 0 {
+		body = a.PutData[0]
+		a.PutData = a.PutData[1:len(a.PutData)]
+	}
+	if len(a.PutError) > 0 {
+		err = a.PutError[0]
+		a.PutError = a.PutError[1:len(a.PutError)]
+	}
+	return resp, body, err
+}
+
+func (a *API) Delete(apiKey, url string) (*http.Response, []byte, error) {
+	return &http.Response{StatusCode: http.StatusNoContent}, nil, nil
 }
 
 func (a *API) URL(paths ...string) string {
@@ -18,27 +18,60 @@
 package mock
 
 import (
+	"sync"
 	"time"
+
+	"github.com/percona/percona-agent/mrms"
 )
 
 type MrmsMonitor struct {
-	c          chan bool
-	globalChan chan string
+	c          chan mrms.RestartEvent
+	dsn        string
+	globalChan chan mrms.RestartEvent
+	globalSubs int
+	monitored  map[string]int
+	mux        sync.Mutex
 }
 
 func NewMrmsMonitor() *MrmsMonitor {
 	m := &MrmsMonitor{
-		globalChan: make(chan string, 100),
+		monitored: make(map[string]int),
 	}
 	return m
 }
 
-func (m *MrmsMonitor) Add(dsn string) (<-chan bool, error) {
-	m.c = make(chan bool, 10)
+func (m *MrmsMonitor) Add(dsn string, interval ...time.Duration) (<-chan mrms.RestartEvent, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.c = make(chan mrms.RestartEvent, 10)
+	m.dsn = dsn
+	m.monitored[dsn]++
 	return m.c, nil
 }
 
-func (m *MrmsMonitor) Remove(dsn string, c <-chan bool) {
+func (m *MrmsMonitor) Remove(dsn string, c <-chan mrms.RestartEvent) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.monitored[dsn]--; m.monitored[dsn] <= 0 {
+		delete(m.monitored, dsn)
+	}
+}
+
+// Monitored returns how many subscribers the DSN has.
+func (m *MrmsMonitor) Monitored(dsn string) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.monitored[dsn]
+}
+
+func (m *MrmsMonitor) SubscriberCounts() map[string]int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	counts := make(map[string]int, len(m.monitored))
+	for dsn, n := range m.monitored {
+		counts[dsn] = n
+	}
+	return counts
 }
 
 func (m *MrmsMonitor) Check() {
@@ -52,6 +85,34 @@ func (m *MrmsMonitor) Stop() error {
 	return nil
 }
 
+func (m *MrmsMonitor) Healthy() (bool, time.Time) {
+	return true, time.Now()
+}
+
+func (m *MrmsMonitor) SetStopGracePeriod(d time.Duration) {
+}
+
+func (m *MrmsMonitor) Metrics() mrms.Metrics {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return mrms.Metrics{InstancesMonitored: uint64(len(m.monitored))}
+}
+
+func (m *MrmsMonitor) Pause() {
+}
+
+func (m *MrmsMonitor) Resume() {
+}
+
+func (m *MrmsMonitor) SetCheckTimeout(d time.Duration) {
+}
+
+func (m *MrmsMonitor) SetCheckConcurrency(n int) {
+}
+
+func (m *MrmsMonitor) SetDetectFailover(detect bool) {
+}
+
 func (m *MrmsMonitor) Status() (status map[string]string) {
 	return map[string]string{
 		"mrms-monitor-mock": "Idle",
@@ -62,10 +123,50 @@ func (m *MrmsMonitor) Status() (status map[string]string) {
 // To be consistent with that, instead of returning the channel just for
 // testing purposes, we have this method to simulate a MySQL restart
 func (m *MrmsMonitor) SimulateMySQLRestart() {
-	m.c <- true
+	m.c <- mrms.RestartEvent{
+		DSN:        m.dsn,
+		DetectedAt: time.Now().UTC(),
+	}
 }
 
-func (m *MrmsMonitor) GlobalSubscribe() (chan string, error) {
-	return m.globalChan, nil
+func (m *MrmsMonitor) GlobalSubscribe(c chan mrms.RestartEvent) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.globalChan = c
+	m.globalSubs++
+	return nil
+}
 
+func (m *MrmsMonitor) GlobalUnsubscribe(c chan mrms.RestartEvent) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.globalChan == c {
+		m.globalChan = nil
+	}
+}
+
+// GlobalSubscribed returns true if there's a global subscriber.
+func (m *MrmsMonitor) GlobalSubscribed() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.globalChan != nil
+}
+
+// GlobalSubscribeCount returns how many times GlobalSubscribe was called.
+func (m *MrmsMonitor) GlobalSubscribeCount() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.globalSubs
+}
+
+// SimulateGlobalMySQLRestart sends a restart event to the global subscriber.
+// It blocks while the subscriber's channel is full.
+func (m *MrmsMonitor) SimulateGlobalMySQLRestart(dsn string) {
+	m.mux.Lock()
+	globalChan := m.globalChan
+	m.mux.Unlock()
+	globalChan <- mrms.RestartEvent{
+		DSN:        dsn,
+		DetectedAt: time.Now().UTC(),
+	}
 }
@@ -19,6 +19,7 @@ package mock
 
 import (
 	"database/sql"
+	"sync"
 
 	"github.com/percona/cloud-protocol/proto"
 	"github.com/percona/percona-agent/mysql"
@@ -35,6 +36,7 @@ type NullMySQL struct {
 	atLeastVersion    bool
 	atLeastVersionErr error
 	Version           string
+	mux               sync.Mutex // callers like mrms check concurrently
 }
 
 func NewNullMySQL() *NullMySQL {
@@ -60,22 +62,32 @@ func (n *NullMySQL) Connect(tries uint) error {
 	return nil
 }
 
+func (n *NullMySQL) Ping() error {
+	return nil
+}
+
 func (n *NullMySQL) Close() {
 	return
 }
 
 func (n *NullMySQL) Explain(query string, db string) (explain *proto.ExplainResult, err error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	return n.explain[query], nil
 }
 
 func (n *NullMySQL) SetExplain(query string, explain *proto.ExplainResult) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.explain[query] = explain
 }
 
 func (n *NullMySQL) Set(queries []mysql.Query) error {
+	n.mux.Lock()
 	for _, q := range queries {
 		n.set = append(n.set, q)
 	}
+	n.mux.Unlock()
 	select {
 	case n.SetChan <- true:
 	default:
@@ -84,16 +96,22 @@ func (n *NullMySQL) Set(queries []mysql.Query) error {
 }
 
 func (n *NullMySQL) GetSet() []mysql.Query {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	return n.set
 }
 
 func (n *NullMySQL) Reset() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.set = nil
 	n.stringVars = make(map[string]string)
 	n.numberVars = make(map[string]float64)
 }
 
 func (n *NullMySQL) GetGlobalVarString(varName string) string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	value, ok := n.stringVars[varName]
 	if ok {
 		return value
@@ -102,6 +120,8 @@ func (n *NullMySQL) GetGlobalVarString(varName string) string {
 }
 
 func (n *NullMySQL) GetGlobalVarNumber(varName string) float64 {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	value, ok := n.numberVars[varName]
 	if ok {
 		return value
@@ -110,32 +130,46 @@ func (n *NullMySQL) GetGlobalVarNumber(varName string) float64 {
 }
 
 func (n *NullMySQL) SetGlobalVarNumber(name string, value float64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.numberVars[name] = value
 }
 
 func (n *NullMySQL) SetGlobalVarString(name, value string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.stringVars[name] = value
 }
 
 func (n *NullMySQL) Uptime() (int64, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.uptimeCount++
 	return n.uptime, nil
 }
 
 func (n *NullMySQL) AtLeastVersion(v string) (bool, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.Version = v
 	return n.atLeastVersion, n.atLeastVersionErr
 }
 
 func (n *NullMySQL) SetAtLeastVersion(atLeastVersion bool, err error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.atLeastVersion = atLeastVersion
 	n.atLeastVersionErr = err
 }
 
 func (n *NullMySQL) GetUptimeCount() uint {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	return n.uptimeCount
 }
 
 func (n *NullMySQL) SetUptime(uptime int64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
 	n.uptime = uptime
 }
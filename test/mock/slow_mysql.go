@@ -51,6 +51,11 @@ func (s *SlowMySQL) Connect(tries uint) error {
 	return s.realConnection.Connect(tries)
 }
 
+func (s *SlowMySQL) Ping() error {
+	time.Sleep(s.globalDelay)
+	return s.realConnection.Ping()
+}
+
 func (s *SlowMySQL) Close() {
 	s.realConnection.Close()
 }
@@ -60,6 +60,7 @@ type SysconfigMonitor struct {
 	ReadyChan chan bool
 	running   bool
 	config    interface{}
+	DiffOnly  bool
 }
 
 func NewSysconfigMonitor() *SysconfigMonitor {
@@ -101,3 +102,7 @@ func (m *SysconfigMonitor) Config() interface{} {
 func (m *SysconfigMonitor) SetConfig(v interface{}) {
 	m.config = v
 }
+
+func (m *SysconfigMonitor) SetDiffOnly(diffOnly bool) {
+	m.DiffOnly = diffOnly
+}